@@ -0,0 +1,716 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/audit"
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	"github.com/shafiquejamal/reactjs-golang-starter/errorhandler"
+	"github.com/shafiquejamal/reactjs-golang-starter/policystore"
+)
+
+// adminStore is the policy store the admin API changes, the cache of
+// resolved permissions, if any, to invalidate after each change and the
+// audit trail each change is recorded to.
+type adminStore struct {
+	store               policystore.AdminStore
+	cache               *policystore.CachingPolicyStore
+	maxPolicyGroupDepth int
+	trail               auditTrail
+}
+
+type listPage struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// holder is a user holding a policy or belonging to a group, directly or
+// through the group Via.
+type holder struct {
+	UserId string `json:"user_id"`
+	Via    string `json:"via,omitempty"`
+}
+
+func (a adminStore) invalidate(invalidation policystore.Invalidation) {
+	if a.cache != nil {
+		a.cache.Invalidate(invalidation)
+	}
+}
+
+func (a adminStore) getPolicyGroup(ctx context.Context, name string) (policystore.PolicyGroup, error) {
+	groups, err := a.store.GetPolicyGroups(ctx, []string{name})
+	if err != nil {
+		return policystore.PolicyGroup{}, err
+	}
+	if len(groups) == 0 {
+		return policystore.PolicyGroup{}, policystore.ErrNotFound
+	}
+	return groups[0], nil
+}
+
+// groupsContaining returns the groups that contain the policy, or the group,
+// directly or through other groups.
+func (a adminStore) groupsContaining(ctx context.Context, options policystore.ListOptions) ([]string, error) {
+	found := map[string]struct{}{}
+	names := []string{}
+	for queue := []policystore.ListOptions{options}; len(queue) > 0; queue = queue[1:] {
+		groups, err := a.allPolicyGroups(ctx, queue[0])
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range groups {
+			if _, exists := found[group.Name]; exists {
+				continue
+			}
+			found[group.Name] = struct{}{}
+			names = append(names, group.Name)
+			queue = append(queue, policystore.ListOptions{Group: group.Name})
+		}
+	}
+	return names, nil
+}
+
+// holders returns the users the options select directly and those that
+// belong to one of the groups, sorted by user id.
+func (a adminStore) holders(ctx context.Context, options policystore.ListOptions, groupNames []string) ([]holder, error) {
+	holders := []holder{}
+	seen := map[string]struct{}{}
+	for i, options := range append([]policystore.ListOptions{options}, groupOptions(groupNames)...) {
+		users, err := a.allUsers(ctx, options)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			if _, exists := seen[user.UserId]; exists {
+				continue
+			}
+			seen[user.UserId] = struct{}{}
+			h := holder{UserId: user.UserId}
+			if i > 0 {
+				h.Via = groupNames[i-1]
+			}
+			holders = append(holders, h)
+		}
+	}
+	sort.Slice(holders, func(i, j int) bool { return holders[i].UserId < holders[j].UserId })
+	return holders, nil
+}
+
+func groupOptions(groupNames []string) []policystore.ListOptions {
+	options := []policystore.ListOptions{}
+	for _, name := range groupNames {
+		options = append(options, policystore.ListOptions{Group: name})
+	}
+	return options
+}
+
+func (a adminStore) allPolicyGroups(ctx context.Context, options policystore.ListOptions) ([]policystore.PolicyGroup, error) {
+	all := []policystore.PolicyGroup{}
+	for {
+		groups, next, err := a.store.ListPolicyGroups(ctx, options)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, groups...)
+		if next == "" {
+			return all, nil
+		}
+		options.Cursor = next
+	}
+}
+
+func (a adminStore) allUsers(ctx context.Context, options policystore.ListOptions) ([]policystore.UserPolicyNames, error) {
+	all := []policystore.UserPolicyNames{}
+	for {
+		users, next, err := a.store.ListUsers(ctx, options)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, users...)
+		if next == "" {
+			return all, nil
+		}
+		options.Cursor = next
+	}
+}
+
+// referenced tells which groups or users still refer to a policy or group
+// the options select, which then cannot be deleted. Permission boundaries
+// are not checked: a user whose boundary is missing is denied everything.
+func (a adminStore) referenced(ctx context.Context, options policystore.ListOptions) (string, error) {
+	options.Limit = 1
+	groups, _, err := a.store.ListPolicyGroups(ctx, options)
+	if err != nil {
+		return "", err
+	}
+	if len(groups) > 0 {
+		return "policy group " + groups[0].Name, nil
+	}
+	users, _, err := a.store.ListUsers(ctx, options)
+	if err != nil {
+		return "", err
+	}
+	if len(users) > 0 {
+		return "user " + users[0].UserId, nil
+	}
+	return "", nil
+}
+
+// inUseError is returned when deleting a policy or group that is still
+// attached.
+type inUseError struct {
+	name     string
+	referrer string
+}
+
+func (e inUseError) Error() string {
+	return fmt.Sprintf("The %s is attached to %s", e.name, e.referrer)
+}
+
+// versionedPolicyError is returned when the inline permissions of a policy
+// that has a default version are changed, as the default version applies.
+type versionedPolicyError struct {
+	name string
+}
+
+func (e versionedPolicyError) Error() string {
+	return fmt.Sprintf("The access policy %s applies its default version, create a version with POST /policies/%s/versions to change its permissions", e.name, e.name)
+}
+
+// putPolicy validates and creates or replaces an access policy, if it is
+// still at its revision, and tells whether it created it. Created_at and the
+// default version, which is changed through the versions API, are kept, so
+// the permissions of a versioned policy cannot be changed here.
+func (a adminStore) putPolicy(ctx context.Context, actor audit.Actor, policy policystore.PermsWithMeta) (policystore.PermsWithMeta, bool, error) {
+	if err := policystore.ValidatePolicy(policy); err != nil {
+		return policy, false, err
+	}
+	existing, err := a.store.GetPolicy(ctx, policy.Name)
+	if err != nil && err != policystore.ErrNotFound {
+		return policy, false, err
+	}
+	created := err == policystore.ErrNotFound
+	now := int(time.Now().Unix())
+	policy.Created_at, policy.Updated_at, policy.DefaultVersion = existing.Created_at, now, existing.DefaultVersion
+	if created {
+		policy.Created_at = now
+	}
+	if policy.Revision != existing.Revision {
+		return policy, false, policystore.ConflictError{Kind: "access policy", Name: policy.Name, Expected: policy.Revision, Current: existing.Revision}
+	}
+	if existing.DefaultVersion > 0 && !samePermissions(policy.Permissions, existing.Permissions) {
+		return policy, false, versionedPolicyError{name: policy.Name}
+	}
+	after := policy
+	after.Revision++
+	if err = a.store.PutPolicies(ctx, policy); err != nil {
+		return policy, false, err
+	}
+	a.invalidate(policystore.Invalidation{Policy: policy.Name})
+	return after, created, recorded(a.trail.record(ctx, actor, "", auditPolicy, policy.Name, replaced(created, existing), after))
+}
+
+func samePermissions(a, b auth.Permission) bool {
+	diff := diffPermissions(a, b)
+	return len(diff.AddedAllows)+len(diff.RemovedAllows)+len(diff.AddedDenys)+len(diff.RemovedDenys) == 0
+}
+
+// replaced is the document a change replaced, nil if it created one.
+func replaced(created bool, existing interface{}) interface{} {
+	if created {
+		return nil
+	}
+	return existing
+}
+
+func (a adminStore) putPolicyGroup(ctx context.Context, actor audit.Actor, group policystore.PolicyGroup) (policystore.PolicyGroup, bool, error) {
+	if err := policystore.ValidatePolicyGroup(ctx, a.store, group, a.maxPolicyGroupDepth); err != nil {
+		return group, false, err
+	}
+	existing, err := a.getPolicyGroup(ctx, group.Name)
+	if err != nil && err != policystore.ErrNotFound {
+		return group, false, err
+	}
+	created := err == policystore.ErrNotFound
+	if group.Revision != existing.Revision {
+		return group, false, policystore.ConflictError{Kind: "policy group", Name: group.Name, Expected: group.Revision, Current: existing.Revision}
+	}
+	after := group
+	after.Revision++
+	if err = a.store.PutPolicyGroups(ctx, group); err != nil {
+		return group, false, err
+	}
+	a.invalidate(policystore.Invalidation{Group: group.Name})
+	return after, created, recorded(a.trail.record(ctx, actor, "", auditPolicyGroup, group.Name, replaced(created, existing), after))
+}
+
+// putUser keeps the SCIM profile of the user when the document has none, as
+// only the provisioning endpoints change it.
+func (a adminStore) putUser(ctx context.Context, actor audit.Actor, user policystore.UserPolicyNames) (policystore.UserPolicyNames, bool, error) {
+	if err := policystore.ValidateUserPolicyNames(ctx, a.store, user); err != nil {
+		return user, false, err
+	}
+	existing, err := a.store.GetUserPolicyNames(ctx, user.UserId)
+	if err != nil {
+		return user, false, err
+	}
+	if user.Scim == nil {
+		user.Scim = existing.Scim
+	}
+	if user.Revision != existing.Revision {
+		return user, false, policystore.ConflictError{Kind: "user", Name: user.UserId, Expected: user.Revision, Current: existing.Revision}
+	}
+	created := existing.UserId == ""
+	after := user
+	after.Revision++
+	if err = a.store.PutUserPolicyNames(ctx, user); err != nil {
+		return user, false, err
+	}
+	a.invalidate(policystore.Invalidation{UserId: user.UserId})
+	return after, created, recorded(a.trail.record(ctx, actor, "", auditUser, user.UserId, replaced(created, existing), after))
+}
+
+// anyRevision deletes a document at whatever revision it is read at.
+const anyRevision = -1
+
+// deletePolicy deletes the access policy if it is at the revision, or at any
+// with anyRevision. Either way the delete is conditional on the revision
+// read, so that a change made meanwhile is not deleted unrecorded.
+func (a adminStore) deletePolicy(ctx context.Context, actor audit.Actor, name string, revision int) error {
+	existing, err := a.store.GetPolicy(ctx, name)
+	if err != nil {
+		return err
+	}
+	if revision != anyRevision && revision != existing.Revision {
+		return policystore.ConflictError{Kind: "access policy", Name: name, Expected: revision, Current: existing.Revision}
+	}
+	referrer, err := a.referenced(ctx, policystore.ListOptions{Policy: name})
+	if err != nil {
+		return err
+	}
+	if referrer != "" {
+		return inUseError{name: name, referrer: referrer}
+	}
+	if err = a.store.DeletePolicy(ctx, name, existing.Revision); err != nil {
+		return err
+	}
+	a.invalidate(policystore.Invalidation{Policy: name})
+	return recorded(a.trail.record(ctx, actor, "", auditPolicy, name, existing, nil))
+}
+
+func (a adminStore) deletePolicyGroup(ctx context.Context, actor audit.Actor, name string, revision int) error {
+	existing, err := a.getPolicyGroup(ctx, name)
+	if err != nil {
+		return err
+	}
+	if revision != anyRevision && revision != existing.Revision {
+		return policystore.ConflictError{Kind: "policy group", Name: name, Expected: revision, Current: existing.Revision}
+	}
+	referrer, err := a.referenced(ctx, policystore.ListOptions{Group: name})
+	if err != nil {
+		return err
+	}
+	if referrer != "" {
+		return inUseError{name: name, referrer: referrer}
+	}
+	if err = a.store.DeletePolicyGroup(ctx, name, existing.Revision); err != nil {
+		return err
+	}
+	a.invalidate(policystore.Invalidation{Group: name})
+	return recorded(a.trail.record(ctx, actor, "", auditPolicyGroup, name, existing, nil))
+}
+
+// deleteUser succeeds for a user without attachments, and records nothing
+// then.
+func (a adminStore) deleteUser(ctx context.Context, actor audit.Actor, userId string, revision int) error {
+	existing, err := a.store.GetUserPolicyNames(ctx, userId)
+	if err != nil {
+		return err
+	}
+	if revision != anyRevision && revision != existing.Revision {
+		return policystore.ConflictError{Kind: "user", Name: userId, Expected: revision, Current: existing.Revision}
+	}
+	if err = a.store.DeleteUserPolicyNames(ctx, userId, existing.Revision); err != nil {
+		return err
+	}
+	a.invalidate(policystore.Invalidation{UserId: userId})
+	if existing.UserId == "" {
+		return nil
+	}
+	return recorded(a.trail.record(ctx, actor, "", auditUser, userId, existing, nil))
+}
+
+func listOptions(r *http.Request) (policystore.ListOptions, error) {
+	query := r.URL.Query()
+	options := policystore.ListOptions{
+		Prefix: query.Get("prefix"),
+		Policy: query.Get("policy"),
+		Group:  query.Get("group"),
+		Cursor: query.Get("cursor"),
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return options, errors.New(fmt.Sprintf("The limit %q is not a positive number", limit))
+		}
+		options.Limit = n
+	}
+	return options, nil
+}
+
+type conflictResponse struct {
+	Error string `json:"error"`
+	// Revision is the one the document is at, 0 if it has been deleted
+	Revision int         `json:"revision"`
+	Current  interface{} `json:"current,omitempty"`
+}
+
+// returnConflict answers with the status and the current document, for the
+// client to merge its changes into and write again, if the error is a
+// conflict. Writes answer 409 and deletes 412, their revision being a
+// precondition.
+func returnConflict(w http.ResponseWriter, status int, err error, current func() (interface{}, error)) bool {
+	var conflict policystore.ConflictError
+	if !errors.As(err, &conflict) {
+		return false
+	}
+	response := conflictResponse{Error: err.Error(), Revision: conflict.Current}
+	if conflict.Current > 0 {
+		document, err := current()
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusInternalServerError, "Could not get the current revision", err)
+			return true
+		}
+		response.Current = document
+	}
+	writeJSON(w, status, response)
+	return true
+}
+
+// expectedRevision is the revision a delete expects, from the If-Match header
+// or else the revision query parameter, and anyRevision without either or
+// with If-Match: *.
+func expectedRevision(r *http.Request) (int, error) {
+	value := strings.Trim(strings.TrimPrefix(r.Header.Get("If-Match"), "W/"), `"`)
+	if value == "" {
+		value = r.URL.Query().Get("revision")
+	}
+	if value == "" || value == "*" {
+		return anyRevision, nil
+	}
+	revision, err := strconv.Atoi(value)
+	if err != nil || revision < 0 {
+		return anyRevision, errors.New(fmt.Sprintf("The revision %q is not a number", value))
+	}
+	return revision, nil
+}
+
+// returnStoreError answers 422 for a document that is not valid, 404 for
+// one that does not exist, 409 for one still in use or changed since it was
+// read and 500 for anything else.
+func returnStoreError(w *http.ResponseWriter, message string, err error) {
+	var validationError policystore.ValidationError
+	var inUse inUseError
+	var conflict policystore.ConflictError
+	switch {
+	case errors.As(err, &validationError):
+		errorhandler.ReturnError(w, http.StatusUnprocessableEntity, message, err)
+	case err == policystore.ErrNotFound:
+		errorhandler.ReturnError(w, http.StatusNotFound, message, err)
+	case errors.As(err, &inUse), errors.As(err, &conflict):
+		errorhandler.ReturnError(w, http.StatusConflict, message, err)
+	default:
+		errorhandler.ReturnError(w, http.StatusInternalServerError, message, err)
+	}
+}
+
+func listAdminPoliciesHandler(admin adminStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		options, err := listOptions(r)
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusBadRequest, "Malformed query", err)
+			return
+		}
+		policies, next, err := admin.store.ListPolicies(r.Context(), options)
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusInternalServerError, "Could not list access policies", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, listPage{Items: policies, NextCursor: next})
+	}
+}
+
+func getAdminPolicyHandler(admin adminStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		policy, err := admin.store.GetPolicy(r.Context(), mux.Vars(r)["name"])
+		if err == policystore.ErrNotFound {
+			errorhandler.ReturnError(&w, http.StatusNotFound, "Access policy not found", err)
+			return
+		}
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusInternalServerError, "Could not get access policy", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, policy)
+	}
+}
+
+func putAdminPolicyHandler(admin adminStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		policy := policystore.PermsWithMeta{}
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			errorhandler.ReturnError(&w, http.StatusBadRequest, "Malformed access policy", err)
+			return
+		}
+		if policy.Name != "" && policy.Name != name {
+			errorhandler.ReturnError(&w, http.StatusBadRequest, "Malformed access policy", errors.New(fmt.Sprintf("The name %s differs from %s", policy.Name, name)))
+			return
+		}
+		policy.Name = name
+		policy, created, err := admin.putPolicy(r.Context(), requestActor(w, r), policy)
+		err = made(w, err)
+		if returnConflict(w, http.StatusConflict, err, func() (interface{}, error) { return admin.store.GetPolicy(r.Context(), name) }) {
+			return
+		}
+		var versioned versionedPolicyError
+		if errors.As(err, &versioned) {
+			errorhandler.ReturnError(&w, http.StatusConflict, versioned.Error(), err)
+			return
+		}
+		if err != nil {
+			returnStoreError(&w, "Could not write access policy", err)
+			return
+		}
+		writeJSON(w, createdStatus(created), policy)
+	}
+}
+
+func deleteAdminPolicyHandler(admin adminStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		revision, err := expectedRevision(r)
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusBadRequest, "Malformed revision", err)
+			return
+		}
+		err = made(w, admin.deletePolicy(r.Context(), requestActor(w, r), name, revision))
+		if returnConflict(w, http.StatusPreconditionFailed, err, func() (interface{}, error) { return admin.store.GetPolicy(r.Context(), name) }) {
+			return
+		}
+		if err != nil {
+			returnStoreError(&w, "Could not delete access policy", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// listPolicyHoldersHandler lists the users holding the policy, directly or
+// through a group.
+func listPolicyHoldersHandler(admin adminStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		options := policystore.ListOptions{Policy: mux.Vars(r)["name"]}
+		groupNames, err := admin.groupsContaining(r.Context(), options)
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusInternalServerError, "Could not list policy holders", err)
+			return
+		}
+		holders, err := admin.holders(r.Context(), options, groupNames)
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusInternalServerError, "Could not list policy holders", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, holders)
+	}
+}
+
+func listAdminPolicyGroupsHandler(admin adminStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		options, err := listOptions(r)
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusBadRequest, "Malformed query", err)
+			return
+		}
+		groups, next, err := admin.store.ListPolicyGroups(r.Context(), options)
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusInternalServerError, "Could not list policy groups", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, listPage{Items: groups, NextCursor: next})
+	}
+}
+
+func getAdminPolicyGroupHandler(admin adminStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		group, err := admin.getPolicyGroup(r.Context(), mux.Vars(r)["name"])
+		if err == policystore.ErrNotFound {
+			errorhandler.ReturnError(&w, http.StatusNotFound, "Policy group not found", err)
+			return
+		}
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusInternalServerError, "Could not get policy group", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, group)
+	}
+}
+
+func putAdminPolicyGroupHandler(admin adminStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		group := policystore.PolicyGroup{}
+		if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+			errorhandler.ReturnError(&w, http.StatusBadRequest, "Malformed policy group", err)
+			return
+		}
+		if group.Name != "" && group.Name != name {
+			errorhandler.ReturnError(&w, http.StatusBadRequest, "Malformed policy group", errors.New(fmt.Sprintf("The name %s differs from %s", group.Name, name)))
+			return
+		}
+		group.Name = name
+		group, created, err := admin.putPolicyGroup(r.Context(), requestActor(w, r), group)
+		err = made(w, err)
+		if returnConflict(w, http.StatusConflict, err, func() (interface{}, error) { return admin.getPolicyGroup(r.Context(), name) }) {
+			return
+		}
+		if err != nil {
+			returnStoreError(&w, "Could not write policy group", err)
+			return
+		}
+		writeJSON(w, createdStatus(created), group)
+	}
+}
+
+func deleteAdminPolicyGroupHandler(admin adminStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		revision, err := expectedRevision(r)
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusBadRequest, "Malformed revision", err)
+			return
+		}
+		err = made(w, admin.deletePolicyGroup(r.Context(), requestActor(w, r), name, revision))
+		if returnConflict(w, http.StatusPreconditionFailed, err, func() (interface{}, error) { return admin.getPolicyGroup(r.Context(), name) }) {
+			return
+		}
+		if err != nil {
+			returnStoreError(&w, "Could not delete policy group", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// listPolicyGroupMembersHandler lists the users in the group, directly or
+// through a group nested in it.
+func listPolicyGroupMembersHandler(admin adminStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		options := policystore.ListOptions{Group: mux.Vars(r)["name"]}
+		groupNames, err := admin.groupsContaining(r.Context(), options)
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusInternalServerError, "Could not list policy group members", err)
+			return
+		}
+		holders, err := admin.holders(r.Context(), options, groupNames)
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusInternalServerError, "Could not list policy group members", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, holders)
+	}
+}
+
+func listAdminUsersHandler(admin adminStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		options, err := listOptions(r)
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusBadRequest, "Malformed query", err)
+			return
+		}
+		users, next, err := admin.store.ListUsers(r.Context(), options)
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusInternalServerError, "Could not list users", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, listPage{Items: users, NextCursor: next})
+	}
+}
+
+func getAdminUserHandler(admin adminStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := admin.store.GetUserPolicyNames(r.Context(), mux.Vars(r)["userId"])
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusInternalServerError, "Could not get user", err)
+			return
+		}
+		if user.UserId == "" {
+			errorhandler.ReturnError(&w, http.StatusNotFound, "User not found", policystore.ErrNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, user)
+	}
+}
+
+func putAdminUserHandler(admin adminStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId := mux.Vars(r)["userId"]
+		user := policystore.UserPolicyNames{}
+		if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+			errorhandler.ReturnError(&w, http.StatusBadRequest, "Malformed user", err)
+			return
+		}
+		if user.UserId != "" && user.UserId != userId {
+			errorhandler.ReturnError(&w, http.StatusBadRequest, "Malformed user", errors.New(fmt.Sprintf("The user_id %s differs from %s", user.UserId, userId)))
+			return
+		}
+		user.UserId = userId
+		user, created, err := admin.putUser(r.Context(), requestActor(w, r), user)
+		err = made(w, err)
+		if returnConflict(w, http.StatusConflict, err, func() (interface{}, error) { return admin.store.GetUserPolicyNames(r.Context(), userId) }) {
+			return
+		}
+		if err != nil {
+			returnStoreError(&w, "Could not write user", err)
+			return
+		}
+		writeJSON(w, createdStatus(created), user)
+	}
+}
+
+func deleteAdminUserHandler(admin adminStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId := mux.Vars(r)["userId"]
+		revision, err := expectedRevision(r)
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusBadRequest, "Malformed revision", err)
+			return
+		}
+		err = made(w, admin.deleteUser(r.Context(), requestActor(w, r), userId, revision))
+		if returnConflict(w, http.StatusPreconditionFailed, err, func() (interface{}, error) { return admin.store.GetUserPolicyNames(r.Context(), userId) }) {
+			return
+		}
+		if err != nil {
+			returnStoreError(&w, "Could not delete user", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func createdStatus(created bool) int {
+	if created {
+		return http.StatusCreated
+	}
+	return http.StatusOK
+}
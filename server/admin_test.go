@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/shafiquejamal/reactjs-golang-starter/audit"
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	"github.com/shafiquejamal/reactjs-golang-starter/policystore"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAdminHandlers(t *testing.T) {
+
+	Convey("Admin API", t, func() {
+		store := policystore.NewMemoryPolicyStore()
+		store.PutPolicies(context.Background(),
+			policystore.PermsWithMeta{Name: "read", Created_at: 100, Permissions: auth.Permission{Allows: []auth.Statement{{Actions: []string{"^/read$"}}}}},
+			policystore.PermsWithMeta{Name: "deploy", Permissions: auth.Permission{Allows: []auth.Statement{{Actions: []string{"^/deploy$"}}}}},
+		)
+		store.PutPolicyGroups(context.Background(),
+			policystore.PolicyGroup{Name: "engineering", PolicyGroups: []string{"backend"}},
+			policystore.PolicyGroup{Name: "backend", PolicyNames: []string{"deploy"}},
+		)
+		store.PutUserPolicyNames(context.Background(),
+			policystore.UserPolicyNames{UserId: "auth0|1", PolicyNames: []string{"deploy"}},
+			policystore.UserPolicyNames{UserId: "auth0|2", PolicyGroups: []string{"engineering"}},
+		)
+		cache := policystore.NewCachingPolicyStore(store, 0)
+		dir, err := ioutil.TempDir("", "admin")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		sink := audit.NewFileSink(filepath.Join(dir, "audit.log"))
+		admin := adminStore{store: store, cache: cache, maxPolicyGroupDepth: policystore.DefaultMaxPolicyGroupDepth, trail: auditTrail{sink: sink}}
+
+		router := mux.NewRouter()
+		router.Handle("/admin/policies", listAdminPoliciesHandler(admin)).Methods("GET")
+		router.Handle("/admin/policies/{name}", getAdminPolicyHandler(admin)).Methods("GET")
+		router.Handle("/admin/policies/{name}", putAdminPolicyHandler(admin)).Methods("PUT")
+		router.Handle("/admin/policies/{name}", deleteAdminPolicyHandler(admin)).Methods("DELETE")
+		router.Handle("/admin/policies/{name}/users", listPolicyHoldersHandler(admin)).Methods("GET")
+		router.Handle("/admin/groups/{name}", putAdminPolicyGroupHandler(admin)).Methods("PUT")
+		router.Handle("/admin/groups/{name}", deleteAdminPolicyGroupHandler(admin)).Methods("DELETE")
+		router.Handle("/admin/groups/{name}/members", listPolicyGroupMembersHandler(admin)).Methods("GET")
+		router.Handle("/admin/users", listAdminUsersHandler(admin)).Methods("GET")
+		router.Handle("/admin/users/{userId}", getAdminUserHandler(admin)).Methods("GET")
+		router.Handle("/admin/users/{userId}", putAdminUserHandler(admin)).Methods("PUT")
+		router.Handle("/admin/users/{userId}", deleteAdminUserHandler(admin)).Methods("DELETE")
+		router.Handle("/admin/audit", listAuditEventsHandler(sink)).Methods("GET")
+		serve := func(method, target, body string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(method, target, strings.NewReader(body))
+			r.Header.Set("X-Request-Id", "request-1")
+			user := auth.User{Identity: auth.UserIdentity{UserId: "auth0|admin", Email: "admin@example.com"}}
+			router.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "User", user)))
+			return w
+		}
+
+		Convey("lists a page with the cursor of the next one", func() {
+			w := serve("GET", "/admin/policies?limit=1", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			page := struct {
+				Items      []policystore.PermsWithMeta `json:"items"`
+				NextCursor string                      `json:"next_cursor"`
+			}{}
+			So(json.Unmarshal(w.Body.Bytes(), &page), ShouldBeNil)
+			So(page.Items[0].Name, ShouldEqual, "deploy")
+			So(page.NextCursor, ShouldEqual, "deploy")
+			So(serve("GET", "/admin/policies?limit=none", "").Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("replaces a policy, keeping when it was created", func() {
+			w := serve("PUT", "/admin/policies/read", `{"Description": "Reads", "Permissions": {"Allows": [{"Actions": ["^/read/.*$"]}]}, "revision": 1}`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			policy, err := store.GetPolicy(context.Background(), "read")
+			So(err, ShouldBeNil)
+			So(policy.Description, ShouldEqual, "Reads")
+			So(policy.Created_at, ShouldEqual, 100)
+			So(policy.Updated_at, ShouldBeGreaterThan, 100)
+			So(serve("PUT", "/admin/policies/write", `{"Permissions": {"Allows": [{"Actions": ["^/write$"]}]}}`).Code, ShouldEqual, http.StatusCreated)
+		})
+
+		Convey("refuses to change the inline permissions of a versioned policy", func() {
+			store.PutPolicies(context.Background(), policystore.PermsWithMeta{Name: "audit", DefaultVersion: 2, Permissions: auth.Permission{Allows: []auth.Statement{{Actions: []string{"^/audit$"}}}}})
+			w := serve("PUT", "/admin/policies/audit", `{"Permissions": {"Allows": [{"Actions": [".*"]}]}, "revision": 1}`)
+			So(w.Code, ShouldEqual, http.StatusConflict)
+			So(w.Body.String(), ShouldContainSubstring, "/policies/audit/versions")
+			w = serve("PUT", "/admin/policies/audit", `{"Description": "Audits", "Permissions": {"Allows": [{"Actions": ["^/audit$"]}]}, "revision": 1}`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			policy, err := store.GetPolicy(context.Background(), "audit")
+			So(err, ShouldBeNil)
+			So(policy.DefaultVersion, ShouldEqual, 2)
+		})
+
+		Convey("answers a write over another revision with the current one", func() {
+			w := serve("PUT", "/admin/policies/read", `{"Description": "Stale", "Permissions": {"Allows": [{"Actions": ["^/read$"]}]}}`)
+			So(w.Code, ShouldEqual, http.StatusConflict)
+			conflict := struct {
+				Revision int
+				Current  policystore.PermsWithMeta
+			}{}
+			So(json.Unmarshal(w.Body.Bytes(), &conflict), ShouldBeNil)
+			So(conflict.Revision, ShouldEqual, 1)
+			So(conflict.Current.Name, ShouldEqual, "read")
+
+			w = serve("PUT", "/admin/policies/read", `{"Description": "Merged", "Permissions": {"Allows": [{"Actions": ["^/read$"]}]}, "revision": 1}`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldContainSubstring, `"revision":2`)
+			So(serve("PUT", "/admin/users/auth0|1", `{"revision": 3}`).Code, ShouldEqual, http.StatusConflict)
+		})
+
+		Convey("rejects invalid documents", func() {
+			So(serve("PUT", "/admin/policies/read", `{"Permissions": {"Allows": [{"Actions": ["^/(read$"]}]}}`).Code, ShouldEqual, http.StatusUnprocessableEntity)
+			So(serve("PUT", "/admin/policies/read", `{"Name": "write"}`).Code, ShouldEqual, http.StatusBadRequest)
+			So(serve("PUT", "/admin/groups/backend", `{"policy_groups": ["engineering"]}`).Code, ShouldEqual, http.StatusUnprocessableEntity)
+			So(serve("PUT", "/admin/users/auth0|3", `{"access_policies": ["nothing"]}`).Code, ShouldEqual, http.StatusUnprocessableEntity)
+		})
+
+		Convey("refuses to delete what is still attached", func() {
+			So(serve("DELETE", "/admin/policies/deploy", "").Code, ShouldEqual, http.StatusConflict)
+			So(serve("DELETE", "/admin/groups/backend", "").Code, ShouldEqual, http.StatusConflict)
+			So(serve("DELETE", "/admin/policies/read", "").Code, ShouldEqual, http.StatusNoContent)
+			So(serve("DELETE", "/admin/policies/read", "").Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("deletes only at the revision expected", func() {
+			w := serve("DELETE", "/admin/policies/read?revision=2", "")
+			So(w.Code, ShouldEqual, http.StatusPreconditionFailed)
+			So(w.Body.String(), ShouldContainSubstring, `"revision":1`)
+			So(serve("DELETE", "/admin/policies/read?revision=one", "").Code, ShouldEqual, http.StatusBadRequest)
+
+			r := httptest.NewRequest("DELETE", "/admin/users/auth0|2", nil)
+			r.Header.Set("If-Match", `"2"`)
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "User", auth.User{})))
+			So(w.Code, ShouldEqual, http.StatusPreconditionFailed)
+			So(serve("GET", "/admin/audit", "").Body.String(), ShouldContainSubstring, `"items":[]`)
+
+			So(serve("DELETE", "/admin/policies/read?revision=1", "").Code, ShouldEqual, http.StatusNoContent)
+			So(serve("DELETE", "/admin/users/auth0|2?revision=1", "").Code, ShouldEqual, http.StatusNoContent)
+		})
+
+		Convey("lists the holders of a policy, through nested groups", func() {
+			w := serve("GET", "/admin/policies/deploy/users", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			holders := []holder{}
+			So(json.Unmarshal(w.Body.Bytes(), &holders), ShouldBeNil)
+			So(holders, ShouldResemble, []holder{{UserId: "auth0|1"}, {UserId: "auth0|2", Via: "engineering"}})
+
+			w = serve("GET", "/admin/groups/backend/members", "")
+			holders = []holder{}
+			So(json.Unmarshal(w.Body.Bytes(), &holders), ShouldBeNil)
+			So(holders, ShouldResemble, []holder{{UserId: "auth0|2", Via: "engineering"}})
+		})
+
+		Convey("records who changed what, before and after", func() {
+			So(serve("PUT", "/admin/policies/read", `{"Description": "Reads", "Permissions": {"Allows": [{"Actions": ["^/read$"]}]}, "revision": 1}`).Code, ShouldEqual, http.StatusOK)
+			So(serve("DELETE", "/admin/groups/engineering", "").Code, ShouldEqual, http.StatusConflict)
+			So(serve("DELETE", "/admin/users/auth0|2", "").Code, ShouldEqual, http.StatusNoContent)
+
+			w := serve("GET", "/admin/audit?actor=auth0|admin", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			page := struct {
+				Items []audit.Event `json:"items"`
+			}{}
+			So(json.Unmarshal(w.Body.Bytes(), &page), ShouldBeNil)
+			So(len(page.Items), ShouldEqual, 2)
+			deleted, updated := page.Items[0], page.Items[1]
+			So(deleted.Action, ShouldEqual, audit.Delete)
+			So(deleted.TargetKind, ShouldEqual, auditUser)
+			So(string(deleted.Before), ShouldContainSubstring, `"policy_groups":["engineering"]`)
+			So(deleted.After, ShouldBeNil)
+			So(updated.Action, ShouldEqual, audit.Update)
+			So(updated.Actor, ShouldResemble, audit.Actor{UserId: "auth0|admin", Email: "admin@example.com", RequestId: "request-1", SourceIp: "192.0.2.1"})
+			So(string(updated.Before), ShouldContainSubstring, `"revision":1`)
+			So(string(updated.After), ShouldContainSubstring, `"Description":"Reads"`)
+
+			So(serve("GET", "/admin/audit?target_kind=policy&target=deploy", "").Body.String(), ShouldContainSubstring, `"items":[]`)
+			So(serve("GET", "/admin/audit?since=yesterday", "").Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("records only the changes it makes", func() {
+			So(serve("PUT", "/admin/policies/read", `{"Description": "Stale", "Permissions": {"Allows": [{"Actions": ["^/read$"]}]}}`).Code, ShouldEqual, http.StatusConflict)
+			failing := admin
+			failing.store = &flakyStore{AdminStore: store, failures: 1}
+			_, _, err := failing.putUser(context.Background(), audit.Actor{UserId: "auth0|admin"}, policystore.UserPolicyNames{UserId: "auth0|2", Revision: 1})
+			So(err, ShouldNotBeNil)
+			So(serve("GET", "/admin/audit", "").Body.String(), ShouldContainSubstring, `"items":[]`)
+
+			Convey("and warns of those it makes but cannot record", func() {
+				router.Handle("/unrecorded/policies/{name}", putAdminPolicyHandler(adminStore{store: store, trail: auditTrail{sink: audit.NewFileSink(filepath.Join(dir, "missing", "audit.log"))}})).Methods("PUT")
+				w := serve("PUT", "/unrecorded/policies/read", `{"Description": "Unrecorded", "Permissions": {"Allows": [{"Actions": ["^/read$"]}]}, "Revision": 1}`)
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Header().Get("Warning"), ShouldEqual, unrecordedWarning)
+				policy, err := store.GetPolicy(context.Background(), "read")
+				So(err, ShouldBeNil)
+				So(policy.Description, ShouldEqual, "Unrecorded")
+			})
+		})
+
+		Convey("writes a user and invalidates its cached permissions", func() {
+			_, err := cache.ResolveUser(context.Background(), "auth0|1", []string{"deploy"}, nil, nil, policystore.DefaultMaxPolicyGroupDepth)
+			So(err, ShouldBeNil)
+			So(serve("GET", "/admin/users/auth0|3", "").Code, ShouldEqual, http.StatusNotFound)
+			So(serve("PUT", "/admin/users/auth0|1", `{"policy_groups": ["backend"], "revision": 1}`).Code, ShouldEqual, http.StatusOK)
+			So(cache.Invalidate(policystore.Invalidation{Policy: "deploy"}), ShouldBeEmpty)
+
+			w := serve("GET", "/admin/users?group=backend", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldContainSubstring, `"user_id":"auth0|1"`)
+		})
+	})
+}
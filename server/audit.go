@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/audit"
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	"github.com/shafiquejamal/reactjs-golang-starter/cf"
+	"github.com/shafiquejamal/reactjs-golang-starter/errorhandler"
+)
+
+// Kinds of the targets of audit events
+const (
+	auditPolicy        = "policy"
+	auditPolicyVersion = "policy version"
+	auditPolicyGroup   = "group"
+	auditUser          = "user"
+	auditGrant         = "grant"
+	auditBreakGlass    = "break-glass"
+)
+
+// auditTrail records changes to the sink, if one is configured.
+type auditTrail struct {
+	sink audit.Sink
+}
+
+// record appends the change of the target from before to after, either of
+// which may be nil. Changes are recorded once made, so the log holds none
+// that failed, and a failure to record one is answered with warnUnrecorded.
+func (t auditTrail) record(ctx context.Context, actor audit.Actor, action, targetKind, target string, before, after interface{}) error {
+	if t.sink == nil {
+		return nil
+	}
+	event, err := audit.NewEvent(actor, action, targetKind, target, before, after)
+	if err == nil {
+		err = t.sink.Append(ctx, event)
+	}
+	if err != nil {
+		log.Printf("The change of %s %s by %s could not be recorded in the audit log, %v", targetKind, target, actor.UserId, err)
+		return errors.New(fmt.Sprintf("The change of the %s %s could not be recorded, %v", targetKind, target, err))
+	}
+	return nil
+}
+
+// unrecordedError is returned for a change that was made but could not be
+// recorded.
+type unrecordedError struct {
+	error
+}
+
+// recorded wraps the error of recording a change that was made.
+func recorded(err error) error {
+	if err != nil {
+		return unrecordedError{err}
+	}
+	return nil
+}
+
+// made drops the error of a change that was made but not recorded, which
+// record has logged, and sets the Warning header of the response, if any.
+// Other errors are returned.
+func made(w http.ResponseWriter, err error) error {
+	if _, ok := err.(unrecordedError); !ok {
+		return err
+	}
+	if w != nil {
+		warnUnrecorded(w, err)
+	}
+	return nil
+}
+
+// unrecordedWarning is the Warning header of a response to a change that was
+// made but could not be recorded.
+const unrecordedWarning = `199 - "The change was made but could not be recorded in the audit log"`
+
+// warnUnrecorded sets the Warning header if the change could not be
+// recorded. The change stands, so the response is still a success.
+func warnUnrecorded(w http.ResponseWriter, err error) {
+	if err != nil {
+		w.Header().Set("Warning", unrecordedWarning)
+	}
+}
+
+// openAuditSink opens the DynamoDB table of audit events if one is
+// configured, or else the audit log file. Without either, changes are not
+// recorded.
+func openAuditSink(configuration cf.Configuration, svc *dynamodb.Client) audit.Sink {
+	switch {
+	case configuration.DdbAuditTableName != "" && svc != nil:
+		return audit.DynamoSink{TableName: configuration.DdbAuditTableName, Svc: svc}
+	case configuration.AuditLogFile != "":
+		return audit.NewFileSink(configuration.AuditLogFile)
+	}
+	log.Println("No audit log is configured, changes to permissions are not recorded")
+	return nil
+}
+
+func newRequestId() string {
+	bs := make([]byte, 8)
+	if _, err := rand.Read(bs); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	return hex.EncodeToString(bs)
+}
+
+// requestActor is the authenticated user making the request. The request id
+// is the X-Request-Id header, set by a proxy or the client, or else a new
+// one, which is returned in the response for support to look the event up.
+func requestActor(w http.ResponseWriter, r *http.Request) audit.Actor {
+	actor := audit.Actor{
+		RequestId:    r.Header.Get("X-Request-Id"),
+		ForwardedFor: r.Header.Get("X-Forwarded-For"),
+	}
+	if user, ok := r.Context().Value("User").(auth.User); ok {
+		actor.UserId, actor.Email = user.Identity.UserId, user.Identity.Email
+	}
+	if actor.RequestId == "" {
+		actor.RequestId = newRequestId()
+		w.Header().Set("X-Request-Id", actor.RequestId)
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		actor.SourceIp = host
+	} else {
+		actor.SourceIp = r.RemoteAddr
+	}
+	return actor
+}
+
+// cliActor is the operating system user running the admin command, as the
+// command authenticates with the credentials of the store rather than as a
+// user of the API.
+func cliActor() audit.Actor {
+	name := os.Getenv("USER")
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+	hostname, _ := os.Hostname()
+	return audit.Actor{UserId: "cli:" + name + "@" + hostname, RequestId: newRequestId()}
+}
+
+func auditFilter(r *http.Request) (audit.Filter, error) {
+	query := r.URL.Query()
+	filter := audit.Filter{
+		Actor:      query.Get("actor"),
+		TargetKind: query.Get("target_kind"),
+		Target:     query.Get("target"),
+		Cursor:     query.Get("cursor"),
+	}
+	var err error
+	if filter.Since, err = parseAuditTime(query.Get("since")); err != nil {
+		return filter, err
+	}
+	if filter.Until, err = parseAuditTime(query.Get("until")); err != nil {
+		return filter, err
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return filter, errors.New(fmt.Sprintf("The limit %q is not a positive number", limit))
+		}
+		filter.Limit = n
+	}
+	return filter, nil
+}
+
+// parseAuditTime accepts RFC 3339 or seconds since the epoch.
+func parseAuditTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.New(fmt.Sprintf("The time %q is neither RFC 3339 nor seconds since the epoch", value))
+	}
+	return t, nil
+}
+
+// listAuditEventsHandler lists the recorded changes, newest first, filtered
+// by actor, target and time range.
+func listAuditEventsHandler(sink audit.Sink) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := auditFilter(r)
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusBadRequest, "Malformed query", err)
+			return
+		}
+		events, next, err := sink.Query(r.Context(), filter)
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusInternalServerError, "Could not query the audit log", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, listPage{Items: events, NextCursor: next})
+	}
+}
@@ -0,0 +1,238 @@
+package audit
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ActorIndexName is the global secondary index of the events of an actor,
+// with the partition key actor and the sort key event_id.
+const ActorIndexName = "actor-index"
+
+// DynamoSink keeps events in a table with the partition key target
+// ("policy#deploy") and the sort key event_id. Events are put on the
+// condition that they do not exist, so one is never overwritten; grant the
+// server dynamodb:PutItem and the read actions only on the table to make it
+// append-only.
+type DynamoSink struct {
+	TableName string
+	Svc       *dynamodb.Client
+}
+
+type dynamoEvent struct {
+	Target       string `dynamodbav:"target"`
+	EventId      string `dynamodbav:"event_id"`
+	Time         int64  `dynamodbav:"time"`
+	Actor        string `dynamodbav:"actor"`
+	Email        string `dynamodbav:"email,omitempty"`
+	RequestId    string `dynamodbav:"request_id,omitempty"`
+	SourceIp     string `dynamodbav:"source_ip,omitempty"`
+	ForwardedFor string `dynamodbav:"forwarded_for,omitempty"`
+	Action       string `dynamodbav:"action"`
+	TargetKind   string `dynamodbav:"target_kind"`
+	TargetName   string `dynamodbav:"target_name"`
+	Before       string `dynamodbav:"before,omitempty"`
+	After        string `dynamodbav:"after,omitempty"`
+}
+
+func targetKey(kind, name string) string {
+	return kind + "#" + name
+}
+
+func (s DynamoSink) Append(ctx context.Context, event Event) error {
+	item, err := attributevalue.MarshalMap(dynamoEvent{
+		Target:       targetKey(event.TargetKind, event.Target),
+		EventId:      event.EventId,
+		Time:         event.Time,
+		Actor:        event.Actor.UserId,
+		Email:        event.Actor.Email,
+		RequestId:    event.Actor.RequestId,
+		SourceIp:     event.Actor.SourceIp,
+		ForwardedFor: event.Actor.ForwardedFor,
+		Action:       event.Action,
+		TargetKind:   event.TargetKind,
+		TargetName:   event.Target,
+		Before:       string(event.Before),
+		After:        string(event.After),
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to marshal audit event, %v", err))
+	}
+	_, err = s.Svc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                aws.String(s.TableName),
+		Item:                     item,
+		ConditionExpression:      aws.String("attribute_not_exists(#e)"),
+		ExpressionAttributeNames: map[string]string{"#e": "event_id"},
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("Got error calling PutItem: %s", err))
+	}
+	return nil
+}
+
+// Query reads the events of a target, or else of an actor, newest first.
+// Without either it scans the table, and the events of a page are only
+// sorted within the page. Filters other than the key are applied after
+// reading, so a page may take several reads to fill.
+func (s DynamoSink) Query(ctx context.Context, filter Filter) ([]Event, string, error) {
+	var read func(startKey map[string]types.AttributeValue) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error)
+	keys := []string{"target", "event_id"}
+	switch {
+	case filter.TargetKind != "" && filter.Target != "":
+		read = s.query(ctx, "", "target", targetKey(filter.TargetKind, filter.Target), filter)
+	case filter.Actor != "":
+		read = s.query(ctx, ActorIndexName, "actor", filter.Actor, filter)
+		keys = append(keys, "actor")
+	default:
+		read = func(startKey map[string]types.AttributeValue) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error) {
+			output, err := s.Svc.Scan(ctx, &dynamodb.ScanInput{TableName: aws.String(s.TableName), ExclusiveStartKey: startKey})
+			if err != nil {
+				return nil, nil, errors.New(fmt.Sprintf("Got error calling Scan: %s", err))
+			}
+			return output.Items, output.LastEvaluatedKey, nil
+		}
+	}
+
+	startKey, err := decodeCursor(filter.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	events := []Event{}
+	for {
+		items, lastKey, err := read(startKey)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, item := range items {
+			event, err := unmarshalEvent(item)
+			if err != nil {
+				return nil, "", err
+			}
+			if !filter.Matches(event) {
+				continue
+			}
+			events = append(events, event)
+			if len(events) == filter.PageLimit() {
+				sortNewestFirst(events)
+				return events, encodeCursor(item, keys), nil
+			}
+		}
+		if lastKey == nil {
+			sortNewestFirst(events)
+			return events, "", nil
+		}
+		startKey = lastKey
+	}
+}
+
+// query reads the partition of the table or index newest first, narrowed
+// to the time range of the filter.
+func (s DynamoSink) query(ctx context.Context, indexName, key, value string, filter Filter) func(startKey map[string]types.AttributeValue) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error) {
+	condition := "#k = :k"
+	values := map[string]types.AttributeValue{":k": &types.AttributeValueMemberS{Value: value}}
+	switch {
+	case !filter.Since.IsZero() && !filter.Until.IsZero():
+		condition += " AND #e BETWEEN :since AND :until"
+	case !filter.Since.IsZero():
+		condition += " AND #e >= :since"
+	case !filter.Until.IsZero():
+		condition += " AND #e < :until"
+	}
+	if !filter.Since.IsZero() {
+		values[":since"] = &types.AttributeValueMemberS{Value: eventIdAt(filter.Since)}
+	}
+	if !filter.Until.IsZero() {
+		values[":until"] = &types.AttributeValueMemberS{Value: eventIdAt(filter.Until)}
+	}
+	return func(startKey map[string]types.AttributeValue) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error) {
+		input := &dynamodb.QueryInput{
+			TableName:                 aws.String(s.TableName),
+			KeyConditionExpression:    aws.String(condition),
+			ExpressionAttributeNames:  map[string]string{"#k": key, "#e": "event_id"},
+			ExpressionAttributeValues: values,
+			ScanIndexForward:          aws.Bool(false),
+			ExclusiveStartKey:         startKey,
+		}
+		if indexName != "" {
+			input.IndexName = aws.String(indexName)
+		}
+		output, err := s.Svc.Query(ctx, input)
+		if err != nil {
+			return nil, nil, errors.New(fmt.Sprintf("Got error calling Query: %s", err))
+		}
+		return output.Items, output.LastEvaluatedKey, nil
+	}
+}
+
+func unmarshalEvent(item map[string]types.AttributeValue) (Event, error) {
+	stored := dynamoEvent{}
+	if err := attributevalue.UnmarshalMap(item, &stored); err != nil {
+		return Event{}, errors.New(fmt.Sprintf("Failed to unmarshal audit event, %v", err))
+	}
+	event := Event{
+		EventId: stored.EventId,
+		Time:    stored.Time,
+		Actor: Actor{
+			UserId:       stored.Actor,
+			Email:        stored.Email,
+			RequestId:    stored.RequestId,
+			SourceIp:     stored.SourceIp,
+			ForwardedFor: stored.ForwardedFor,
+		},
+		Action:     stored.Action,
+		TargetKind: stored.TargetKind,
+		Target:     stored.TargetName,
+	}
+	if stored.Before != "" {
+		event.Before = json.RawMessage(stored.Before)
+	}
+	if stored.After != "" {
+		event.After = json.RawMessage(stored.After)
+	}
+	return event, nil
+}
+
+func sortNewestFirst(events []Event) {
+	sort.Slice(events, func(i, j int) bool { return events[i].EventId > events[j].EventId })
+}
+
+// encodeCursor keeps the key attributes of the last event of a page, which
+// the next page starts after.
+func encodeCursor(item map[string]types.AttributeValue, keys []string) string {
+	cursor := map[string]string{}
+	for _, key := range keys {
+		if value, ok := item[key].(*types.AttributeValueMemberS); ok {
+			cursor[key] = value.Value
+		}
+	}
+	bs, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(bs)
+}
+
+func decodeCursor(cursor string) (map[string]types.AttributeValue, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	bs, err := base64.RawURLEncoding.DecodeString(cursor)
+	keys := map[string]string{}
+	if err == nil {
+		err = json.Unmarshal(bs, &keys)
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Malformed cursor %s", cursor))
+	}
+	startKey := map[string]types.AttributeValue{}
+	for key, value := range keys {
+		startKey[key] = &types.AttributeValueMemberS{Value: value}
+	}
+	return startKey, nil
+}
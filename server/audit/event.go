@@ -0,0 +1,138 @@
+package audit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	Create = "create"
+	Update = "update"
+	Delete = "delete"
+)
+
+// Actor is who made a change and the request it was made through. Changes
+// made from the command line have no source IP.
+type Actor struct {
+	UserId    string `json:"user_id"`
+	Email     string `json:"email,omitempty"`
+	RequestId string `json:"request_id,omitempty"`
+	SourceIp  string `json:"source_ip,omitempty"`
+	// ForwardedFor is the X-Forwarded-For header as received, which only a
+	// trusted proxy makes reliable
+	ForwardedFor string `json:"forwarded_for,omitempty"`
+}
+
+// Event records a change to a policy, policy group or user: who made it,
+// when, and the document before and after. Before is missing for a
+// creation and After for a deletion.
+type Event struct {
+	// EventId sorts in the order the events were recorded
+	EventId    string          `json:"event_id"`
+	Time       int64           `json:"time"`
+	Actor      Actor           `json:"actor"`
+	Action     string          `json:"action"`
+	TargetKind string          `json:"target_kind"`
+	Target     string          `json:"target"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+}
+
+// NewEvent records the change of the target from before to after, either of
+// which may be nil. The action is taken from which of them are set unless
+// one is given.
+func NewEvent(actor Actor, action, targetKind, target string, before, after interface{}) (Event, error) {
+	now := time.Now()
+	bs := make([]byte, 4)
+	if _, err := rand.Read(bs); err != nil {
+		return Event{}, err
+	}
+	event := Event{
+		EventId:    eventIdAt(now) + "-" + hex.EncodeToString(bs),
+		Time:       now.Unix(),
+		Actor:      actor,
+		Action:     action,
+		TargetKind: targetKind,
+		Target:     target,
+	}
+	var err error
+	if before != nil {
+		if event.Before, err = json.Marshal(before); err != nil {
+			return Event{}, errors.New(fmt.Sprintf("Failed to marshal %s %s, %v", targetKind, target, err))
+		}
+	}
+	if after != nil {
+		if event.After, err = json.Marshal(after); err != nil {
+			return Event{}, errors.New(fmt.Sprintf("Failed to marshal %s %s, %v", targetKind, target, err))
+		}
+	}
+	if event.Action == "" {
+		switch {
+		case before == nil:
+			event.Action = Create
+		case after == nil:
+			event.Action = Delete
+		default:
+			event.Action = Update
+		}
+	}
+	return event, nil
+}
+
+// eventIdAt is the prefix of the ids of the events recorded at t, zero
+// padded so that ids compare as strings in time order.
+func eventIdAt(t time.Time) string {
+	return fmt.Sprintf("%019d", t.UnixNano())
+}
+
+// Filter selects the events of an actor, a target or a time range, newest
+// first. Zero values select everything.
+type Filter struct {
+	Actor      string
+	TargetKind string
+	Target     string
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+	// Cursor is the next cursor of the previous page
+	Cursor string
+}
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 1000
+)
+
+func (f Filter) PageLimit() int {
+	if f.Limit <= 0 {
+		return defaultPageLimit
+	}
+	if f.Limit > maxPageLimit {
+		return maxPageLimit
+	}
+	return f.Limit
+}
+
+// Matches tells whether the filter selects the event, leaving out the
+// cursor and the limit.
+func (f Filter) Matches(event Event) bool {
+	return (f.Actor == "" || event.Actor.UserId == f.Actor) &&
+		(f.TargetKind == "" || event.TargetKind == f.TargetKind) &&
+		(f.Target == "" || event.Target == f.Target) &&
+		(f.Since.IsZero() || event.EventId >= eventIdAt(f.Since)) &&
+		(f.Until.IsZero() || event.EventId < eventIdAt(f.Until))
+}
+
+// Sink stores events. Sinks only ever append: there is no way to change or
+// delete an event through them.
+type Sink interface {
+	Append(ctx context.Context, event Event) error
+	// Query returns a page of the events the filter selects and the cursor
+	// of the next page, empty on the last one.
+	Query(ctx context.Context, filter Filter) ([]Event, string, error)
+}
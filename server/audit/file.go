@@ -0,0 +1,79 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// FileSink appends events to a file, one JSON document per line. The file
+// is only ever opened for appending, so that events already written are
+// not rewritten; making it immutable beyond that, e.g. with chattr +a or
+// by shipping it elsewhere, is up to the host.
+type FileSink struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func NewFileSink(path string) *FileSink {
+	return &FileSink{Path: path}
+}
+
+func (s *FileSink) Append(ctx context.Context, event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to marshal audit event, %v", err))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Unable to open audit log, %v", err))
+	}
+	defer f.Close()
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		return errors.New(fmt.Sprintf("Unable to write audit log, %v", err))
+	}
+	// The change is only acknowledged once its event is on disk
+	return f.Sync()
+}
+
+// Query reads the whole file, which suits the volume of changes to
+// permissions; rotate the file to keep it small.
+func (s *FileSink) Query(ctx context.Context, filter Filter) ([]Event, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.Open(s.Path)
+	if os.IsNotExist(err) {
+		return []Event{}, "", nil
+	}
+	if err != nil {
+		return nil, "", errors.New(fmt.Sprintf("Unable to open audit log, %v", err))
+	}
+	defer f.Close()
+	events := []Event{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		event := Event{}
+		if err = json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, "", errors.New(fmt.Sprintf("Malformed audit event on line %d of %s, %v", line, s.Path, err))
+		}
+		if filter.Matches(event) && (filter.Cursor == "" || event.EventId < filter.Cursor) {
+			events = append(events, event)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, "", errors.New(fmt.Sprintf("Unable to read audit log, %v", err))
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].EventId > events[j].EventId })
+	if limit := filter.PageLimit(); len(events) > limit {
+		return events[:limit], events[limit-1].EventId, nil
+	}
+	return events, "", nil
+}
@@ -0,0 +1,78 @@
+package audit
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFileSink(t *testing.T) {
+
+	Convey("FileSink", t, func() {
+		dir, err := ioutil.TempDir("", "audit")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		sink := NewFileSink(filepath.Join(dir, "audit.log"))
+
+		Convey("answers an empty page before anything is recorded", func() {
+			events, next, err := sink.Query(context.Background(), Filter{})
+			So(err, ShouldBeNil)
+			So(events, ShouldBeEmpty)
+			So(next, ShouldBeEmpty)
+		})
+
+		alice := Actor{UserId: "auth0|alice", RequestId: "r1", SourceIp: "10.0.0.1"}
+		bob := Actor{UserId: "auth0|bob"}
+		created, err := NewEvent(alice, "", "policy", "deploy", nil, map[string]string{"name": "deploy"})
+		So(err, ShouldBeNil)
+		So(created.Action, ShouldEqual, Create)
+		So(string(created.After), ShouldEqual, `{"name":"deploy"}`)
+		So(sink.Append(context.Background(), created), ShouldBeNil)
+		middle := time.Now()
+		updated, _ := NewEvent(bob, "", "policy", "deploy", map[string]string{"name": "deploy"}, map[string]string{"name": "deploy", "description": "Deploys"})
+		So(updated.Action, ShouldEqual, Update)
+		So(sink.Append(context.Background(), updated), ShouldBeNil)
+		deleted, _ := NewEvent(alice, "", "group", "backend", map[string]string{"name": "backend"}, nil)
+		So(deleted.Action, ShouldEqual, Delete)
+		So(sink.Append(context.Background(), deleted), ShouldBeNil)
+
+		Convey("lists newest first, a page at a time", func() {
+			events, next, err := sink.Query(context.Background(), Filter{Limit: 2})
+			So(err, ShouldBeNil)
+			So(len(events), ShouldEqual, 2)
+			So(events[0].EventId, ShouldEqual, deleted.EventId)
+			So(events[1].EventId, ShouldEqual, updated.EventId)
+			So(next, ShouldEqual, updated.EventId)
+
+			events, next, err = sink.Query(context.Background(), Filter{Limit: 2, Cursor: next})
+			So(err, ShouldBeNil)
+			So(events, ShouldResemble, []Event{created})
+			So(next, ShouldBeEmpty)
+		})
+
+		Convey("filters by actor, target and time", func() {
+			events, _, err := sink.Query(context.Background(), Filter{Actor: "auth0|alice"})
+			So(err, ShouldBeNil)
+			So(len(events), ShouldEqual, 2)
+			events, _, _ = sink.Query(context.Background(), Filter{TargetKind: "policy", Target: "deploy"})
+			So(len(events), ShouldEqual, 2)
+			events, _, _ = sink.Query(context.Background(), Filter{Since: middle})
+			So(len(events), ShouldEqual, 2)
+			events, _, _ = sink.Query(context.Background(), Filter{Until: middle})
+			So(events, ShouldResemble, []Event{created})
+		})
+
+		Convey("never rewrites what was recorded", func() {
+			again := NewFileSink(sink.Path)
+			So(again.Append(context.Background(), created), ShouldBeNil)
+			events, _, err := again.Query(context.Background(), Filter{})
+			So(err, ShouldBeNil)
+			So(len(events), ShouldEqual, 4)
+		})
+	})
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	Allow   = "allow"
+	Deny    = "deny"
+	Abstain = "abstain"
+)
+
+// DecisionTrace records how a strategy, and the strategies it combines,
+// reached a decision.
+type DecisionTrace struct {
+	Strategy string
+	Decision string
+	Reason   string
+	Children []DecisionTrace
+}
+
+func (t DecisionTrace) String() string {
+	s := t.Decision
+	if t.Strategy != "" {
+		s = t.Strategy + " " + s
+	}
+	if t.Reason != "" {
+		s += ": " + t.Reason
+	}
+	if len(t.Children) > 0 {
+		children := []string{}
+		for _, child := range t.Children {
+			children = append(children, child.String())
+		}
+		s += " [" + strings.Join(children, ", ") + "]"
+	}
+	return s
+}
+
+// DecisionError is returned by the combinators when they do not allow a
+// request, and carries the trace of the decision. A decision reached because
+// a strategy failed, rather than denied, keeps the error of the strategy.
+type DecisionError struct {
+	Trace DecisionTrace
+	err   error
+}
+
+func (e *DecisionError) Error() string {
+	return e.Trace.String()
+}
+
+func (e *DecisionError) Unwrap() error {
+	return e.err
+}
+
+// Denied is the error of a strategy that denies a request, as opposed to one
+// that could not decide, say because a store timed out. Only a denial is
+// inverted by Not.
+func Denied(reason string) error {
+	return &DecisionError{Trace: DecisionTrace{Decision: Deny, Reason: reason}}
+}
+
+// failure returns the error of the strategy that failed, if the error is
+// not a decision.
+func failure(err error) error {
+	if decisionError, ok := err.(*DecisionError); ok {
+		return decisionError.err
+	}
+	return err
+}
+
+// Trace returns the decision trace of the error returned by a strategy.
+func Trace(err error) DecisionTrace {
+	if err == nil {
+		return DecisionTrace{Decision: Allow}
+	}
+	if decisionError, ok := err.(*DecisionError); ok {
+		return decisionError.Trace
+	}
+	return DecisionTrace{Decision: Deny, Reason: err.Error()}
+}
+
+// Named labels the decision traces of a strategy.
+func Named(name string, authorizationStrategy func(user User, r *http.Request) error) func(user User, r *http.Request) error {
+	return func(user User, r *http.Request) error {
+		err := authorizationStrategy(user, r)
+		if err == nil {
+			return nil
+		}
+		trace := Trace(err)
+		trace.Strategy = name
+		return &DecisionError{Trace: trace, err: failure(err)}
+	}
+}
+
+// AllOf allows a request if every strategy allows it, stopping at the first
+// one that denies it. Strategies that abstain are skipped, and AllOf itself
+// abstains if they all do.
+func AllOf(authorizationStrategies ...func(user User, r *http.Request) error) func(user User, r *http.Request) error {
+	return func(user User, r *http.Request) error {
+		children := []DecisionTrace{}
+		allowed := false
+		for i, authorizationStrategy := range authorizationStrategies {
+			err := authorizationStrategy(user, r)
+			child := childTrace(i, err)
+			children = append(children, child)
+			switch child.Decision {
+			case Deny:
+				return &DecisionError{Trace: DecisionTrace{Strategy: "AllOf", Decision: Deny, Children: children}, err: failure(err)}
+			case Allow:
+				allowed = true
+			}
+		}
+		if !allowed {
+			return &DecisionError{Trace: DecisionTrace{Strategy: "AllOf", Decision: Abstain, Children: children}}
+		}
+		return nil
+	}
+}
+
+// AnyOf allows a request as soon as one strategy allows it, and denies it
+// if none does. The denial is a failure if a strategy failed, as it might
+// have allowed the request.
+func AnyOf(authorizationStrategies ...func(user User, r *http.Request) error) func(user User, r *http.Request) error {
+	return func(user User, r *http.Request) error {
+		children := []DecisionTrace{}
+		var failed error
+		for i, authorizationStrategy := range authorizationStrategies {
+			err := authorizationStrategy(user, r)
+			child := childTrace(i, err)
+			if child.Decision == Allow {
+				return nil
+			}
+			if failed == nil {
+				failed = failure(err)
+			}
+			children = append(children, child)
+		}
+		return &DecisionError{Trace: DecisionTrace{Strategy: "AnyOf", Decision: Deny, Children: children}, err: failed}
+	}
+}
+
+// Not allows a request the strategy denies and denies one it allows. An
+// abstention, or the error of a strategy that failed rather than denied, is
+// passed on unchanged, so that Not fails closed.
+func Not(authorizationStrategy func(user User, r *http.Request) error) func(user User, r *http.Request) error {
+	return func(user User, r *http.Request) error {
+		err := authorizationStrategy(user, r)
+		if failure(err) != nil {
+			return err
+		}
+		child := childTrace(0, err)
+		switch child.Decision {
+		case Allow:
+			return &DecisionError{Trace: DecisionTrace{Strategy: "Not", Decision: Deny, Children: []DecisionTrace{child}}}
+		case Abstain:
+			return &DecisionError{Trace: DecisionTrace{Strategy: "Not", Decision: Abstain, Children: []DecisionTrace{child}}}
+		}
+		return nil
+	}
+}
+
+// When applies the strategy only to requests matching the predicate and
+// abstains on the others. On its own, an abstention is an error and the
+// request is refused, so When is meant to be combined, e.g.
+// AllOf(scope, When(MethodIs("POST"), admin)).
+func When(predicate func(user User, r *http.Request) bool, authorizationStrategy func(user User, r *http.Request) error) func(user User, r *http.Request) error {
+	return func(user User, r *http.Request) error {
+		if !predicate(user, r) {
+			return &DecisionError{Trace: DecisionTrace{Strategy: "When", Decision: Abstain, Reason: "predicate not met"}}
+		}
+		return authorizationStrategy(user, r)
+	}
+}
+
+func MethodIs(methods ...string) func(user User, r *http.Request) bool {
+	return func(user User, r *http.Request) bool {
+		for _, method := range methods {
+			if r.Method == method {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func childTrace(i int, err error) DecisionTrace {
+	child := Trace(err)
+	if child.Strategy == "" {
+		child.Strategy = fmt.Sprintf("#%d", i+1)
+	}
+	return child
+}
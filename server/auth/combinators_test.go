@@ -0,0 +1,107 @@
+package auth_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCombinators(t *testing.T) {
+	calls := 0
+	countingStrategy := func(user auth.User, r *http.Request) error {
+		calls++
+		return nil
+	}
+	deny := auth.Named("deny", testAlwaysDenyAuthorizationStrategy)
+	allow := auth.AllowAllAuthorizationStrategy
+	u := auth.User{}
+
+	Convey("AllOf", t, func() {
+		calls = 0
+		r := http.Request{Method: "GET"}
+
+		Convey("allows when every strategy allows", func() {
+			So(auth.AllOf(allow, countingStrategy)(u, &r), ShouldBeNil)
+		})
+
+		Convey("denies at the first strategy that denies, with the trace of the children", func() {
+			err := auth.AllOf(allow, deny, countingStrategy)(u, &r)
+			So(err, ShouldNotBeNil)
+			So(calls, ShouldEqual, 0)
+			trace := auth.Trace(err)
+			So(trace.Decision, ShouldEqual, auth.Deny)
+			So(len(trace.Children), ShouldEqual, 2)
+			So(trace.Children[1].Strategy, ShouldEqual, "deny")
+			So(trace.Children[1].Reason, ShouldEqual, "Always deny")
+		})
+
+		Convey("skips strategies that abstain", func() {
+			So(auth.AllOf(allow, auth.When(auth.MethodIs("POST"), deny))(u, &r), ShouldBeNil)
+		})
+
+		Convey("refuses the request if every strategy abstains", func() {
+			err := auth.AllOf(auth.When(auth.MethodIs("POST"), allow))(u, &r)
+			So(auth.Trace(err).Decision, ShouldEqual, auth.Abstain)
+		})
+	})
+
+	Convey("AnyOf", t, func() {
+		calls = 0
+		r := http.Request{Method: "GET"}
+
+		Convey("allows at the first strategy that allows", func() {
+			So(auth.AnyOf(deny, allow, countingStrategy)(u, &r), ShouldBeNil)
+			So(calls, ShouldEqual, 0)
+		})
+
+		Convey("denies when no strategy allows, with the trace of every child", func() {
+			err := auth.AnyOf(deny, auth.When(auth.MethodIs("POST"), allow))(u, &r)
+			trace := auth.Trace(err)
+			So(trace.Decision, ShouldEqual, auth.Deny)
+			So(len(trace.Children), ShouldEqual, 2)
+			So(trace.Children[1].Decision, ShouldEqual, auth.Abstain)
+		})
+	})
+
+	Convey("Not", t, func() {
+		r := http.Request{Method: "GET"}
+
+		Convey("inverts the decision", func() {
+			So(auth.Not(deny)(u, &r), ShouldBeNil)
+			So(auth.Not(allow)(u, &r), ShouldNotBeNil)
+		})
+
+		Convey("passes on an abstention", func() {
+			err := auth.Not(auth.When(auth.MethodIs("POST"), allow))(u, &r)
+			So(auth.Trace(err).Decision, ShouldEqual, auth.Abstain)
+		})
+
+		Convey("denies when the strategy fails rather than denies", func() {
+			timedOut := func(user auth.User, r *http.Request) error {
+				return context.DeadlineExceeded
+			}
+			storeDown := func(user auth.User, r *http.Request) error {
+				return errors.New("Could not reach the tuple store")
+			}
+			err := auth.Not(timedOut)(u, &r)
+			So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+			So(auth.Not(auth.Named("store", storeDown))(u, &r), ShouldNotBeNil)
+			So(errors.Is(auth.Not(auth.Named("store", timedOut))(u, &r), context.DeadlineExceeded), ShouldBeTrue)
+			So(auth.Not(auth.AllOf(allow, timedOut))(u, &r), ShouldNotBeNil)
+			So(auth.Not(auth.AnyOf(deny, storeDown))(u, &r), ShouldNotBeNil)
+			So(auth.Not(auth.Not(auth.Not(storeDown)))(u, &r), ShouldNotBeNil)
+		})
+	})
+
+	Convey("When", t, func() {
+		Convey("applies the strategy when the predicate holds", func() {
+			r := http.Request{Method: "POST"}
+			So(auth.When(auth.MethodIs("POST"), deny)(u, &r), ShouldNotBeNil)
+			So(auth.When(auth.MethodIs("POST"), allow)(u, &r), ShouldBeNil)
+		})
+	})
+}
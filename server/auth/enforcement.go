@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+type EnforcementMode string
+
+const (
+	EnforceMode EnforcementMode = "enforce"
+	AuditMode   EnforcementMode = "audit"
+)
+
+// AuthorizationDecisions counts decisions per route and outcome, e.g.
+// "/pong:would_deny", and is published through expvar.
+var AuthorizationDecisions = expvar.NewMap("authorization_decisions")
+
+func ParseEnforcementMode(mode string) (EnforcementMode, error) {
+	switch EnforcementMode(mode) {
+	case "", EnforceMode:
+		return EnforceMode, nil
+	case AuditMode:
+		return AuditMode, nil
+	}
+	return "", errors.New(fmt.Sprintf("Unknown enforcement mode: %s", mode))
+}
+
+// EnforcementModeStrategy evaluates the given strategy and records the
+// decision. In audit mode a denial is logged but the request is let through,
+// so that a policy can be observed on a route before it is enforced.
+func EnforcementModeStrategy(mode EnforcementMode, route string, authorizationStrategy func(user User, r *http.Request) error) func(user User, r *http.Request) error {
+	return func(user User, r *http.Request) error {
+		err := authorizationStrategy(user, r)
+		if err == nil {
+			AuthorizationDecisions.Add(route+":allow", 1)
+			return nil
+		}
+		if mode == AuditMode {
+			AuthorizationDecisions.Add(route+":would_deny", 1)
+			log.Println("Audit mode - would deny", user.Identity.UserId, r.Method, r.RequestURI, err)
+			return nil
+		}
+		AuthorizationDecisions.Add(route+":deny", 1)
+		return err
+	}
+}
@@ -0,0 +1,48 @@
+package auth_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEnforcementMode(t *testing.T) {
+
+	Convey("ParseEnforcementMode", t, func() {
+		Convey("defaults to enforce mode", func() {
+			mode, err := auth.ParseEnforcementMode("")
+			So(err, ShouldBeNil)
+			So(mode, ShouldEqual, auth.EnforceMode)
+		})
+
+		Convey("errors on an unknown mode", func() {
+			_, err := auth.ParseEnforcementMode("maybe")
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("EnforcementModeStrategy", t, func() {
+		r := http.Request{RequestURI: "/api/pong?foo=bar"}
+		u := auth.User{}
+
+		Convey("returns the error of the strategy in enforce mode", func() {
+			err := auth.EnforcementModeStrategy(auth.EnforceMode, "/enforced", testAlwaysDenyAuthorizationStrategy)(u, &r)
+			So(err, ShouldNotBeNil)
+			So(auth.AuthorizationDecisions.Get("/enforced:deny").String(), ShouldEqual, "1")
+		})
+
+		Convey("lets a denied request through in audit mode and records the would-be denial", func() {
+			err := auth.EnforcementModeStrategy(auth.AuditMode, "/audited", testAlwaysDenyAuthorizationStrategy)(u, &r)
+			So(err, ShouldBeNil)
+			So(auth.AuthorizationDecisions.Get("/audited:would_deny").String(), ShouldEqual, "1")
+		})
+
+		Convey("records allowed requests", func() {
+			err := auth.EnforcementModeStrategy(auth.AuditMode, "/allowed", auth.AllowAllAuthorizationStrategy)(u, &r)
+			So(err, ShouldBeNil)
+			So(auth.AuthorizationDecisions.Get("/allowed:allow").String(), ShouldEqual, "1")
+		})
+	})
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type PrincipalType string
+
+const (
+	// UserPrincipal is any authenticated user
+	UserPrincipal PrincipalType = "user"
+	// BreakGlassPrincipal is a user while their break-glass access is
+	// activated
+	BreakGlassPrincipal PrincipalType = "break_glass"
+)
+
+func ParsePrincipalType(principalType string) (PrincipalType, error) {
+	switch PrincipalType(principalType) {
+	case UserPrincipal, BreakGlassPrincipal:
+		return PrincipalType(principalType), nil
+	}
+	return "", errors.New(fmt.Sprintf("Unknown principal type: %s", principalType))
+}
+
+// PrincipalTypes returns the types of principal the user acts as.
+func PrincipalTypes(user User) []PrincipalType {
+	principalTypes := []PrincipalType{UserPrincipal}
+	if user.BreakGlass != nil {
+		principalTypes = append(principalTypes, BreakGlassPrincipal)
+	}
+	return principalTypes
+}
+
+// PrincipalTypeStrategy allows a user acting as any of the principal types
+// and denies the others.
+func PrincipalTypeStrategy(principalTypes ...PrincipalType) func(user User, r *http.Request) error {
+	return func(user User, r *http.Request) error {
+		for _, principalType := range PrincipalTypes(user) {
+			for _, required := range principalTypes {
+				if principalType == required {
+					return nil
+				}
+			}
+		}
+		names := []string{}
+		for _, required := range principalTypes {
+			names = append(names, string(required))
+		}
+		return &DecisionError{Trace: DecisionTrace{Strategy: "PrincipalType", Decision: Deny, Reason: "not a principal of type " + strings.Join(names, " or ")}}
+	}
+}
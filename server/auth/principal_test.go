@@ -0,0 +1,43 @@
+package auth_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPrincipalType(t *testing.T) {
+
+	Convey("ParsePrincipalType", t, func() {
+		Convey("accepts the known principal types", func() {
+			principalType, err := auth.ParsePrincipalType("break_glass")
+			So(err, ShouldBeNil)
+			So(principalType, ShouldEqual, auth.BreakGlassPrincipal)
+		})
+
+		Convey("errors on an unknown principal type", func() {
+			_, err := auth.ParsePrincipalType("robot")
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("PrincipalTypeStrategy", t, func() {
+		r := http.Request{RequestURI: "/api/pong"}
+		user := auth.User{}
+		elevated := auth.User{BreakGlass: &auth.BreakGlassElevation{ActivationId: "1"}}
+
+		Convey("allows any authenticated user as a user", func() {
+			So(auth.PrincipalTypeStrategy(auth.UserPrincipal)(user, &r), ShouldBeNil)
+			So(auth.PrincipalTypeStrategy(auth.UserPrincipal)(elevated, &r), ShouldBeNil)
+		})
+
+		Convey("allows only users with break-glass access activated as break_glass", func() {
+			So(auth.PrincipalTypeStrategy(auth.BreakGlassPrincipal)(elevated, &r), ShouldBeNil)
+			err := auth.PrincipalTypeStrategy(auth.BreakGlassPrincipal)(user, &r)
+			So(err, ShouldNotBeNil)
+			So(auth.Trace(err).Decision, ShouldEqual, auth.Deny)
+		})
+	})
+}
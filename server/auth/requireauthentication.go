@@ -4,16 +4,32 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/shafiquejamal/reactjs-golang-starter/errorhandler"
 )
 
+// Timeouts bound the stages of RequireAuthentication: fetching the identity
+// of the bearer token, fetching the permissions of the user and authorizing
+// the request. Zero leaves a stage bounded only by the request.
+type Timeouts struct {
+	Identity      time.Duration
+	UserData      time.Duration
+	Authorization time.Duration
+}
+
+// RequireAuthentication passes the request's context to the fetchers and the
+// authorization strategy, so that a client going away or a stage running
+// out of time cancels the lookups. A stage that runs out of time is answered
+// with 504 Gateway Timeout.
 func RequireAuthentication(
 	authorizationStrategy func(user User, r *http.Request) error,
-	userIdentityFetcher func(bearerToken string, w *http.ResponseWriter) ([]byte, error),
-	userDataFetcher func(userIdentity *UserIdentity, user *User, w *http.ResponseWriter) error) func(http.Handler) http.Handler {
+	userIdentityFetcher func(ctx context.Context, bearerToken string) ([]byte, error),
+	userDataFetcher func(ctx context.Context, userIdentity *UserIdentity, user *User) error,
+	timeouts Timeouts) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			authHeader := strings.Split(r.Header.Get("Authorization"), "Bearer")
@@ -22,22 +38,48 @@ func RequireAuthentication(
 				return
 			} else {
 				bearerToken := strings.TrimSpace(authHeader[1])
-				body, err := userIdentityFetcher(bearerToken, &w)
+				var body []byte
+				timedOut, err := inStage(r.Context(), timeouts.Identity, func(ctx context.Context) (err error) {
+					body, err = userIdentityFetcher(ctx, bearerToken)
+					return err
+				})
+				if err != nil {
+					returnStageError(&w, r, timedOut, "UserID error", err)
+					return
+				}
 				userIdentity := UserIdentity{}
 				if err := json.Unmarshal(body, &userIdentity); err != nil {
 					errorhandler.ReturnError(&w, http.StatusInternalServerError, "UserID error", err)
 					return
 				}
-				user := User{}
-				if err := userDataFetcher(&userIdentity, &user, &w); err != nil {
+				if err := json.Unmarshal(body, &userIdentity.Claims); err != nil {
 					errorhandler.ReturnError(&w, http.StatusInternalServerError, "UserID error", err)
 					return
 				}
+				user := User{}
+				timedOut, err = inStage(r.Context(), timeouts.UserData, func(ctx context.Context) error {
+					return userDataFetcher(ctx, &userIdentity, &user)
+				})
+				if err != nil {
+					returnStageError(&w, r, timedOut, "UserID error", err)
+					return
+				}
 				if !user.Identity.EmailVerified {
 					errorhandler.ReturnError(&w, http.StatusUnauthorized, "Unauthorized - email not verified", err)
 					return
 				}
-				if err := authorizationStrategy(user, r); err != nil {
+				if user.Deactivated {
+					errorhandler.ReturnError(&w, http.StatusForbidden, "Forbidden - user is deactivated", errors.New("User is deactivated"))
+					return
+				}
+				timedOut, err = inStage(r.Context(), timeouts.Authorization, func(ctx context.Context) error {
+					return authorizationStrategy(user, r.WithContext(ctx))
+				})
+				if err != nil && (timedOut || r.Context().Err() != nil) {
+					returnStageError(&w, r, timedOut, "Authorization error", err)
+					return
+				}
+				if err != nil {
 					errorhandler.ReturnError(&w, http.StatusUnauthorized, "Unauthorized - denied by policy", err)
 					return
 				}
@@ -47,3 +89,28 @@ func RequireAuthentication(
 		})
 	}
 }
+
+// inStage runs a stage with its timeout, if any, and tells whether the stage
+// ran out of time, which its error may not show.
+func inStage(parent context.Context, timeout time.Duration, stage func(ctx context.Context) error) (bool, error) {
+	ctx, cancel := parent, context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, timeout)
+	}
+	defer cancel()
+	err := stage(ctx)
+	return ctx.Err() == context.DeadlineExceeded, err
+}
+
+// returnStageError answers 504 for a stage that ran out of time and 500 for
+// one that failed, and nothing to a client that went away.
+func returnStageError(w *http.ResponseWriter, r *http.Request, timedOut bool, message string, err error) {
+	switch {
+	case timedOut:
+		errorhandler.ReturnError(w, http.StatusGatewayTimeout, message+" - timed out", err)
+	case r.Context().Err() == context.Canceled:
+		log.Println(message+" - request canceled", err)
+	default:
+		errorhandler.ReturnError(w, http.StatusInternalServerError, message, err)
+	}
+}
@@ -1,16 +1,19 @@
 package auth_test
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/shafiquejamal/reactjs-golang-starter/auth"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
 var errorOutputForTesting = ""
+var statusCodeForTesting = 0
 
 func createUser(u *auth.User, allowActions1, allowActions2, denyActions1, denyActions2 []string) {
 	allowStatement1 := auth.Statement{
@@ -40,12 +43,12 @@ func createUser(u *auth.User, allowActions1, allowActions2, denyActions1, denyAc
 	(*u).Permissions = []auth.Permission{permission1, permission2}
 }
 
-func testBadUserIdentityDataFetcher(bearerToken string, w *http.ResponseWriter) ([]byte, error) {
+func testBadUserIdentityDataFetcher(ctx context.Context, bearerToken string) ([]byte, error) {
 	return []byte{}, nil
 }
 
-func testGoodUserIdentityDataFetcher(emailVerified bool) func(bearerToken string, w *http.ResponseWriter) ([]byte, error) {
-	return func(bearerToken string, w *http.ResponseWriter) ([]byte, error) {
+func testGoodUserIdentityDataFetcher(emailVerified bool) func(ctx context.Context, bearerToken string) ([]byte, error) {
+	return func(ctx context.Context, bearerToken string) ([]byte, error) {
 		u := auth.UserIdentity{
 			EmailVerified: emailVerified,
 		}
@@ -53,11 +56,11 @@ func testGoodUserIdentityDataFetcher(emailVerified bool) func(bearerToken string
 	}
 }
 
-func testBadUserDataFetcher(userI *auth.UserIdentity, u *auth.User, w *http.ResponseWriter) error {
+func testBadUserDataFetcher(ctx context.Context, userI *auth.UserIdentity, u *auth.User) error {
 	return errors.New("bad user data fetecher")
 }
 
-func testGoodUserDataFetcher(userI *auth.UserIdentity, u *auth.User, w *http.ResponseWriter) error {
+func testGoodUserDataFetcher(ctx context.Context, userI *auth.UserIdentity, u *auth.User) error {
 	allowStatement := auth.Statement{
 		Actions:   []string{"^/ping$", "^/pong$"},
 		Resources: []string{".*"},
@@ -76,7 +79,7 @@ func testGoodUserDataFetcher(userI *auth.UserIdentity, u *auth.User, w *http.Res
 }
 
 func testAlwaysDenyAuthorizationStrategy(user auth.User, r *http.Request) error {
-	return errors.New("Always deny")
+	return auth.Denied("Always deny")
 }
 
 func TestSpec(t *testing.T) {
@@ -100,6 +103,18 @@ func TestSpec(t *testing.T) {
 				err := auth.PolicyAuthorizationStrategy(apiPrefix)(u, &r)
 				So(err, ShouldBeNil)
 			})
+
+			Convey("An allow action matches the URL path and every permission boundary allows it", func() {
+				r := http.Request{RequestURI: "/api/ping?foo=bar"}
+				u := auth.User{}
+				createUser(&u, []string{"^/ping$", "^/pong$"}, []string{}, []string{}, []string{})
+				u.Boundaries = []auth.Permission{
+					{Allows: []auth.Statement{{Actions: []string{"^/ping$"}}}},
+					{Allows: []auth.Statement{{Actions: []string{".*"}}}},
+				}
+				err := auth.PolicyAuthorizationStrategy(apiPrefix)(u, &r)
+				So(err, ShouldBeNil)
+			})
 		})
 
 		Convey("returns an error when", func() {
@@ -136,6 +151,24 @@ func TestSpec(t *testing.T) {
 				So(err, ShouldNotBeNil)
 			})
 
+			Convey("An allow action matches the URL path, but a permission boundary does not allow it", func() {
+				r := http.Request{RequestURI: "/api/pong?foo=bar"}
+				u := auth.User{}
+				createUser(&u, []string{"^/ping$", "^/pong$"}, []string{}, []string{}, []string{})
+				u.Boundaries = []auth.Permission{{Allows: []auth.Statement{{Actions: []string{"^/ping$"}}}}}
+				err := auth.PolicyAuthorizationStrategy(apiPrefix)(u, &r)
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("A permission boundary allows the URL path, but no attached policy does", func() {
+				r := http.Request{RequestURI: "/api/pang?foo=bar"}
+				u := auth.User{}
+				createUser(&u, []string{"^/ping$"}, []string{}, []string{}, []string{})
+				u.Boundaries = []auth.Permission{{Allows: []auth.Statement{{Actions: []string{".*"}}}}}
+				err := auth.PolicyAuthorizationStrategy(apiPrefix)(u, &r)
+				So(err, ShouldNotBeNil)
+			})
+
 			Convey("The URL path cannot be extracted", func() {
 				r := http.Request{RequestURI: ""}
 				u := auth.User{}
@@ -162,7 +195,7 @@ func TestSpec(t *testing.T) {
 		Convey("errors if the header is malformed", func() {
 			r := http.Request{}
 			w := MockResponseWriter{}
-			fn := auth.RequireAuthentication(auth.AllowAllAuthorizationStrategy, testGoodUserIdentityDataFetcher(true), testGoodUserDataFetcher)
+			fn := auth.RequireAuthentication(auth.AllowAllAuthorizationStrategy, testGoodUserIdentityDataFetcher(true), testGoodUserDataFetcher, auth.Timeouts{})
 			mockNext := MockNext{}
 			fn(mockNext).ServeHTTP(w, &r)
 			So(errorOutputForTesting, ShouldEqual, "Malformed authorization header or token")
@@ -175,7 +208,7 @@ func TestSpec(t *testing.T) {
 				Header: header,
 			}
 			w := MockResponseWriter{}
-			fn := auth.RequireAuthentication(auth.AllowAllAuthorizationStrategy, testBadUserIdentityDataFetcher, testGoodUserDataFetcher)
+			fn := auth.RequireAuthentication(auth.AllowAllAuthorizationStrategy, testBadUserIdentityDataFetcher, testGoodUserDataFetcher, auth.Timeouts{})
 			mockNext := MockNext{}
 			fn(mockNext).ServeHTTP(w, &r)
 			So(errorOutputForTesting, ShouldEqual, "UserID error")
@@ -188,7 +221,7 @@ func TestSpec(t *testing.T) {
 				Header: header,
 			}
 			w := MockResponseWriter{}
-			fn := auth.RequireAuthentication(auth.AllowAllAuthorizationStrategy, testGoodUserIdentityDataFetcher(true), testBadUserDataFetcher)
+			fn := auth.RequireAuthentication(auth.AllowAllAuthorizationStrategy, testGoodUserIdentityDataFetcher(true), testBadUserDataFetcher, auth.Timeouts{})
 			mockNext := MockNext{}
 			fn(mockNext).ServeHTTP(w, &r)
 			So(errorOutputForTesting, ShouldEqual, "UserID error")
@@ -201,7 +234,7 @@ func TestSpec(t *testing.T) {
 				Header: header,
 			}
 			w := MockResponseWriter{}
-			fn := auth.RequireAuthentication(auth.AllowAllAuthorizationStrategy, testGoodUserIdentityDataFetcher(false), testGoodUserDataFetcher)
+			fn := auth.RequireAuthentication(auth.AllowAllAuthorizationStrategy, testGoodUserIdentityDataFetcher(false), testGoodUserDataFetcher, auth.Timeouts{})
 			mockNext := MockNext{}
 			fn(mockNext).ServeHTTP(w, &r)
 			So(errorOutputForTesting, ShouldEqual, "Unauthorized - email not verified")
@@ -214,7 +247,7 @@ func TestSpec(t *testing.T) {
 				Header: header,
 			}
 			w := MockResponseWriter{}
-			fn := auth.RequireAuthentication(testAlwaysDenyAuthorizationStrategy, testGoodUserIdentityDataFetcher(true), testGoodUserDataFetcher)
+			fn := auth.RequireAuthentication(testAlwaysDenyAuthorizationStrategy, testGoodUserIdentityDataFetcher(true), testGoodUserDataFetcher, auth.Timeouts{})
 			mockNext := MockNext{}
 			fn(mockNext).ServeHTTP(w, &r)
 			So(errorOutputForTesting, ShouldEqual, "Unauthorized - denied by policy")
@@ -228,11 +261,84 @@ func TestSpec(t *testing.T) {
 				RequestURI: "/api/ping?foo=bar",
 			}
 			w := MockResponseWriter{}
-			fn := auth.RequireAuthentication(auth.AllowAllAuthorizationStrategy, testGoodUserIdentityDataFetcher(true), testGoodUserDataFetcher)
+			fn := auth.RequireAuthentication(auth.AllowAllAuthorizationStrategy, testGoodUserIdentityDataFetcher(true), testGoodUserDataFetcher, auth.Timeouts{})
 			mockNext := MockNext{}
 			fn(mockNext).ServeHTTP(w, &r)
 			So(errorOutputForTesting, ShouldEqual, "pass")
 		})
+
+		Convey("refuses a deactivated user even where all are allowed", func() {
+			header := make(map[string][]string)
+			header["Authorization"] = []string{"Bearer some-token"}
+			r := http.Request{
+				Header:     header,
+				RequestURI: "/api/ping",
+			}
+			deactivatedUserDataFetcher := func(ctx context.Context, userI *auth.UserIdentity, u *auth.User) error {
+				(*u).Identity = *userI
+				(*u).Deactivated = true
+				return nil
+			}
+			w := MockResponseWriter{}
+			fn := auth.RequireAuthentication(auth.AllowAllAuthorizationStrategy, testGoodUserIdentityDataFetcher(true), deactivatedUserDataFetcher, auth.Timeouts{})
+			fn(MockNext{}).ServeHTTP(w, &r)
+			So(errorOutputForTesting, ShouldEqual, "Forbidden - user is deactivated")
+			So(statusCodeForTesting, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("passes on the claims of the identity provider", func() {
+			header := make(map[string][]string)
+			header["Authorization"] = []string{"Bearer some-token"}
+			r := http.Request{
+				Header:     header,
+				RequestURI: "/api/ping",
+			}
+			identityFetcher := func(ctx context.Context, bearerToken string) ([]byte, error) {
+				return []byte(`{"sub": "auth0|1", "email_verified": true, "groups": ["oncall"]}`), nil
+			}
+			var claims map[string]interface{}
+			userDataFetcher := func(ctx context.Context, userI *auth.UserIdentity, u *auth.User) error {
+				claims = userI.Claims
+				return testGoodUserDataFetcher(ctx, userI, u)
+			}
+			fn := auth.RequireAuthentication(auth.AllowAllAuthorizationStrategy, identityFetcher, userDataFetcher, auth.Timeouts{})
+			fn(MockNext{}).ServeHTTP(MockResponseWriter{}, &r)
+			So(claims["groups"], ShouldResemble, []interface{}{"oncall"})
+			So(claims["sub"], ShouldEqual, "auth0|1")
+		})
+
+		Convey("answers 504 when a stage runs out of time", func() {
+			header := make(map[string][]string)
+			header["Authorization"] = []string{"Bearer some-token"}
+			r := http.Request{
+				Header:     header,
+				RequestURI: "/api/ping",
+			}
+			slowUserDataFetcher := func(ctx context.Context, userI *auth.UserIdentity, u *auth.User) error {
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			w := MockResponseWriter{}
+			fn := auth.RequireAuthentication(auth.AllowAllAuthorizationStrategy, testGoodUserIdentityDataFetcher(true), slowUserDataFetcher, auth.Timeouts{UserData: time.Millisecond})
+			fn(MockNext{}).ServeHTTP(w, &r)
+			So(errorOutputForTesting, ShouldEqual, "UserID error - timed out")
+			So(statusCodeForTesting, ShouldEqual, http.StatusGatewayTimeout)
+		})
+
+		Convey("stops when the client goes away", func() {
+			header := make(map[string][]string)
+			header["Authorization"] = []string{"Bearer some-token"}
+			ctx, cancel := context.WithCancel(context.Background())
+			r := (&http.Request{Header: header, RequestURI: "/api/ping"}).WithContext(ctx)
+			identityFetcher := func(ctx context.Context, bearerToken string) ([]byte, error) {
+				cancel()
+				return nil, ctx.Err()
+			}
+			errorOutputForTesting = ""
+			fn := auth.RequireAuthentication(auth.AllowAllAuthorizationStrategy, identityFetcher, testGoodUserDataFetcher, auth.Timeouts{Identity: time.Minute})
+			fn(MockNext{}).ServeHTTP(MockResponseWriter{}, r)
+			So(errorOutputForTesting, ShouldBeEmpty)
+		})
 	})
 
 }
@@ -253,6 +359,7 @@ type MockResponseWriter struct {
 }
 
 func (m MockResponseWriter) WriteHeader(statusCode int) {
+	statusCodeForTesting = statusCode
 }
 
 func (m MockResponseWriter) Header() http.Header {
@@ -20,30 +20,44 @@ func PolicyAuthorizationStrategy(apiPrefix string) func(user User, r *http.Reque
 			return errors.New("matches < 2 or matches 1 is empty")
 		}
 		path := strings.TrimSpace(matches[1])
-		allowPolicyMatched := false
-		for _, p := range user.Permissions {
-			for _, deny := range p.Denys {
-				for _, a := range deny.Actions {
-					m, err := regexp.MatchString(a, path)
-					if m || err != nil {
-						return errors.New("Denied by policy")
-					}
-				}
+		if err := evaluatePermissions(user.Permissions, path); err != nil {
+			return err
+		}
+		for _, boundary := range user.Boundaries {
+			if err := evaluatePermissions([]Permission{boundary}, path); err != nil {
+				return Denied("Outside permission boundary")
 			}
+		}
+		return nil
+	}
+}
 
-			for _, allow := range p.Allows {
-				for _, a := range allow.Actions {
-					m, err := regexp.MatchString(a, path)
-					if m && err == nil {
-						allowPolicyMatched = true
-					}
+// evaluatePermissions allows the path if an allow action of the permissions
+// matches it and no deny action does.
+func evaluatePermissions(permissions []Permission, path string) error {
+	allowPolicyMatched := false
+	for _, p := range permissions {
+		for _, deny := range p.Denys {
+			for _, a := range deny.Actions {
+				m, err := regexp.MatchString(a, path)
+				if m || err != nil {
+					return Denied("Denied by policy")
 				}
 			}
 		}
-		if allowPolicyMatched {
-			return nil
-		} else {
-			return errors.New("No match in policy")
+
+		for _, allow := range p.Allows {
+			for _, a := range allow.Actions {
+				m, err := regexp.MatchString(a, path)
+				if m && err == nil {
+					allowPolicyMatched = true
+				}
+			}
 		}
 	}
+	if allowPolicyMatched {
+		return nil
+	} else {
+		return Denied("No match in policy")
+	}
 }
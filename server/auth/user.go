@@ -1,10 +1,11 @@
 package auth
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
-
-	"github.com/shafiquejamal/reactjs-golang-starter/errorhandler"
 )
 
 type UserIdentity struct {
@@ -12,6 +13,9 @@ type UserIdentity struct {
 	Email         string
 	UserId        string `json:"sub"`
 	EmailVerified bool   `json:"email_verified"`
+	// Claims are all the claims of the identity provider, such as its roles
+	// and groups, which are not passed on to clients
+	Claims map[string]interface{} `json:"-"`
 }
 
 type Statement struct {
@@ -27,27 +31,48 @@ type Permission struct {
 type User struct {
 	Identity    UserIdentity
 	Permissions []Permission
+	// Boundaries cap the permissions: a path is only allowed if every
+	// boundary allows it as well.
+	Boundaries []Permission
+	// PolicyPaths maps each policy name to the chain of policy groups through
+	// which the user holds it, empty when the policy is attached directly.
+	PolicyPaths map[string][]string
+	// BreakGlass is set while the user has break-glass access activated, so
+	// that handlers can tag the actions taken under it.
+	BreakGlass *BreakGlassElevation
+	// IdpPolicyGroups are the policy groups the user belongs to through the
+	// claims of the identity provider rather than the policy store.
+	IdpPolicyGroups []string
+	// Deactivated is set for a user the identity provider deactivated, who
+	// is refused on every authenticated route, whatever its strategy.
+	Deactivated bool
+}
+
+type BreakGlassElevation struct {
+	ActivationId  string
+	Justification string
+	ExpiresAt     int64
 }
 
-func OAuthUserIdentityFetcher(ep string) func(bearerToken string, w *http.ResponseWriter) ([]byte, error) {
-	return func(bearerToken string, w *http.ResponseWriter) ([]byte, error) {
+// OAuthUserIdentityFetcher gets the claims of the bearer token from the
+// userinfo endpoint of the authorization server, giving up when the context
+// is done.
+func OAuthUserIdentityFetcher(ep string) func(ctx context.Context, bearerToken string) ([]byte, error) {
+	return func(ctx context.Context, bearerToken string) ([]byte, error) {
 		client := http.Client{}
-		req, err := http.NewRequest("GET", ep, nil)
+		req, err := http.NewRequestWithContext(ctx, "GET", ep, nil)
 		if err != nil {
-			errorhandler.ReturnError(w, http.StatusInternalServerError, "Could not create GET request for client info", err)
-			return []byte{}, err
+			return []byte{}, errors.New(fmt.Sprintf("Could not create GET request for client info, %v", err))
 		}
 		req.Header.Add("Authorization", "Bearer "+bearerToken)
 		resp, err := client.Do(req)
 		if err != nil {
-			errorhandler.ReturnError(w, http.StatusInternalServerError, "Response error", err)
-			return []byte{}, err
+			return []byte{}, errors.New(fmt.Sprintf("Response error, %v", err))
 		}
 		defer resp.Body.Close()
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			errorhandler.ReturnError(w, http.StatusInternalServerError, "Error while reading the response bytes", err)
-			return []byte{}, err
+			return []byte{}, errors.New(fmt.Sprintf("Error while reading the response bytes, %v", err))
 		}
 		return body, nil
 	}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/audit"
+	"github.com/shafiquejamal/reactjs-golang-starter/cf"
+	"github.com/shafiquejamal/reactjs-golang-starter/policystore"
+)
+
+// bootstrap creates or verifies the DynamoDB tables of the configuration,
+// seeds policies from a file and runs the data migrations:
+//
+//	server bootstrap [-verify] [-seed policies.yaml]
+func bootstrap(configuration cf.Configuration, args []string) error {
+	flags := flag.NewFlagSet("bootstrap", flag.ContinueOnError)
+	verify := flags.Bool("verify", false, "only check the tables and migrations, change nothing")
+	seed := flags.String("seed", "", "policy file with the users, groups and policies to create if missing")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if configuration.DdbSchemaMigrationTableName == "" {
+		return errors.New("ddbSchemaMigrationTableName is not configured")
+	}
+
+	ctx := context.Background()
+	store := dynamoPolicyStore(configuration, dynamoClient(configuration))
+	for _, spec := range tableSpecs(configuration, store) {
+		changes, err := policystore.EnsureTable(ctx, store.Svc, spec, !*verify)
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			log.Println("Bootstrap", change)
+		}
+		log.Println("Table", spec.Name, "is ready")
+	}
+
+	if *verify {
+		return nil
+	}
+	if *seed != "" {
+		seeded, err := store.Seed(ctx, *seed)
+		if err != nil {
+			return err
+		}
+		log.Printf("Seeded %d items from %s: %v", len(seeded), *seed, seeded)
+	}
+	version, err := store.Migrate(ctx, configuration.DdbSchemaMigrationTableName)
+	if err != nil {
+		return err
+	}
+	log.Println("Policy data is at version", version)
+	return nil
+}
+
+// tableSpecs lists the tables of the store and of the optional features
+// that are configured.
+func tableSpecs(configuration cf.Configuration, store policystore.DynamoPolicyStore) []policystore.TableSpec {
+	userId := policystore.KeyAttribute{Name: "user_id", Type: types.ScalarAttributeTypeS}
+	specs := append(store.TableSpecs(), policystore.MigrationsTableSpec(configuration.DdbSchemaMigrationTableName))
+	if configuration.DdbTemporaryGrantTableName != "" {
+		specs = append(specs, policystore.TableSpec{
+			Name:         configuration.DdbTemporaryGrantTableName,
+			PartitionKey: userId,
+			SortKey:      &policystore.KeyAttribute{Name: "grant_id", Type: types.ScalarAttributeTypeS},
+			TTLAttribute: "expires_at",
+		})
+	}
+	if configuration.DdbBreakGlassTableName != "" {
+		specs = append(specs, policystore.TableSpec{
+			Name:         configuration.DdbBreakGlassTableName,
+			PartitionKey: userId,
+			SortKey:      &policystore.KeyAttribute{Name: "activation_id", Type: types.ScalarAttributeTypeS},
+			TTLAttribute: "expires_at",
+		})
+	}
+	if configuration.DdbRelationTupleTableName != "" {
+		objectRelation := policystore.KeyAttribute{Name: "object_relation", Type: types.ScalarAttributeTypeS}
+		subject := policystore.KeyAttribute{Name: "subject", Type: types.ScalarAttributeTypeS}
+		specs = append(specs, policystore.TableSpec{
+			Name:         configuration.DdbRelationTupleTableName,
+			PartitionKey: objectRelation,
+			SortKey:      &subject,
+			// Reverse lookups, from a subject to the objects it relates to
+			Indexes: []policystore.IndexSpec{{Name: "subject-index", PartitionKey: subject, SortKey: &objectRelation}},
+		})
+	}
+	if configuration.DdbAuditTableName != "" {
+		eventId := policystore.KeyAttribute{Name: "event_id", Type: types.ScalarAttributeTypeS}
+		specs = append(specs, policystore.TableSpec{
+			Name:         configuration.DdbAuditTableName,
+			PartitionKey: policystore.KeyAttribute{Name: "target", Type: types.ScalarAttributeTypeS},
+			SortKey:      &eventId,
+			// The events of an actor
+			Indexes: []policystore.IndexSpec{{Name: audit.ActorIndexName, PartitionKey: policystore.KeyAttribute{Name: "actor", Type: types.ScalarAttributeTypeS}, SortKey: &eventId}},
+		})
+	}
+	return specs
+}
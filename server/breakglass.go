@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	"github.com/shafiquejamal/reactjs-golang-starter/errorhandler"
+	"github.com/shafiquejamal/reactjs-golang-starter/policystore"
+)
+
+const (
+	defaultMaxBreakGlassDuration = time.Hour
+	minJustificationLength       = 20
+	// activateBreakGlass is the audit action of activating break-glass access
+	activateBreakGlass = "activate"
+)
+
+// BreakGlassActivation elevates a user to the break-glass policies until
+// ExpiresAt, the TTL attribute of the table.
+type BreakGlassActivation struct {
+	UserId        string   `dynamodbav:"user_id"`
+	ActivationId  string   `dynamodbav:"activation_id"`
+	Justification string   `dynamodbav:"justification"`
+	PolicyNames   []string `dynamodbav:"policy_names"`
+	ActivatedAt   int64    `dynamodbav:"activated_at"`
+	ExpiresAt     int64    `dynamodbav:"expires_at"`
+}
+
+type breakGlassStore struct {
+	breakGlassTableName string
+	svc                 *dynamodb.Client
+}
+
+func (s breakGlassStore) Activate(ctx context.Context, activation BreakGlassActivation) (BreakGlassActivation, error) {
+	activationId, err := newGrantId()
+	if err != nil {
+		return BreakGlassActivation{}, err
+	}
+	activation.ActivationId = activationId
+	item, err := attributevalue.MarshalMap(activation)
+	if err != nil {
+		return BreakGlassActivation{}, errors.New(fmt.Sprintf("Failed to marshal break-glass activation, %v", err))
+	}
+	_, err = s.svc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.breakGlassTableName),
+		Item:      item,
+	})
+	if err != nil {
+		return BreakGlassActivation{}, errors.New(fmt.Sprintf("Got error calling PutItem: %s", err))
+	}
+	return activation, nil
+}
+
+// Active returns the activations of the user that have not expired yet.
+func (s breakGlassStore) Active(ctx context.Context, userId string) ([]BreakGlassActivation, error) {
+	result, err := s.svc.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(s.breakGlassTableName),
+		KeyConditionExpression: aws.String("user_id = :u"),
+		FilterExpression:       aws.String("expires_at > :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":u":   &types.AttributeValueMemberS{Value: userId},
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+		},
+	})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Got error calling Query: %s", err))
+	}
+	activations := []BreakGlassActivation{}
+	if err = attributevalue.UnmarshalListOfMaps(result.Items, &activations); err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to unmarshal break-glass activations, %v", err))
+	}
+	return activations, nil
+}
+
+// breakGlassEligibility is the policy that makes a user eligible for
+// break-glass access, and what is needed to tell whether they hold it.
+type breakGlassEligibility struct {
+	policy              string
+	store               policystore.PolicyStore
+	idpGroups           *idpGroupMapper
+	maxPolicyGroupDepth int
+}
+
+// permanentPolicies resolves the policies the user holds through their
+// permanent attachments, from the store or the identity provider. Time-bound
+// attachments, grants and break-glass policies are left out, so that none of
+// them can make a user eligible for more. A user deactivated by SCIM
+// provisioning holds none.
+func (e breakGlassEligibility) permanentPolicies(ctx context.Context, identity auth.UserIdentity) (map[string][]string, error) {
+	userPolicyNames, err := e.store.GetUserPolicyNames(ctx, identity.UserId)
+	if err != nil {
+		return nil, err
+	}
+	if userPolicyNames.Scim != nil && !userPolicyNames.Scim.Active {
+		return map[string][]string{}, nil
+	}
+	groupNames := userPolicyNames.PolicyGroups
+	if e.idpGroups != nil {
+		groupNames, _ = e.idpGroups.combine(groupNames, identity.Claims)
+	}
+	resolution, err := policystore.Resolve(ctx, e.store, userPolicyNames.PolicyNames, groupNames, nil, e.maxPolicyGroupDepth)
+	if err != nil {
+		return nil, err
+	}
+	return resolution.PolicyPaths, nil
+}
+
+// validateBreakGlassRequest checks that the permanent policies of the user
+// include the eligibility policy and that the user justified the request.
+func validateBreakGlassRequest(permanentPolicies map[string][]string, eligibilityPolicy, justification string, duration, maxDuration time.Duration) error {
+	if _, eligible := permanentPolicies[eligibilityPolicy]; !eligible || eligibilityPolicy == "" {
+		return errors.New("Not eligible for break-glass access")
+	}
+	if len(strings.TrimSpace(justification)) < minJustificationLength {
+		return errors.New(fmt.Sprintf("A justification of at least %d characters is required", minJustificationLength))
+	}
+	if duration <= 0 || duration > maxDuration {
+		return errors.New(fmt.Sprintf("Break-glass duration must be positive and at most %s", maxDuration))
+	}
+	return nil
+}
+
+// notifyBreakGlass posts the activation to the webhook without holding up
+// the request.
+func notifyBreakGlass(webhookUrl string, user auth.User, activation BreakGlassActivation) {
+	if webhookUrl == "" {
+		return
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"event":      "break_glass_activated",
+		"user":       user.Identity,
+		"activation": activation,
+	})
+	if err != nil {
+		log.Println("Could not encode break-glass notification", err)
+		return
+	}
+	go func() {
+		client := http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Post(webhookUrl, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Println("Break-glass notification failed", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Println("Break-glass notification failed with status", resp.StatusCode)
+		}
+	}()
+}
+
+func activateBreakGlassHandler(store breakGlassStore, eligibility breakGlassEligibility, policyNames []string, maxDuration time.Duration, webhookUrl string, trail auditTrail) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("User")).(auth.User)
+		request := struct {
+			Justification   string
+			DurationSeconds int64
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			errorhandler.ReturnError(&w, http.StatusBadRequest, "Malformed break-glass request", err)
+			return
+		}
+		permanentPolicies, err := eligibility.permanentPolicies(r.Context(), user.Identity)
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusInternalServerError, "Could not check break-glass eligibility", err)
+			return
+		}
+		duration := time.Duration(request.DurationSeconds) * time.Second
+		if err := validateBreakGlassRequest(permanentPolicies, eligibility.policy, request.Justification, duration, maxDuration); err != nil {
+			errorhandler.ReturnError(&w, http.StatusForbidden, "Break-glass request refused", err)
+			return
+		}
+		now := time.Now()
+		activation, err := store.Activate(r.Context(), BreakGlassActivation{
+			UserId:        user.Identity.UserId,
+			Justification: request.Justification,
+			PolicyNames:   policyNames,
+			ActivatedAt:   now.Unix(),
+			ExpiresAt:     now.Add(duration).Unix(),
+		})
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusInternalServerError, "Could not activate break-glass access", err)
+			return
+		}
+		log.Printf("BREAK-GLASS ACTIVATED user=%s email=%s activation=%s policies=%v expires_at=%d justification=%q",
+			user.Identity.UserId, user.Identity.Email, activation.ActivationId, activation.PolicyNames, activation.ExpiresAt, activation.Justification)
+		notifyBreakGlass(webhookUrl, user, activation)
+		// The activation gets its id as it is stored, so it is recorded after
+		warnUnrecorded(w, trail.record(r.Context(), requestActor(w, r), activateBreakGlass, auditBreakGlass, user.Identity.UserId, nil, activation))
+		writeJSON(w, http.StatusCreated, activation)
+	}
+}
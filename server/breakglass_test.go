@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	"github.com/shafiquejamal/reactjs-golang-starter/policystore"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestValidateBreakGlassRequest(t *testing.T) {
+
+	Convey("validateBreakGlassRequest", t, func() {
+		eligible := map[string][]string{"break-glass-eligible": {"oncall"}}
+		justification := "INC-1234 payments are down, need to restart workers"
+
+		Convey("accepts an eligible user with a justification", func() {
+			So(validateBreakGlassRequest(eligible, "break-glass-eligible", justification, time.Hour, time.Hour), ShouldBeNil)
+		})
+
+		Convey("refuses a user without the eligibility policy", func() {
+			So(validateBreakGlassRequest(map[string][]string{}, "break-glass-eligible", justification, time.Hour, time.Hour), ShouldNotBeNil)
+		})
+
+		Convey("refuses everyone when no eligibility policy is configured", func() {
+			So(validateBreakGlassRequest(map[string][]string{"": {}}, "", justification, time.Hour, time.Hour), ShouldNotBeNil)
+		})
+
+		Convey("refuses a missing or short justification", func() {
+			So(validateBreakGlassRequest(eligible, "break-glass-eligible", "  because  ", time.Hour, time.Hour), ShouldNotBeNil)
+		})
+
+		Convey("refuses a duration above the maximum", func() {
+			So(validateBreakGlassRequest(eligible, "break-glass-eligible", justification, 2*time.Hour, time.Hour), ShouldNotBeNil)
+		})
+	})
+
+	Convey("breakGlassEligibility", t, func() {
+		store := policystore.NewMemoryPolicyStore()
+		store.PutPolicies(context.Background(), policystore.PermsWithMeta{Name: "break-glass-eligible"})
+		store.PutPolicyGroups(context.Background(), policystore.PolicyGroup{Name: "oncall", PolicyNames: []string{"break-glass-eligible"}})
+		store.PutUserPolicyNames(context.Background(),
+			policystore.UserPolicyNames{UserId: "auth0|1", PolicyGroups: []string{"oncall"}},
+			policystore.UserPolicyNames{UserId: "auth0|2", TimeBoundPolicies: []policystore.TimeBoundAttachment{{Name: "break-glass-eligible", ExpiresAt: 2000000000}}},
+			policystore.UserPolicyNames{UserId: "auth0|3", PolicyGroups: []string{"oncall"}, Scim: &policystore.ScimProfile{Active: false}},
+		)
+		eligibility := breakGlassEligibility{policy: "break-glass-eligible", store: store, maxPolicyGroupDepth: policystore.DefaultMaxPolicyGroupDepth}
+		permanentPolicies := func(userId string) map[string][]string {
+			policies, err := eligibility.permanentPolicies(context.Background(), auth.UserIdentity{UserId: userId})
+			So(err, ShouldBeNil)
+			return policies
+		}
+
+		Convey("holds the policies of the permanent attachments", func() {
+			So(permanentPolicies("auth0|1"), ShouldResemble, map[string][]string{"break-glass-eligible": {"oncall"}})
+		})
+
+		Convey("leaves out time-bound attachments", func() {
+			So(permanentPolicies("auth0|2"), ShouldBeEmpty)
+		})
+
+		Convey("holds nothing for a deactivated user", func() {
+			So(permanentPolicies("auth0|3"), ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/audit"
+	"github.com/shafiquejamal/reactjs-golang-starter/errorhandler"
+	"github.com/shafiquejamal/reactjs-golang-starter/policystore"
+)
+
+const (
+	// importBatchSize is the number of users handed to the store, and
+	// retried, together. The store writes each on its own, so a batch is not
+	// atomic, and one that fails part way is retried for the users not
+	// written.
+	importBatchSize   = 25
+	importMaxAttempts = 5
+	importBackoff     = 200 * time.Millisecond
+
+	// maxImportSize bounds the body of an import request
+	maxImportSize = 32 << 20
+
+	// listSeparator separates the names in a CSV cell
+	listSeparator = ";"
+)
+
+// attachmentRow is a row of a bulk import or export: the policies and groups
+// attached to a user permanently. Time-bound attachments and permission
+// boundaries are not part of it, and an import keeps those a user has.
+type attachmentRow struct {
+	// Row is the line of the CSV file, or the position in the JSON array
+	Row          int      `json:"-"`
+	UserId       string   `json:"user_id"`
+	PolicyGroups []string `json:"policy_groups"`
+	PolicyNames  []string `json:"access_policies"`
+}
+
+var attachmentColumns = []string{"user_id", "policy_groups", "access_policies"}
+
+// attachmentFormat tells the format of a file from its extension.
+func attachmentFormat(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return "csv", nil
+	case ".json":
+		return "json", nil
+	}
+	return "", errors.New(fmt.Sprintf("Cannot tell the format of %s, expected a .csv or .json file", path))
+}
+
+// readAttachmentRows reads a CSV file with a header naming its columns,
+// and names separated by semicolons, or a JSON array of rows. Rows that
+// cannot be read are rejected; a file that cannot be read at all is an
+// error.
+func readAttachmentRows(r io.Reader, format string) ([]attachmentRow, []rejectedRow, error) {
+	rows := []attachmentRow{}
+	rejected := []rejectedRow{}
+	switch format {
+	case "json":
+		if err := json.NewDecoder(r).Decode(&rows); err != nil {
+			return nil, nil, errors.New(fmt.Sprintf("Malformed JSON rows, %v", err))
+		}
+		for i := range rows {
+			rows[i].Row = i + 1
+		}
+		return rows, rejected, nil
+	case "csv":
+	default:
+		return nil, nil, errors.New(fmt.Sprintf("Unknown format %s, expected csv or json", format))
+	}
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("Malformed CSV header, %v", err))
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	if _, exists := columns["user_id"]; !exists {
+		return nil, nil, errors.New(fmt.Sprintf("The CSV header has no user_id column, expected %s", strings.Join(attachmentColumns, ",")))
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, rejected, nil
+		}
+		if err != nil {
+			return nil, nil, errors.New(fmt.Sprintf("Malformed CSV, %v", err))
+		}
+		line, _ := reader.FieldPos(0)
+		if len(record) != len(header) {
+			rejected = append(rejected, rejectedRow{Row: line, Reason: fmt.Sprintf("The row has %d fields rather than %d", len(record), len(header))})
+			continue
+		}
+		cell := func(column string) string {
+			if i, exists := columns[column]; exists {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		rows = append(rows, attachmentRow{
+			Row:          line,
+			UserId:       cell("user_id"),
+			PolicyGroups: splitNames(cell("policy_groups")),
+			PolicyNames:  splitNames(cell("access_policies")),
+		})
+	}
+}
+
+func splitNames(cell string) []string {
+	names := []string{}
+	for _, name := range strings.Split(cell, listSeparator) {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// writeAttachmentRows writes rows in the format readAttachmentRows reads.
+func writeAttachmentRows(w io.Writer, format string, rows []attachmentRow) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(rows)
+	case "csv":
+		writer := csv.NewWriter(w)
+		writer.Write(attachmentColumns)
+		for _, row := range rows {
+			writer.Write([]string{row.UserId, strings.Join(row.PolicyGroups, listSeparator), strings.Join(row.PolicyNames, listSeparator)})
+		}
+		writer.Flush()
+		return writer.Error()
+	}
+	return errors.New(fmt.Sprintf("Unknown format %s, expected csv or json", format))
+}
+
+// exportAttachments returns the permanent attachments of every user, sorted
+// by user id.
+func (a adminStore) exportAttachments(ctx context.Context) ([]attachmentRow, error) {
+	users, err := a.allUsers(ctx, policystore.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	rows := []attachmentRow{}
+	for _, user := range users {
+		rows = append(rows, attachmentRow{UserId: user.UserId, PolicyGroups: nonNil(user.PolicyGroups), PolicyNames: nonNil(user.PolicyNames)})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].UserId < rows[j].UserId })
+	return rows, nil
+}
+
+func nonNil(names []string) []string {
+	if names == nil {
+		return []string{}
+	}
+	return names
+}
+
+type attachmentChange struct {
+	Row             int      `json:"row"`
+	UserId          string   `json:"user_id"`
+	Result          string   `json:"result"`
+	AddedPolicies   []string `json:"added_policies,omitempty"`
+	RemovedPolicies []string `json:"removed_policies,omitempty"`
+	AddedGroups     []string `json:"added_groups,omitempty"`
+	RemovedGroups   []string `json:"removed_groups,omitempty"`
+}
+
+type rejectedRow struct {
+	Row    int    `json:"row"`
+	UserId string `json:"user_id,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// importReport lists the users an import created or updated, or would on a
+// dry run, and the rows it rejected. Unchanged users are only counted.
+type importReport struct {
+	DryRun    bool               `json:"dry_run"`
+	Created   int                `json:"created"`
+	Updated   int                `json:"updated"`
+	Unchanged int                `json:"unchanged"`
+	Changes   []attachmentChange `json:"changes"`
+	Rejected  []rejectedRow      `json:"rejected"`
+	// Unrecorded counts the changes made but not recorded in the audit log
+	Unrecorded int `json:"unrecorded,omitempty"`
+}
+
+// attachmentImport upserts the rows of a bulk import, so that importing the
+// same file twice changes nothing the second time.
+type attachmentImport struct {
+	admin       adminStore
+	actor       audit.Actor
+	batchSize   int
+	maxAttempts int
+	backoff     time.Duration
+}
+
+func newAttachmentImport(admin adminStore, actor audit.Actor) attachmentImport {
+	return attachmentImport{admin: admin, actor: actor, batchSize: importBatchSize, maxAttempts: importMaxAttempts, backoff: importBackoff}
+}
+
+// pendingWrite is the document a row is to be written as, over the one it
+// was planned against.
+type pendingWrite struct {
+	row    attachmentRow
+	before policystore.UserPolicyNames
+	after  policystore.UserPolicyNames
+}
+
+// planRow applies the row to the current document of the user. The row
+// replaces the permanent attachments only.
+func planRow(row attachmentRow, current policystore.UserPolicyNames) (pendingWrite, attachmentChange) {
+	after := current
+	after.UserId, after.PolicyNames, after.PolicyGroups = row.UserId, nonNil(row.PolicyNames), nonNil(row.PolicyGroups)
+	change := attachmentChange{Row: row.Row, UserId: row.UserId}
+	change.AddedPolicies, change.RemovedPolicies = difference(row.PolicyNames, current.PolicyNames), difference(current.PolicyNames, row.PolicyNames)
+	change.AddedGroups, change.RemovedGroups = difference(row.PolicyGroups, current.PolicyGroups), difference(current.PolicyGroups, row.PolicyGroups)
+	switch {
+	case current.UserId == "":
+		change.Result = "created"
+	case len(change.AddedPolicies)+len(change.RemovedPolicies)+len(change.AddedGroups)+len(change.RemovedGroups) == 0:
+		change.Result = "unchanged"
+	default:
+		change.Result = "updated"
+	}
+	return pendingWrite{row: row, before: current, after: after}, change
+}
+
+// difference returns the names of a that are not in b.
+func difference(a, b []string) []string {
+	names := []string{}
+	for _, name := range a {
+		if !contains(b, name) && !contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (i attachmentImport) run(ctx context.Context, rows []attachmentRow, rejected []rejectedRow, dryRun bool) (importReport, error) {
+	report := importReport{DryRun: dryRun, Changes: []attachmentChange{}, Rejected: rejected}
+	rows, report.Rejected = uniqueRows(rows, report.Rejected)
+	var err error
+	if rows, report.Rejected, err = i.validRows(ctx, rows, report.Rejected); err != nil {
+		return report, err
+	}
+	users, err := i.admin.allUsers(ctx, policystore.ListOptions{})
+	if err != nil {
+		return report, err
+	}
+	current := map[string]policystore.UserPolicyNames{}
+	for _, user := range users {
+		current[user.UserId] = user
+	}
+
+	pending := []pendingWrite{}
+	for _, row := range rows {
+		write, change := planRow(row, current[row.UserId])
+		switch {
+		case change.Result == "unchanged":
+			report.Unchanged++
+		case dryRun:
+			report.add(change)
+		default:
+			pending = append(pending, write)
+		}
+	}
+
+	for start := 0; start < len(pending); start += i.batchSize {
+		end := start + i.batchSize
+		if end > len(pending) {
+			end = len(pending)
+		}
+		written, failed, err := i.writeBatch(ctx, pending[start:end])
+		for _, write := range failed {
+			report.Rejected = append(report.Rejected, rejectedRow{Row: write.row.Row, UserId: write.row.UserId, Reason: err.Error()})
+		}
+		for _, write := range written {
+			_, change := planRow(write.row, write.before)
+			report.add(change)
+			i.admin.invalidate(policystore.Invalidation{UserId: write.row.UserId})
+			after := write.after
+			after.Revision = write.before.Revision + 1
+			// The write was retried against whatever was there, so it is only
+			// known once made
+			if i.admin.trail.record(ctx, i.actor, "", auditUser, write.row.UserId, replaced(write.before.UserId == "", write.before), after) != nil {
+				report.Unrecorded++
+			}
+		}
+	}
+	sort.Slice(report.Rejected, func(a, b int) bool { return report.Rejected[a].Row < report.Rejected[b].Row })
+	return report, nil
+}
+
+func (r *importReport) add(change attachmentChange) {
+	if change.Result == "created" {
+		r.Created++
+	} else {
+		r.Updated++
+	}
+	r.Changes = append(r.Changes, change)
+}
+
+// uniqueRows rejects rows without a user id and those repeating the user of
+// an earlier row.
+func uniqueRows(rows []attachmentRow, rejected []rejectedRow) ([]attachmentRow, []rejectedRow) {
+	unique := []attachmentRow{}
+	first := map[string]int{}
+	for _, row := range rows {
+		if row.UserId == "" {
+			rejected = append(rejected, rejectedRow{Row: row.Row, Reason: "The user_id is empty"})
+			continue
+		}
+		if line, exists := first[row.UserId]; exists {
+			rejected = append(rejected, rejectedRow{Row: row.Row, UserId: row.UserId, Reason: fmt.Sprintf("The user is already on row %d", line)})
+			continue
+		}
+		first[row.UserId] = row.Row
+		unique = append(unique, row)
+	}
+	return unique, rejected
+}
+
+// validRows rejects rows naming policies or groups that do not exist,
+// looking all of them up at once rather than row by row.
+func (i attachmentImport) validRows(ctx context.Context, rows []attachmentRow, rejected []rejectedRow) ([]attachmentRow, []rejectedRow, error) {
+	policyNames, groupNames := []string{}, []string{}
+	for _, row := range rows {
+		policyNames = append(policyNames, difference(row.PolicyNames, policyNames)...)
+		groupNames = append(groupNames, difference(row.PolicyGroups, groupNames)...)
+	}
+	permissions, err := i.admin.store.GetPermissions(ctx, policyNames)
+	if err != nil {
+		return nil, nil, err
+	}
+	groups, err := i.admin.store.GetPolicyGroups(ctx, groupNames)
+	if err != nil {
+		return nil, nil, err
+	}
+	foundGroups := map[string]struct{}{}
+	for _, group := range groups {
+		foundGroups[group.Name] = struct{}{}
+	}
+	valid := []attachmentRow{}
+	for _, row := range rows {
+		reasons := []string{}
+		for _, name := range row.PolicyNames {
+			if _, exists := permissions[name]; !exists {
+				reasons = append(reasons, "No such policy "+name)
+			}
+		}
+		for _, name := range row.PolicyGroups {
+			if _, exists := foundGroups[name]; !exists {
+				reasons = append(reasons, "No such policy group "+name)
+			}
+		}
+		if len(reasons) > 0 {
+			rejected = append(rejected, rejectedRow{Row: row.Row, UserId: row.UserId, Reason: strings.Join(reasons, ", ")})
+			continue
+		}
+		valid = append(valid, row)
+	}
+	return valid, rejected, nil
+}
+
+// writeBatch writes the batch, retrying with exponential backoff, and
+// returns the writes made and those that failed. Writes are conditional on
+// the revision they were planned against, so after a failure, which may
+// have left part of the batch written, each user is read again: those
+// already as the row wants them were written by an earlier attempt, and the
+// others are planned again over what is there now.
+func (i attachmentImport) writeBatch(ctx context.Context, batch []pendingWrite) ([]pendingWrite, []pendingWrite, error) {
+	written := []pendingWrite{}
+	for attempt := 1; ; attempt++ {
+		documents := []policystore.UserPolicyNames{}
+		for _, write := range batch {
+			documents = append(documents, write.after)
+		}
+		err := i.admin.store.PutUserPolicyNames(ctx, documents...)
+		if err == nil {
+			return append(written, batch...), nil, nil
+		}
+
+		retry := []pendingWrite{}
+		for _, write := range batch {
+			current, readErr := i.admin.store.GetUserPolicyNames(ctx, write.row.UserId)
+			if readErr != nil {
+				return written, batch, readErr
+			}
+			replanned, change := planRow(write.row, current)
+			switch {
+			case change.Result != "unchanged":
+				retry = append(retry, replanned)
+			case current.Revision > write.before.Revision:
+				// Written by an earlier attempt
+				written = append(written, write)
+			}
+		}
+		if len(retry) == 0 {
+			return written, nil, nil
+		}
+		var validationError policystore.ValidationError
+		if attempt == i.maxAttempts || errors.As(err, &validationError) {
+			return written, retry, errors.New(fmt.Sprintf("Could not write after %d attempts, %v", attempt, err))
+		}
+		select {
+		case <-time.After(i.backoff << (attempt - 1)):
+		case <-ctx.Done():
+			return written, retry, ctx.Err()
+		}
+		batch = retry
+	}
+}
+
+// attachmentRequestFormat is the format query parameter or else taken from
+// the content type.
+func attachmentRequestFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		return "csv"
+	}
+	return "json"
+}
+
+func exportAttachmentsHandler(admin adminStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := attachmentRequestFormat(r)
+		if format != "csv" && format != "json" {
+			errorhandler.ReturnError(&w, http.StatusBadRequest, "Malformed query", errors.New(fmt.Sprintf("Unknown format %s, expected csv or json", format)))
+			return
+		}
+		rows, err := admin.exportAttachments(r.Context())
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusInternalServerError, "Could not export user attachments", err)
+			return
+		}
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.Header().Set("Content-Disposition", "attachment; filename=user-attachments."+format)
+		w.WriteHeader(http.StatusOK)
+		writeAttachmentRows(w, format, rows)
+	}
+}
+
+// importAttachmentsHandler imports a CSV or JSON file of user attachments,
+// or with dry_run=true only reports what it would change.
+func importAttachmentsHandler(admin adminStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, rejected, err := readAttachmentRows(http.MaxBytesReader(w, r.Body, maxImportSize), attachmentRequestFormat(r))
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusBadRequest, "Malformed import", err)
+			return
+		}
+		report, err := newAttachmentImport(admin, requestActor(w, r)).run(r.Context(), rows, rejected, r.URL.Query().Get("dry_run") == "true")
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusInternalServerError, "Could not import user attachments", err)
+			return
+		}
+		if report.Unrecorded > 0 {
+			w.Header().Set("Warning", unrecordedWarning)
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/audit"
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	"github.com/shafiquejamal/reactjs-golang-starter/policystore"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testAttachments = `user_id,policy_groups,access_policies
+auth0|1,backend,read; deploy
+auth0|2,,read
+auth0|3,nothing,
+auth0|2,,
+auth0|4,backend
+`
+
+// flakyStore fails to write the given number of times, writing only the
+// first user of the batch first if partial, as DynamoDB may part way
+// through a batch when throttled.
+type flakyStore struct {
+	policystore.AdminStore
+	failures int
+	partial  bool
+}
+
+func (s *flakyStore) PutUserPolicyNames(ctx context.Context, users ...policystore.UserPolicyNames) error {
+	if s.failures == 0 {
+		return s.AdminStore.PutUserPolicyNames(ctx, users...)
+	}
+	s.failures--
+	if !s.partial {
+		return errors.New("ProvisionedThroughputExceededException")
+	}
+	if err := s.AdminStore.PutUserPolicyNames(ctx, users[0]); err != nil {
+		return err
+	}
+	return errors.New("ProvisionedThroughputExceededException")
+}
+
+func TestAttachmentImport(t *testing.T) {
+
+	Convey("Bulk import and export of user attachments", t, func() {
+		store := policystore.NewMemoryPolicyStore()
+		store.PutPolicies(context.Background(),
+			policystore.PermsWithMeta{Name: "read", Permissions: auth.Permission{Allows: []auth.Statement{{Actions: []string{"^/read$"}}}}},
+			policystore.PermsWithMeta{Name: "deploy", Permissions: auth.Permission{Allows: []auth.Statement{{Actions: []string{"^/deploy$"}}}}},
+		)
+		store.PutPolicyGroups(context.Background(), policystore.PolicyGroup{Name: "backend", PolicyNames: []string{"deploy"}})
+		store.PutUserPolicyNames(context.Background(), policystore.UserPolicyNames{
+			UserId:            "auth0|1",
+			PolicyNames:       []string{"read"},
+			TimeBoundPolicies: []policystore.TimeBoundAttachment{{Name: "deploy", ExpiresAt: 2000000000}},
+		})
+		dir, err := ioutil.TempDir("", "bulk")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		sink := audit.NewFileSink(filepath.Join(dir, "audit.log"))
+		admin := adminStore{store: store, maxPolicyGroupDepth: policystore.DefaultMaxPolicyGroupDepth, trail: auditTrail{sink: sink}}
+		importer := attachmentImport{admin: admin, actor: audit.Actor{UserId: "auth0|admin"}, batchSize: 2, maxAttempts: 3}
+
+		rows, rejected, err := readAttachmentRows(strings.NewReader(testAttachments), "csv")
+		So(err, ShouldBeNil)
+		So(len(rows), ShouldEqual, 4)
+		So(rows[0], ShouldResemble, attachmentRow{Row: 2, UserId: "auth0|1", PolicyGroups: []string{"backend"}, PolicyNames: []string{"read", "deploy"}})
+		So(rejected, ShouldResemble, []rejectedRow{{Row: 6, Reason: "The row has 2 fields rather than 3"}})
+
+		Convey("reports what it would change on a dry run, and changes nothing", func() {
+			report, err := importer.run(context.Background(), rows, rejected, true)
+			So(err, ShouldBeNil)
+			So(report.Created, ShouldEqual, 1)
+			So(report.Updated, ShouldEqual, 1)
+			So(report.Changes[0], ShouldResemble, attachmentChange{Row: 2, UserId: "auth0|1", Result: "updated", AddedPolicies: []string{"deploy"}, RemovedPolicies: []string{}, AddedGroups: []string{"backend"}, RemovedGroups: []string{}})
+			So(report.Rejected, ShouldResemble, []rejectedRow{
+				{Row: 4, UserId: "auth0|3", Reason: "No such policy group nothing"},
+				{Row: 5, UserId: "auth0|2", Reason: "The user is already on row 3"},
+				{Row: 6, Reason: "The row has 2 fields rather than 3"},
+			})
+			user, _ := store.GetUserPolicyNames(context.Background(), "auth0|2")
+			So(user.UserId, ShouldBeEmpty)
+		})
+
+		Convey("upserts, keeping time-bound attachments, and changes nothing the second time", func() {
+			report, err := importer.run(context.Background(), rows, rejected, false)
+			So(err, ShouldBeNil)
+			So(report.Created, ShouldEqual, 1)
+			So(report.Updated, ShouldEqual, 1)
+			user, _ := store.GetUserPolicyNames(context.Background(), "auth0|1")
+			So(user.PolicyNames, ShouldResemble, []string{"read", "deploy"})
+			So(user.PolicyGroups, ShouldResemble, []string{"backend"})
+			So(user.TimeBoundPolicies[0].Name, ShouldEqual, "deploy")
+			events, _, _ := sink.Query(context.Background(), audit.Filter{Actor: "auth0|admin"})
+			So(len(events), ShouldEqual, 2)
+
+			report, err = importer.run(context.Background(), rows, nil, false)
+			So(err, ShouldBeNil)
+			So(report.Unchanged, ShouldEqual, 2)
+			So(report.Changes, ShouldBeEmpty)
+		})
+
+		Convey("retries a batch written in part", func() {
+			importer.admin.store = &flakyStore{AdminStore: store, failures: 2, partial: true}
+			report, err := importer.run(context.Background(), rows, nil, false)
+			So(err, ShouldBeNil)
+			So(report.Created+report.Updated, ShouldEqual, 2)
+			So(report.Rejected, ShouldHaveLength, 2)
+			user, _ := store.GetUserPolicyNames(context.Background(), "auth0|2")
+			So(user.PolicyNames, ShouldResemble, []string{"read"})
+			events, _, _ := sink.Query(context.Background(), audit.Filter{Actor: "auth0|admin"})
+			So(len(events), ShouldEqual, 2)
+		})
+
+		Convey("rejects the rows it could not write", func() {
+			importer.admin.store = &flakyStore{AdminStore: store, failures: 3}
+			report, err := importer.run(context.Background(), rows, nil, false)
+			So(err, ShouldBeNil)
+			So(report.Changes, ShouldBeEmpty)
+			So(report.Rejected[0].UserId, ShouldEqual, "auth0|1")
+			So(report.Rejected[0].Reason, ShouldStartWith, "Could not write after 3 attempts")
+			events, _, _ := sink.Query(context.Background(), audit.Filter{})
+			So(events, ShouldBeEmpty)
+		})
+
+		Convey("keeps the changes it made but could not record, and counts them", func() {
+			importer.admin.trail = auditTrail{sink: audit.NewFileSink(filepath.Join(dir, "missing", "audit.log"))}
+			report, err := importer.run(context.Background(), rows, nil, false)
+			So(err, ShouldBeNil)
+			So(report.Created+report.Updated, ShouldEqual, 2)
+			So(report.Unrecorded, ShouldEqual, 2)
+			user, _ := store.GetUserPolicyNames(context.Background(), "auth0|2")
+			So(user.PolicyNames, ShouldResemble, []string{"read"})
+		})
+
+		Convey("exports in the format it imports", func() {
+			_, err := importer.run(context.Background(), rows, nil, false)
+			So(err, ShouldBeNil)
+			exported, err := admin.exportAttachments(context.Background())
+			So(err, ShouldBeNil)
+			for _, format := range []string{"csv", "json"} {
+				out := &bytes.Buffer{}
+				So(writeAttachmentRows(out, format, exported), ShouldBeNil)
+				again, rejected, err := readAttachmentRows(out, format)
+				So(err, ShouldBeNil)
+				So(rejected, ShouldBeEmpty)
+				So(len(again), ShouldEqual, 2)
+				So(again[0].UserId, ShouldEqual, "auth0|1")
+				So(again[0].PolicyNames, ShouldResemble, []string{"read", "deploy"})
+				So(again[1].PolicyGroups, ShouldResemble, []string{})
+			}
+		})
+
+		Convey("is served over HTTP", func() {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/admin/user-attachments?dry_run=true", strings.NewReader(`[{"user_id": "auth0|2", "access_policies": ["read"]}]`))
+			importAttachmentsHandler(admin)(w, r)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			report := importReport{}
+			So(json.Unmarshal(w.Body.Bytes(), &report), ShouldBeNil)
+			So(report.DryRun, ShouldBeTrue)
+			So(report.Created, ShouldEqual, 1)
+
+			w = httptest.NewRecorder()
+			r = httptest.NewRequest("POST", "/admin/user-attachments", strings.NewReader("user_id\n\"auth0"))
+			r.Header.Set("Content-Type", "text/csv")
+			importAttachmentsHandler(admin)(w, r)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+
+			w = httptest.NewRecorder()
+			exportAttachmentsHandler(admin)(w, httptest.NewRequest("GET", "/admin/user-attachments?format=csv", nil))
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqual, "user_id,policy_groups,access_policies\nauth0|1,,read\n")
+		})
+	})
+}
@@ -1,14 +1,71 @@
 package cf
 
+import "time"
+
+// IdpGroupMapping puts the users whose Claim has the Value, or contains it
+// when the claim is a list, in the PolicyGroups.
+type IdpGroupMapping struct {
+	Claim        string
+	Value        string
+	PolicyGroups []string
+}
+
+// Route declares an authenticated route of the API: its Path under the API
+// prefix, its Methods (GET if none), the authorization Strategy and its
+// StrategyParameters, the PrincipalTypes allowed on it if only some are, its
+// EnforcementMode and either the name of its Handler or the Upstream URL it
+// is proxied to.
+type Route struct {
+	Path               string
+	Methods            []string
+	Strategy           string
+	StrategyParameters map[string]string
+	PrincipalTypes     []string
+	EnforcementMode    string
+	Handler            string
+	Upstream           string
+}
+
 type Configuration struct {
-	ClientSecret                 string
-	AuthServerUserInfoEndpoint   string
-	ApiPrefix                    string
-	DdbAccessKeyId               string
-	DdbSecretAccessKey           string
-	DdbUserAccessPolicyTableName string
-	DdbAccessPolicyTableName     string
-	DdbPolicyGroupTableName      string
-	AwsRegion                    string
-	AwsProfile                   string
+	ClientSecret                    string
+	AuthServerUserInfoEndpoint      string
+	ApiPrefix                       string
+	PolicyStore                     string
+	PolicyStoreDir                  string
+	PolicyStoreDsn                  string
+	DdbAccessKeyId                  string
+	DdbSecretAccessKey              string
+	DdbUserAccessPolicyTableName    string
+	DdbAccessPolicyTableName        string
+	DdbAccessPolicyVersionTableName string
+	DdbPolicyGroupTableName         string
+	DdbSchemaMigrationTableName     string
+	DdbRelationTupleTableName       string
+	DdbTemporaryGrantTableName      string
+	MaxGrantDuration                time.Duration
+	DdbBreakGlassTableName          string
+	BreakGlassEligibilityPolicy     string
+	BreakGlassPolicies              []string
+	BreakGlassMaxDuration           time.Duration
+	BreakGlassWebhookUrl            string
+	RebacNamespaceFile              string
+	IdpGroupMappings                []IdpGroupMapping
+	IdpGroupPrecedence              string
+	DdbAuditTableName               string
+	AuditLogFile                    string
+	ScimBearerToken                 string
+	ScimUserIdPrefix                string
+	MaxPolicyGroupDepth             int
+	PermissionCacheTtl              time.Duration
+	PolicyStreamPollInterval        time.Duration
+	IdentityLookupTimeout           time.Duration
+	PolicyLookupTimeout             time.Duration
+	AuthorizationTimeout            time.Duration
+	AwsRegion                       string
+	AwsProfile                      string
+	EnforcementModes                map[string]string
+	RouteStrategies                 map[string]string
+	Routes                          []Route
+	RegoPolicyDir                   string
+	RegoQuery                       string
 }
@@ -0,0 +1,658 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/audit"
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	"github.com/shafiquejamal/reactjs-golang-starter/cf"
+	"github.com/shafiquejamal/reactjs-golang-starter/policystore"
+)
+
+const adminUsage = `Usage:
+  server admin [-o table|json] policies|groups|users list [-prefix p] [-policy name] [-group name] [-limit n] [-cursor c]
+  server admin [-o table|json] policies|groups|users show NAME
+  server admin [-o table|json] policies|groups|users delete NAME
+  server admin [-o table|json] apply FILE
+  server admin [-o table|json] attach|detach USER_ID (-policy NAME | -group NAME) [-not-before t] [-expires t]
+  server admin [-o table|json] whoami USER_ID
+  server admin [-o table|json] import [-dry-run] FILE.csv|FILE.json
+  server admin export [-format csv|json] [FILE]
+  server admin [-o table|json] audit [-actor id] [-target-kind kind] [-target name] [-since t] [-until t] [-limit n] [-cursor c]`
+
+// adminCommand runs the admin subcommands against the same store, and
+// resolves permissions the same way, as the server.
+type adminCommand struct {
+	admin         adminStore
+	fetchUserData func(ctx context.Context, userI *auth.UserIdentity, u *auth.User) error
+	// actor is recorded in the audit log as having made the changes
+	actor audit.Actor
+	out   io.Writer
+	json  bool
+}
+
+// runAdmin manages policies, groups and user attachments from the command
+// line. Servers that cache permissions see the changes once their cache is
+// invalidated by the DynamoDB Streams of the tables, or expires.
+func runAdmin(configuration cf.Configuration, args []string) error {
+	store, svc, err := openPolicyStore(configuration)
+	if err != nil {
+		return err
+	}
+	writableStore, ok := store.(policystore.AdminStore)
+	if !ok {
+		return errors.New(fmt.Sprintf("The %s policy store cannot be managed, edit its files instead", configuration.PolicyStore))
+	}
+	grants, breakGlass := grantAndBreakGlassStores(configuration, svc)
+	idpGroups, err := newIdpGroupMapper(configuration)
+	if err != nil {
+		return err
+	}
+	command := adminCommand{
+		admin: adminStore{
+			store:               writableStore,
+			maxPolicyGroupDepth: policyGroupDepth(configuration),
+			trail:               auditTrail{sink: openAuditSink(configuration, svc)},
+		},
+		fetchUserData: userDataFetcher(store, grants, breakGlass, idpGroups, policyGroupDepth(configuration)),
+		actor:         cliActor(),
+		out:           os.Stdout,
+	}
+	return command.run(args)
+}
+
+func (c adminCommand) run(args []string) error {
+	flags := flag.NewFlagSet("admin", flag.ContinueOnError)
+	output := flags.String("o", "table", "output format, table or json")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *output != "table" && *output != "json" {
+		return errors.New(fmt.Sprintf("Unknown output format %s, expected table or json", *output))
+	}
+	c.json = *output == "json"
+	args = flags.Args()
+	if len(args) == 0 {
+		return errors.New(adminUsage)
+	}
+	switch args[0] {
+	case "policies", "groups", "users":
+		if len(args) < 2 {
+			return errors.New(adminUsage)
+		}
+		return c.resource(args[0], args[1], args[2:])
+	case "apply":
+		if len(args) != 2 {
+			return errors.New(adminUsage)
+		}
+		return c.apply(args[1])
+	case "attach", "detach":
+		return c.attach(args[0] == "attach", args[1:])
+	case "whoami":
+		if len(args) != 2 {
+			return errors.New(adminUsage)
+		}
+		return c.whoami(args[1])
+	case "import":
+		return c.importAttachments(args[1:])
+	case "export":
+		return c.exportAttachments(args[1:])
+	case "audit":
+		return c.audit(args[1:])
+	}
+	return errors.New(adminUsage)
+}
+
+func (c adminCommand) resource(kind, verb string, args []string) error {
+	switch verb {
+	case "list":
+		flags := flag.NewFlagSet(kind+" list", flag.ContinueOnError)
+		options := policystore.ListOptions{}
+		flags.StringVar(&options.Prefix, "prefix", "", "prefix of the names")
+		flags.StringVar(&options.Policy, "policy", "", "only those the policy is attached to")
+		flags.StringVar(&options.Group, "group", "", "only those the group is attached to")
+		flags.IntVar(&options.Limit, "limit", 0, "number of items")
+		flags.StringVar(&options.Cursor, "cursor", "", "cursor of the page to list")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		return c.list(kind, options)
+	case "show", "delete":
+		if len(args) != 1 {
+			return errors.New(adminUsage)
+		}
+		if verb == "delete" {
+			return c.delete(kind, args[0])
+		}
+		return c.show(kind, args[0])
+	}
+	return errors.New(adminUsage)
+}
+
+func (c adminCommand) list(kind string, options policystore.ListOptions) error {
+	var items interface{}
+	var next string
+	var err error
+	switch kind {
+	case "policies":
+		items, next, err = c.admin.store.ListPolicies(context.Background(), options)
+	case "groups":
+		items, next, err = c.admin.store.ListPolicyGroups(context.Background(), options)
+	default:
+		items, next, err = c.admin.store.ListUsers(context.Background(), options)
+	}
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(listPage{Items: items, NextCursor: next})
+	}
+	if err = c.printTable(items); err != nil {
+		return err
+	}
+	if next != "" {
+		fmt.Fprintf(c.out, "\nMore with -cursor %s\n", next)
+	}
+	return nil
+}
+
+func (c adminCommand) show(kind, name string) error {
+	var item interface{}
+	var err error
+	switch kind {
+	case "policies":
+		item, err = c.admin.store.GetPolicy(context.Background(), name)
+	case "groups":
+		item, err = c.admin.getPolicyGroup(context.Background(), name)
+	default:
+		var user policystore.UserPolicyNames
+		user, err = c.admin.store.GetUserPolicyNames(context.Background(), name)
+		if err == nil && user.UserId == "" {
+			err = policystore.ErrNotFound
+		}
+		item = user
+	}
+	if err == policystore.ErrNotFound {
+		return errors.New(fmt.Sprintf("No such %s %s", singular[kind], name))
+	}
+	if err != nil {
+		return err
+	}
+	// Single items are always shown in full
+	return c.printJSON(item)
+}
+
+var singular = map[string]string{"policies": "policy", "groups": "group", "users": "user"}
+
+func (c adminCommand) delete(kind, name string) error {
+	var err error
+	switch kind {
+	case "policies":
+		err = c.admin.deletePolicy(context.Background(), c.actor, name, anyRevision)
+	case "groups":
+		err = c.admin.deletePolicyGroup(context.Background(), c.actor, name, anyRevision)
+	default:
+		err = c.admin.deleteUser(context.Background(), c.actor, name, anyRevision)
+	}
+	if err = made(nil, err); err != nil {
+		return err
+	}
+	return c.printResults([]applyResult{{Kind: singular[kind], Name: name, Result: "deleted"}})
+}
+
+type applyResult struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Result string `json:"result"`
+}
+
+// apply creates or replaces the policies, groups and users of a policy
+// file, in that order, and the groups each after those it contains.
+func (c adminCommand) apply(path string) error {
+	file, err := policystore.ReadPolicyFile(path)
+	if err != nil {
+		return err
+	}
+	results := []applyResult{}
+	result := func(kind, name string, created bool) {
+		if created {
+			results = append(results, applyResult{kind, name, "created"})
+		} else {
+			results = append(results, applyResult{kind, name, "updated"})
+		}
+	}
+	// The file is the desired state, so it replaces whatever revision is
+	// current
+	for _, policy := range file.Policies {
+		current, err := c.admin.store.GetPolicy(context.Background(), policy.Name)
+		if err != nil && err != policystore.ErrNotFound {
+			return err
+		}
+		policy.Revision = current.Revision
+		_, created, err := c.admin.putPolicy(context.Background(), c.actor, policy)
+		if err = made(nil, err); err != nil {
+			c.printResults(results)
+			return errors.New(fmt.Sprintf("Could not apply policy %s, %v", policy.Name, err))
+		}
+		result("policy", policy.Name, created)
+	}
+	for _, group := range groupsInOrder(file.Groups) {
+		current, err := c.admin.getPolicyGroup(context.Background(), group.Name)
+		if err != nil && err != policystore.ErrNotFound {
+			return err
+		}
+		group.Revision = current.Revision
+		_, created, err := c.admin.putPolicyGroup(context.Background(), c.actor, group)
+		if err = made(nil, err); err != nil {
+			c.printResults(results)
+			return errors.New(fmt.Sprintf("Could not apply group %s, %v", group.Name, err))
+		}
+		result("group", group.Name, created)
+	}
+	for _, user := range file.Users {
+		current, err := c.admin.store.GetUserPolicyNames(context.Background(), user.UserId)
+		if err != nil {
+			return err
+		}
+		user.Revision = current.Revision
+		_, created, err := c.admin.putUser(context.Background(), c.actor, user)
+		if err = made(nil, err); err != nil {
+			c.printResults(results)
+			return errors.New(fmt.Sprintf("Could not apply user %s, %v", user.UserId, err))
+		}
+		result("user", user.UserId, created)
+	}
+	return c.printResults(results)
+}
+
+// groupsInOrder sorts the groups so that those of the file that a group
+// contains come before it. Groups in a cycle are left in file order, for
+// validation to reject.
+func groupsInOrder(groups []policystore.PolicyGroup) []policystore.PolicyGroup {
+	pending := map[string]struct{}{}
+	for _, group := range groups {
+		pending[group.Name] = struct{}{}
+	}
+	ordered := []policystore.PolicyGroup{}
+	for len(ordered) < len(groups) {
+		progress := false
+		for _, group := range groups {
+			if _, isPending := pending[group.Name]; !isPending {
+				continue
+			}
+			ready := true
+			for _, member := range group.PolicyGroups {
+				if _, isPending := pending[member]; isPending && member != group.Name {
+					ready = false
+				}
+			}
+			if ready {
+				ordered = append(ordered, group)
+				delete(pending, group.Name)
+				progress = true
+			}
+		}
+		if !progress {
+			for _, group := range groups {
+				if _, isPending := pending[group.Name]; isPending {
+					ordered = append(ordered, group)
+				}
+			}
+		}
+	}
+	return ordered
+}
+
+// attach attaches a policy or group to a user, or detaches it, keeping the
+// other attachments.
+func (c adminCommand) attach(attach bool, args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errors.New(adminUsage)
+	}
+	userId := args[0]
+	flags := flag.NewFlagSet("attach", flag.ContinueOnError)
+	policyName := flags.String("policy", "", "policy to attach or detach")
+	groupName := flags.String("group", "", "policy group to attach or detach")
+	notBefore := flags.String("not-before", "", "RFC 3339 time from which the attachment is active")
+	expires := flags.String("expires", "", "RFC 3339 time at which the attachment expires, or a duration from now")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if (*policyName == "") == (*groupName == "") {
+		return errors.New("Give either -policy or -group")
+	}
+	attachment := policystore.TimeBoundAttachment{Name: *policyName + *groupName}
+	var err error
+	if attachment.NotBefore, err = parseAttachmentTime(*notBefore); err != nil {
+		return err
+	}
+	if attachment.ExpiresAt, err = parseAttachmentTime(*expires); err != nil {
+		return err
+	}
+
+	user, err := c.admin.store.GetUserPolicyNames(context.Background(), userId)
+	if err != nil {
+		return err
+	}
+	user.UserId = userId
+	kind := "policy"
+	names, timeBound := &user.PolicyNames, &user.TimeBoundPolicies
+	if *groupName != "" {
+		kind = "group"
+		names, timeBound = &user.PolicyGroups, &user.TimeBoundPolicyGroups
+	}
+	detached := removeAttachment(names, timeBound, attachment, !attach)
+	result := "attached"
+	switch {
+	case !attach && !detached:
+		return errors.New(fmt.Sprintf("The %s %s is not attached to %s", kind, attachment.Name, userId))
+	case !attach:
+		result = "detached"
+	case attachment.NotBefore == 0 && attachment.ExpiresAt == 0:
+		*names = append(*names, attachment.Name)
+	default:
+		*timeBound = append(*timeBound, attachment)
+	}
+	if _, _, err = c.admin.putUser(context.Background(), c.actor, user); made(nil, err) != nil {
+		return err
+	}
+	return c.printResults([]applyResult{{Kind: kind, Name: attachment.Name, Result: result + " to " + userId}})
+}
+
+// removeAttachment removes the attachment with the same window, or every
+// attachment of the name if anyWindow, and tells whether it was there.
+func removeAttachment(names *[]string, timeBound *[]policystore.TimeBoundAttachment, attachment policystore.TimeBoundAttachment, anyWindow bool) bool {
+	found := false
+	keptNames := []string{}
+	permanent := attachment.NotBefore == 0 && attachment.ExpiresAt == 0
+	for _, n := range *names {
+		if n == attachment.Name && (anyWindow || permanent) {
+			found = true
+			continue
+		}
+		keptNames = append(keptNames, n)
+	}
+	keptTimeBound := []policystore.TimeBoundAttachment{}
+	for _, a := range *timeBound {
+		if a.Name == attachment.Name && (anyWindow || a == attachment) {
+			found = true
+			continue
+		}
+		keptTimeBound = append(keptTimeBound, a)
+	}
+	*names, *timeBound = keptNames, keptTimeBound
+	return found
+}
+
+func parseAttachmentTime(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(d).Unix(), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Invalid time %q, expected RFC 3339 or a duration", s))
+	}
+	return t.Unix(), nil
+}
+
+// whoami resolves the permissions of the user as the server would on their
+// next request, but without the claims of their token, so without the
+// policy groups the identity provider puts them in.
+func (c adminCommand) whoami(userId string) error {
+	user := auth.User{}
+	if err := c.fetchUserData(context.Background(), &auth.UserIdentity{UserId: userId}, &user); err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(user)
+	}
+	policyNames := []string{}
+	for name := range user.PolicyPaths {
+		policyNames = append(policyNames, name)
+	}
+	sort.Strings(policyNames)
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "POLICY\tVIA")
+	for _, name := range policyNames {
+		via := strings.Join(user.PolicyPaths[name], " > ")
+		if via == "" {
+			via = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\n", name, via)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "\n%d allowing or denying policies, %d boundaries\n", len(user.Permissions), len(user.Boundaries))
+	if user.BreakGlass != nil {
+		fmt.Fprintf(c.out, "Break-glass access %s is active until %s\n", user.BreakGlass.ActivationId, time.Unix(user.BreakGlass.ExpiresAt, 0).Format(time.RFC3339))
+	}
+	return nil
+}
+
+// importAttachments upserts the user attachments of a CSV or JSON file, or
+// only shows what it would change with -dry-run.
+func (c adminCommand) importAttachments(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only show what would change")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New(adminUsage)
+	}
+	path := flags.Arg(0)
+	format, err := attachmentFormat(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rows, rejected, err := readAttachmentRows(f, format)
+	if err != nil {
+		return err
+	}
+	report, err := newAttachmentImport(c.admin, c.actor).run(context.Background(), rows, rejected, *dryRun)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(report)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ROW\tUSER_ID\tRESULT\tPOLICIES\tGROUPS")
+	for _, change := range report.Changes {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", change.Row, change.UserId, change.Result, changedNames(change.AddedPolicies, change.RemovedPolicies), changedNames(change.AddedGroups, change.RemovedGroups))
+	}
+	for _, row := range report.Rejected {
+		fmt.Fprintf(w, "%d\t%s\trejected\t%s\t\n", row.Row, orDash(row.UserId), row.Reason)
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	verb := "Imported"
+	if report.DryRun {
+		verb = "Would import"
+	}
+	fmt.Fprintf(c.out, "\n%s: %d created, %d updated, %d unchanged, %d rejected\n", verb, report.Created, report.Updated, report.Unchanged, len(report.Rejected))
+	if report.Unrecorded > 0 {
+		return errors.New(fmt.Sprintf("%d changes were made but could not be recorded in the audit log", report.Unrecorded))
+	}
+	return nil
+}
+
+// changedNames shows names added as +name and those removed as -name.
+func changedNames(added, removed []string) string {
+	names := []string{}
+	for _, name := range added {
+		names = append(names, "+"+name)
+	}
+	for _, name := range removed {
+		names = append(names, "-"+name)
+	}
+	return joinOrDash(names)
+}
+
+// exportAttachments writes the user attachments of every user to the file,
+// or to the output, in the format the import reads.
+func (c adminCommand) exportAttachments(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "", "csv or json, taken from the extension of the file if not given")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return errors.New(adminUsage)
+	}
+	out := c.out
+	if flags.NArg() == 1 {
+		if *format == "" {
+			extensionFormat, err := attachmentFormat(flags.Arg(0))
+			if err != nil {
+				return err
+			}
+			*format = extensionFormat
+		}
+		f, err := os.Create(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	if *format == "" {
+		*format = "csv"
+	}
+	rows, err := c.admin.exportAttachments(context.Background())
+	if err != nil {
+		return err
+	}
+	return writeAttachmentRows(out, *format, rows)
+}
+
+// audit lists the recorded changes, newest first.
+func (c adminCommand) audit(args []string) error {
+	if c.admin.trail.sink == nil {
+		return errors.New("No audit log is configured, set ddbAuditTableName or auditLogFile")
+	}
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	filter := audit.Filter{}
+	flags.StringVar(&filter.Actor, "actor", "", "only the changes of the actor")
+	flags.StringVar(&filter.TargetKind, "target-kind", "", "only the changes to policies, groups, users, policy versions or grants")
+	flags.StringVar(&filter.Target, "target", "", "only the changes to the named target")
+	since := flags.String("since", "", "only the changes since, RFC 3339 or seconds since the epoch")
+	until := flags.String("until", "", "only the changes before, RFC 3339 or seconds since the epoch")
+	flags.IntVar(&filter.Limit, "limit", 0, "number of events")
+	flags.StringVar(&filter.Cursor, "cursor", "", "cursor of the page to list")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	var err error
+	if filter.Since, err = parseAuditTime(*since); err != nil {
+		return err
+	}
+	if filter.Until, err = parseAuditTime(*until); err != nil {
+		return err
+	}
+	events, next, err := c.admin.trail.sink.Query(context.Background(), filter)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(listPage{Items: events, NextCursor: next})
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tACTOR\tACTION\tKIND\tTARGET\tREQUEST_ID")
+	for _, event := range events {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", formatUnix(event.Time), event.Actor.UserId, event.Action, event.TargetKind, event.Target, orDash(event.Actor.RequestId))
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if next != "" {
+		fmt.Fprintf(c.out, "\nMore with -cursor %s\n", next)
+	}
+	return nil
+}
+
+func (c adminCommand) printResults(results []applyResult) error {
+	if c.json {
+		return c.printJSON(results)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tNAME\tRESULT")
+	for _, result := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", result.Kind, result.Name, result.Result)
+	}
+	return w.Flush()
+}
+
+func (c adminCommand) printJSON(v interface{}) error {
+	encoder := json.NewEncoder(c.out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func (c adminCommand) printTable(items interface{}) error {
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	switch items := items.(type) {
+	case []policystore.PermsWithMeta:
+		fmt.Fprintln(w, "NAME\tALLOWS\tDENYS\tUPDATED\tDESCRIPTION")
+		for _, policy := range items {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", policy.Name, len(policy.Permissions.Allows), len(policy.Permissions.Denys), formatUnix(int64(policy.Updated_at)), policy.Description)
+		}
+	case []policystore.PolicyGroup:
+		fmt.Fprintln(w, "NAME\tPOLICIES\tGROUPS\tBOUNDARY")
+		for _, group := range items {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", group.Name, joinOrDash(group.PolicyNames), joinOrDash(group.PolicyGroups), orDash(group.PermissionBoundary))
+		}
+	case []policystore.UserPolicyNames:
+		fmt.Fprintln(w, "USER_ID\tPOLICIES\tGROUPS\tBOUNDARY")
+		for _, user := range items {
+			policyNames := append([]string{}, user.PolicyNames...)
+			for _, attachment := range user.TimeBoundPolicies {
+				policyNames = append(policyNames, attachment.Name)
+			}
+			groupNames := append([]string{}, user.PolicyGroups...)
+			for _, attachment := range user.TimeBoundPolicyGroups {
+				groupNames = append(groupNames, attachment.Name)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", user.UserId, joinOrDash(policyNames), joinOrDash(groupNames), orDash(user.PermissionBoundary))
+		}
+	}
+	return w.Flush()
+}
+
+func formatUnix(seconds int64) string {
+	if seconds == 0 {
+		return "-"
+	}
+	return time.Unix(seconds, 0).UTC().Format(time.RFC3339)
+}
+
+func joinOrDash(values []string) string {
+	return orDash(strings.Join(values, ","))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/audit"
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	"github.com/shafiquejamal/reactjs-golang-starter/policystore"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testPolicyFile = `
+users:
+  - user_id: auth0|1
+    policy_groups: [engineering]
+groups:
+  - name: engineering
+    policy_groups: [backend]
+  - name: backend
+    policy_names: [deploy]
+policies:
+  - name: deploy
+    Permissions:
+      Allows:
+        - Actions: ["^/deploy$"]
+  - name: read
+    Permissions:
+      Allows:
+        - Actions: ["^/read$"]
+`
+
+func TestAdminCommand(t *testing.T) {
+
+	Convey("The admin command", t, func() {
+		dir, err := ioutil.TempDir("", "admin")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "policies.yaml")
+		So(ioutil.WriteFile(path, []byte(testPolicyFile), 0600), ShouldBeNil)
+
+		store := policystore.NewMemoryPolicyStore()
+		out := &bytes.Buffer{}
+		command := adminCommand{
+			admin: adminStore{
+				store:               store,
+				maxPolicyGroupDepth: policystore.DefaultMaxPolicyGroupDepth,
+				trail:               auditTrail{sink: audit.NewFileSink(filepath.Join(dir, "audit.log"))},
+			},
+			fetchUserData: userDataFetcher(store, nil, nil, nil, policystore.DefaultMaxPolicyGroupDepth),
+			actor:         audit.Actor{UserId: "cli:ops@host"},
+			out:           out,
+		}
+		So(command.run([]string{"apply", path}), ShouldBeNil)
+
+		Convey("applies a file, groups after the groups they contain", func() {
+			So(out.String(), ShouldContainSubstring, "group   backend      created\ngroup   engineering  created")
+			So(out.String(), ShouldContainSubstring, "user    auth0|1      created")
+			group, err := command.admin.getPolicyGroup(context.Background(), "engineering")
+			So(err, ShouldBeNil)
+			So(group.PolicyGroups, ShouldResemble, []string{"backend"})
+		})
+
+		Convey("lists as JSON", func() {
+			out.Reset()
+			So(command.run([]string{"-o", "json", "policies", "list", "-prefix", "r"}), ShouldBeNil)
+			page := struct {
+				Items []policystore.PermsWithMeta `json:"items"`
+			}{}
+			So(json.Unmarshal(out.Bytes(), &page), ShouldBeNil)
+			So(len(page.Items), ShouldEqual, 1)
+			So(page.Items[0].Name, ShouldEqual, "read")
+		})
+
+		Convey("attaches and detaches, with an expiry", func() {
+			So(command.run([]string{"attach", "auth0|1", "-policy", "read", "-expires", "1h"}), ShouldBeNil)
+			user, err := store.GetUserPolicyNames(context.Background(), "auth0|1")
+			So(err, ShouldBeNil)
+			So(user.TimeBoundPolicies[0].Name, ShouldEqual, "read")
+			So(user.TimeBoundPolicies[0].ExpiresAt, ShouldBeGreaterThan, 0)
+
+			So(command.run([]string{"attach", "auth0|1", "-policy", "read"}), ShouldBeNil)
+			So(command.run([]string{"attach", "auth0|1", "-policy", "read", "-expires", "2030-01-01T00:00:00Z"}), ShouldBeNil)
+			So(command.run([]string{"attach", "auth0|1", "-policy", "read", "-expires", "2030-01-01T00:00:00Z"}), ShouldBeNil)
+			user, err = store.GetUserPolicyNames(context.Background(), "auth0|1")
+			So(err, ShouldBeNil)
+			So(user.PolicyNames, ShouldContain, "read")
+			So(len(user.TimeBoundPolicies), ShouldEqual, 2)
+
+			So(command.run([]string{"detach", "auth0|1", "-policy", "read"}), ShouldBeNil)
+			So(command.run([]string{"detach", "auth0|1", "-policy", "read"}), ShouldNotBeNil)
+			So(command.run([]string{"attach", "auth0|1", "-policy", "nothing"}), ShouldNotBeNil)
+		})
+
+		Convey("resolves the permissions of a user", func() {
+			out.Reset()
+			So(command.run([]string{"-o", "json", "whoami", "auth0|1"}), ShouldBeNil)
+			user := auth.User{}
+			So(json.Unmarshal(out.Bytes(), &user), ShouldBeNil)
+			So(user.PolicyPaths, ShouldResemble, map[string][]string{"deploy": {"engineering", "backend"}})
+			out.Reset()
+			So(command.run([]string{"whoami", "auth0|1"}), ShouldBeNil)
+			So(out.String(), ShouldContainSubstring, "engineering > backend")
+		})
+
+		Convey("refuses to delete what is still attached", func() {
+			So(command.run([]string{"groups", "delete", "backend"}), ShouldHaveSameTypeAs, inUseError{})
+			So(command.run([]string{"policies", "delete", "read"}), ShouldBeNil)
+			So(command.run([]string{"policies", "show", "read"}), ShouldNotBeNil)
+		})
+
+		Convey("records the changes it makes", func() {
+			So(command.run([]string{"detach", "auth0|1", "-group", "engineering"}), ShouldBeNil)
+			out.Reset()
+			So(command.run([]string{"-o", "json", "audit", "-target-kind", "user", "-target", "auth0|1"}), ShouldBeNil)
+			page := struct {
+				Items []audit.Event `json:"items"`
+			}{}
+			So(json.Unmarshal(out.Bytes(), &page), ShouldBeNil)
+			So(len(page.Items), ShouldEqual, 2)
+			So(page.Items[0].Action, ShouldEqual, audit.Update)
+			So(page.Items[0].Actor.UserId, ShouldEqual, "cli:ops@host")
+			So(page.Items[1].Action, ShouldEqual, audit.Create)
+			So(command.run([]string{"audit", "-since", "yesterday"}), ShouldNotBeNil)
+		})
+
+		Convey("imports and exports user attachments", func() {
+			csvPath := filepath.Join(dir, "users.csv")
+			So(ioutil.WriteFile(csvPath, []byte("user_id,policy_groups,access_policies\nauth0|1,engineering,read\nauth0|2,,nothing\n"), 0600), ShouldBeNil)
+			out.Reset()
+			So(command.run([]string{"import", "-dry-run", csvPath}), ShouldBeNil)
+			So(out.String(), ShouldContainSubstring, "2    auth0|1  updated   +read")
+			So(out.String(), ShouldContainSubstring, "Would import: 0 created, 1 updated, 0 unchanged, 1 rejected")
+			So(command.run([]string{"import", csvPath}), ShouldBeNil)
+
+			out.Reset()
+			So(command.run([]string{"export"}), ShouldBeNil)
+			So(out.String(), ShouldEqual, "user_id,policy_groups,access_policies\nauth0|1,engineering,read\n")
+			So(command.run([]string{"import", filepath.Join(dir, "users.txt")}), ShouldNotBeNil)
+		})
+
+		Convey("rejects unknown commands and formats", func() {
+			So(command.run([]string{"policies", "rename"}), ShouldNotBeNil)
+			So(command.run([]string{"-o", "yaml", "policies", "list"}), ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/gorilla/mux"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/audit"
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	"github.com/shafiquejamal/reactjs-golang-starter/errorhandler"
+	"github.com/shafiquejamal/reactjs-golang-starter/policystore"
+)
+
+const (
+	grantPending  = "pending"
+	grantApproved = "approved"
+
+	defaultMaxGrantDuration = 4 * time.Hour
+)
+
+// TemporaryGrant is a request for a policy or policy group for a limited
+// time, which takes effect once someone other than the requester approves
+// it. ExpiresAt is the TTL attribute of the table, so DynamoDB deletes
+// grants, approved or not, once they expire.
+type TemporaryGrant struct {
+	UserId      string `dynamodbav:"user_id"`
+	GrantId     string `dynamodbav:"grant_id"`
+	PolicyName  string `dynamodbav:"policy_name,omitempty"`
+	PolicyGroup string `dynamodbav:"policy_group,omitempty"`
+	Reason      string `dynamodbav:"reason"`
+	RequestedBy string `dynamodbav:"requested_by"`
+	ApprovedBy  string `dynamodbav:"approved_by,omitempty"`
+	Status      string `dynamodbav:"status"`
+	NotBefore   int64  `dynamodbav:"not_before"`
+	ExpiresAt   int64  `dynamodbav:"expires_at"`
+}
+
+func (g TemporaryGrant) ActiveAt(t time.Time) bool {
+	return g.Status == grantApproved && policystore.TimeBoundAttachment{NotBefore: g.NotBefore, ExpiresAt: g.ExpiresAt}.ActiveAt(t)
+}
+
+// activeAttachments returns the names of the policies and policy groups
+// attached to the user at the given time, permanently or temporarily.
+func activeAttachments(userPolicyNames policystore.UserPolicyNames, grants []TemporaryGrant, t time.Time) ([]string, []string) {
+	policyNames := append([]string{}, userPolicyNames.PolicyNames...)
+	groupNames := append([]string{}, userPolicyNames.PolicyGroups...)
+	for _, attachment := range userPolicyNames.TimeBoundPolicies {
+		if attachment.ActiveAt(t) {
+			policyNames = append(policyNames, attachment.Name)
+		}
+	}
+	for _, attachment := range userPolicyNames.TimeBoundPolicyGroups {
+		if attachment.ActiveAt(t) {
+			groupNames = append(groupNames, attachment.Name)
+		}
+	}
+	for _, grant := range grants {
+		if !grant.ActiveAt(t) {
+			continue
+		}
+		if grant.PolicyName != "" {
+			policyNames = append(policyNames, grant.PolicyName)
+		}
+		if grant.PolicyGroup != "" {
+			groupNames = append(groupNames, grant.PolicyGroup)
+		}
+	}
+	return policyNames, groupNames
+}
+
+type grantStore struct {
+	temporaryGrantsTableName string
+	maxDuration              time.Duration
+	svc                      *dynamodb.Client
+}
+
+func (s grantStore) Request(ctx context.Context, grant TemporaryGrant, duration time.Duration) (TemporaryGrant, error) {
+	if (grant.PolicyName == "") == (grant.PolicyGroup == "") {
+		return TemporaryGrant{}, errors.New("A grant is for either one policy or one policy group")
+	}
+	if duration <= 0 || duration > s.maxDuration {
+		return TemporaryGrant{}, errors.New(fmt.Sprintf("Grant duration must be positive and at most %s", s.maxDuration))
+	}
+	grantId, err := newGrantId()
+	if err != nil {
+		return TemporaryGrant{}, err
+	}
+	now := time.Now().Unix()
+	if grant.NotBefore < now {
+		grant.NotBefore = now
+	}
+	grant.GrantId = grantId
+	grant.Status = grantPending
+	grant.ApprovedBy = ""
+	grant.ExpiresAt = grant.NotBefore + int64(duration.Seconds())
+	item, err := attributevalue.MarshalMap(grant)
+	if err != nil {
+		return TemporaryGrant{}, errors.New(fmt.Sprintf("Failed to marshal grant, %v", err))
+	}
+	_, err = s.svc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.temporaryGrantsTableName),
+		Item:      item,
+	})
+	if err != nil {
+		return TemporaryGrant{}, errors.New(fmt.Sprintf("Got error calling PutItem: %s", err))
+	}
+	return grant, nil
+}
+
+// Approve activates a pending grant. Requesters cannot approve their own
+// grants.
+func (s grantStore) Approve(ctx context.Context, userId, grantId, approver string) (TemporaryGrant, error) {
+	result, err := s.svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.temporaryGrantsTableName),
+		Key: map[string]types.AttributeValue{
+			"user_id":  &types.AttributeValueMemberS{Value: userId},
+			"grant_id": &types.AttributeValueMemberS{Value: grantId},
+		},
+		UpdateExpression:         aws.String("SET #s = :approved, approved_by = :approver"),
+		ConditionExpression:      aws.String("#s = :pending AND requested_by <> :approver AND expires_at > :now"),
+		ExpressionAttributeNames: map[string]string{"#s": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":approved": &types.AttributeValueMemberS{Value: grantApproved},
+			":pending":  &types.AttributeValueMemberS{Value: grantPending},
+			":approver": &types.AttributeValueMemberS{Value: approver},
+			":now":      &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	if err != nil {
+		return TemporaryGrant{}, errors.New(fmt.Sprintf("Could not approve grant %s, %s", grantId, err))
+	}
+	grant := TemporaryGrant{}
+	if err = attributevalue.UnmarshalMap(result.Attributes, &grant); err != nil {
+		return TemporaryGrant{}, errors.New(fmt.Sprintf("Failed to unmarshal grant, %v", err))
+	}
+	return grant, nil
+}
+
+// List returns the grants of the user that have not expired yet, whether
+// approved or pending. Expired grants may linger until DynamoDB's TTL
+// deletes them, so they are filtered out here.
+func (s grantStore) List(ctx context.Context, userId string) ([]TemporaryGrant, error) {
+	grants := []TemporaryGrant{}
+	paginator := dynamodb.NewQueryPaginator(s.svc, &dynamodb.QueryInput{
+		TableName:              aws.String(s.temporaryGrantsTableName),
+		KeyConditionExpression: aws.String("user_id = :u"),
+		FilterExpression:       aws.String("expires_at > :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":u":   &types.AttributeValueMemberS{Value: userId},
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Got error calling Query: %s", err))
+		}
+		pageGrants := []TemporaryGrant{}
+		if err = attributevalue.UnmarshalListOfMaps(page.Items, &pageGrants); err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to unmarshal grants, %v", err))
+		}
+		grants = append(grants, pageGrants...)
+	}
+	return grants, nil
+}
+
+func newGrantId() (string, error) {
+	bs := make([]byte, 8)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(time.Now().Unix(), 10) + "-" + hex.EncodeToString(bs), nil
+}
+
+func requestGrantHandler(store grantStore, trail auditTrail) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("User")).(auth.User)
+		request := struct {
+			UserId          string
+			PolicyName      string
+			PolicyGroup     string
+			Reason          string
+			NotBefore       int64
+			DurationSeconds int64
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			errorhandler.ReturnError(&w, http.StatusBadRequest, "Malformed grant request", err)
+			return
+		}
+		if request.UserId == "" {
+			request.UserId = user.Identity.UserId
+		}
+		grant, err := store.Request(r.Context(), TemporaryGrant{
+			UserId:      request.UserId,
+			PolicyName:  request.PolicyName,
+			PolicyGroup: request.PolicyGroup,
+			Reason:      request.Reason,
+			RequestedBy: user.Identity.UserId,
+			NotBefore:   request.NotBefore,
+		}, time.Duration(request.DurationSeconds)*time.Second)
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusBadRequest, "Could not request grant", err)
+			return
+		}
+		// The grant gets its id as it is stored, so it is recorded after
+		warnUnrecorded(w, trail.record(r.Context(), requestActor(w, r), audit.Create, auditGrant, grant.UserId, nil, grant))
+		writeJSON(w, http.StatusCreated, grant)
+	}
+}
+
+func approveGrantHandler(store grantStore, trail auditTrail) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("User")).(auth.User)
+		vars := mux.Vars(r)
+		grant, err := store.Approve(r.Context(), vars["userId"], vars["grantId"], user.Identity.UserId)
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusConflict, "Could not approve grant", err)
+			return
+		}
+		pending := grant
+		pending.Status, pending.ApprovedBy = grantPending, ""
+		warnUnrecorded(w, trail.record(r.Context(), requestActor(w, r), "approve", auditGrant, grant.UserId, pending, grant))
+		writeJSON(w, http.StatusOK, grant)
+	}
+}
+
+func listGrantsHandler(store grantStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		grants, err := store.List(r.Context(), mux.Vars(r)["userId"])
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusInternalServerError, "Could not list grants", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, grants)
+	}
+}
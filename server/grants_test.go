@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/policystore"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestActiveAttachments(t *testing.T) {
+
+	Convey("activeAttachments", t, func() {
+		now := time.Unix(1000, 0)
+
+		Convey("keeps permanent attachments and drops time-bound ones outside their window", func() {
+			userPolicyNames := policystore.UserPolicyNames{
+				PolicyNames:  []string{"read"},
+				PolicyGroups: []string{"engineering"},
+				TimeBoundPolicies: []policystore.TimeBoundAttachment{
+					{Name: "active", NotBefore: 900, ExpiresAt: 1100},
+					{Name: "expired", ExpiresAt: 1000},
+					{Name: "future", NotBefore: 1001},
+				},
+				TimeBoundPolicyGroups: []policystore.TimeBoundAttachment{
+					{Name: "oncall", ExpiresAt: 1001},
+				},
+			}
+			policyNames, groupNames := activeAttachments(userPolicyNames, []TemporaryGrant{}, now)
+			So(policyNames, ShouldResemble, []string{"read", "active"})
+			So(groupNames, ShouldResemble, []string{"engineering", "oncall"})
+		})
+
+		Convey("only adds approved grants that are active", func() {
+			grants := []TemporaryGrant{
+				{PolicyName: "approved", Status: grantApproved, NotBefore: 900, ExpiresAt: 1100},
+				{PolicyName: "pending", Status: grantPending, NotBefore: 900, ExpiresAt: 1100},
+				{PolicyGroup: "payments-oncall", Status: grantApproved, NotBefore: 900, ExpiresAt: 1100},
+				{PolicyName: "expired", Status: grantApproved, NotBefore: 900, ExpiresAt: 950},
+			}
+			policyNames, groupNames := activeAttachments(policystore.UserPolicyNames{}, grants, now)
+			So(policyNames, ShouldResemble, []string{"approved"})
+			So(groupNames, ShouldResemble, []string{"payments-oncall"})
+		})
+	})
+}
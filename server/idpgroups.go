@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/cf"
+)
+
+// How the policy groups mapped from the claims of the identity provider
+// combine with the memberships kept in the policy store
+const (
+	idpGroupsMerge       = "merge"
+	idpGroupsOnly        = "idp"
+	idpGroupsPreferIdp   = "prefer_idp"
+	idpGroupsPreferStore = "prefer_store"
+)
+
+// idpGroupMapper puts users in policy groups from the role and group claims
+// of the identity provider, so that memberships managed there need not be
+// copied to the policy store.
+type idpGroupMapper struct {
+	mappings   []cf.IdpGroupMapping
+	precedence string
+}
+
+// newIdpGroupMapper returns nil when no mapping is configured.
+func newIdpGroupMapper(configuration cf.Configuration) (*idpGroupMapper, error) {
+	precedence := configuration.IdpGroupPrecedence
+	switch precedence {
+	case "":
+		precedence = idpGroupsMerge
+	case idpGroupsMerge, idpGroupsOnly, idpGroupsPreferIdp, idpGroupsPreferStore:
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown idpGroupPrecedence %s, expected %s, %s, %s or %s", precedence, idpGroupsMerge, idpGroupsOnly, idpGroupsPreferIdp, idpGroupsPreferStore))
+	}
+	if len(configuration.IdpGroupMappings) == 0 {
+		return nil, nil
+	}
+	for i, mapping := range configuration.IdpGroupMappings {
+		if mapping.Claim == "" || mapping.Value == "" || len(mapping.PolicyGroups) == 0 {
+			return nil, errors.New(fmt.Sprintf("The idpGroupMappings entry #%d needs a claim, a value and policyGroups", i+1))
+		}
+	}
+	return &idpGroupMapper{mappings: configuration.IdpGroupMappings, precedence: precedence}, nil
+}
+
+// groups returns the policy groups the claims map to, in the order of the
+// mappings.
+func (m *idpGroupMapper) groups(claims map[string]interface{}) []string {
+	groupNames := []string{}
+	for _, mapping := range m.mappings {
+		if !contains(claimValues(claims, mapping.Claim), mapping.Value) {
+			continue
+		}
+		for _, name := range mapping.PolicyGroups {
+			if !contains(groupNames, name) {
+				groupNames = append(groupNames, name)
+			}
+		}
+	}
+	return groupNames
+}
+
+// combine returns the policy groups of the user according to the
+// precedence, and those that came from the identity provider.
+func (m *idpGroupMapper) combine(storeGroups []string, claims map[string]interface{}) ([]string, []string) {
+	idpGroups := m.groups(claims)
+	switch {
+	case m.precedence == idpGroupsOnly,
+		m.precedence == idpGroupsPreferIdp && len(idpGroups) > 0,
+		m.precedence == idpGroupsPreferStore && len(storeGroups) == 0:
+		return idpGroups, idpGroups
+	case m.precedence == idpGroupsMerge:
+		combined := append([]string{}, storeGroups...)
+		for _, name := range idpGroups {
+			if !contains(combined, name) {
+				combined = append(combined, name)
+			}
+		}
+		return combined, idpGroups
+	}
+	return storeGroups, []string{}
+}
+
+// claimValues returns the values of a claim, a string or a list of them. A
+// claim not found by its name, which may well contain dots, is looked up as
+// a path into nested claims, such as realm_access.roles.
+func claimValues(claims map[string]interface{}, name string) []string {
+	value, exists := claims[name]
+	if !exists {
+		var nested interface{} = claims
+		for _, key := range strings.Split(name, ".") {
+			object, ok := nested.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			nested = object[key]
+		}
+		value = nested
+	}
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := []string{}
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
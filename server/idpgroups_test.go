@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	"github.com/shafiquejamal/reactjs-golang-starter/cf"
+	"github.com/shafiquejamal/reactjs-golang-starter/policystore"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestIdpGroupMapper(t *testing.T) {
+
+	Convey("Policy groups from the claims of the identity provider", t, func() {
+		configuration := cf.Configuration{IdpGroupMappings: []cf.IdpGroupMapping{
+			{Claim: "https://example.com/roles", Value: "engineer", PolicyGroups: []string{"engineering"}},
+			{Claim: "realm_access.roles", Value: "oncall", PolicyGroups: []string{"oncall", "engineering"}},
+		}}
+		claims := map[string]interface{}{
+			"https://example.com/roles": []interface{}{"engineer", "manager"},
+			"realm_access":              map[string]interface{}{"roles": []interface{}{"oncall"}},
+		}
+
+		Convey("maps claims, nested or with dots in their names", func() {
+			mapper, err := newIdpGroupMapper(configuration)
+			So(err, ShouldBeNil)
+			So(mapper.groups(claims), ShouldResemble, []string{"engineering", "oncall"})
+			So(mapper.groups(map[string]interface{}{"https://example.com/roles": "engineer"}), ShouldResemble, []string{"engineering"})
+			So(mapper.groups(nil), ShouldBeEmpty)
+		})
+
+		Convey("combines them with the store by precedence", func() {
+			combine := func(precedence string, storeGroups []string, claims map[string]interface{}) []string {
+				configuration.IdpGroupPrecedence = precedence
+				mapper, err := newIdpGroupMapper(configuration)
+				So(err, ShouldBeNil)
+				groups, _ := mapper.combine(storeGroups, claims)
+				return groups
+			}
+			So(combine("", []string{"backend", "oncall"}, claims), ShouldResemble, []string{"backend", "oncall", "engineering"})
+			So(combine("idp", []string{"backend"}, claims), ShouldResemble, []string{"engineering", "oncall"})
+			So(combine("idp", []string{"backend"}, nil), ShouldBeEmpty)
+			So(combine("prefer_idp", []string{"backend"}, claims), ShouldResemble, []string{"engineering", "oncall"})
+			So(combine("prefer_idp", []string{"backend"}, nil), ShouldResemble, []string{"backend"})
+			So(combine("prefer_store", []string{"backend"}, claims), ShouldResemble, []string{"backend"})
+			So(combine("prefer_store", nil, claims), ShouldResemble, []string{"engineering", "oncall"})
+		})
+
+		Convey("refuses an unknown precedence or an incomplete mapping", func() {
+			configuration.IdpGroupPrecedence = "idp_first"
+			_, err := newIdpGroupMapper(configuration)
+			So(err, ShouldNotBeNil)
+			_, err = newIdpGroupMapper(cf.Configuration{IdpGroupMappings: []cf.IdpGroupMapping{{Claim: "groups", Value: "oncall"}}})
+			So(err, ShouldNotBeNil)
+			mapper, err := newIdpGroupMapper(cf.Configuration{})
+			So(err, ShouldBeNil)
+			So(mapper, ShouldBeNil)
+		})
+
+		Convey("puts the user in the mapped groups when resolving permissions", func() {
+			store := policystore.NewMemoryPolicyStore()
+			store.PutPolicies(context.Background(), policystore.PermsWithMeta{Name: "deploy", Permissions: auth.Permission{Allows: []auth.Statement{{Actions: []string{"^/deploy$"}}}}})
+			store.PutPolicyGroups(context.Background(), policystore.PolicyGroup{Name: "engineering", PolicyNames: []string{"deploy"}})
+			mapper, err := newIdpGroupMapper(configuration)
+			So(err, ShouldBeNil)
+			fetchUserData := userDataFetcher(store, nil, nil, mapper, policystore.DefaultMaxPolicyGroupDepth)
+			u := auth.User{}
+			So(fetchUserData(context.Background(), &auth.UserIdentity{UserId: "auth0|1", Claims: claims}, &u), ShouldBeNil)
+			So(u.PolicyPaths, ShouldResemble, map[string][]string{"deploy": {"engineering"}})
+			So(u.IdpPolicyGroups, ShouldResemble, []string{"engineering", "oncall"})
+		})
+	})
+}
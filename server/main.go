@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"expvar"
 	"fmt"
 	"log"
 	"net/http"
@@ -12,14 +14,19 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
 
 	"github.com/shafiquejamal/reactjs-golang-starter/auth"
 	"github.com/shafiquejamal/reactjs-golang-starter/cf"
+	"github.com/shafiquejamal/reactjs-golang-starter/policystore"
+	"github.com/shafiquejamal/reactjs-golang-starter/rebac"
+	"github.com/shafiquejamal/reactjs-golang-starter/regoauth"
 	"github.com/spf13/viper"
 
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+
 	"github.com/gorilla/mux"
 )
 
@@ -79,22 +86,174 @@ func main() {
 		log.Fatalf("Unable to decode into struct, %v", err)
 	}
 
-	cfg, err := config.LoadDefaultConfig(
-		context.TODO(),
-		config.WithRegion(configuration.AwsRegion),
-		config.WithSharedCredentialsFiles([]string{".aws/credentials"}),
-		config.WithSharedConfigProfile(configuration.AwsProfile))
+	if len(os.Args) > 1 && os.Args[1] == "bootstrap" {
+		if err = bootstrap(configuration, os.Args[2:]); err != nil {
+			log.Fatalf("Bootstrap failed, %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		if err = runAdmin(configuration, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	store, svc, err := openPolicyStore(configuration)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
+	}
+	if fileStore, ok := store.(*policystore.FilePolicyStore); ok {
+		if err = fileStore.Watch(context.Background()); err != nil {
+			log.Fatalf("Unable to watch policy files, %v", err)
+		}
 	}
-	svc := dynamodb.NewFromConfig(cfg)
 
-	r := mux.NewRouter()
+	// The file store is changed by editing its files, the others through the
+	// admin API
+	writableStore, _ := store.(policystore.AdminStore)
+
+	var cache *policystore.CachingPolicyStore
+	if configuration.PermissionCacheTtl > 0 {
+		cache = policystore.NewCachingPolicyStore(store, configuration.PermissionCacheTtl)
+		if dynamoStore, ok := store.(policystore.DynamoPolicyStore); ok {
+			consumePolicyStreams(context.Background(), configuration, dynamoStore, cache)
+		}
+		store = cache
+	}
+
+	grants, breakGlass := grantAndBreakGlassStores(configuration, svc)
+
+	trail := auditTrail{sink: openAuditSink(configuration, svc)}
+
+	idpGroups, err := newIdpGroupMapper(configuration)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	maxPolicyGroupDepth := policyGroupDepth(configuration)
+	fetchUserData := userDataFetcher(store, grants, breakGlass, idpGroups, maxPolicyGroupDepth)
+	timeouts := lookupTimeouts(configuration)
+
 	apiPrefix := configuration.ApiPrefix
-	r.Handle(apiPrefix+"/ping", auth.RequireAuthentication(auth.AllowAllAuthorizationStrategy, auth.OAuthUserIdentityFetcher(configuration.AuthServerUserInfoEndpoint), userDataFetcher(configuration.DdbUserAccessPolicyTableName, configuration.DdbAccessPolicyTableName, configuration.DdbPolicyGroupTableName, svc))(pingHandler())).Methods("GET")
-	r.Handle(apiPrefix+"/pong", auth.RequireAuthentication(auth.PolicyAuthorizationStrategy(apiPrefix), auth.OAuthUserIdentityFetcher(configuration.AuthServerUserInfoEndpoint), userDataFetcher(configuration.DdbUserAccessPolicyTableName, configuration.DdbAccessPolicyTableName, configuration.DdbPolicyGroupTableName, svc))(pingHandler())).Methods("GET")
-	r.Handle(apiPrefix+"/pung", auth.RequireAuthentication(auth.PolicyAuthorizationStrategy(apiPrefix), auth.OAuthUserIdentityFetcher(configuration.AuthServerUserInfoEndpoint), userDataFetcher(configuration.DdbUserAccessPolicyTableName, configuration.DdbAccessPolicyTableName, configuration.DdbPolicyGroupTableName, svc))(pingHandler())).Methods("GET")
-	r.Handle(apiPrefix+"/pang", auth.RequireAuthentication(auth.PolicyAuthorizationStrategy(apiPrefix), auth.OAuthUserIdentityFetcher(configuration.AuthServerUserInfoEndpoint), userDataFetcher(configuration.DdbUserAccessPolicyTableName, configuration.DdbAccessPolicyTableName, configuration.DdbPolicyGroupTableName, svc))(pingHandler())).Methods("GET")
+	strategies := map[string]strategyFactory{
+		"allow_all": withoutParameters(auth.AllowAllAuthorizationStrategy),
+		"policy":    withoutParameters(auth.PolicyAuthorizationStrategy(apiPrefix)),
+	}
+	if configuration.RegoPolicyDir != "" {
+		regoStrategy, err := regoauth.NewRegoStrategy(configuration.RegoPolicyDir, configuration.RegoQuery)
+		if err != nil {
+			log.Fatalf("Unable to load Rego policies, %v", err)
+		}
+		if err = regoStrategy.Watch(context.Background()); err != nil {
+			log.Fatalf("Unable to watch Rego policies, %v", err)
+		}
+		strategies["rego"] = withoutParameters(regoStrategy.Authorize)
+		strategies["policy_and_rego"] = withoutParameters(auth.AllOf(auth.Named("policy", auth.PolicyAuthorizationStrategy(apiPrefix)), auth.Named("rego", regoStrategy.Authorize)))
+	}
+
+	r := mux.NewRouter()
+	// routeAuthorizations keeps the strategy of every authenticated route,
+	// before it is wrapped in an enforcement mode, so that /me/can can
+	// evaluate it without calling the route or recording a decision
+	routeAuthorizations := map[string]func(user auth.User, r *http.Request) error{}
+	authenticate := func(method, route string, mode auth.EnforcementMode, authorizationStrategy func(user auth.User, r *http.Request) error) func(http.Handler) http.Handler {
+		routeAuthorizations[method+" "+apiPrefix+route] = authorizationStrategy
+		return auth.RequireAuthentication(auth.EnforcementModeStrategy(mode, route, authorizationStrategy), auth.OAuthUserIdentityFetcher(configuration.AuthServerUserInfoEndpoint), fetchUserData, timeouts)
+	}
+
+	routes := configuration.Routes
+	if len(routes) == 0 {
+		routes = defaultRoutes(configuration)
+	}
+	handlers := map[string]http.Handler{
+		"ping":       pingHandler(),
+		"me":         meHandler(),
+		"me_can":     canIHandler(r, apiPrefix, routeAuthorizations),
+		"debug_vars": expvar.Handler(),
+	}
+	features := [][]cf.Route{meRoutes}
+
+	if svc != nil && configuration.DdbRelationTupleTableName != "" {
+		namespaces, err := rebac.LoadNamespaces(configuration.RebacNamespaceFile)
+		if err != nil {
+			log.Fatalf("Unable to load relation namespaces, %v", err)
+		}
+		checker := rebac.Checker{
+			Store:      rebac.DynamoTupleStore{TableName: configuration.DdbRelationTupleTableName, Svc: svc},
+			Namespaces: namespaces,
+		}
+		strategies["relation"] = relationStrategy(checker)
+		features = append(features, documentRoutes)
+	}
+
+	if svc != nil {
+		policyVersions := policyVersionStore{
+			accessPoliciesTableName:       configuration.DdbAccessPolicyTableName,
+			accessPolicyVersionsTableName: configuration.DdbAccessPolicyVersionTableName,
+			svc:                           svc,
+			cache:                         cache,
+		}
+		handlers["list_policy_versions"] = listPolicyVersionsHandler(policyVersions)
+		handlers["create_policy_version"] = createPolicyVersionHandler(policyVersions, trail)
+		handlers["diff_policy_versions"] = diffPolicyVersionsHandler(policyVersions)
+		handlers["set_default_policy_version"] = setDefaultPolicyVersionHandler(policyVersions, trail)
+		features = append(features, policyVersionRoutes)
+	}
+
+	if grants != nil {
+		handlers["request_grant"] = requestGrantHandler(*grants, trail)
+		handlers["list_grants"] = listGrantsHandler(*grants)
+		handlers["approve_grant"] = approveGrantHandler(*grants, trail)
+		features = append(features, grantRoutes)
+	}
+
+	if breakGlass != nil {
+		maxBreakGlassDuration := configuration.BreakGlassMaxDuration
+		if maxBreakGlassDuration <= 0 {
+			maxBreakGlassDuration = defaultMaxBreakGlassDuration
+		}
+		eligibility := breakGlassEligibility{policy: configuration.BreakGlassEligibilityPolicy, store: store, idpGroups: idpGroups, maxPolicyGroupDepth: maxPolicyGroupDepth}
+		handlers["activate_break_glass"] = activateBreakGlassHandler(*breakGlass, eligibility, configuration.BreakGlassPolicies, maxBreakGlassDuration, configuration.BreakGlassWebhookUrl, trail)
+		features = append(features, breakGlassRoutes)
+	}
+
+	if writableStore != nil {
+		admin := adminStore{store: writableStore, cache: cache, maxPolicyGroupDepth: maxPolicyGroupDepth, trail: trail}
+		handlers["list_policies"] = listAdminPoliciesHandler(admin)
+		handlers["get_policy"] = getAdminPolicyHandler(admin)
+		handlers["put_policy"] = putAdminPolicyHandler(admin)
+		handlers["delete_policy"] = deleteAdminPolicyHandler(admin)
+		handlers["list_policy_holders"] = listPolicyHoldersHandler(admin)
+		handlers["list_policy_groups"] = listAdminPolicyGroupsHandler(admin)
+		handlers["get_policy_group"] = getAdminPolicyGroupHandler(admin)
+		handlers["put_policy_group"] = putAdminPolicyGroupHandler(admin)
+		handlers["delete_policy_group"] = deleteAdminPolicyGroupHandler(admin)
+		handlers["list_policy_group_members"] = listPolicyGroupMembersHandler(admin)
+		handlers["export_attachments"] = exportAttachmentsHandler(admin)
+		handlers["import_attachments"] = importAttachmentsHandler(admin)
+		handlers["list_users"] = listAdminUsersHandler(admin)
+		handlers["get_user"] = getAdminUserHandler(admin)
+		handlers["put_user"] = putAdminUserHandler(admin)
+		handlers["delete_user"] = deleteAdminUserHandler(admin)
+		features = append(features, adminRoutes)
+
+		// Identity providers provision users with a token of their own
+		// rather than as a user
+		if configuration.ScimBearerToken != "" {
+			routeScim(r, scimProvisioning{admin: admin, userIdPrefix: configuration.ScimUserIdPrefix}, configuration.ScimBearerToken)
+		}
+	}
+
+	if trail.sink != nil {
+		handlers["list_audit_events"] = listAuditEventsHandler(trail.sink)
+		features = append(features, auditRoutes)
+	}
+
+	routes = append(routes, featureRoutes(configuration, features...)...)
+	if err = routeTable(r, apiPrefix, routes, strategies, handlers, authenticate); err != nil {
+		log.Fatalf("Invalid route table, %v", err)
+	}
 
 	spa := spaHandler{staticPath: "../app/build", indexPath: "index.html"}
 	r.PathPrefix("/").Handler(spa).Methods("GET")
@@ -112,133 +271,223 @@ func main() {
 	log.Fatal(srv.ListenAndServe())
 }
 
-func pingHandler() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		user := (r.Context().Value("User")).(auth.User)
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(user.Identity.Email))
+// openPolicyStore opens the policy store of the configuration. Policies are
+// read from DynamoDB unless another store is configured, in which case no
+// AWS credentials are needed and the DynamoDB client is nil.
+func openPolicyStore(configuration cf.Configuration) (policystore.PolicyStore, *dynamodb.Client, error) {
+	switch configuration.PolicyStore {
+	case "", "dynamodb":
+		svc := dynamoClient(configuration)
+		return dynamoPolicyStore(configuration, svc), svc, nil
+	case "file":
+		fileStore, err := policystore.NewFilePolicyStore(configuration.PolicyStoreDir)
+		if err != nil {
+			return nil, nil, errors.New(fmt.Sprintf("Unable to load policy files, %v", err))
+		}
+		return fileStore, nil, nil
+	case "postgres", "sqlite3":
+		dialect, _ := policystore.ParseDialect(configuration.PolicyStore)
+		db, err := sql.Open(string(dialect), configuration.PolicyStoreDsn)
+		if err != nil {
+			return nil, nil, errors.New(fmt.Sprintf("Unable to open policy database, %v", err))
+		}
+		sqlStore := policystore.SQLPolicyStore{DB: db, Dialect: dialect}
+		version, err := sqlStore.Migrate()
+		if err != nil {
+			return nil, nil, errors.New(fmt.Sprintf("Unable to migrate policy database, %v", err))
+		}
+		log.Printf("Policy database is at schema version %d", version)
+		return sqlStore, nil, nil
+	}
+	return nil, nil, errors.New(fmt.Sprintf("Unknown policy store %s", configuration.PolicyStore))
+}
+
+// grantAndBreakGlassStores returns the stores of the optional features that
+// are configured, which need DynamoDB.
+func grantAndBreakGlassStores(configuration cf.Configuration, svc *dynamodb.Client) (*grantStore, *breakGlassStore) {
+	var grants *grantStore
+	if svc != nil && configuration.DdbTemporaryGrantTableName != "" {
+		maxGrantDuration := configuration.MaxGrantDuration
+		if maxGrantDuration <= 0 {
+			maxGrantDuration = defaultMaxGrantDuration
+		}
+		grants = &grantStore{
+			temporaryGrantsTableName: configuration.DdbTemporaryGrantTableName,
+			maxDuration:              maxGrantDuration,
+			svc:                      svc,
+		}
+	}
+	var breakGlass *breakGlassStore
+	if svc != nil && configuration.DdbBreakGlassTableName != "" {
+		breakGlass = &breakGlassStore{breakGlassTableName: configuration.DdbBreakGlassTableName, svc: svc}
+	}
+	return grants, breakGlass
+}
+
+func policyGroupDepth(configuration cf.Configuration) int {
+	if configuration.MaxPolicyGroupDepth <= 0 {
+		return policystore.DefaultMaxPolicyGroupDepth
+	}
+	return configuration.MaxPolicyGroupDepth
+}
+
+const defaultLookupTimeout = 5 * time.Second
+
+// lookupTimeouts bounds each stage of authenticating a request, so that a
+// slow auth server or store is answered with 504 rather than holding the
+// request.
+func lookupTimeouts(configuration cf.Configuration) auth.Timeouts {
+	timeouts := auth.Timeouts{
+		Identity:      configuration.IdentityLookupTimeout,
+		UserData:      configuration.PolicyLookupTimeout,
+		Authorization: configuration.AuthorizationTimeout,
+	}
+	for _, timeout := range []*time.Duration{&timeouts.Identity, &timeouts.UserData, &timeouts.Authorization} {
+		if *timeout <= 0 {
+			*timeout = defaultLookupTimeout
+		}
+	}
+	return timeouts
+}
+
+func awsConfig(configuration cf.Configuration) aws.Config {
+	cfg, err := config.LoadDefaultConfig(
+		context.TODO(),
+		config.WithRegion(configuration.AwsRegion),
+		config.WithSharedCredentialsFiles([]string{".aws/credentials"}),
+		config.WithSharedConfigProfile(configuration.AwsProfile))
+	if err != nil {
+		panic(err)
 	}
+	return cfg
+}
+
+func dynamoClient(configuration cf.Configuration) *dynamodb.Client {
+	return dynamodb.NewFromConfig(awsConfig(configuration))
 }
 
-type UserPolicyNames struct {
-	PolicyNames  []string `dynamodbav:"access_policies"`
-	UserId       string   `dynamodbav:"user_id"`
-	PolicyGroups []string `dynamodbav:"policy_groups"`
+// consumePolicyStreams invalidates the cache on changes to the policy tables
+// that have a stream. Without one, changes take up to the TTL of the cache
+// to reach this instance.
+func consumePolicyStreams(ctx context.Context, configuration cf.Configuration, store policystore.DynamoPolicyStore, cache *policystore.CachingPolicyStore) {
+	consumer := policystore.StreamConsumer{
+		Streams:      dynamodbstreams.NewFromConfig(awsConfig(configuration)),
+		Cache:        cache,
+		PollInterval: configuration.PolicyStreamPollInterval,
+	}
+	tables := map[string]policystore.KeyInvalidation{
+		store.UserAccessPoliciesTableName:   policystore.UserKeyInvalidation,
+		store.PolicyGroupsTableName:         policystore.GroupKeyInvalidation,
+		store.AccessPoliciesTableName:       policystore.PolicyKeyInvalidation,
+		store.AccessPolicyVersionsTableName: policystore.PolicyKeyInvalidation,
+	}
+	for tableName, invalidation := range tables {
+		description, err := store.Svc.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+		if err != nil || description.Table.LatestStreamArn == nil {
+			log.Printf("Not consuming the stream of %s, cached permissions may be stale for %s: %v", tableName, configuration.PermissionCacheTtl, err)
+			continue
+		}
+		streamArn, invalidation := aws.ToString(description.Table.LatestStreamArn), invalidation
+		go func() {
+			if err := consumer.Consume(ctx, streamArn, invalidation); err != nil && ctx.Err() == nil {
+				log.Printf("Stopped consuming stream %s, %v", streamArn, err)
+			}
+		}()
+	}
 }
 
-type PolicyGroup struct {
-	Name        string
-	PolicyNames []string `dynamodbav:"policy_names"`
+func dynamoPolicyStore(configuration cf.Configuration, svc *dynamodb.Client) policystore.DynamoPolicyStore {
+	return policystore.DynamoPolicyStore{
+		UserAccessPoliciesTableName:   configuration.DdbUserAccessPolicyTableName,
+		AccessPoliciesTableName:       configuration.DdbAccessPolicyTableName,
+		AccessPolicyVersionsTableName: configuration.DdbAccessPolicyVersionTableName,
+		PolicyGroupsTableName:         configuration.DdbPolicyGroupTableName,
+		Svc:                           svc,
+	}
 }
 
-type PermsWithMeta struct {
-	Name        string
-	Created_at  int
-	Updated_at  int
-	Description string
-	Permissions auth.Permission
+func pingHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("User")).(auth.User)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(user.Identity.Email))
+	}
 }
 
-func userDataFetcher(userAccessPoliciesTableName, accessPoliciesTableName, policyGroupsTableName string, svc *dynamodb.Client) func(userI *auth.UserIdentity, u *auth.User, w *http.ResponseWriter) error {
-	return func(userI *auth.UserIdentity, u *auth.User, w *http.ResponseWriter) error {
+// userDataFetcher resolves the permissions of the user from the store. The
+// grant and break-glass stores and the mapping of identity provider claims
+// to policy groups are optional. The lookups give up when the context is
+// done.
+func userDataFetcher(store policystore.PolicyStore, grants *grantStore, breakGlassActivations *breakGlassStore, idpGroups *idpGroupMapper, maxPolicyGroupDepth int) func(ctx context.Context, userI *auth.UserIdentity, u *auth.User) error {
+	return func(ctx context.Context, userI *auth.UserIdentity, u *auth.User) error {
 
 		if userI.UserId == "" {
 			return errors.New("UserId is empty")
 		}
 
 		// Get names of policies attached directly
-		directlyAttachedPoliciesResult, err := svc.GetItem(context.TODO(), &dynamodb.GetItemInput{
-			TableName: aws.String(userAccessPoliciesTableName),
-			Key: map[string]types.AttributeValue{
-				"user_id": &types.AttributeValueMemberS{Value: userI.UserId},
-			},
-		})
-		if err != nil {
-			return errors.New(fmt.Sprintf("Got error calling GetItem: %s", err))
-		}
-		userPolicyNames := UserPolicyNames{}
-		err = attributevalue.UnmarshalMap(directlyAttachedPoliciesResult.Item, &userPolicyNames)
-		if err != nil {
-			return errors.New(fmt.Sprintf("Failed to unmarshal Record, %v", err))
-		}
-		policyNames := userPolicyNames.PolicyNames
-
-		// Get policy names from groups
-		policyGroupsForQuery := []map[string]types.AttributeValue{}
-		for _, group := range userPolicyNames.PolicyGroups {
-			policyGroupsForQuery = append(policyGroupsForQuery, map[string]types.AttributeValue{
-				"name": &types.AttributeValueMemberS{Value: group},
-			})
-		}
-		policiesFromGroupsResult, err := svc.BatchGetItem(context.TODO(), &dynamodb.BatchGetItemInput{
-			RequestItems: map[string]types.KeysAndAttributes{
-				policyGroupsTableName: {
-					Keys: policyGroupsForQuery,
-				},
-			},
-		})
+		userPolicyNames, err := store.GetUserPolicyNames(ctx, userI.UserId)
 		if err != nil {
-			return errors.New(fmt.Sprintf("Got error calling BatchGetItem: %s", err))
+			return err
 		}
-		for _, table := range policiesFromGroupsResult.Responses {
-			for _, item := range table {
-				var policyGroup PolicyGroup
-				err = attributevalue.UnmarshalMap(item, &policyGroup)
 
-				if err != nil {
-					return errors.New(fmt.Sprintf("failed to unmarshall place from dynamodb response, err: %s", err))
-				}
-				policyNames = append(policyNames, policyGroup.PolicyNames...)
-			}
-		}
-		toSet(&policyNames)
-
-		avs := []map[string]types.AttributeValue{}
-		for _, accessPolicy := range policyNames {
-			avs = append(avs, map[string]types.AttributeValue{
-				"name": &types.AttributeValueMemberS{Value: accessPolicy},
-			})
-		}
-		permissionsResult, err := svc.BatchGetItem(context.TODO(), &dynamodb.BatchGetItemInput{
-			RequestItems: map[string]types.KeysAndAttributes{
-				accessPoliciesTableName: {
-					Keys: avs,
-				},
-			},
-		})
-		if err != nil {
-			return errors.New(fmt.Sprintf("err2: %v", permissionsResult))
+		// A user the identity provider deactivated keeps its attachments,
+		// for when it is activated again, but is refused everything meanwhile
+		if userPolicyNames.Scim != nil && !userPolicyNames.Scim.Active {
+			log.Printf("User %s is deactivated by SCIM provisioning", userI.UserId)
+			(*u).Identity = *userI
+			(*u).Deactivated = true
+			return nil
 		}
 
-		authPermissions := []auth.Permission{}
-		for _, table := range permissionsResult.Responses {
-			for _, item := range table {
-				permission := PermsWithMeta{}
-				err = attributevalue.UnmarshalMap(item, &permission)
+		// The permanent memberships may come from the identity provider as
+		// well, or instead
+		idpPolicyGroups := []string{}
+		if idpGroups != nil {
+			userPolicyNames.PolicyGroups, idpPolicyGroups = idpGroups.combine(userPolicyNames.PolicyGroups, userI.Claims)
+		}
 
-				if err != nil {
-					return errors.New(fmt.Sprintf("failed to unmarshall place from dynamodb response, err: %s", err))
+		// Add the attachments and approved grants that are currently active
+		activeGrants := []TemporaryGrant{}
+		if grants != nil {
+			activeGrants, err = grants.List(ctx, userI.UserId)
+			if err != nil {
+				return err
+			}
+		}
+		attachedPolicyNames, attachedGroupNames := activeAttachments(userPolicyNames, activeGrants, time.Now())
+		var breakGlass *auth.BreakGlassElevation
+		if breakGlassActivations != nil {
+			activations, err := breakGlassActivations.Active(ctx, userI.UserId)
+			if err != nil {
+				return err
+			}
+			for _, activation := range activations {
+				attachedPolicyNames = append(attachedPolicyNames, activation.PolicyNames...)
+				breakGlass = &auth.BreakGlassElevation{
+					ActivationId:  activation.ActivationId,
+					Justification: activation.Justification,
+					ExpiresAt:     activation.ExpiresAt,
 				}
-				authPermissions = append(authPermissions, permission.Permissions)
+				log.Printf("BREAK-GLASS IN USE user=%s activation=%s policies=%v", userI.UserId, activation.ActivationId, activation.PolicyNames)
 			}
 		}
 
+		boundaryNames := []string{}
+		if userPolicyNames.PermissionBoundary != "" {
+			boundaryNames = append(boundaryNames, userPolicyNames.PermissionBoundary)
+		}
+		resolution, err := policystore.ResolveUser(ctx, store, userI.UserId, attachedPolicyNames, attachedGroupNames, boundaryNames, maxPolicyGroupDepth)
+		if err != nil {
+			return err
+		}
+
 		(*u).Identity = *userI
-		(*u).Permissions = authPermissions
+		(*u).Permissions = resolution.Permissions
+		(*u).Boundaries = resolution.Boundaries
+		(*u).PolicyPaths = resolution.PolicyPaths
+		(*u).BreakGlass = breakGlass
+		(*u).IdpPolicyGroups = idpPolicyGroups
 		return nil
 	}
 }
-
-func toSet(slice *[]string) {
-	processed := map[string]struct{}{}
-	w := 0
-	for _, s := range *slice {
-		if _, exists := processed[s]; !exists {
-			// If this city has not been seen yet, add it to the list
-			processed[s] = struct{}{}
-			(*slice)[w] = s
-			w++
-		}
-	}
-	*slice = (*slice)[:w]
-}
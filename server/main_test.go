@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	"github.com/shafiquejamal/reactjs-golang-starter/policystore"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestUserDataFetcher(t *testing.T) {
+
+	Convey("userDataFetcher", t, func() {
+		store := policystore.NewMemoryPolicyStore()
+		store.PutUserPolicyNames(context.Background(), policystore.UserPolicyNames{
+			UserId:            "auth0|0123456789",
+			PolicyNames:       []string{"ping"},
+			TimeBoundPolicies: []policystore.TimeBoundAttachment{{Name: "pong", ExpiresAt: 1}},
+		})
+		store.PutPolicies(context.Background(),
+			policystore.PermsWithMeta{Name: "ping", Permissions: auth.Permission{Allows: []auth.Statement{{Actions: []string{"^/ping$"}}}}},
+			policystore.PermsWithMeta{Name: "pong", Permissions: auth.Permission{Allows: []auth.Statement{{Actions: []string{"^/pong$"}}}}},
+		)
+		fetchUserData := userDataFetcher(store, nil, nil, nil, policystore.DefaultMaxPolicyGroupDepth)
+
+		Convey("resolves the active attachments of the user", func() {
+			u := auth.User{}
+			So(fetchUserData(context.Background(), &auth.UserIdentity{UserId: "auth0|0123456789"}, &u), ShouldBeNil)
+			So(u.Identity.UserId, ShouldEqual, "auth0|0123456789")
+			So(u.PolicyPaths, ShouldResemble, map[string][]string{"ping": {}})
+			So(len(u.Permissions), ShouldEqual, 1)
+		})
+
+		Convey("gives an unknown user no permissions", func() {
+			u := auth.User{}
+			So(fetchUserData(context.Background(), &auth.UserIdentity{UserId: "nobody"}, &u), ShouldBeNil)
+			So(u.Permissions, ShouldBeEmpty)
+		})
+
+		Convey("refuses an identity without a user id", func() {
+			So(fetchUserData(context.Background(), &auth.UserIdentity{}, &auth.User{}), ShouldNotBeNil)
+		})
+	})
+}
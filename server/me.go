@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	"github.com/shafiquejamal/reactjs-golang-starter/errorhandler"
+)
+
+type permissionCheck struct {
+	Method  string
+	Path    string
+	Allowed bool
+	Reason  string `json:",omitempty"`
+}
+
+// meHandler returns the identity of the user together with the permissions
+// resolved for them.
+func meHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("User")).(auth.User)
+		writeJSONWithETag(w, r, user)
+	}
+}
+
+// maxChecks bounds the checks of a /me/can request, each of which evaluates
+// an authorization strategy.
+const maxChecks = 100
+
+// canIHandler evaluates, for the user, each "check" query parameter of the
+// form "METHOD /path", where the path is relative to the API prefix, against
+// the authorization strategy of the route that would serve it.
+func canIHandler(router *mux.Router, apiPrefix string, routeAuthorizations map[string]func(user auth.User, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("User")).(auth.User)
+		queries := r.URL.Query()["check"]
+		if len(queries) > maxChecks {
+			errorhandler.ReturnError(&w, http.StatusBadRequest, fmt.Sprintf("At most %d checks can be made at once", maxChecks), nil)
+			return
+		}
+		checks := []permissionCheck{}
+		for _, check := range queries {
+			parts := strings.SplitN(strings.TrimSpace(check), " ", 2)
+			if len(parts) != 2 {
+				errorhandler.ReturnError(&w, http.StatusBadRequest, "Malformed check, expected METHOD /path", nil)
+				return
+			}
+			checks = append(checks, evaluateCheck(r.Context(), router, apiPrefix, routeAuthorizations, user, strings.ToUpper(parts[0]), parts[1]))
+		}
+		writeJSONWithETag(w, r, checks)
+	}
+}
+
+// evaluateCheck builds the request of the check with the context of the
+// request to /me/can, so that a strategy that looks something up gives up
+// with it.
+func evaluateCheck(ctx context.Context, router *mux.Router, apiPrefix string, routeAuthorizations map[string]func(user auth.User, r *http.Request) error, user auth.User, method, path string) permissionCheck {
+	check := permissionCheck{Method: method, Path: path}
+	req, err := http.NewRequestWithContext(ctx, method, apiPrefix+path, nil)
+	if err != nil {
+		check.Reason = err.Error()
+		return check
+	}
+	req.RequestURI = apiPrefix + path
+	var match mux.RouteMatch
+	if !router.Match(req, &match) || match.Route == nil {
+		check.Reason = "No such route"
+		return check
+	}
+	template, _ := match.Route.GetPathTemplate()
+	authorizationStrategy, exists := routeAuthorizations[method+" "+template]
+	if !exists {
+		check.Reason = "No such route"
+		return check
+	}
+	if err := authorizationStrategy(user, mux.SetURLVars(req, match.Vars)); err != nil {
+		check.Reason = err.Error()
+		return check
+	}
+	check.Allowed = true
+	return check
+}
+
+// writeJSONWithETag lets clients poll with If-None-Match and get a 304 while
+// the response is unchanged.
+func writeJSONWithETag(w http.ResponseWriter, r *http.Request, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		errorhandler.ReturnError(&w, http.StatusInternalServerError, "Could not encode response", err)
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if match := r.Header.Get("If-None-Match"); match != "" && strings.Contains(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
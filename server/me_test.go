@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCanIHandler(t *testing.T) {
+
+	Convey("canIHandler", t, func() {
+		router := mux.NewRouter()
+		router.Handle("/api/pong", pingHandler()).Methods("GET")
+		router.Handle("/api/documents/{id}", pingHandler()).Methods("GET")
+		routeAuthorizations := map[string]func(user auth.User, r *http.Request) error{
+			"GET /api/pong": auth.PolicyAuthorizationStrategy("/api"),
+			"GET /api/documents/{id}": func(user auth.User, r *http.Request) error {
+				if mux.Vars(r)["id"] != "42" {
+					return errors.New("Not document 42")
+				}
+				return nil
+			},
+		}
+		user := auth.User{Permissions: []auth.Permission{{Allows: []auth.Statement{{Actions: []string{"^/pong$"}}}}}}
+		handler := canIHandler(router, "/api", routeAuthorizations)
+		check := func(header http.Header, checks ...string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest("GET", "/api/me/can", nil)
+			q := r.URL.Query()
+			q["check"] = checks
+			r.URL.RawQuery = q.Encode()
+			for name, values := range header {
+				r.Header[name] = values
+			}
+			w := httptest.NewRecorder()
+			handler(w, r.WithContext(context.WithValue(r.Context(), "User", user)))
+			return w
+		}
+
+		Convey("evaluates each check against the strategy of its route", func() {
+			w := check(nil, "GET /pong", "get /documents/42", "GET /documents/7", "POST /pong", "GET /nowhere")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			results := []permissionCheck{}
+			So(json.Unmarshal(w.Body.Bytes(), &results), ShouldBeNil)
+			allowed := []bool{}
+			for _, result := range results {
+				allowed = append(allowed, result.Allowed)
+			}
+			So(allowed, ShouldResemble, []bool{true, true, false, false, false})
+		})
+
+		Convey("answers 304 when the ETag still matches", func() {
+			w := check(nil, "GET /pong")
+			etag := w.Header().Get("ETag")
+			So(etag, ShouldNotBeEmpty)
+			w = check(http.Header{"If-None-Match": {etag}}, "GET /pong")
+			So(w.Code, ShouldEqual, http.StatusNotModified)
+			So(w.Body.Len(), ShouldEqual, 0)
+		})
+
+		Convey("evaluates the checks with the context of the request", func() {
+			routeAuthorizations["GET /api/pong"] = func(user auth.User, r *http.Request) error {
+				return r.Context().Err()
+			}
+			r := httptest.NewRequest("GET", "/api/me/can?check=GET+/pong", nil)
+			ctx, cancel := context.WithCancel(context.WithValue(r.Context(), "User", user))
+			cancel()
+			w := httptest.NewRecorder()
+			handler(w, r.WithContext(ctx))
+			results := []permissionCheck{}
+			So(json.Unmarshal(w.Body.Bytes(), &results), ShouldBeNil)
+			So(results[0].Allowed, ShouldBeFalse)
+			So(results[0].Reason, ShouldEqual, context.Canceled.Error())
+		})
+
+		Convey("rejects more checks than can be made at once", func() {
+			checks := make([]string, maxChecks+1)
+			for i := range checks {
+				checks[i] = "GET /pong"
+			}
+			So(check(nil, checks[:maxChecks]...).Code, ShouldEqual, http.StatusOK)
+			So(check(nil, checks...).Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("rejects a malformed check", func() {
+			w := check(nil, "/pong")
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
@@ -0,0 +1,212 @@
+package policystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+)
+
+var ErrNotFound = errors.New("Not found")
+
+// ValidationError is what is wrong with a document, as opposed to an error of
+// the store.
+type ValidationError struct {
+	Reason string
+}
+
+func (e ValidationError) Error() string {
+	return e.Reason
+}
+
+// ConflictError is returned when writing a document that has been changed
+// since it was read. Current is the revision it is at, 0 if it is gone.
+type ConflictError struct {
+	Kind     string
+	Name     string
+	Expected int
+	Current  int
+}
+
+func (e ConflictError) Error() string {
+	return fmt.Sprintf("The %s %s is at revision %d rather than %d, it has been changed since it was read", e.Kind, e.Name, e.Current, e.Expected)
+}
+
+func invalid(format string, args ...interface{}) error {
+	return ValidationError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// ListOptions selects a page of a listing. Items come in a stable order, and
+// Cursor continues after the last item of the previous page.
+type ListOptions struct {
+	// Prefix of the policy name, group name or user id
+	Prefix string
+	// Policy keeps the users or groups the policy is attached to directly
+	Policy string
+	// Group keeps the users or groups the group is attached to directly
+	Group  string
+	Limit  int
+	Cursor string
+}
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 1000
+)
+
+// PageLimit is the number of items to return for the options.
+func (o ListOptions) PageLimit() int {
+	if o.Limit <= 0 {
+		return defaultListLimit
+	}
+	if o.Limit > maxListLimit {
+		return maxListLimit
+	}
+	return o.Limit
+}
+
+// AdminStore is a PolicyStore that can also be changed. Put replaces whole
+// documents, each only if it is still at its Revision, which is the one it
+// was read at and 0 for a new document. The document is then stored at the
+// next revision. Otherwise Put returns a ConflictError and, when given
+// several documents, writes none of them, except in DynamoDB where those
+// before the conflict are written. Delete likewise deletes a document only
+// if it is still at the given revision, a missing one counting as 0, and
+// otherwise returns a ConflictError. The List methods return the cursor of
+// the next page, empty on the last page.
+type AdminStore interface {
+	PolicyStore
+	// GetPolicy returns ErrNotFound if there is no such policy
+	GetPolicy(ctx context.Context, name string) (PermsWithMeta, error)
+	ListPolicies(ctx context.Context, options ListOptions) ([]PermsWithMeta, string, error)
+	ListPolicyGroups(ctx context.Context, options ListOptions) ([]PolicyGroup, string, error)
+	ListUsers(ctx context.Context, options ListOptions) ([]UserPolicyNames, string, error)
+	PutPolicies(ctx context.Context, policies ...PermsWithMeta) error
+	PutPolicyGroups(ctx context.Context, groups ...PolicyGroup) error
+	PutUserPolicyNames(ctx context.Context, users ...UserPolicyNames) error
+	DeletePolicy(ctx context.Context, name string, revision int) error
+	DeletePolicyGroup(ctx context.Context, name string, revision int) error
+	DeleteUserPolicyNames(ctx context.Context, userId string, revision int) error
+}
+
+var (
+	_ AdminStore = (*MemoryPolicyStore)(nil)
+	_ AdminStore = SQLPolicyStore{}
+	_ AdminStore = DynamoPolicyStore{}
+)
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:-]{0,127}$`)
+
+func ValidateName(kind, name string) error {
+	if !namePattern.MatchString(name) {
+		return invalid("Invalid %s name %q, expected letters, digits and _.:- and at most 128 characters", kind, name)
+	}
+	return nil
+}
+
+// ValidatePolicy checks the name of the policy and that its statements name
+// actions and are valid regular expressions.
+func ValidatePolicy(policy PermsWithMeta) error {
+	if err := ValidateName("policy", policy.Name); err != nil {
+		return err
+	}
+	for _, statements := range []struct {
+		kind       string
+		statements []auth.Statement
+	}{{"allow", policy.Permissions.Allows}, {"deny", policy.Permissions.Denys}} {
+		for i, statement := range statements.statements {
+			if len(statement.Actions) == 0 {
+				return invalid("The %s statement #%d has no actions", statements.kind, i+1)
+			}
+			for _, pattern := range append(append([]string{}, statement.Actions...), statement.Resources...) {
+				if _, err := regexp.Compile(pattern); err != nil {
+					return invalid("The %s statement #%d has an invalid pattern %q, %v", statements.kind, i+1, pattern, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ValidatePolicyGroup checks the names of the group, that the policies and
+// groups it refers to exist, and that with it the groups remain acyclic.
+func ValidatePolicyGroup(ctx context.Context, store PolicyStore, group PolicyGroup, maxDepth int) error {
+	if err := ValidateName("group", group.Name); err != nil {
+		return err
+	}
+	if err := validateReferences(ctx, store, group.PolicyNames, group.PolicyGroups, group.PermissionBoundary); err != nil {
+		return err
+	}
+	// Resolve the groups as they would be with this one written
+	var storeErr error
+	_, err := resolvePolicyGroups(nil, []string{group.Name}, maxDepth, func(names []string) ([]PolicyGroup, error) {
+		others := []string{}
+		groups := []PolicyGroup{}
+		for _, name := range names {
+			if name == group.Name {
+				groups = append(groups, group)
+			} else {
+				others = append(others, name)
+			}
+		}
+		found, err := store.GetPolicyGroups(ctx, others)
+		storeErr = err
+		return append(groups, found...), err
+	})
+	if storeErr != nil {
+		return storeErr
+	}
+	if err != nil {
+		return ValidationError{Reason: err.Error()}
+	}
+	return nil
+}
+
+// ValidateUserPolicyNames checks that the policies and groups attached to the
+// user exist.
+func ValidateUserPolicyNames(ctx context.Context, store PolicyStore, user UserPolicyNames) error {
+	if strings.TrimSpace(user.UserId) == "" {
+		return invalid("The user_id is empty")
+	}
+	policyNames := append([]string{}, user.PolicyNames...)
+	for _, attachment := range user.TimeBoundPolicies {
+		policyNames = append(policyNames, attachment.Name)
+	}
+	groupNames := append([]string{}, user.PolicyGroups...)
+	for _, attachment := range user.TimeBoundPolicyGroups {
+		groupNames = append(groupNames, attachment.Name)
+	}
+	return validateReferences(ctx, store, policyNames, groupNames, user.PermissionBoundary)
+}
+
+func validateReferences(ctx context.Context, store PolicyStore, policyNames, groupNames []string, boundary string) error {
+	if boundary != "" {
+		policyNames = append(append([]string{}, policyNames...), boundary)
+	}
+	permissions, err := store.GetPermissions(ctx, policyNames)
+	if err != nil {
+		return err
+	}
+	for _, name := range policyNames {
+		if _, exists := permissions[name]; !exists {
+			return invalid("No such policy %s", name)
+		}
+	}
+	groups, err := store.GetPolicyGroups(ctx, groupNames)
+	if err != nil {
+		return err
+	}
+	found := map[string]struct{}{}
+	for _, group := range groups {
+		found[group.Name] = struct{}{}
+	}
+	for _, name := range groupNames {
+		if _, exists := found[name]; !exists {
+			return invalid("No such policy group %s", name)
+		}
+	}
+	return nil
+}
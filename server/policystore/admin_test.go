@@ -0,0 +1,91 @@
+package policystore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestValidate(t *testing.T) {
+
+	Convey("Validation", t, func() {
+		store := NewMemoryPolicyStore()
+		store.PutPolicies(context.Background(),
+			PermsWithMeta{Name: "read", Permissions: auth.Permission{Allows: []auth.Statement{{Actions: []string{"^/read$"}}}}},
+			PermsWithMeta{Name: "deploy", Permissions: auth.Permission{Allows: []auth.Statement{{Actions: []string{"^/deploy$"}}}}},
+		)
+		store.PutPolicyGroups(context.Background(),
+			PolicyGroup{Name: "engineering", PolicyNames: []string{"read"}, PolicyGroups: []string{"backend"}},
+			PolicyGroup{Name: "backend", PolicyNames: []string{"deploy"}},
+		)
+
+		Convey("rejects names with other characters", func() {
+			So(ValidateName("policy", "read-only:v1.2"), ShouldBeNil)
+			So(ValidateName("policy", "read only"), ShouldHaveSameTypeAs, ValidationError{})
+			So(ValidateName("policy", ""), ShouldNotBeNil)
+		})
+
+		Convey("rejects statements without actions or with invalid patterns", func() {
+			So(ValidatePolicy(PermsWithMeta{Name: "empty", Permissions: auth.Permission{Allows: []auth.Statement{{}}}}), ShouldNotBeNil)
+			So(ValidatePolicy(PermsWithMeta{Name: "broken", Permissions: auth.Permission{Denys: []auth.Statement{{Actions: []string{"^/(read$"}}}}}), ShouldNotBeNil)
+		})
+
+		Convey("rejects groups referring to what does not exist", func() {
+			So(ValidatePolicyGroup(context.Background(), store, PolicyGroup{Name: "ops", PolicyNames: []string{"deploy"}, PolicyGroups: []string{"backend"}}, DefaultMaxPolicyGroupDepth), ShouldBeNil)
+			So(ValidatePolicyGroup(context.Background(), store, PolicyGroup{Name: "ops", PolicyNames: []string{"nothing"}}, DefaultMaxPolicyGroupDepth), ShouldHaveSameTypeAs, ValidationError{})
+			So(ValidatePolicyGroup(context.Background(), store, PolicyGroup{Name: "ops", PermissionBoundary: "nothing"}, DefaultMaxPolicyGroupDepth), ShouldNotBeNil)
+		})
+
+		Convey("rejects groups that would make a cycle", func() {
+			err := ValidatePolicyGroup(context.Background(), store, PolicyGroup{Name: "backend", PolicyGroups: []string{"engineering"}}, DefaultMaxPolicyGroupDepth)
+			So(err, ShouldHaveSameTypeAs, ValidationError{})
+			So(err.Error(), ShouldContainSubstring, "cycle")
+		})
+
+		Convey("rejects users attached to what does not exist", func() {
+			So(ValidateUserPolicyNames(context.Background(), store, UserPolicyNames{UserId: "auth0|1", PolicyGroups: []string{"engineering"}}), ShouldBeNil)
+			So(ValidateUserPolicyNames(context.Background(), store, UserPolicyNames{UserId: "auth0|1", TimeBoundPolicies: []TimeBoundAttachment{{Name: "nothing"}}}), ShouldNotBeNil)
+			So(ValidateUserPolicyNames(context.Background(), store, UserPolicyNames{}), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestMemoryPolicyStoreListing(t *testing.T) {
+
+	Convey("MemoryPolicyStore listing", t, func() {
+		store := NewMemoryPolicyStore()
+		store.PutUserPolicyNames(context.Background(),
+			UserPolicyNames{UserId: "auth0|3", PolicyGroups: []string{"backend"}},
+			UserPolicyNames{UserId: "auth0|1", PolicyNames: []string{"read"}},
+			UserPolicyNames{UserId: "google|2", TimeBoundPolicies: []TimeBoundAttachment{{Name: "read", ExpiresAt: 1000}}},
+		)
+
+		Convey("pages through the users in order", func() {
+			users, next, err := store.ListUsers(context.Background(), ListOptions{Limit: 2})
+			So(err, ShouldBeNil)
+			So(len(users), ShouldEqual, 2)
+			So(users[0].UserId, ShouldEqual, "auth0|1")
+			So(next, ShouldEqual, "auth0|3")
+			users, next, err = store.ListUsers(context.Background(), ListOptions{Limit: 2, Cursor: next})
+			So(err, ShouldBeNil)
+			So(users[0].UserId, ShouldEqual, "google|2")
+			So(next, ShouldBeEmpty)
+		})
+
+		Convey("filters by prefix and by attachment, time-bound ones included", func() {
+			users, _, _ := store.ListUsers(context.Background(), ListOptions{Prefix: "auth0|"})
+			So(len(users), ShouldEqual, 2)
+			users, _, _ = store.ListUsers(context.Background(), ListOptions{Policy: "read"})
+			So(len(users), ShouldEqual, 2)
+			users, _, _ = store.ListUsers(context.Background(), ListOptions{Group: "backend"})
+			So(users[0].UserId, ShouldEqual, "auth0|3")
+		})
+
+		Convey("returns ErrNotFound for a missing policy", func() {
+			_, err := store.GetPolicy(context.Background(), "nothing")
+			So(err, ShouldEqual, ErrNotFound)
+		})
+	})
+}
@@ -0,0 +1,112 @@
+package policystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// maxBatchGetKeys is the most keys DynamoDB accepts in one BatchGetItem.
+const maxBatchGetKeys = 100
+
+var (
+	// batchGetAttempts bounds how often keys DynamoDB leaves unprocessed,
+	// usually because of throttling, are requested again.
+	batchGetAttempts   = 8
+	batchGetRetryDelay = 50 * time.Millisecond
+)
+
+type batchGetItemAPI interface {
+	BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error)
+}
+
+// batchGetItems reads every item of the table with one of the keys, in
+// batches of at most 100 keys, retrying unprocessed keys with exponential
+// backoff. Keys that are still unprocessed after the last attempt are an
+// error, so that a user never silently loses permissions under throttling.
+// DynamoDB rejects empty and duplicate keys, so no request is made without
+// keys and duplicates are dropped.
+func batchGetItems(ctx context.Context, svc batchGetItemAPI, tableName string, keys []map[string]types.AttributeValue) ([]map[string]types.AttributeValue, error) {
+	items := []map[string]types.AttributeValue{}
+	keys = uniqueKeys(keys)
+	for start := 0; start < len(keys); start += maxBatchGetKeys {
+		end := start + maxBatchGetKeys
+		if end > len(keys) {
+			end = len(keys)
+		}
+		pending := keys[start:end]
+		delay := batchGetRetryDelay
+		for attempt := 1; len(pending) > 0; attempt++ {
+			if attempt > batchGetAttempts {
+				return nil, errors.New(fmt.Sprintf("%d keys of %s were still unprocessed after %d attempts", len(pending), tableName, batchGetAttempts))
+			}
+			if attempt > 1 {
+				select {
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				case <-time.After(delay):
+				}
+				delay *= 2
+			}
+			result, err := svc.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+				RequestItems: map[string]types.KeysAndAttributes{
+					tableName: {Keys: pending},
+				},
+			})
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Got error calling BatchGetItem: %s", err))
+			}
+			items = append(items, result.Responses[tableName]...)
+			pending = result.UnprocessedKeys[tableName].Keys
+		}
+	}
+	return items, nil
+}
+
+func nameKeys(names []string) []map[string]types.AttributeValue {
+	keys := []map[string]types.AttributeValue{}
+	for _, name := range names {
+		keys = append(keys, map[string]types.AttributeValue{
+			"name": &types.AttributeValueMemberS{Value: name},
+		})
+	}
+	return keys
+}
+
+// uniqueKeys drops repeated keys. Key attributes are strings or numbers.
+func uniqueKeys(keys []map[string]types.AttributeValue) []map[string]types.AttributeValue {
+	seen := map[string]struct{}{}
+	unique := []map[string]types.AttributeValue{}
+	for _, key := range keys {
+		id := keyId(key)
+		if _, exists := seen[id]; exists {
+			continue
+		}
+		seen[id] = struct{}{}
+		unique = append(unique, key)
+	}
+	return unique
+}
+
+func keyId(key map[string]types.AttributeValue) string {
+	names := []string{}
+	for name := range key {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	id := ""
+	for _, name := range names {
+		switch value := key[name].(type) {
+		case *types.AttributeValueMemberS:
+			id += name + "=S:" + value.Value + "\x00"
+		case *types.AttributeValueMemberN:
+			id += name + "=N:" + value.Value + "\x00"
+		}
+	}
+	return id
+}
@@ -0,0 +1,93 @@
+package policystore
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// throttlingBatchGetter answers every key it is asked for, except that it
+// leaves the last unprocessed keys of each request unprocessed as long as it
+// has throttles left.
+type throttlingBatchGetter struct {
+	throttles   int
+	unprocessed int
+	batchSizes  []int
+}
+
+func (g *throttlingBatchGetter) BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	output := &dynamodb.BatchGetItemOutput{
+		Responses:       map[string][]map[string]types.AttributeValue{},
+		UnprocessedKeys: map[string]types.KeysAndAttributes{},
+	}
+	for tableName, keysAndAttributes := range params.RequestItems {
+		keys := keysAndAttributes.Keys
+		g.batchSizes = append(g.batchSizes, len(keys))
+		processed := keys
+		if g.throttles > 0 {
+			g.throttles--
+			split := len(keys) - g.unprocessed
+			if split < 0 {
+				split = 0
+			}
+			processed = keys[:split]
+			output.UnprocessedKeys[tableName] = types.KeysAndAttributes{Keys: keys[split:]}
+		}
+		output.Responses[tableName] = processed
+	}
+	return output, nil
+}
+
+func TestBatchGetItems(t *testing.T) {
+
+	Convey("batchGetItems", t, func() {
+		batchGetRetryDelay = time.Millisecond
+		names := []string{}
+		for i := 0; i < 250; i++ {
+			names = append(names, "policy-"+strconv.Itoa(i))
+		}
+
+		Convey("requests at most 100 keys at a time", func() {
+			getter := &throttlingBatchGetter{}
+			items, err := batchGetItems(context.Background(), getter, "policies", nameKeys(names))
+			So(err, ShouldBeNil)
+			So(len(items), ShouldEqual, 250)
+			So(getter.batchSizes, ShouldResemble, []int{100, 100, 50})
+		})
+
+		Convey("retries unprocessed keys", func() {
+			getter := &throttlingBatchGetter{throttles: 2, unprocessed: 30}
+			items, err := batchGetItems(context.Background(), getter, "policies", nameKeys(names[:100]))
+			So(err, ShouldBeNil)
+			So(len(items), ShouldEqual, 100)
+			So(getter.batchSizes, ShouldResemble, []int{100, 30, 30})
+		})
+
+		Convey("errors rather than dropping keys that stay unprocessed", func() {
+			getter := &throttlingBatchGetter{throttles: 1000, unprocessed: 1}
+			_, err := batchGetItems(context.Background(), getter, "policies", nameKeys(names[:10]))
+			So(err, ShouldNotBeNil)
+			So(len(getter.batchSizes), ShouldEqual, batchGetAttempts)
+		})
+
+		Convey("makes no request without keys", func() {
+			getter := &throttlingBatchGetter{}
+			items, err := batchGetItems(context.Background(), getter, "policies", nameKeys(nil))
+			So(err, ShouldBeNil)
+			So(items, ShouldBeEmpty)
+			So(getter.batchSizes, ShouldBeEmpty)
+		})
+
+		Convey("drops duplicate keys", func() {
+			getter := &throttlingBatchGetter{}
+			items, err := batchGetItems(context.Background(), getter, "policies", nameKeys([]string{"a", "b", "a"}))
+			So(err, ShouldBeNil)
+			So(len(items), ShouldEqual, 2)
+		})
+	})
+}
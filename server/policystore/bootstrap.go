@@ -0,0 +1,301 @@
+package policystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+type KeyAttribute struct {
+	Name string
+	Type types.ScalarAttributeType
+}
+
+type IndexSpec struct {
+	Name         string
+	PartitionKey KeyAttribute
+	SortKey      *KeyAttribute
+}
+
+// TableSpec describes the keys, time to live attribute, stream and global
+// secondary indexes a table must have.
+type TableSpec struct {
+	Name         string
+	PartitionKey KeyAttribute
+	SortKey      *KeyAttribute
+	TTLAttribute string
+	// StreamViewType is empty for a table without a stream
+	StreamViewType types.StreamViewType
+	Indexes        []IndexSpec
+}
+
+// TableSpecs lists the tables of the store. Their streams carry the keys of
+// changed items to the StreamConsumer.
+func (s DynamoPolicyStore) TableSpecs() []TableSpec {
+	name := KeyAttribute{Name: "name", Type: types.ScalarAttributeTypeS}
+	return []TableSpec{
+		{Name: s.UserAccessPoliciesTableName, PartitionKey: KeyAttribute{Name: "user_id", Type: types.ScalarAttributeTypeS}, StreamViewType: types.StreamViewTypeKeysOnly},
+		{Name: s.AccessPoliciesTableName, PartitionKey: name, StreamViewType: types.StreamViewTypeKeysOnly},
+		{Name: s.AccessPolicyVersionsTableName, PartitionKey: name, SortKey: &KeyAttribute{Name: "version", Type: types.ScalarAttributeTypeN}, StreamViewType: types.StreamViewTypeKeysOnly},
+		{Name: s.PolicyGroupsTableName, PartitionKey: name, StreamViewType: types.StreamViewTypeKeysOnly},
+	}
+}
+
+// EnsureTable checks that the table matches the spec. A missing table, time
+// to live or index is created when create is set, and an error otherwise.
+// Keys cannot be changed once a table exists, so a table with different
+// keys is always an error. It reports what it changed.
+func EnsureTable(ctx context.Context, svc *dynamodb.Client, spec TableSpec, create bool) ([]string, error) {
+	changes := []string{}
+	description, err := svc.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(spec.Name)})
+	var notFound *types.ResourceNotFoundException
+	switch {
+	case errors.As(err, &notFound):
+		if !create {
+			return nil, errors.New(fmt.Sprintf("Table %s does not exist", spec.Name))
+		}
+		if err = createTable(ctx, svc, spec); err != nil {
+			return nil, err
+		}
+		changes = append(changes, "created table "+spec.Name)
+	case err != nil:
+		return nil, errors.New(fmt.Sprintf("Got error calling DescribeTable: %s", err))
+	default:
+		if err = verifyKeys(spec.Name, description.Table.KeySchema, description.Table.AttributeDefinitions, spec.PartitionKey, spec.SortKey); err != nil {
+			return nil, err
+		}
+		stream := description.Table.StreamSpecification
+		if spec.StreamViewType != "" && (stream == nil || !aws.ToBool(stream.StreamEnabled)) {
+			if !create {
+				return nil, errors.New(fmt.Sprintf("Table %s has no stream", spec.Name))
+			}
+			_, err = svc.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+				TableName:           aws.String(spec.Name),
+				StreamSpecification: &types.StreamSpecification{StreamEnabled: aws.Bool(true), StreamViewType: spec.StreamViewType},
+			})
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not enable the stream of %s, %v", spec.Name, err))
+			}
+			if err = waitForTable(ctx, svc, spec.Name); err != nil {
+				return nil, err
+			}
+			changes = append(changes, "enabled the stream of "+spec.Name)
+		}
+		for _, index := range spec.Indexes {
+			found := false
+			for _, existing := range description.Table.GlobalSecondaryIndexes {
+				if aws.ToString(existing.IndexName) == index.Name {
+					found = true
+					if err = verifyKeys(spec.Name+"/"+index.Name, existing.KeySchema, description.Table.AttributeDefinitions, index.PartitionKey, index.SortKey); err != nil {
+						return nil, err
+					}
+				}
+			}
+			if found {
+				continue
+			}
+			if !create {
+				return nil, errors.New(fmt.Sprintf("Table %s has no index %s", spec.Name, index.Name))
+			}
+			// DynamoDB only accepts one new index per update
+			_, err = svc.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+				TableName:            aws.String(spec.Name),
+				AttributeDefinitions: attributeDefinitions(TableSpec{Indexes: []IndexSpec{index}}),
+				GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{
+					{Create: &types.CreateGlobalSecondaryIndexAction{
+						IndexName:  aws.String(index.Name),
+						KeySchema:  keySchema(index.PartitionKey, index.SortKey),
+						Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+					}},
+				},
+			})
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not create index %s on %s, %v", index.Name, spec.Name, err))
+			}
+			if err = waitForTable(ctx, svc, spec.Name); err != nil {
+				return nil, err
+			}
+			changes = append(changes, "created index "+index.Name+" on "+spec.Name)
+		}
+	}
+
+	if spec.TTLAttribute == "" {
+		return changes, nil
+	}
+	ttl, err := svc.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(spec.Name)})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Got error calling DescribeTimeToLive: %s", err))
+	}
+	if ttl.TimeToLiveDescription != nil && aws.ToString(ttl.TimeToLiveDescription.AttributeName) == spec.TTLAttribute &&
+		ttl.TimeToLiveDescription.TimeToLiveStatus != types.TimeToLiveStatusDisabled {
+		return changes, nil
+	}
+	if !create {
+		return nil, errors.New(fmt.Sprintf("Table %s has no time to live on %s", spec.Name, spec.TTLAttribute))
+	}
+	_, err = svc.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(spec.Name),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String(spec.TTLAttribute),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not enable time to live on %s, %v", spec.Name, err))
+	}
+	return append(changes, "enabled time to live on "+spec.Name+"."+spec.TTLAttribute), nil
+}
+
+func createTable(ctx context.Context, svc *dynamodb.Client, spec TableSpec) error {
+	input := &dynamodb.CreateTableInput{
+		TableName:            aws.String(spec.Name),
+		AttributeDefinitions: attributeDefinitions(spec),
+		KeySchema:            keySchema(spec.PartitionKey, spec.SortKey),
+		BillingMode:          types.BillingModePayPerRequest,
+	}
+	if spec.StreamViewType != "" {
+		input.StreamSpecification = &types.StreamSpecification{StreamEnabled: aws.Bool(true), StreamViewType: spec.StreamViewType}
+	}
+	for _, index := range spec.Indexes {
+		input.GlobalSecondaryIndexes = append(input.GlobalSecondaryIndexes, types.GlobalSecondaryIndex{
+			IndexName:  aws.String(index.Name),
+			KeySchema:  keySchema(index.PartitionKey, index.SortKey),
+			Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+		})
+	}
+	if _, err := svc.CreateTable(ctx, input); err != nil {
+		return errors.New(fmt.Sprintf("Could not create table %s, %v", spec.Name, err))
+	}
+	return waitForTable(ctx, svc, spec.Name)
+}
+
+func waitForTable(ctx context.Context, svc *dynamodb.Client, tableName string) error {
+	err := dynamodb.NewTableExistsWaiter(svc).Wait(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(tableName)}, 5*time.Minute)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Table %s did not become active, %v", tableName, err))
+	}
+	return nil
+}
+
+func keySchema(partitionKey KeyAttribute, sortKey *KeyAttribute) []types.KeySchemaElement {
+	schema := []types.KeySchemaElement{{AttributeName: aws.String(partitionKey.Name), KeyType: types.KeyTypeHash}}
+	if sortKey != nil {
+		schema = append(schema, types.KeySchemaElement{AttributeName: aws.String(sortKey.Name), KeyType: types.KeyTypeRange})
+	}
+	return schema
+}
+
+// attributeDefinitions declares every key attribute of the table and of its
+// indexes, once each.
+func attributeDefinitions(spec TableSpec) []types.AttributeDefinition {
+	keys := []KeyAttribute{}
+	if spec.PartitionKey.Name != "" {
+		keys = append(keys, spec.PartitionKey)
+	}
+	if spec.SortKey != nil {
+		keys = append(keys, *spec.SortKey)
+	}
+	for _, index := range spec.Indexes {
+		keys = append(keys, index.PartitionKey)
+		if index.SortKey != nil {
+			keys = append(keys, *index.SortKey)
+		}
+	}
+	definitions := []types.AttributeDefinition{}
+	declared := map[string]struct{}{}
+	for _, key := range keys {
+		if _, exists := declared[key.Name]; exists {
+			continue
+		}
+		declared[key.Name] = struct{}{}
+		definitions = append(definitions, types.AttributeDefinition{AttributeName: aws.String(key.Name), AttributeType: key.Type})
+	}
+	return definitions
+}
+
+func verifyKeys(name string, schema []types.KeySchemaElement, definitions []types.AttributeDefinition, partitionKey KeyAttribute, sortKey *KeyAttribute) error {
+	expected := keySchema(partitionKey, sortKey)
+	mismatch := errors.New(fmt.Sprintf("%s does not have the expected keys %s", name, describeKeys(partitionKey, sortKey)))
+	if len(schema) != len(expected) {
+		return mismatch
+	}
+	attributeTypes := map[string]types.ScalarAttributeType{}
+	for _, definition := range definitions {
+		attributeTypes[aws.ToString(definition.AttributeName)] = definition.AttributeType
+	}
+	keys := []KeyAttribute{partitionKey}
+	if sortKey != nil {
+		keys = append(keys, *sortKey)
+	}
+	for i, element := range schema {
+		if aws.ToString(element.AttributeName) != keys[i].Name || element.KeyType != expected[i].KeyType || attributeTypes[keys[i].Name] != keys[i].Type {
+			return mismatch
+		}
+	}
+	return nil
+}
+
+func describeKeys(partitionKey KeyAttribute, sortKey *KeyAttribute) string {
+	if sortKey == nil {
+		return fmt.Sprintf("(%s %s)", partitionKey.Name, partitionKey.Type)
+	}
+	return fmt.Sprintf("(%s %s, %s %s)", partitionKey.Name, partitionKey.Type, sortKey.Name, sortKey.Type)
+}
+
+// Seed writes the users, groups and policies of a policy file, in the format
+// the FilePolicyStore reads, but never overwrites one that already exists.
+// It returns the names of those it wrote.
+func (s DynamoPolicyStore) Seed(ctx context.Context, path string) ([]string, error) {
+	file, err := ReadPolicyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	type seedItem struct {
+		tableName string
+		key       string
+		label     string
+		document  interface{}
+	}
+	items := []seedItem{}
+	now := int(time.Now().Unix())
+	for _, policy := range file.Policies {
+		if policy.Created_at == 0 {
+			policy.Created_at, policy.Updated_at = now, now
+		}
+		items = append(items, seedItem{s.AccessPoliciesTableName, "name", "policy " + policy.Name, policy})
+	}
+	for _, group := range file.Groups {
+		items = append(items, seedItem{s.PolicyGroupsTableName, "name", "group " + group.Name, group})
+	}
+	for _, user := range file.Users {
+		items = append(items, seedItem{s.UserAccessPoliciesTableName, "user_id", "user " + user.UserId, user})
+	}
+	seeded := []string{}
+	for _, item := range items {
+		av, err := attributevalue.MarshalMap(item.document)
+		if err != nil {
+			return seeded, errors.New(fmt.Sprintf("Failed to marshal %s, %v", item.label, err))
+		}
+		_, err = s.Svc.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:                aws.String(item.tableName),
+			Item:                     av,
+			ConditionExpression:      aws.String("attribute_not_exists(#k)"),
+			ExpressionAttributeNames: map[string]string{"#k": item.key},
+		})
+		var exists *types.ConditionalCheckFailedException
+		if errors.As(err, &exists) {
+			continue
+		}
+		if err != nil {
+			return seeded, errors.New(fmt.Sprintf("Could not seed %s, %v", item.label, err))
+		}
+		seeded = append(seeded, item.label)
+	}
+	return seeded, nil
+}
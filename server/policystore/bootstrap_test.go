@@ -0,0 +1,92 @@
+package policystore
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestVerifyKeys(t *testing.T) {
+
+	Convey("verifyKeys", t, func() {
+		name := KeyAttribute{Name: "name", Type: types.ScalarAttributeTypeS}
+		version := KeyAttribute{Name: "version", Type: types.ScalarAttributeTypeN}
+		spec := TableSpec{PartitionKey: name, SortKey: &version}
+		schema := keySchema(name, &version)
+		definitions := attributeDefinitions(spec)
+
+		Convey("accepts the keys of the spec", func() {
+			So(verifyKeys("versions", schema, definitions, name, &version), ShouldBeNil)
+		})
+
+		Convey("refuses a missing sort key", func() {
+			So(verifyKeys("versions", keySchema(name, nil), definitions, name, &version), ShouldNotBeNil)
+		})
+
+		Convey("refuses a key of another type", func() {
+			So(verifyKeys("versions", schema, definitions, name, &KeyAttribute{Name: "version", Type: types.ScalarAttributeTypeS}), ShouldNotBeNil)
+		})
+
+		Convey("declares attributes shared with an index once", func() {
+			spec.Indexes = []IndexSpec{{Name: "by-version", PartitionKey: version, SortKey: &name}}
+			So(len(attributeDefinitions(spec)), ShouldEqual, 2)
+		})
+	})
+}
+
+func TestBootstrap(t *testing.T) {
+	svc := localDynamoDB(t)
+
+	Convey("Bootstrapping against DynamoDB Local", t, func() {
+		suffix := strconv.FormatInt(time.Now().UnixNano(), 10)
+		store := DynamoPolicyStore{
+			UserAccessPoliciesTableName:   "user-policies-" + suffix,
+			AccessPoliciesTableName:       "policies-" + suffix,
+			AccessPolicyVersionsTableName: "policy-versions-" + suffix,
+			PolicyGroupsTableName:         "policy-groups-" + suffix,
+			Svc:                           svc,
+		}
+		specs := append(store.TableSpecs(), MigrationsTableSpec("migrations-"+suffix))
+		ctx := context.Background()
+
+		Convey("verifying fails before the tables exist", func() {
+			_, err := EnsureTable(ctx, svc, specs[0], false)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("creates the tables once, seeds and migrates", func() {
+			for _, spec := range specs {
+				changes, err := EnsureTable(ctx, svc, spec, true)
+				So(err, ShouldBeNil)
+				So(changes, ShouldNotBeEmpty)
+				changes, err = EnsureTable(ctx, svc, spec, true)
+				So(err, ShouldBeNil)
+				So(changes, ShouldBeEmpty)
+			}
+			seeded, err := store.Seed(ctx, "../cf/seed-example.yaml")
+			So(err, ShouldBeNil)
+			So(seeded, ShouldResemble, []string{"policy admin", "group admins"})
+			seeded, err = store.Seed(ctx, "../cf/seed-example.yaml")
+			So(err, ShouldBeNil)
+			So(seeded, ShouldBeEmpty)
+
+			version, err := store.Migrate(ctx, "migrations-"+suffix)
+			So(err, ShouldBeNil)
+			So(version, ShouldEqual, len(dynamoMigrations))
+
+			permissions, err := store.GetPermissions(context.Background(), []string{"admin"})
+			So(err, ShouldBeNil)
+			So(permissions, ShouldContainKey, "admin")
+
+			for _, spec := range specs {
+				svc.DeleteTable(ctx, &dynamodb.DeleteTableInput{TableName: aws.String(spec.Name)})
+			}
+		})
+	})
+}
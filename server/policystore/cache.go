@@ -0,0 +1,218 @@
+package policystore
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Invalidation names an item of the store that changed. Only one of its
+// fields is set.
+type Invalidation struct {
+	UserId string
+	Group  string
+	Policy string
+}
+
+// CachingPolicyStore caches the attachments of each user and what they
+// resolve to, for at most TTL. Invalidate drops exactly the users a change
+// can affect: the user, the members of a group, or the users holding a
+// policy, directly, through a group or as a boundary.
+//
+// A lookup that overlaps an invalidation is not cached, as it may have read
+// what the invalidation replaced. Expired entries are dropped when read, and
+// all of them at most once per TTL as entries are added.
+type CachingPolicyStore struct {
+	PolicyStore
+	ttl time.Duration
+	now func() time.Time
+
+	mu          sync.Mutex
+	users       map[string]cachedUserPolicyNames
+	resolutions map[string]cachedResolution
+	groupUsers  map[string]map[string]struct{}
+	policyUsers map[string]map[string]struct{}
+	// generation counts the invalidations
+	generation uint64
+	lastSweep  time.Time
+}
+
+type cachedUserPolicyNames struct {
+	userPolicyNames UserPolicyNames
+	expiresAt       time.Time
+}
+
+type cachedResolution struct {
+	// inputs are the attachments the resolution was made from, which vary
+	// with time-bound attachments and grants
+	inputs     string
+	resolution Resolution
+	expiresAt  time.Time
+}
+
+func NewCachingPolicyStore(store PolicyStore, ttl time.Duration) *CachingPolicyStore {
+	return &CachingPolicyStore{
+		PolicyStore: store,
+		ttl:         ttl,
+		now:         time.Now,
+		users:       map[string]cachedUserPolicyNames{},
+		resolutions: map[string]cachedResolution{},
+		groupUsers:  map[string]map[string]struct{}{},
+		policyUsers: map[string]map[string]struct{}{},
+	}
+}
+
+func (s *CachingPolicyStore) GetUserPolicyNames(ctx context.Context, userId string) (UserPolicyNames, error) {
+	s.mu.Lock()
+	cached, exists := s.users[userId]
+	if exists && !s.now().Before(cached.expiresAt) {
+		delete(s.users, userId)
+		exists = false
+	}
+	generation := s.generation
+	s.mu.Unlock()
+	if exists {
+		return cached.userPolicyNames, nil
+	}
+	userPolicyNames, err := s.PolicyStore.GetUserPolicyNames(ctx, userId)
+	if err != nil {
+		return UserPolicyNames{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.generation == generation {
+		s.sweep()
+		s.users[userId] = cachedUserPolicyNames{userPolicyNames: userPolicyNames, expiresAt: s.now().Add(s.ttl)}
+	}
+	return userPolicyNames, nil
+}
+
+// ResolveUser is Resolve, cached for the user.
+func (s *CachingPolicyStore) ResolveUser(ctx context.Context, userId string, policyNames, groupNames, boundaryNames []string, maxDepth int) (Resolution, error) {
+	inputs := strings.Join(policyNames, ",") + "|" + strings.Join(groupNames, ",") + "|" + strings.Join(boundaryNames, ",")
+	s.mu.Lock()
+	cached, exists := s.resolutions[userId]
+	if exists && !s.now().Before(cached.expiresAt) {
+		s.dropResolution(userId)
+		exists = false
+	}
+	generation := s.generation
+	s.mu.Unlock()
+	if exists && cached.inputs == inputs {
+		return cached.resolution, nil
+	}
+	resolution, err := Resolve(ctx, s.PolicyStore, policyNames, groupNames, boundaryNames, maxDepth)
+	if err != nil {
+		return Resolution{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.generation != generation {
+		return resolution, nil
+	}
+	s.sweep()
+	s.dropResolution(userId)
+	s.resolutions[userId] = cachedResolution{inputs: inputs, resolution: resolution, expiresAt: s.now().Add(s.ttl)}
+	for _, groupName := range resolution.GroupNames {
+		addToIndex(s.groupUsers, groupName, userId)
+	}
+	for _, policyName := range resolution.PolicyNames {
+		addToIndex(s.policyUsers, policyName, userId)
+	}
+	return resolution, nil
+}
+
+// sweep drops the expired entries, if a TTL has passed since the last sweep.
+// It is called with the lock held.
+func (s *CachingPolicyStore) sweep() {
+	now := s.now()
+	if now.Sub(s.lastSweep) < s.ttl {
+		return
+	}
+	s.lastSweep = now
+	for userId, cached := range s.users {
+		if !now.Before(cached.expiresAt) {
+			delete(s.users, userId)
+		}
+	}
+	for userId, cached := range s.resolutions {
+		if !now.Before(cached.expiresAt) {
+			s.dropResolution(userId)
+		}
+	}
+}
+
+// Invalidate drops what the change can affect and returns the ids of the
+// users it dropped.
+func (s *CachingPolicyStore) Invalidate(invalidation Invalidation) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generation++
+	userIds := []string{}
+	switch {
+	case invalidation.UserId != "":
+		userIds = append(userIds, invalidation.UserId)
+	case invalidation.Group != "":
+		for userId := range s.groupUsers[invalidation.Group] {
+			userIds = append(userIds, userId)
+		}
+	case invalidation.Policy != "":
+		for userId := range s.policyUsers[invalidation.Policy] {
+			userIds = append(userIds, userId)
+		}
+	}
+	for _, userId := range userIds {
+		delete(s.users, userId)
+		s.dropResolution(userId)
+	}
+	return userIds
+}
+
+// InvalidateAll empties the cache, for when changes may have been missed.
+func (s *CachingPolicyStore) InvalidateAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generation++
+	s.users = map[string]cachedUserPolicyNames{}
+	s.resolutions = map[string]cachedResolution{}
+	s.groupUsers = map[string]map[string]struct{}{}
+	s.policyUsers = map[string]map[string]struct{}{}
+}
+
+func (s *CachingPolicyStore) dropResolution(userId string) {
+	cached, exists := s.resolutions[userId]
+	if !exists {
+		return
+	}
+	delete(s.resolutions, userId)
+	for _, groupName := range cached.resolution.GroupNames {
+		removeFromIndex(s.groupUsers, groupName, userId)
+	}
+	for _, policyName := range cached.resolution.PolicyNames {
+		removeFromIndex(s.policyUsers, policyName, userId)
+	}
+}
+
+func addToIndex(index map[string]map[string]struct{}, key, userId string) {
+	if index[key] == nil {
+		index[key] = map[string]struct{}{}
+	}
+	index[key][userId] = struct{}{}
+}
+
+func removeFromIndex(index map[string]map[string]struct{}, key, userId string) {
+	delete(index[key], userId)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
+
+// ResolveUser resolves the attachments of the user through the cache of the
+// store, if it has one.
+func ResolveUser(ctx context.Context, store PolicyStore, userId string, policyNames, groupNames, boundaryNames []string, maxDepth int) (Resolution, error) {
+	if cache, ok := store.(*CachingPolicyStore); ok {
+		return cache.ResolveUser(ctx, userId, policyNames, groupNames, boundaryNames, maxDepth)
+	}
+	return Resolve(ctx, store, policyNames, groupNames, boundaryNames, maxDepth)
+}
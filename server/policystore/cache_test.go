@@ -0,0 +1,111 @@
+package policystore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// countingPolicyStore counts the lookups that reach the store, calling
+// during, if set, on each.
+type countingPolicyStore struct {
+	PolicyStore
+	lookups int
+	during  func()
+}
+
+func (s *countingPolicyStore) GetUserPolicyNames(ctx context.Context, userId string) (UserPolicyNames, error) {
+	s.lookups++
+	if s.during != nil {
+		s.during()
+	}
+	return s.PolicyStore.GetUserPolicyNames(ctx, userId)
+}
+
+func (s *countingPolicyStore) GetPermissions(ctx context.Context, names []string) (map[string]auth.Permission, error) {
+	s.lookups++
+	if s.during != nil {
+		s.during()
+	}
+	return s.PolicyStore.GetPermissions(ctx, names)
+}
+
+func TestCachingPolicyStore(t *testing.T) {
+
+	Convey("CachingPolicyStore", t, func() {
+		memory := NewMemoryPolicyStore()
+		memory.PutPolicyGroups(context.Background(), PolicyGroup{Name: "engineering", PolicyNames: []string{"pong"}})
+		memory.PutPolicies(context.Background(), PermsWithMeta{Name: "ping"}, PermsWithMeta{Name: "pong"})
+		counting := &countingPolicyStore{PolicyStore: memory}
+		cache := NewCachingPolicyStore(counting, time.Minute)
+		now := time.Unix(1000, 0)
+		cache.now = func() time.Time { return now }
+		resolve := func(userId string, policyNames, groupNames []string) Resolution {
+			resolution, err := ResolveUser(context.Background(), cache, userId, policyNames, groupNames, nil, DefaultMaxPolicyGroupDepth)
+			So(err, ShouldBeNil)
+			return resolution
+		}
+		resolve("alice", []string{"ping"}, []string{})
+		resolve("bob", []string{}, []string{"engineering"})
+		lookups := counting.lookups
+
+		Convey("serves repeated resolutions from the cache", func() {
+			resolve("alice", []string{"ping"}, []string{})
+			So(counting.lookups, ShouldEqual, lookups)
+		})
+
+		Convey("resolves again when the attachments differ", func() {
+			resolve("alice", []string{"ping", "pong"}, []string{})
+			So(counting.lookups, ShouldEqual, lookups+1)
+		})
+
+		Convey("resolves again once the TTL has passed", func() {
+			now = now.Add(time.Minute)
+			resolve("alice", []string{"ping"}, []string{})
+			So(counting.lookups, ShouldEqual, lookups+1)
+		})
+
+		Convey("drops expired entries as others are added", func() {
+			now = now.Add(time.Minute)
+			resolve("carol", []string{"ping"}, []string{})
+			So(cache.resolutions, ShouldContainKey, "carol")
+			So(cache.resolutions, ShouldNotContainKey, "bob")
+			So(cache.Invalidate(Invalidation{Group: "engineering"}), ShouldBeEmpty)
+		})
+
+		Convey("does not cache what was looked up while an invalidation was made", func() {
+			counting.during = func() { cache.Invalidate(Invalidation{Policy: "ping"}) }
+			resolve("carol", []string{"ping"}, []string{})
+			_, err := cache.GetUserPolicyNames(context.Background(), "carol")
+			So(err, ShouldBeNil)
+			So(cache.resolutions, ShouldNotContainKey, "carol")
+			So(cache.users, ShouldNotContainKey, "carol")
+
+			counting.during = nil
+			resolve("carol", []string{"ping"}, []string{})
+			So(cache.resolutions, ShouldContainKey, "carol")
+		})
+
+		Convey("invalidates the members of a changed group", func() {
+			So(cache.Invalidate(Invalidation{Group: "engineering"}), ShouldResemble, []string{"bob"})
+		})
+
+		Convey("invalidates the users holding a changed policy, through groups too", func() {
+			So(cache.Invalidate(Invalidation{Policy: "ping"}), ShouldResemble, []string{"alice"})
+			So(cache.Invalidate(Invalidation{Policy: "pong"}), ShouldResemble, []string{"bob"})
+			So(cache.Invalidate(Invalidation{Policy: "ping"}), ShouldBeEmpty)
+		})
+
+		Convey("invalidates a changed user", func() {
+			_, err := cache.GetUserPolicyNames(context.Background(), "alice")
+			So(err, ShouldBeNil)
+			cache.Invalidate(Invalidation{UserId: "alice"})
+			_, err = cache.GetUserPolicyNames(context.Background(), "alice")
+			So(err, ShouldBeNil)
+			So(counting.lookups, ShouldEqual, lookups+2)
+		})
+	})
+}
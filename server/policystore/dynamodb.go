@@ -0,0 +1,89 @@
+package policystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+)
+
+// DynamoPolicyStore reads user attachments keyed by user_id, and policy
+// groups, access policies and their versions keyed by name.
+type DynamoPolicyStore struct {
+	UserAccessPoliciesTableName   string
+	AccessPoliciesTableName       string
+	AccessPolicyVersionsTableName string
+	PolicyGroupsTableName         string
+	Svc                           *dynamodb.Client
+}
+
+func (s DynamoPolicyStore) GetUserPolicyNames(ctx context.Context, userId string) (UserPolicyNames, error) {
+	directlyAttachedPoliciesResult, err := s.Svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.UserAccessPoliciesTableName),
+		Key: map[string]types.AttributeValue{
+			"user_id": &types.AttributeValueMemberS{Value: userId},
+		},
+	})
+	if err != nil {
+		return UserPolicyNames{}, errors.New(fmt.Sprintf("Got error calling GetItem: %s", err))
+	}
+	userPolicyNames := UserPolicyNames{}
+	err = attributevalue.UnmarshalMap(directlyAttachedPoliciesResult.Item, &userPolicyNames)
+	if err != nil {
+		return UserPolicyNames{}, errors.New(fmt.Sprintf("Failed to unmarshal Record, %v", err))
+	}
+	return userPolicyNames, nil
+}
+
+func (s DynamoPolicyStore) GetPolicyGroups(ctx context.Context, groupNames []string) ([]PolicyGroup, error) {
+	items, err := batchGetItems(ctx, s.Svc, s.PolicyGroupsTableName, nameKeys(groupNames))
+	if err != nil {
+		return nil, err
+	}
+	policyGroups := []PolicyGroup{}
+	if err = attributevalue.UnmarshalListOfMaps(items, &policyGroups); err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to unmarshal policy groups, %v", err))
+	}
+	return policyGroups, nil
+}
+
+func (s DynamoPolicyStore) GetPermissions(ctx context.Context, policyNames []string) (map[string]auth.Permission, error) {
+	items, err := batchGetItems(ctx, s.Svc, s.AccessPoliciesTableName, nameKeys(policyNames))
+	if err != nil {
+		return nil, err
+	}
+	policies := []PermsWithMeta{}
+	if err = attributevalue.UnmarshalListOfMaps(items, &policies); err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to unmarshal access policies, %v", err))
+	}
+
+	permissionsByName := map[string]auth.Permission{}
+	defaultVersionKeys := []map[string]types.AttributeValue{}
+	for _, policy := range policies {
+		// Versioned policies are resolved to their default version below
+		if policy.DefaultVersion > 0 {
+			defaultVersionKeys = append(defaultVersionKeys, PolicyVersionKey(policy.Name, policy.DefaultVersion))
+			continue
+		}
+		permissionsByName[policy.Name] = policy.Permissions
+	}
+
+	items, err = batchGetItems(ctx, s.Svc, s.AccessPolicyVersionsTableName, defaultVersionKeys)
+	if err != nil {
+		return nil, err
+	}
+	policyVersions := []PolicyVersion{}
+	if err = attributevalue.UnmarshalListOfMaps(items, &policyVersions); err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to unmarshal policy versions, %v", err))
+	}
+	for _, policyVersion := range policyVersions {
+		permissionsByName[policyVersion.Name] = policyVersion.Permissions
+	}
+	return permissionsByName, nil
+}
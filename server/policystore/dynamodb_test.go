@@ -0,0 +1,108 @@
+package policystore
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// localDynamoDB connects to DynamoDB Local, e.g.
+//
+//	docker run -p 8000:8000 amazon/dynamodb-local
+//	DYNAMODB_LOCAL_ENDPOINT=http://localhost:8000 go test ./policystore/
+func localDynamoDB(t *testing.T) *dynamodb.Client {
+	endpoint := os.Getenv("DYNAMODB_LOCAL_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("DYNAMODB_LOCAL_ENDPOINT is not set")
+	}
+	return dynamodb.New(dynamodb.Options{
+		Region:           "us-east-1",
+		EndpointResolver: dynamodb.EndpointResolverFromURL(endpoint),
+		Credentials:      localCredentials,
+	})
+}
+
+var localCredentials = aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+	return aws.Credentials{AccessKeyID: "local", SecretAccessKey: "local"}, nil
+})
+
+func createLocalTable(svc *dynamodb.Client, tableName string, keys ...string) error {
+	attributes := []types.AttributeDefinition{}
+	schema := []types.KeySchemaElement{}
+	for i, key := range keys {
+		keyType, attributeType := types.KeyTypeHash, types.ScalarAttributeTypeS
+		if i > 0 {
+			keyType, attributeType = types.KeyTypeRange, types.ScalarAttributeTypeN
+		}
+		attributes = append(attributes, types.AttributeDefinition{AttributeName: aws.String(key), AttributeType: attributeType})
+		schema = append(schema, types.KeySchemaElement{AttributeName: aws.String(key), KeyType: keyType})
+	}
+	_, err := svc.CreateTable(context.Background(), &dynamodb.CreateTableInput{
+		TableName:            aws.String(tableName),
+		AttributeDefinitions: attributes,
+		KeySchema:            schema,
+		BillingMode:          types.BillingModePayPerRequest,
+	})
+	return err
+}
+
+func TestDynamoPolicyStore(t *testing.T) {
+	svc := localDynamoDB(t)
+
+	Convey("DynamoPolicyStore against DynamoDB Local", t, func() {
+		suffix := strconv.FormatInt(time.Now().UnixNano(), 10)
+		store := DynamoPolicyStore{
+			UserAccessPoliciesTableName:   "user-policies-" + suffix,
+			AccessPoliciesTableName:       "policies-" + suffix,
+			AccessPolicyVersionsTableName: "policy-versions-" + suffix,
+			PolicyGroupsTableName:         "policy-groups-" + suffix,
+			Svc:                           svc,
+		}
+		So(createLocalTable(svc, store.UserAccessPoliciesTableName, "user_id"), ShouldBeNil)
+		So(createLocalTable(svc, store.AccessPoliciesTableName, "name"), ShouldBeNil)
+		So(createLocalTable(svc, store.AccessPolicyVersionsTableName, "name", "version"), ShouldBeNil)
+		So(createLocalTable(svc, store.PolicyGroupsTableName, "name"), ShouldBeNil)
+		defer func() {
+			for _, tableName := range []string{store.UserAccessPoliciesTableName, store.AccessPoliciesTableName, store.AccessPolicyVersionsTableName, store.PolicyGroupsTableName} {
+				svc.DeleteTable(context.Background(), &dynamodb.DeleteTableInput{TableName: aws.String(tableName)})
+			}
+		}()
+
+		names := []string{}
+		for i := 0; i < 250; i++ {
+			name := "policy-" + strconv.Itoa(i)
+			names = append(names, name)
+			item, err := attributevalue.MarshalMap(PermsWithMeta{Name: name, Permissions: auth.Permission{Allows: []auth.Statement{{Actions: []string{"^/" + name + "$"}}}}})
+			So(err, ShouldBeNil)
+			_, err = svc.PutItem(context.Background(), &dynamodb.PutItemInput{TableName: aws.String(store.AccessPoliciesTableName), Item: item})
+			So(err, ShouldBeNil)
+		}
+
+		Convey("reads more than 100 policies", func() {
+			permissions, err := store.GetPermissions(context.Background(), append(names, "missing"))
+			So(err, ShouldBeNil)
+			So(len(permissions), ShouldEqual, 250)
+		})
+
+		Convey("resolves a user without groups or policies", func() {
+			resolution, err := Resolve(context.Background(), store, nil, nil, nil, DefaultMaxPolicyGroupDepth)
+			So(err, ShouldBeNil)
+			So(resolution.Permissions, ShouldBeEmpty)
+		})
+
+		Convey("reads no groups for no names", func() {
+			groups, err := store.GetPolicyGroups(context.Background(), []string{})
+			So(err, ShouldBeNil)
+			So(groups, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,256 @@
+package policystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func (s DynamoPolicyStore) GetPolicy(ctx context.Context, name string) (PermsWithMeta, error) {
+	result, err := s.Svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.AccessPoliciesTableName),
+		Key:       nameKeys([]string{name})[0],
+	})
+	if err != nil {
+		return PermsWithMeta{}, errors.New(fmt.Sprintf("Got error calling GetItem: %s", err))
+	}
+	if result.Item == nil {
+		return PermsWithMeta{}, ErrNotFound
+	}
+	policy := PermsWithMeta{}
+	if err = attributevalue.UnmarshalMap(result.Item, &policy); err != nil {
+		return PermsWithMeta{}, errors.New(fmt.Sprintf("Failed to unmarshal access policy, %v", err))
+	}
+	return policy, nil
+}
+
+// The List methods scan the tables, since a list attribute cannot be
+// indexed. Items come in the order of the scan rather than sorted, and the
+// cursor is the key of the last item of the page.
+
+func (s DynamoPolicyStore) ListPolicies(ctx context.Context, options ListOptions) ([]PermsWithMeta, string, error) {
+	policies := []PermsWithMeta{}
+	next, err := s.scanPage(ctx, s.AccessPoliciesTableName, "name", options, func(item map[string]types.AttributeValue) (bool, error) {
+		policy := PermsWithMeta{}
+		if err := attributevalue.UnmarshalMap(item, &policy); err != nil {
+			return false, errors.New(fmt.Sprintf("Failed to unmarshal access policy, %v", err))
+		}
+		policies = append(policies, policy)
+		return true, nil
+	})
+	return policies, next, err
+}
+
+func (s DynamoPolicyStore) ListPolicyGroups(ctx context.Context, options ListOptions) ([]PolicyGroup, string, error) {
+	groups := []PolicyGroup{}
+	next, err := s.scanPage(ctx, s.PolicyGroupsTableName, "name", options, func(item map[string]types.AttributeValue) (bool, error) {
+		group := PolicyGroup{}
+		if err := attributevalue.UnmarshalMap(item, &group); err != nil {
+			return false, errors.New(fmt.Sprintf("Failed to unmarshal policy group, %v", err))
+		}
+		if !attachedTo(options, group.PolicyNames, group.PolicyGroups, nil, nil) {
+			return false, nil
+		}
+		groups = append(groups, group)
+		return true, nil
+	})
+	return groups, next, err
+}
+
+func (s DynamoPolicyStore) ListUsers(ctx context.Context, options ListOptions) ([]UserPolicyNames, string, error) {
+	users := []UserPolicyNames{}
+	next, err := s.scanPage(ctx, s.UserAccessPoliciesTableName, "user_id", options, func(item map[string]types.AttributeValue) (bool, error) {
+		user := UserPolicyNames{}
+		if err := attributevalue.UnmarshalMap(item, &user); err != nil {
+			return false, errors.New(fmt.Sprintf("Failed to unmarshal user attachments, %v", err))
+		}
+		if !attachedTo(options, user.PolicyNames, user.PolicyGroups, user.TimeBoundPolicies, user.TimeBoundPolicyGroups) {
+			return false, nil
+		}
+		users = append(users, user)
+		return true, nil
+	})
+	return users, next, err
+}
+
+// scanPage scans the table from the cursor for the items with the prefix,
+// passing each to add until a page has been added. add tells whether it kept
+// the item. It returns the cursor of the next page.
+func (s DynamoPolicyStore) scanPage(ctx context.Context, tableName, key string, options ListOptions, add func(item map[string]types.AttributeValue) (bool, error)) (string, error) {
+	input := &dynamodb.ScanInput{TableName: aws.String(tableName)}
+	if options.Prefix != "" {
+		input.FilterExpression = aws.String("begins_with(#k, :prefix)")
+		input.ExpressionAttributeNames = map[string]string{"#k": key}
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{":prefix": &types.AttributeValueMemberS{Value: options.Prefix}}
+	}
+	if options.Cursor != "" {
+		input.ExclusiveStartKey = map[string]types.AttributeValue{key: &types.AttributeValueMemberS{Value: options.Cursor}}
+	}
+	added := 0
+	last := ""
+	paginator := dynamodb.NewScanPaginator(s.Svc, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Got error calling Scan: %s", err))
+		}
+		for _, item := range page.Items {
+			if added == options.PageLimit() {
+				return last, nil
+			}
+			kept, err := add(item)
+			if err != nil {
+				return "", err
+			}
+			if kept {
+				added++
+				last = stringValue(item[key])
+			}
+		}
+		// The page may be full with no item left, but it is only known to be
+		// the last one when the scan is done
+		if added == options.PageLimit() && page.LastEvaluatedKey != nil {
+			return last, nil
+		}
+	}
+	return "", nil
+}
+
+func stringValue(av types.AttributeValue) string {
+	if s, ok := av.(*types.AttributeValueMemberS); ok {
+		return s.Value
+	}
+	return ""
+}
+
+func (s DynamoPolicyStore) PutPolicies(ctx context.Context, policies ...PermsWithMeta) error {
+	for _, policy := range policies {
+		expected := policy.Revision
+		policy.Revision++
+		if err := s.putRevision(ctx, s.AccessPoliciesTableName, "name", "access policy", policy.Name, expected, policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s DynamoPolicyStore) PutPolicyGroups(ctx context.Context, groups ...PolicyGroup) error {
+	for _, group := range groups {
+		expected := group.Revision
+		group.Revision++
+		if err := s.putRevision(ctx, s.PolicyGroupsTableName, "name", "policy group", group.Name, expected, group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s DynamoPolicyStore) PutUserPolicyNames(ctx context.Context, users ...UserPolicyNames) error {
+	for _, user := range users {
+		expected := user.Revision
+		user.Revision++
+		if err := s.putRevision(ctx, s.UserAccessPoliciesTableName, "user_id", "user", user.UserId, expected, user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putRevision writes the document if the item is still at the expected
+// revision.
+func (s DynamoPolicyStore) putRevision(ctx context.Context, tableName, key, kind, name string, expected int, document interface{}) error {
+	item, err := attributevalue.MarshalMap(document)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to marshal %s %s, %v", kind, name, err))
+	}
+	_, err = s.Svc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                 aws.String(tableName),
+		Item:                      item,
+		ConditionExpression:       aws.String(revisionCondition(expected)),
+		ExpressionAttributeNames:  map[string]string{"#r": "revision"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":expected": &types.AttributeValueMemberN{Value: strconv.Itoa(expected)}},
+	})
+	var conflict *types.ConditionalCheckFailedException
+	if errors.As(err, &conflict) {
+		current, err := s.currentRevision(ctx, tableName, key, name)
+		if err != nil {
+			return err
+		}
+		return ConflictError{Kind: kind, Name: name, Expected: expected, Current: current}
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Could not write %s %s, %v", kind, name, err))
+	}
+	return nil
+}
+
+// revisionCondition holds for an item at the expected revision. Items
+// written before revisions were introduced have none, which counts as 0.
+func revisionCondition(expected int) string {
+	if expected == 0 {
+		return "attribute_not_exists(#r) OR #r = :expected"
+	}
+	return "#r = :expected"
+}
+
+func (s DynamoPolicyStore) currentRevision(ctx context.Context, tableName, key, name string) (int, error) {
+	result, err := s.Svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:                aws.String(tableName),
+		Key:                      map[string]types.AttributeValue{key: &types.AttributeValueMemberS{Value: name}},
+		ProjectionExpression:     aws.String("#r"),
+		ExpressionAttributeNames: map[string]string{"#r": "revision"},
+		ConsistentRead:           aws.Bool(true),
+	})
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Got error calling GetItem: %s", err))
+	}
+	current := struct {
+		Revision int `dynamodbav:"revision"`
+	}{}
+	if err = attributevalue.UnmarshalMap(result.Item, &current); err != nil {
+		return 0, errors.New(fmt.Sprintf("Failed to unmarshal revision, %v", err))
+	}
+	return current.Revision, nil
+}
+
+func (s DynamoPolicyStore) DeletePolicy(ctx context.Context, name string, revision int) error {
+	return s.deleteRevision(ctx, s.AccessPoliciesTableName, "name", "access policy", name, revision)
+}
+
+func (s DynamoPolicyStore) DeletePolicyGroup(ctx context.Context, name string, revision int) error {
+	return s.deleteRevision(ctx, s.PolicyGroupsTableName, "name", "policy group", name, revision)
+}
+
+func (s DynamoPolicyStore) DeleteUserPolicyNames(ctx context.Context, userId string, revision int) error {
+	return s.deleteRevision(ctx, s.UserAccessPoliciesTableName, "user_id", "user", userId, revision)
+}
+
+// deleteRevision deletes the item if it is still at the revision. A missing
+// item passes the condition at revision 0, and deleting it changes nothing.
+func (s DynamoPolicyStore) deleteRevision(ctx context.Context, tableName, key, kind, name string, revision int) error {
+	_, err := s.Svc.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       map[string]types.AttributeValue{key: &types.AttributeValueMemberS{Value: name}},
+		ConditionExpression:       aws.String(revisionCondition(revision)),
+		ExpressionAttributeNames:  map[string]string{"#r": "revision"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":expected": &types.AttributeValueMemberN{Value: strconv.Itoa(revision)}},
+	})
+	var conflict *types.ConditionalCheckFailedException
+	if errors.As(err, &conflict) {
+		current, err := s.currentRevision(ctx, tableName, key, name)
+		if err != nil {
+			return err
+		}
+		return ConflictError{Kind: kind, Name: name, Expected: revision, Current: current}
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Got error calling DeleteItem: %s", err))
+	}
+	return nil
+}
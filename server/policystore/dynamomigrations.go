@@ -0,0 +1,110 @@
+package policystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+type dynamoMigration struct {
+	Description string
+	Apply       func(ctx context.Context, s DynamoPolicyStore) error
+}
+
+// dynamoMigrations rewrite the items of the store when the format of its
+// documents evolves. They are applied in order and the version of each one
+// applied is recorded in the migrations table. A migration may be
+// interrupted and run again, so it must be idempotent. Never edit a
+// migration once released; append a new one instead.
+var dynamoMigrations = []dynamoMigration{
+	{
+		Description: "Backfill Created_at and Updated_at of access policies",
+		Apply:       backfillPolicyTimestamps,
+	},
+}
+
+// MigrationsTableSpec is the table that records the data migrations applied.
+func MigrationsTableSpec(tableName string) TableSpec {
+	return TableSpec{Name: tableName, PartitionKey: KeyAttribute{Name: "version", Type: types.ScalarAttributeTypeN}}
+}
+
+type appliedMigration struct {
+	Version     int    `dynamodbav:"version"`
+	Description string `dynamodbav:"description"`
+	AppliedAt   int64  `dynamodbav:"applied_at"`
+}
+
+// Migrate applies the data migrations not recorded in the migrations table
+// yet and returns the version the data is at.
+func (s DynamoPolicyStore) Migrate(ctx context.Context, migrationsTableName string) (int, error) {
+	result, err := s.Svc.Scan(ctx, &dynamodb.ScanInput{TableName: aws.String(migrationsTableName)})
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Got error calling Scan: %s", err))
+	}
+	applied := []appliedMigration{}
+	if err = attributevalue.UnmarshalListOfMaps(result.Items, &applied); err != nil {
+		return 0, errors.New(fmt.Sprintf("Failed to unmarshal applied migrations, %v", err))
+	}
+	version := 0
+	for _, migration := range applied {
+		if migration.Version > version {
+			version = migration.Version
+		}
+	}
+	if version > len(dynamoMigrations) {
+		return version, errors.New(fmt.Sprintf("Data version %d is newer than this server, which knows %d", version, len(dynamoMigrations)))
+	}
+	for ; version < len(dynamoMigrations); version++ {
+		migration := dynamoMigrations[version]
+		if err = migration.Apply(ctx, s); err != nil {
+			return version, errors.New(fmt.Sprintf("Migration %d (%s) failed, %v", version+1, migration.Description, err))
+		}
+		item, err := attributevalue.MarshalMap(appliedMigration{Version: version + 1, Description: migration.Description, AppliedAt: time.Now().Unix()})
+		if err != nil {
+			return version, err
+		}
+		_, err = s.Svc.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(migrationsTableName), Item: item})
+		if err != nil {
+			return version, errors.New(fmt.Sprintf("Could not record migration %d, %v", version+1, err))
+		}
+	}
+	return version, nil
+}
+
+func backfillPolicyTimestamps(ctx context.Context, s DynamoPolicyStore) error {
+	now := &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)}
+	paginator := dynamodb.NewScanPaginator(s.Svc, &dynamodb.ScanInput{
+		TableName:                aws.String(s.AccessPoliciesTableName),
+		FilterExpression:         aws.String("attribute_not_exists(Created_at) OR attribute_not_exists(Updated_at)"),
+		ProjectionExpression:     aws.String("#n"),
+		ExpressionAttributeNames: map[string]string{"#n": "name"},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Got error calling Scan: %s", err))
+		}
+		for _, key := range page.Items {
+			_, err = s.Svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+				TableName:                 aws.String(s.AccessPoliciesTableName),
+				Key:                       key,
+				UpdateExpression:          aws.String("SET Created_at = if_not_exists(Created_at, :now), Updated_at = if_not_exists(Updated_at, :now)"),
+				ConditionExpression:       aws.String("attribute_exists(#n)"),
+				ExpressionAttributeNames:  map[string]string{"#n": "name"},
+				ExpressionAttributeValues: map[string]types.AttributeValue{":now": now},
+			})
+			var deleted *types.ConditionalCheckFailedException
+			if err != nil && !errors.As(err, &deleted) {
+				return errors.New(fmt.Sprintf("Got error calling UpdateItem: %s", err))
+			}
+		}
+	}
+	return nil
+}
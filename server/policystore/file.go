@@ -0,0 +1,158 @@
+package policystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/ghodss/yaml"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+)
+
+// PolicyFile is the shape of each YAML or JSON file in a policy directory,
+// and of the files the admin tool applies. Its documents use the same
+// attribute names as the DynamoDB items.
+type PolicyFile struct {
+	Users    []UserPolicyNames `json:"users"`
+	Groups   []PolicyGroup     `json:"groups"`
+	Policies []PermsWithMeta   `json:"policies"`
+}
+
+// FilePolicyStore reads users, groups and access policies from the files in
+// a directory, for local development and for keeping policies in git.
+type FilePolicyStore struct {
+	dir       string
+	mu        sync.RWMutex
+	documents *MemoryPolicyStore
+}
+
+func NewFilePolicyStore(dir string) (*FilePolicyStore, error) {
+	s := &FilePolicyStore{dir: dir}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the directory again. The documents in use are only replaced
+// if every file could be read.
+func (s *FilePolicyStore) Reload() error {
+	documents, err := readPolicyFiles(s.dir)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.documents = documents
+	s.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the documents whenever a file in the directory changes,
+// until the context is done.
+func (s *FilePolicyStore) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err = watcher.Add(s.dir); err != nil {
+		watcher.Close()
+		return err
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-watcher.Events:
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+					continue
+				}
+				if err := s.Reload(); err != nil {
+					log.Println("Keeping previous policy files", err)
+					continue
+				}
+				log.Println("Reloaded policy files from", s.dir)
+			case err := <-watcher.Errors:
+				log.Println("Policy file watcher error", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *FilePolicyStore) current() *MemoryPolicyStore {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.documents
+}
+
+func (s *FilePolicyStore) GetUserPolicyNames(ctx context.Context, userId string) (UserPolicyNames, error) {
+	return s.current().GetUserPolicyNames(ctx, userId)
+}
+
+func (s *FilePolicyStore) GetPolicyGroups(ctx context.Context, names []string) ([]PolicyGroup, error) {
+	return s.current().GetPolicyGroups(ctx, names)
+}
+
+func (s *FilePolicyStore) GetPermissions(ctx context.Context, names []string) (map[string]auth.Permission, error) {
+	return s.current().GetPermissions(ctx, names)
+}
+
+func readPolicyFiles(dir string) (*MemoryPolicyStore, error) {
+	documents := NewMemoryPolicyStore()
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		extension := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (extension != ".yaml" && extension != ".yml" && extension != ".json") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		file, err := ReadPolicyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range file.Users {
+			if _, exists := documents.users[user.UserId]; exists || user.UserId == "" {
+				return nil, errors.New(fmt.Sprintf("Missing or duplicate user_id %q in %s", user.UserId, path))
+			}
+			documents.users[user.UserId] = user
+		}
+		for _, group := range file.Groups {
+			if _, exists := documents.groups[group.Name]; exists || group.Name == "" {
+				return nil, errors.New(fmt.Sprintf("Missing or duplicate group name %q in %s", group.Name, path))
+			}
+			documents.groups[group.Name] = group
+		}
+		for _, policy := range file.Policies {
+			if _, exists := documents.policies[policy.Name]; exists || policy.Name == "" {
+				return nil, errors.New(fmt.Sprintf("Missing or duplicate policy name %q in %s", policy.Name, path))
+			}
+			documents.policies[policy.Name] = policy
+		}
+	}
+	return documents, nil
+}
+
+func ReadPolicyFile(path string) (PolicyFile, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return PolicyFile{}, err
+	}
+	file := PolicyFile{}
+	// YAML is converted to JSON first, so both use the same field names
+	if err = yaml.Unmarshal(bs, &file); err != nil {
+		return PolicyFile{}, errors.New(fmt.Sprintf("Malformed policy file %s, %v", path, err))
+	}
+	return file, nil
+}
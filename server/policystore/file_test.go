@@ -0,0 +1,50 @@
+package policystore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFilePolicyStore(t *testing.T) {
+
+	Convey("FilePolicyStore", t, func() {
+		store, err := NewFilePolicyStore("../policies-example")
+		So(err, ShouldBeNil)
+
+		Convey("resolves a user like any other store", func() {
+			userPolicyNames, err := store.GetUserPolicyNames(context.Background(), "auth0|0123456789")
+			So(err, ShouldBeNil)
+			resolution, err := Resolve(context.Background(), store, userPolicyNames.PolicyNames, userPolicyNames.PolicyGroups, nil, DefaultMaxPolicyGroupDepth)
+			So(err, ShouldBeNil)
+			So(len(resolution.Permissions), ShouldEqual, 3)
+			So(resolution.PolicyPaths["pung"], ShouldResemble, []string{"engineering", "backend"})
+			So(resolution.Permissions[2].Denys[0].Actions, ShouldResemble, []string{"^/pang$"})
+		})
+
+		Convey("gives an unknown user no attachments", func() {
+			userPolicyNames, err := store.GetUserPolicyNames(context.Background(), "nobody")
+			So(err, ShouldBeNil)
+			So(userPolicyNames.PolicyNames, ShouldBeEmpty)
+			So(userPolicyNames.PolicyGroups, ShouldBeEmpty)
+		})
+
+		Convey("keeps the previous documents when a file is malformed", func() {
+			dir, err := ioutil.TempDir("", "policies")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+			So(ioutil.WriteFile(filepath.Join(dir, "a.json"), []byte(`{"policies": [{"name": "ping"}]}`), 0644), ShouldBeNil)
+			store, err := NewFilePolicyStore(dir)
+			So(err, ShouldBeNil)
+			So(ioutil.WriteFile(filepath.Join(dir, "b.yaml"), []byte("policies:\n  - name: ping\n"), 0644), ShouldBeNil)
+			So(store.Reload(), ShouldNotBeNil)
+			permissions, err := store.GetPermissions(context.Background(), []string{"ping"})
+			So(err, ShouldBeNil)
+			So(permissions, ShouldContainKey, "ping")
+		})
+	})
+}
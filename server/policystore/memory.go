@@ -0,0 +1,232 @@
+package policystore
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+)
+
+// MemoryPolicyStore keeps users, groups and policies in memory, for tests and
+// for services that load their policies some other way.
+type MemoryPolicyStore struct {
+	mu       sync.RWMutex
+	users    map[string]UserPolicyNames
+	groups   map[string]PolicyGroup
+	policies map[string]PermsWithMeta
+}
+
+func NewMemoryPolicyStore() *MemoryPolicyStore {
+	return &MemoryPolicyStore{
+		users:    map[string]UserPolicyNames{},
+		groups:   map[string]PolicyGroup{},
+		policies: map[string]PermsWithMeta{},
+	}
+}
+
+func (s *MemoryPolicyStore) PutUserPolicyNames(ctx context.Context, users ...UserPolicyNames) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, user := range users {
+		if current := s.users[user.UserId].Revision; current != user.Revision {
+			return ConflictError{Kind: "user", Name: user.UserId, Expected: user.Revision, Current: current}
+		}
+	}
+	for _, user := range users {
+		user.Revision++
+		s.users[user.UserId] = user
+	}
+	return nil
+}
+
+func (s *MemoryPolicyStore) PutPolicyGroups(ctx context.Context, groups ...PolicyGroup) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, group := range groups {
+		if current := s.groups[group.Name].Revision; current != group.Revision {
+			return ConflictError{Kind: "policy group", Name: group.Name, Expected: group.Revision, Current: current}
+		}
+	}
+	for _, group := range groups {
+		group.Revision++
+		s.groups[group.Name] = group
+	}
+	return nil
+}
+
+func (s *MemoryPolicyStore) PutPolicies(ctx context.Context, policies ...PermsWithMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, policy := range policies {
+		if current := s.policies[policy.Name].Revision; current != policy.Revision {
+			return ConflictError{Kind: "access policy", Name: policy.Name, Expected: policy.Revision, Current: current}
+		}
+	}
+	for _, policy := range policies {
+		policy.Revision++
+		s.policies[policy.Name] = policy
+	}
+	return nil
+}
+
+func (s *MemoryPolicyStore) GetUserPolicyNames(ctx context.Context, userId string) (UserPolicyNames, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.users[userId], nil
+}
+
+func (s *MemoryPolicyStore) GetPolicyGroups(ctx context.Context, names []string) ([]PolicyGroup, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	policyGroups := []PolicyGroup{}
+	for _, name := range names {
+		if policyGroup, exists := s.groups[name]; exists {
+			policyGroups = append(policyGroups, policyGroup)
+		}
+	}
+	return policyGroups, nil
+}
+
+func (s *MemoryPolicyStore) GetPermissions(ctx context.Context, names []string) (map[string]auth.Permission, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	permissionsByName := map[string]auth.Permission{}
+	for _, name := range names {
+		if policy, exists := s.policies[name]; exists {
+			permissionsByName[name] = policy.Permissions
+		}
+	}
+	return permissionsByName, nil
+}
+
+func (s *MemoryPolicyStore) GetPolicy(ctx context.Context, name string) (PermsWithMeta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	policy, exists := s.policies[name]
+	if !exists {
+		return PermsWithMeta{}, ErrNotFound
+	}
+	return policy, nil
+}
+
+func (s *MemoryPolicyStore) ListPolicies(ctx context.Context, options ListOptions) ([]PermsWithMeta, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	policies := []PermsWithMeta{}
+	all := []string{}
+	for name := range s.policies {
+		all = append(all, name)
+	}
+	names, next := page(all, options, func(name string) bool { return true })
+	for _, name := range names {
+		policies = append(policies, s.policies[name])
+	}
+	return policies, next, nil
+}
+
+func (s *MemoryPolicyStore) ListPolicyGroups(ctx context.Context, options ListOptions) ([]PolicyGroup, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	groups := []PolicyGroup{}
+	all := []string{}
+	for name := range s.groups {
+		all = append(all, name)
+	}
+	names, next := page(all, options, func(name string) bool {
+		return attachedTo(options, s.groups[name].PolicyNames, s.groups[name].PolicyGroups, nil, nil)
+	})
+	for _, name := range names {
+		groups = append(groups, s.groups[name])
+	}
+	return groups, next, nil
+}
+
+func (s *MemoryPolicyStore) ListUsers(ctx context.Context, options ListOptions) ([]UserPolicyNames, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := []UserPolicyNames{}
+	all := []string{}
+	for userId := range s.users {
+		all = append(all, userId)
+	}
+	userIds, next := page(all, options, func(userId string) bool {
+		user := s.users[userId]
+		return attachedTo(options, user.PolicyNames, user.PolicyGroups, user.TimeBoundPolicies, user.TimeBoundPolicyGroups)
+	})
+	for _, userId := range userIds {
+		users = append(users, s.users[userId])
+	}
+	return users, next, nil
+}
+
+func (s *MemoryPolicyStore) DeletePolicy(ctx context.Context, name string, revision int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if current := s.policies[name].Revision; current != revision {
+		return ConflictError{Kind: "access policy", Name: name, Expected: revision, Current: current}
+	}
+	delete(s.policies, name)
+	return nil
+}
+
+func (s *MemoryPolicyStore) DeletePolicyGroup(ctx context.Context, name string, revision int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if current := s.groups[name].Revision; current != revision {
+		return ConflictError{Kind: "policy group", Name: name, Expected: revision, Current: current}
+	}
+	delete(s.groups, name)
+	return nil
+}
+
+func (s *MemoryPolicyStore) DeleteUserPolicyNames(ctx context.Context, userId string, revision int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if current := s.users[userId].Revision; current != revision {
+		return ConflictError{Kind: "user", Name: userId, Expected: revision, Current: current}
+	}
+	delete(s.users, userId)
+	return nil
+}
+
+// page returns the sorted keys after the cursor that match and have the
+// prefix, at most the limit of the options, and the cursor of the next page.
+func page(all []string, options ListOptions, matches func(key string) bool) ([]string, string) {
+	sort.Strings(all)
+	selected := []string{}
+	for _, key := range all {
+		if key <= options.Cursor || !strings.HasPrefix(key, options.Prefix) || !matches(key) {
+			continue
+		}
+		if len(selected) == options.PageLimit() {
+			return selected, selected[len(selected)-1]
+		}
+		selected = append(selected, key)
+	}
+	return selected, ""
+}
+
+// attachedTo tells whether the policy and group of the filter, if any, are
+// among the attachments.
+func attachedTo(options ListOptions, policyNames, groupNames []string, timeBoundPolicies, timeBoundGroups []TimeBoundAttachment) bool {
+	policyNames = append([]string{}, policyNames...)
+	for _, attachment := range timeBoundPolicies {
+		policyNames = append(policyNames, attachment.Name)
+	}
+	groupNames = append([]string{}, groupNames...)
+	for _, attachment := range timeBoundGroups {
+		groupNames = append(groupNames, attachment.Name)
+	}
+	return (options.Policy == "" || contains(policyNames, options.Policy)) && (options.Group == "" || contains(groupNames, options.Group))
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package policystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+)
+
+const DefaultMaxPolicyGroupDepth = 10
+
+// Resolution is what Resolve makes of the attachments of a user.
+type Resolution struct {
+	Permissions []auth.Permission
+	Boundaries  []auth.Permission
+	// PolicyPaths maps each policy reached to the groups it was reached through
+	PolicyPaths map[string][]string
+	// GroupNames and PolicyNames are every group and policy looked up, found
+	// or not, which a change to any of them could alter
+	GroupNames  []string
+	PolicyNames []string
+}
+
+// Resolve follows the policy groups transitively and loads the permissions
+// of every policy reached, and of the permission boundaries given and of
+// those of the groups on the way. A missing boundary must not widen access,
+// so it is an error, while a missing policy grants nothing.
+func Resolve(ctx context.Context, store PolicyStore, policyNames, groupNames, boundaryNames []string, maxDepth int) (Resolution, error) {
+	resolved, err := resolvePolicyGroups(policyNames, groupNames, maxDepth, func(names []string) ([]PolicyGroup, error) {
+		return store.GetPolicyGroups(ctx, names)
+	})
+	if err != nil {
+		return Resolution{}, err
+	}
+	boundaryNames = append(append([]string{}, boundaryNames...), resolved.BoundaryNames...)
+	// Boundaries are ordinary access policies, so fetch them together with
+	// the attached ones
+	names := append([]string{}, boundaryNames...)
+	for policyName := range resolved.PolicyPaths {
+		names = append(names, policyName)
+	}
+	sort.Strings(names)
+	toSet(&names)
+
+	permissionsByName, err := store.GetPermissions(ctx, names)
+	if err != nil {
+		return Resolution{}, err
+	}
+
+	permissions := []auth.Permission{}
+	for _, policyName := range names {
+		if _, attached := resolved.PolicyPaths[policyName]; !attached {
+			continue
+		}
+		if permission, exists := permissionsByName[policyName]; exists {
+			permissions = append(permissions, permission)
+		}
+	}
+	boundaries := []auth.Permission{}
+	for _, boundaryName := range boundaryNames {
+		boundary, exists := permissionsByName[boundaryName]
+		if !exists {
+			return Resolution{}, errors.New(fmt.Sprintf("Permission boundary %s not found", boundaryName))
+		}
+		boundaries = append(boundaries, boundary)
+	}
+	return Resolution{
+		Permissions: permissions,
+		Boundaries:  boundaries,
+		PolicyPaths: resolved.PolicyPaths,
+		GroupNames:  resolved.GroupNames,
+		PolicyNames: names,
+	}, nil
+}
+
+type resolvedPolicies struct {
+	PolicyPaths   map[string][]string
+	BoundaryNames []string
+	GroupNames    []string
+}
+
+// resolvePolicyGroups walks the policy groups of a user transitively, one
+// level per call to fetchGroups, and returns every policy name reachable
+// from the user together with the path of group names through which it was
+// first reached, and the permission boundaries of every group on the way.
+// Directly attached policies have an empty path. A group that contains one
+// of its ancestors, or a chain of groups deeper than maxDepth, is an error.
+func resolvePolicyGroups(policyNames, groupNames []string, maxDepth int, fetchGroups func(names []string) ([]PolicyGroup, error)) (resolvedPolicies, error) {
+	policyPaths := map[string][]string{}
+	boundaryNames := []string{}
+	for _, policyName := range policyNames {
+		policyPaths[policyName] = []string{}
+	}
+
+	groupPaths := map[string][]string{}
+	level := []string{}
+	for _, groupName := range groupNames {
+		if _, exists := groupPaths[groupName]; !exists {
+			groupPaths[groupName] = []string{groupName}
+			level = append(level, groupName)
+		}
+	}
+
+	for depth := 1; len(level) > 0; depth++ {
+		if depth > maxDepth {
+			return resolvedPolicies{}, errors.New(fmt.Sprintf("Policy groups are nested deeper than %d: %s", maxDepth, strings.Join(groupPaths[level[0]], " > ")))
+		}
+		groups, err := fetchGroups(level)
+		if err != nil {
+			return resolvedPolicies{}, err
+		}
+		next := []string{}
+		for _, group := range groups {
+			path := groupPaths[group.Name]
+			if group.PermissionBoundary != "" {
+				boundaryNames = append(boundaryNames, group.PermissionBoundary)
+			}
+			for _, policyName := range group.PolicyNames {
+				if _, exists := policyPaths[policyName]; !exists {
+					policyPaths[policyName] = path
+				}
+			}
+			for _, member := range group.PolicyGroups {
+				for _, ancestor := range path {
+					if ancestor == member {
+						return resolvedPolicies{}, errors.New(fmt.Sprintf("Policy group cycle: %s > %s", strings.Join(path, " > "), member))
+					}
+				}
+				if _, exists := groupPaths[member]; exists {
+					continue
+				}
+				groupPaths[member] = append(append([]string{}, path...), member)
+				next = append(next, member)
+			}
+		}
+		level = next
+	}
+	groupNames = []string{}
+	for groupName := range groupPaths {
+		groupNames = append(groupNames, groupName)
+	}
+	sort.Strings(groupNames)
+	return resolvedPolicies{PolicyPaths: policyPaths, BoundaryNames: boundaryNames, GroupNames: groupNames}, nil
+}
+
+func toSet(slice *[]string) {
+	processed := map[string]struct{}{}
+	w := 0
+	for _, s := range *slice {
+		if _, exists := processed[s]; !exists {
+			// If this city has not been seen yet, add it to the list
+			processed[s] = struct{}{}
+			(*slice)[w] = s
+			w++
+		}
+	}
+	*slice = (*slice)[:w]
+}
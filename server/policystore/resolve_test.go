@@ -0,0 +1,97 @@
+package policystore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func testGroupFetcher(groups ...PolicyGroup) func(names []string) ([]PolicyGroup, error) {
+	return func(names []string) ([]PolicyGroup, error) {
+		found := []PolicyGroup{}
+		for _, name := range names {
+			for _, group := range groups {
+				if group.Name == name {
+					found = append(found, group)
+				}
+			}
+		}
+		return found, nil
+	}
+}
+
+func TestResolvePolicyGroups(t *testing.T) {
+
+	Convey("resolvePolicyGroups", t, func() {
+		engineering := PolicyGroup{Name: "engineering", PolicyNames: []string{"read"}, PolicyGroups: []string{"backend"}}
+		backend := PolicyGroup{Name: "backend", PolicyNames: []string{"deploy"}, PolicyGroups: []string{"payments-oncall"}}
+		paymentsOncall := PolicyGroup{Name: "payments-oncall", PolicyNames: []string{"payments", "read"}}
+
+		Convey("resolves nested groups transitively with the path to each policy", func() {
+			resolved, err := resolvePolicyGroups([]string{"direct"}, []string{"engineering"}, 10, testGroupFetcher(engineering, backend, paymentsOncall))
+			So(err, ShouldBeNil)
+			So(resolved.PolicyPaths, ShouldResemble, map[string][]string{
+				"direct":   {},
+				"read":     {"engineering"},
+				"deploy":   {"engineering", "backend"},
+				"payments": {"engineering", "backend", "payments-oncall"},
+			})
+		})
+
+		Convey("collects the permission boundaries of the groups", func() {
+			backend.PermissionBoundary = "backend-boundary"
+			resolved, err := resolvePolicyGroups([]string{}, []string{"engineering"}, 10, testGroupFetcher(engineering, backend, paymentsOncall))
+			So(err, ShouldBeNil)
+			So(resolved.BoundaryNames, ShouldResemble, []string{"backend-boundary"})
+		})
+
+		Convey("errors when a group contains one of its ancestors", func() {
+			cyclic := PolicyGroup{Name: "payments-oncall", PolicyGroups: []string{"engineering"}}
+			_, err := resolvePolicyGroups([]string{}, []string{"engineering"}, 10, testGroupFetcher(engineering, backend, cyclic))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("errors when groups are nested deeper than the limit", func() {
+			_, err := resolvePolicyGroups([]string{}, []string{"engineering"}, 2, testGroupFetcher(engineering, backend, paymentsOncall))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("does not fetch groups when the user has none", func() {
+			resolved, err := resolvePolicyGroups([]string{"direct"}, []string{}, 10, func(names []string) ([]PolicyGroup, error) {
+				panic("should not fetch")
+			})
+			So(err, ShouldBeNil)
+			So(resolved.PolicyPaths, ShouldResemble, map[string][]string{"direct": {}})
+		})
+	})
+}
+
+func TestResolve(t *testing.T) {
+
+	Convey("Resolve", t, func() {
+		store := NewMemoryPolicyStore()
+		store.PutPolicyGroups(context.Background(),
+			PolicyGroup{Name: "engineering", PolicyNames: []string{"pong"}, PermissionBoundary: "no-pang"},
+		)
+		store.PutPolicies(context.Background(),
+			PermsWithMeta{Name: "ping", Permissions: auth.Permission{Allows: []auth.Statement{{Actions: []string{"^/ping$"}}}}},
+			PermsWithMeta{Name: "pong", Permissions: auth.Permission{Allows: []auth.Statement{{Actions: []string{"^/pong$"}}}}},
+			PermsWithMeta{Name: "no-pang", Permissions: auth.Permission{Allows: []auth.Statement{{Actions: []string{"^/p[io]ng$"}}}}},
+		)
+
+		Convey("loads the permissions of attached policies and boundaries", func() {
+			resolution, err := Resolve(context.Background(), store, []string{"ping", "missing"}, []string{"engineering"}, nil, DefaultMaxPolicyGroupDepth)
+			So(err, ShouldBeNil)
+			So(len(resolution.Permissions), ShouldEqual, 2)
+			So(len(resolution.Boundaries), ShouldEqual, 1)
+			So(resolution.PolicyPaths, ShouldResemble, map[string][]string{"ping": {}, "missing": {}, "pong": {"engineering"}})
+		})
+
+		Convey("errors when a permission boundary does not exist", func() {
+			_, err := Resolve(context.Background(), store, []string{"ping"}, []string{}, []string{"missing"}, DefaultMaxPolicyGroupDepth)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
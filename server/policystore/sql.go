@@ -0,0 +1,365 @@
+package policystore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+)
+
+// Dialect is the name of the database/sql driver a SQLPolicyStore talks to.
+type Dialect string
+
+const (
+	Postgres Dialect = "postgres"
+	SQLite   Dialect = "sqlite3"
+)
+
+func ParseDialect(s string) (Dialect, error) {
+	switch Dialect(s) {
+	case Postgres, SQLite:
+		return Dialect(s), nil
+	}
+	return "", errors.New(fmt.Sprintf("Unknown SQL dialect %s, expected postgres or sqlite3", s))
+}
+
+// SQLPolicyStore keeps users, groups and access policies in a relational
+// database, in the schema created by Migrate. Attachments and group members
+// are rows of their own, and each lookup is a single query that joins them
+// to their user or group.
+type SQLPolicyStore struct {
+	DB      *sql.DB
+	Dialect Dialect
+}
+
+const userAttachmentsQuery = `
+SELECT u.permission_boundary, u.revision, u.scim_profile, a.kind, a.name, a.not_before, a.expires_at
+FROM users u
+LEFT JOIN (
+	SELECT user_id, 'policy' AS kind, policy_name AS name, not_before, expires_at FROM user_policies
+	UNION ALL
+	SELECT user_id, 'group' AS kind, group_name AS name, not_before, expires_at FROM user_policy_groups
+) a ON a.user_id = u.user_id
+WHERE u.user_id = ?
+ORDER BY a.kind, a.name, a.not_before, a.expires_at`
+
+const policyGroupsQuery = `
+SELECT g.name, g.permission_boundary, g.revision, m.kind, m.name
+FROM policy_groups g
+LEFT JOIN (
+	SELECT group_name, 'policy' AS kind, policy_name AS name FROM policy_group_policies
+	UNION ALL
+	SELECT group_name, 'group' AS kind, member_group AS name FROM policy_group_members
+) m ON m.group_name = g.name
+WHERE g.name IN (%s)
+ORDER BY g.name, m.kind, m.name`
+
+const permissionsQuery = `SELECT name, permissions FROM access_policies WHERE name IN (%s)`
+
+func (s SQLPolicyStore) GetUserPolicyNames(ctx context.Context, userId string) (UserPolicyNames, error) {
+	rows, err := s.DB.QueryContext(ctx, s.rebind(userAttachmentsQuery), userId)
+	if err != nil {
+		return UserPolicyNames{}, errors.New(fmt.Sprintf("Got error querying user attachments: %s", err))
+	}
+	defer rows.Close()
+	userPolicyNames := UserPolicyNames{}
+	for rows.Next() {
+		var scimProfile, kind, name sql.NullString
+		var notBefore, expiresAt sql.NullInt64
+		if err = rows.Scan(&userPolicyNames.PermissionBoundary, &userPolicyNames.Revision, &scimProfile, &kind, &name, &notBefore, &expiresAt); err != nil {
+			return UserPolicyNames{}, errors.New(fmt.Sprintf("Failed to scan user attachment, %v", err))
+		}
+		if userPolicyNames.UserId == "" && scimProfile.Valid {
+			userPolicyNames.Scim = &ScimProfile{}
+			if err = json.Unmarshal([]byte(scimProfile.String), userPolicyNames.Scim); err != nil {
+				return UserPolicyNames{}, errors.New(fmt.Sprintf("Malformed SCIM profile of user %s, %v", userId, err))
+			}
+		}
+		userPolicyNames.UserId = userId
+		if !name.Valid {
+			continue
+		}
+		permanent := notBefore.Int64 == 0 && expiresAt.Int64 == 0
+		attachment := TimeBoundAttachment{Name: name.String, NotBefore: notBefore.Int64, ExpiresAt: expiresAt.Int64}
+		switch {
+		case kind.String == "policy" && permanent:
+			userPolicyNames.PolicyNames = append(userPolicyNames.PolicyNames, name.String)
+		case kind.String == "policy":
+			userPolicyNames.TimeBoundPolicies = append(userPolicyNames.TimeBoundPolicies, attachment)
+		case permanent:
+			userPolicyNames.PolicyGroups = append(userPolicyNames.PolicyGroups, name.String)
+		default:
+			userPolicyNames.TimeBoundPolicyGroups = append(userPolicyNames.TimeBoundPolicyGroups, attachment)
+		}
+	}
+	return userPolicyNames, rows.Err()
+}
+
+func (s SQLPolicyStore) GetPolicyGroups(ctx context.Context, names []string) ([]PolicyGroup, error) {
+	policyGroups := []PolicyGroup{}
+	if len(names) == 0 {
+		return policyGroups, nil
+	}
+	rows, err := s.DB.QueryContext(ctx, s.rebind(fmt.Sprintf(policyGroupsQuery, placeholders(len(names)))), stringArgs(names)...)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Got error querying policy groups: %s", err))
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, boundary string
+		var revision int
+		var kind, member sql.NullString
+		if err = rows.Scan(&name, &boundary, &revision, &kind, &member); err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to scan policy group, %v", err))
+		}
+		if len(policyGroups) == 0 || policyGroups[len(policyGroups)-1].Name != name {
+			policyGroups = append(policyGroups, PolicyGroup{Name: name, PermissionBoundary: boundary, Revision: revision})
+		}
+		policyGroup := &policyGroups[len(policyGroups)-1]
+		if !member.Valid {
+			continue
+		}
+		if kind.String == "policy" {
+			policyGroup.PolicyNames = append(policyGroup.PolicyNames, member.String)
+		} else {
+			policyGroup.PolicyGroups = append(policyGroup.PolicyGroups, member.String)
+		}
+	}
+	return policyGroups, rows.Err()
+}
+
+func (s SQLPolicyStore) GetPermissions(ctx context.Context, names []string) (map[string]auth.Permission, error) {
+	permissionsByName := map[string]auth.Permission{}
+	if len(names) == 0 {
+		return permissionsByName, nil
+	}
+	rows, err := s.DB.QueryContext(ctx, s.rebind(fmt.Sprintf(permissionsQuery, placeholders(len(names)))), stringArgs(names)...)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Got error querying access policies: %s", err))
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, document string
+		if err = rows.Scan(&name, &document); err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to scan access policy, %v", err))
+		}
+		permission := auth.Permission{}
+		if err = json.Unmarshal([]byte(document), &permission); err != nil {
+			return nil, errors.New(fmt.Sprintf("Malformed permissions of access policy %s, %v", name, err))
+		}
+		permissionsByName[name] = permission
+	}
+	return permissionsByName, rows.Err()
+}
+
+// PutUserPolicyNames replaces the attachments of each user.
+func (s SQLPolicyStore) PutUserPolicyNames(ctx context.Context, users ...UserPolicyNames) error {
+	return s.inTransaction(ctx, func(tx *sql.Tx) error {
+		for _, user := range users {
+			scimProfile := sql.NullString{}
+			if user.Scim != nil {
+				document, err := json.Marshal(user.Scim)
+				if err != nil {
+					return errors.New(fmt.Sprintf("Failed to marshal SCIM profile of user %s, %v", user.UserId, err))
+				}
+				scimProfile = sql.NullString{String: string(document), Valid: true}
+			}
+			err := s.putRevision(ctx, tx, revisionedRow{
+				table: "users", key: "user_id", kind: "user", name: user.UserId, revision: user.Revision,
+				columns: []string{"permission_boundary", "scim_profile"}, values: []interface{}{user.PermissionBoundary, scimProfile},
+			})
+			if err != nil {
+				return err
+			}
+			statements := []sqlStatement{
+				{`DELETE FROM user_policies WHERE user_id = ?`, []interface{}{user.UserId}},
+				{`DELETE FROM user_policy_groups WHERE user_id = ?`, []interface{}{user.UserId}},
+			}
+			for _, name := range user.PolicyNames {
+				statements = append(statements, sqlStatement{`INSERT INTO user_policies (user_id, policy_name) VALUES (?, ?)`, []interface{}{user.UserId, name}})
+			}
+			for _, attachment := range user.TimeBoundPolicies {
+				statements = append(statements, sqlStatement{`INSERT INTO user_policies (user_id, policy_name, not_before, expires_at) VALUES (?, ?, ?, ?)`, []interface{}{user.UserId, attachment.Name, attachment.NotBefore, attachment.ExpiresAt}})
+			}
+			for _, name := range user.PolicyGroups {
+				statements = append(statements, sqlStatement{`INSERT INTO user_policy_groups (user_id, group_name) VALUES (?, ?)`, []interface{}{user.UserId, name}})
+			}
+			for _, attachment := range user.TimeBoundPolicyGroups {
+				statements = append(statements, sqlStatement{`INSERT INTO user_policy_groups (user_id, group_name, not_before, expires_at) VALUES (?, ?, ?, ?)`, []interface{}{user.UserId, attachment.Name, attachment.NotBefore, attachment.ExpiresAt}})
+			}
+			if err := s.exec(ctx, tx, statements); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PutPolicyGroups replaces each group and its members.
+func (s SQLPolicyStore) PutPolicyGroups(ctx context.Context, groups ...PolicyGroup) error {
+	return s.inTransaction(ctx, func(tx *sql.Tx) error {
+		for _, group := range groups {
+			err := s.putRevision(ctx, tx, revisionedRow{
+				table: "policy_groups", key: "name", kind: "policy group", name: group.Name, revision: group.Revision,
+				columns: []string{"permission_boundary"}, values: []interface{}{group.PermissionBoundary},
+			})
+			if err != nil {
+				return err
+			}
+			statements := []sqlStatement{
+				{`DELETE FROM policy_group_policies WHERE group_name = ?`, []interface{}{group.Name}},
+				{`DELETE FROM policy_group_members WHERE group_name = ?`, []interface{}{group.Name}},
+			}
+			for _, name := range group.PolicyNames {
+				statements = append(statements, sqlStatement{`INSERT INTO policy_group_policies (group_name, policy_name) VALUES (?, ?)`, []interface{}{group.Name, name}})
+			}
+			for _, name := range group.PolicyGroups {
+				statements = append(statements, sqlStatement{`INSERT INTO policy_group_members (group_name, member_group) VALUES (?, ?)`, []interface{}{group.Name, name}})
+			}
+			if err := s.exec(ctx, tx, statements); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PutPolicies creates or replaces each access policy. Created_at is kept
+// from the first write.
+func (s SQLPolicyStore) PutPolicies(ctx context.Context, policies ...PermsWithMeta) error {
+	return s.inTransaction(ctx, func(tx *sql.Tx) error {
+		now := time.Now().Unix()
+		for _, policy := range policies {
+			document, err := json.Marshal(policy.Permissions)
+			if err != nil {
+				return errors.New(fmt.Sprintf("Failed to marshal permissions of access policy %s, %v", policy.Name, err))
+			}
+			err = s.putRevision(ctx, tx, revisionedRow{
+				table: "access_policies", key: "name", kind: "access policy", name: policy.Name, revision: policy.Revision,
+				columns: []string{"description", "permissions", "updated_at"}, values: []interface{}{policy.Description, string(document), now},
+				insertColumns: []string{"created_at"}, insertValues: []interface{}{now},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// revisionedRow is the row of a user, group or policy, with the columns to
+// write besides its key and revision, and those to write only when the row
+// is inserted.
+type revisionedRow struct {
+	table         string
+	key           string
+	kind          string
+	name          string
+	revision      int
+	columns       []string
+	values        []interface{}
+	insertColumns []string
+	insertValues  []interface{}
+}
+
+// putRevision writes the row if it is still at its revision, at the next
+// revision, and returns a ConflictError otherwise. A row at revision 0 may
+// be missing, in which case it is inserted.
+func (s SQLPolicyStore) putRevision(ctx context.Context, tx *sql.Tx, row revisionedRow) error {
+	assignments := []string{}
+	for _, column := range row.columns {
+		assignments = append(assignments, column+" = ?")
+	}
+	args := append(append([]interface{}{}, row.values...), row.revision+1, row.name, row.revision)
+	result, err := tx.ExecContext(ctx, s.rebind(fmt.Sprintf(`UPDATE %s SET %s, revision = ? WHERE %s = ? AND revision = ?`, row.table, strings.Join(assignments, ", "), row.key)), args...)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Got error updating %s %s: %s", row.kind, row.name, err))
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 && row.revision == 0 {
+		columns := append(append([]string{row.key, "revision"}, row.columns...), row.insertColumns...)
+		values := append(append([]interface{}{row.name, 1}, row.values...), row.insertValues...)
+		result, err = tx.ExecContext(ctx, s.rebind(fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO NOTHING`, row.table, strings.Join(columns, ", "), placeholders(len(columns)), row.key)), values...)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Got error inserting %s %s: %s", row.kind, row.name, err))
+		}
+		if updated, err = result.RowsAffected(); err != nil {
+			return err
+		}
+	}
+	if updated == 0 {
+		current := 0
+		err = tx.QueryRowContext(ctx, s.rebind(fmt.Sprintf(`SELECT revision FROM %s WHERE %s = ?`, row.table, row.key)), row.name).Scan(&current)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		return ConflictError{Kind: row.kind, Name: row.name, Expected: row.revision, Current: current}
+	}
+	return nil
+}
+
+type sqlStatement struct {
+	query string
+	args  []interface{}
+}
+
+func (s SQLPolicyStore) exec(ctx context.Context, tx *sql.Tx, statements []sqlStatement) error {
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, s.rebind(statement.query), statement.args...); err != nil {
+			return errors.New(fmt.Sprintf("Got error executing %q: %s", strings.Fields(statement.query)[0], err))
+		}
+	}
+	return nil
+}
+
+func (s SQLPolicyStore) inTransaction(ctx context.Context, f func(tx *sql.Tx) error) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// rebind turns the ? placeholders the queries are written with into the
+// numbered ones Postgres expects.
+func (s SQLPolicyStore) rebind(query string) string {
+	if s.Dialect != Postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func stringArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		args[i] = value
+	}
+	return args
+}
@@ -0,0 +1,231 @@
+package policystore
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSQLPolicyStore(t *testing.T) {
+
+	Convey("SQLPolicyStore on SQLite", t, func() {
+		dir, err := ioutil.TempDir("", "policystore")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		db, err := sql.Open("sqlite3", filepath.Join(dir, "policies.db"))
+		So(err, ShouldBeNil)
+		defer db.Close()
+		store := SQLPolicyStore{DB: db, Dialect: SQLite}
+		version, err := store.Migrate()
+		So(err, ShouldBeNil)
+		So(version, ShouldEqual, len(sqlMigrations))
+
+		So(store.PutPolicies(context.Background(),
+			PermsWithMeta{Name: "ping", Permissions: auth.Permission{Allows: []auth.Statement{{Actions: []string{"^/ping$"}}}}},
+			PermsWithMeta{Name: "pong", Permissions: auth.Permission{Allows: []auth.Statement{{Actions: []string{"^/pong$"}}}}},
+			PermsWithMeta{Name: "pung", Permissions: auth.Permission{Denys: []auth.Statement{{Actions: []string{"^/pang$"}}}}},
+		), ShouldBeNil)
+		So(store.PutPolicyGroups(context.Background(),
+			PolicyGroup{Name: "engineering", PolicyNames: []string{"pong"}, PolicyGroups: []string{"backend"}},
+			PolicyGroup{Name: "backend", PolicyNames: []string{"pung"}},
+		), ShouldBeNil)
+		So(store.PutUserPolicyNames(context.Background(), UserPolicyNames{
+			UserId:                "auth0|0123456789",
+			PolicyNames:           []string{"ping"},
+			PolicyGroups:          []string{"engineering"},
+			TimeBoundPolicyGroups: []TimeBoundAttachment{{Name: "oncall", ExpiresAt: 1000}},
+		}), ShouldBeNil)
+
+		Convey("migrating again is a no-op", func() {
+			version, err := store.Migrate()
+			So(err, ShouldBeNil)
+			So(version, ShouldEqual, len(sqlMigrations))
+		})
+
+		Convey("reads the attachments of a user", func() {
+			userPolicyNames, err := store.GetUserPolicyNames(context.Background(), "auth0|0123456789")
+			So(err, ShouldBeNil)
+			So(userPolicyNames.PolicyNames, ShouldResemble, []string{"ping"})
+			So(userPolicyNames.PolicyGroups, ShouldResemble, []string{"engineering"})
+			So(userPolicyNames.TimeBoundPolicyGroups, ShouldResemble, []TimeBoundAttachment{{Name: "oncall", ExpiresAt: 1000}})
+		})
+
+		Convey("holds a policy and a group both permanently and for a time", func() {
+			So(store.PutUserPolicyNames(context.Background(), UserPolicyNames{
+				UserId:                "auth0|0123456789",
+				PolicyNames:           []string{"ping"},
+				PolicyGroups:          []string{"engineering"},
+				TimeBoundPolicies:     []TimeBoundAttachment{{Name: "ping", ExpiresAt: 2000}, {Name: "ping", NotBefore: 3000, ExpiresAt: 4000}},
+				TimeBoundPolicyGroups: []TimeBoundAttachment{{Name: "engineering", ExpiresAt: 1000}},
+				Revision:              1,
+			}), ShouldBeNil)
+			userPolicyNames, err := store.GetUserPolicyNames(context.Background(), "auth0|0123456789")
+			So(err, ShouldBeNil)
+			So(userPolicyNames.PolicyNames, ShouldResemble, []string{"ping"})
+			So(userPolicyNames.TimeBoundPolicies, ShouldResemble, []TimeBoundAttachment{{Name: "ping", ExpiresAt: 2000}, {Name: "ping", NotBefore: 3000, ExpiresAt: 4000}})
+			So(userPolicyNames.PolicyGroups, ShouldResemble, []string{"engineering"})
+			So(userPolicyNames.TimeBoundPolicyGroups, ShouldResemble, []TimeBoundAttachment{{Name: "engineering", ExpiresAt: 1000}})
+		})
+
+		Convey("replaces the attachments of a user", func() {
+			So(store.PutUserPolicyNames(context.Background(), UserPolicyNames{UserId: "auth0|0123456789", PermissionBoundary: "ping", Revision: 1}), ShouldBeNil)
+			userPolicyNames, err := store.GetUserPolicyNames(context.Background(), "auth0|0123456789")
+			So(err, ShouldBeNil)
+			So(userPolicyNames, ShouldResemble, UserPolicyNames{UserId: "auth0|0123456789", PermissionBoundary: "ping", Revision: 2})
+		})
+
+		Convey("keeps the SCIM profile of a user", func() {
+			profile := &ScimProfile{UserName: "jane@example.com", Active: true, Emails: []ScimEmail{{Value: "jane@example.com", Primary: true}}, Created: 1000}
+			So(store.PutUserPolicyNames(context.Background(), UserPolicyNames{UserId: "okta|jane@example.com", PolicyGroups: []string{"backend"}, Scim: profile}), ShouldBeNil)
+			userPolicyNames, err := store.GetUserPolicyNames(context.Background(), "okta|jane@example.com")
+			So(err, ShouldBeNil)
+			So(userPolicyNames.Scim, ShouldResemble, profile)
+			userPolicyNames, err = store.GetUserPolicyNames(context.Background(), "auth0|0123456789")
+			So(err, ShouldBeNil)
+			So(userPolicyNames.Scim, ShouldBeNil)
+		})
+
+		Convey("refuses to write over a revision other than the one read", func() {
+			err := store.PutUserPolicyNames(context.Background(), UserPolicyNames{UserId: "auth0|0123456789", PermissionBoundary: "ping"})
+			So(err, ShouldResemble, ConflictError{Kind: "user", Name: "auth0|0123456789", Expected: 0, Current: 1})
+			err = store.PutPolicies(context.Background(), PermsWithMeta{Name: "ping", Revision: 2})
+			So(err, ShouldResemble, ConflictError{Kind: "access policy", Name: "ping", Expected: 2, Current: 1})
+			err = store.PutPolicyGroups(context.Background(), PolicyGroup{Name: "new", Revision: 1})
+			So(err, ShouldResemble, ConflictError{Kind: "policy group", Name: "new", Expected: 1, Current: 0})
+
+			// Nothing of a failed write is kept
+			policy, err := store.GetPolicy(context.Background(), "ping")
+			So(err, ShouldBeNil)
+			So(policy.Revision, ShouldEqual, 1)
+			So(store.PutPolicies(context.Background(), PermsWithMeta{Name: "ping", Description: "Ping", Revision: 1}), ShouldBeNil)
+			policy, err = store.GetPolicy(context.Background(), "ping")
+			So(err, ShouldBeNil)
+			So(policy.Revision, ShouldEqual, 2)
+			So(policy.Created_at, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("resolves a user like any other store", func() {
+			resolution, err := Resolve(context.Background(), store, []string{"ping"}, []string{"engineering"}, nil, DefaultMaxPolicyGroupDepth)
+			So(err, ShouldBeNil)
+			So(resolution.PolicyPaths, ShouldResemble, map[string][]string{
+				"ping": {},
+				"pong": {"engineering"},
+				"pung": {"engineering", "backend"},
+			})
+			So(resolution.Permissions[2].Denys[0].Actions, ShouldResemble, []string{"^/pang$"})
+		})
+
+		Convey("lists and filters for the admin API", func() {
+			policies, next, err := store.ListPolicies(context.Background(), ListOptions{Prefix: "p", Limit: 2})
+			So(err, ShouldBeNil)
+			So(len(policies), ShouldEqual, 2)
+			So(policies[0].Name, ShouldEqual, "ping")
+			So(policies[0].Created_at, ShouldBeGreaterThan, 0)
+			So(next, ShouldEqual, "pong")
+			policies, next, err = store.ListPolicies(context.Background(), ListOptions{Prefix: "p", Cursor: next})
+			So(err, ShouldBeNil)
+			So(policies[0].Name, ShouldEqual, "pung")
+			So(next, ShouldBeEmpty)
+
+			groups, _, err := store.ListPolicyGroups(context.Background(), ListOptions{Group: "backend"})
+			So(err, ShouldBeNil)
+			So(len(groups), ShouldEqual, 1)
+			So(groups[0].Name, ShouldEqual, "engineering")
+			users, _, err := store.ListUsers(context.Background(), ListOptions{Policy: "ping"})
+			So(err, ShouldBeNil)
+			So(users[0].UserId, ShouldEqual, "auth0|0123456789")
+			users, _, err = store.ListUsers(context.Background(), ListOptions{Policy: "pong"})
+			So(err, ShouldBeNil)
+			So(users, ShouldBeEmpty)
+		})
+
+		Convey("gets and deletes", func() {
+			policy, err := store.GetPolicy(context.Background(), "pung")
+			So(err, ShouldBeNil)
+			So(policy.Permissions.Denys[0].Actions, ShouldResemble, []string{"^/pang$"})
+			So(store.DeletePolicy(context.Background(), "pung", policy.Revision+1), ShouldResemble, ConflictError{Kind: "access policy", Name: "pung", Expected: policy.Revision + 1, Current: policy.Revision})
+			So(store.DeletePolicy(context.Background(), "pung", policy.Revision), ShouldBeNil)
+			So(store.DeletePolicy(context.Background(), "pung", 0), ShouldBeNil)
+			_, err = store.GetPolicy(context.Background(), "pung")
+			So(err, ShouldEqual, ErrNotFound)
+
+			So(store.DeletePolicyGroup(context.Background(), "backend", 0), ShouldHaveSameTypeAs, ConflictError{})
+			So(store.DeletePolicyGroup(context.Background(), "backend", 1), ShouldBeNil)
+			groups, err := store.GetPolicyGroups(context.Background(), []string{"backend"})
+			So(err, ShouldBeNil)
+			So(groups, ShouldBeEmpty)
+
+			So(store.DeleteUserPolicyNames(context.Background(), "auth0|0123456789", 1), ShouldBeNil)
+			userPolicyNames, err := store.GetUserPolicyNames(context.Background(), "auth0|0123456789")
+			So(err, ShouldBeNil)
+			So(userPolicyNames.UserId, ShouldBeEmpty)
+		})
+
+		Convey("gives up reading and writing once the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := store.GetUserPolicyNames(ctx, "auth0|0123456789")
+			So(err, ShouldNotBeNil)
+			_, _, err = store.ListPolicies(ctx, ListOptions{})
+			So(err, ShouldNotBeNil)
+			So(store.PutPolicies(ctx, PermsWithMeta{Name: "pang"}), ShouldNotBeNil)
+			_, err = store.GetPolicy(context.Background(), "pang")
+			So(err, ShouldEqual, ErrNotFound)
+		})
+
+		Convey("leaves out names that do not exist", func() {
+			groups, err := store.GetPolicyGroups(context.Background(), []string{"nothing"})
+			So(err, ShouldBeNil)
+			So(groups, ShouldBeEmpty)
+			permissions, err := store.GetPermissions(context.Background(), []string{})
+			So(err, ShouldBeNil)
+			So(permissions, ShouldBeEmpty)
+			userPolicyNames, err := store.GetUserPolicyNames(context.Background(), "nobody")
+			So(err, ShouldBeNil)
+			So(userPolicyNames.PolicyNames, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestRebind(t *testing.T) {
+
+	Convey("rebind numbers the placeholders for Postgres only", t, func() {
+		So(SQLPolicyStore{Dialect: Postgres}.rebind("a = ? AND b IN (?, ?)"), ShouldEqual, "a = $1 AND b IN ($2, $3)")
+		So(SQLPolicyStore{Dialect: SQLite}.rebind("a = ?"), ShouldEqual, "a = ?")
+	})
+
+	Convey("The migration of the attachment keys keeps the attachments", t, func() {
+		dir, err := ioutil.TempDir("", "policystore")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		db, err := sql.Open("sqlite3", filepath.Join(dir, "policies.db"))
+		So(err, ShouldBeNil)
+		defer db.Close()
+		store := SQLPolicyStore{DB: db, Dialect: SQLite}
+		all := sqlMigrations
+		sqlMigrations = all[:4]
+		_, err = store.Migrate()
+		sqlMigrations = all
+		So(err, ShouldBeNil)
+		So(store.PutUserPolicyNames(context.Background(), UserPolicyNames{
+			UserId:                "auth0|0123456789",
+			PolicyNames:           []string{"ping"},
+			TimeBoundPolicyGroups: []TimeBoundAttachment{{Name: "oncall", ExpiresAt: 1000}},
+		}), ShouldBeNil)
+
+		version, err := store.Migrate()
+		So(err, ShouldBeNil)
+		So(version, ShouldEqual, len(sqlMigrations))
+		userPolicyNames, err := store.GetUserPolicyNames(context.Background(), "auth0|0123456789")
+		So(err, ShouldBeNil)
+		So(userPolicyNames.PolicyNames, ShouldResemble, []string{"ping"})
+		So(userPolicyNames.TimeBoundPolicyGroups, ShouldResemble, []TimeBoundAttachment{{Name: "oncall", ExpiresAt: 1000}})
+	})
+}
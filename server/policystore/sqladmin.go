@@ -0,0 +1,186 @@
+package policystore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const policiesQuery = `SELECT name, description, permissions, created_at, updated_at, revision FROM access_policies`
+
+func (s SQLPolicyStore) GetPolicy(ctx context.Context, name string) (PermsWithMeta, error) {
+	policy, err := scanPolicy(s.DB.QueryRowContext(ctx, s.rebind(policiesQuery+` WHERE name = ?`), name))
+	if err == sql.ErrNoRows {
+		return PermsWithMeta{}, ErrNotFound
+	}
+	return policy, err
+}
+
+// rowScanner is a *sql.Row or *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanPolicy(row rowScanner) (PermsWithMeta, error) {
+	policy := PermsWithMeta{}
+	var document string
+	err := row.Scan(&policy.Name, &policy.Description, &document, &policy.Created_at, &policy.Updated_at, &policy.Revision)
+	if err == sql.ErrNoRows {
+		return PermsWithMeta{}, err
+	}
+	if err != nil {
+		return PermsWithMeta{}, errors.New(fmt.Sprintf("Failed to scan access policy, %v", err))
+	}
+	if err = json.Unmarshal([]byte(document), &policy.Permissions); err != nil {
+		return PermsWithMeta{}, errors.New(fmt.Sprintf("Malformed permissions of access policy %s, %v", policy.Name, err))
+	}
+	return policy, nil
+}
+
+func (s SQLPolicyStore) ListPolicies(ctx context.Context, options ListOptions) ([]PermsWithMeta, string, error) {
+	names, next, err := s.listKeys(ctx, `SELECT name FROM access_policies`, "name", options, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	policies := []PermsWithMeta{}
+	if len(names) == 0 {
+		return policies, next, nil
+	}
+	rows, err := s.DB.QueryContext(ctx, s.rebind(fmt.Sprintf(policiesQuery+` WHERE name IN (%s) ORDER BY name`, placeholders(len(names)))), stringArgs(names)...)
+	if err != nil {
+		return nil, "", errors.New(fmt.Sprintf("Got error querying access policies: %s", err))
+	}
+	defer rows.Close()
+	for rows.Next() {
+		policy, err := scanPolicy(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		policies = append(policies, policy)
+	}
+	return policies, next, rows.Err()
+}
+
+func (s SQLPolicyStore) ListPolicyGroups(ctx context.Context, options ListOptions) ([]PolicyGroup, string, error) {
+	names, next, err := s.listKeys(ctx, `SELECT name FROM policy_groups g`, "g.name", options, []string{
+		`EXISTS (SELECT 1 FROM policy_group_policies p WHERE p.group_name = g.name AND p.policy_name = ?)`,
+		`EXISTS (SELECT 1 FROM policy_group_members m WHERE m.group_name = g.name AND m.member_group = ?)`,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	groups, err := s.GetPolicyGroups(ctx, names)
+	return groups, next, err
+}
+
+func (s SQLPolicyStore) ListUsers(ctx context.Context, options ListOptions) ([]UserPolicyNames, string, error) {
+	userIds, next, err := s.listKeys(ctx, `SELECT user_id FROM users u`, "u.user_id", options, []string{
+		`EXISTS (SELECT 1 FROM user_policies p WHERE p.user_id = u.user_id AND p.policy_name = ?)`,
+		`EXISTS (SELECT 1 FROM user_policy_groups m WHERE m.user_id = u.user_id AND m.group_name = ?)`,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	users := []UserPolicyNames{}
+	for _, userId := range userIds {
+		user, err := s.GetUserPolicyNames(ctx, userId)
+		if err != nil {
+			return nil, "", err
+		}
+		users = append(users, user)
+	}
+	return users, next, nil
+}
+
+// listKeys selects a page of the keys of the query. filters are the
+// conditions for the policy and group of the options, which are left out
+// when those are not set.
+func (s SQLPolicyStore) listKeys(ctx context.Context, query, key string, options ListOptions, filters []string) ([]string, string, error) {
+	query += fmt.Sprintf(" WHERE %s > ? AND substr(%s, 1, ?) = ?", key, key)
+	args := []interface{}{options.Cursor, len(options.Prefix), options.Prefix}
+	for i, value := range []string{options.Policy, options.Group} {
+		if value != "" && i < len(filters) {
+			query += " AND " + filters[i]
+			args = append(args, value)
+		}
+	}
+	// One more than the page, to know whether there is a next one
+	query += fmt.Sprintf(" ORDER BY %s LIMIT %d", key, options.PageLimit()+1)
+	rows, err := s.DB.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, "", errors.New(fmt.Sprintf("Got error listing: %s", err))
+	}
+	defer rows.Close()
+	keys := []string{}
+	for rows.Next() {
+		var value string
+		if err = rows.Scan(&value); err != nil {
+			return nil, "", errors.New(fmt.Sprintf("Failed to scan key, %v", err))
+		}
+		keys = append(keys, value)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", err
+	}
+	if len(keys) > options.PageLimit() {
+		keys = keys[:options.PageLimit()]
+		return keys, keys[len(keys)-1], nil
+	}
+	return keys, "", nil
+}
+
+func (s SQLPolicyStore) DeletePolicy(ctx context.Context, name string, revision int) error {
+	return s.inTransaction(ctx, func(tx *sql.Tx) error {
+		return s.deleteRevision(ctx, tx, "access_policies", "name", "access policy", name, revision)
+	})
+}
+
+// DeletePolicyGroup deletes the group and its members. Foreign keys are not
+// enforced by SQLite by default, so the members are deleted explicitly.
+func (s SQLPolicyStore) DeletePolicyGroup(ctx context.Context, name string, revision int) error {
+	return s.inTransaction(ctx, func(tx *sql.Tx) error {
+		if err := s.deleteRevision(ctx, tx, "policy_groups", "name", "policy group", name, revision); err != nil {
+			return err
+		}
+		return s.exec(ctx, tx, []sqlStatement{
+			{`DELETE FROM policy_group_policies WHERE group_name = ?`, []interface{}{name}},
+			{`DELETE FROM policy_group_members WHERE group_name = ?`, []interface{}{name}},
+		})
+	})
+}
+
+func (s SQLPolicyStore) DeleteUserPolicyNames(ctx context.Context, userId string, revision int) error {
+	return s.inTransaction(ctx, func(tx *sql.Tx) error {
+		if err := s.deleteRevision(ctx, tx, "users", "user_id", "user", userId, revision); err != nil {
+			return err
+		}
+		return s.exec(ctx, tx, []sqlStatement{
+			{`DELETE FROM user_policies WHERE user_id = ?`, []interface{}{userId}},
+			{`DELETE FROM user_policy_groups WHERE user_id = ?`, []interface{}{userId}},
+		})
+	})
+}
+
+// deleteRevision deletes the row if it is still at the revision. A missing
+// row is at revision 0, so deleting it at 0 succeeds and changes nothing.
+func (s SQLPolicyStore) deleteRevision(ctx context.Context, tx *sql.Tx, table, key, kind, name string, revision int) error {
+	result, err := tx.ExecContext(ctx, s.rebind(fmt.Sprintf(`DELETE FROM %s WHERE %s = ? AND revision = ?`, table, key)), name, revision)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Got error deleting %s %s: %s", kind, name, err))
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil || deleted > 0 {
+		return err
+	}
+	current := 0
+	err = tx.QueryRowContext(ctx, s.rebind(fmt.Sprintf(`SELECT revision FROM %s WHERE %s = ?`, table, key)), name).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if current != revision {
+		return ConflictError{Kind: kind, Name: name, Expected: revision, Current: current}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package policystore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// sqlMigrations are applied in order, each in its own transaction, and the
+// version of the last one applied is recorded in schema_migrations. Never
+// edit a migration once released; append a new one instead. The statements
+// are written so that they run on both Postgres and SQLite.
+var sqlMigrations = [][]string{
+	{
+		`CREATE TABLE access_policies (
+			name TEXT PRIMARY KEY,
+			description TEXT NOT NULL DEFAULT '',
+			permissions TEXT NOT NULL,
+			created_at BIGINT NOT NULL,
+			updated_at BIGINT NOT NULL
+		)`,
+		`CREATE TABLE policy_groups (
+			name TEXT PRIMARY KEY,
+			permission_boundary TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE TABLE policy_group_policies (
+			group_name TEXT NOT NULL REFERENCES policy_groups (name) ON DELETE CASCADE,
+			policy_name TEXT NOT NULL,
+			PRIMARY KEY (group_name, policy_name)
+		)`,
+		`CREATE TABLE policy_group_members (
+			group_name TEXT NOT NULL REFERENCES policy_groups (name) ON DELETE CASCADE,
+			member_group TEXT NOT NULL,
+			PRIMARY KEY (group_name, member_group)
+		)`,
+		`CREATE TABLE users (
+			user_id TEXT PRIMARY KEY,
+			permission_boundary TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE TABLE user_policies (
+			user_id TEXT NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+			policy_name TEXT NOT NULL,
+			not_before BIGINT NOT NULL DEFAULT 0,
+			expires_at BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (user_id, policy_name)
+		)`,
+		`CREATE TABLE user_policy_groups (
+			user_id TEXT NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+			group_name TEXT NOT NULL,
+			not_before BIGINT NOT NULL DEFAULT 0,
+			expires_at BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (user_id, group_name)
+		)`,
+	},
+	{
+		// Reverse lookups: who holds a policy or belongs to a group
+		`CREATE INDEX user_policies_policy_name ON user_policies (policy_name)`,
+		`CREATE INDEX user_policy_groups_group_name ON user_policy_groups (group_name)`,
+		`CREATE INDEX policy_group_policies_policy_name ON policy_group_policies (policy_name)`,
+	},
+	{
+		// Optimistic concurrency: writes are conditional on the revision read
+		`ALTER TABLE access_policies ADD COLUMN revision BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE policy_groups ADD COLUMN revision BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN revision BIGINT NOT NULL DEFAULT 0`,
+	},
+	{
+		// The SCIM profile of provisioned users, as JSON
+		`ALTER TABLE users ADD COLUMN scim_profile TEXT`,
+	},
+	{
+		// A user may hold a policy or group both permanently and for a time,
+		// so the window is part of the key. SQLite cannot change a primary
+		// key, so the tables are copied.
+		`CREATE TABLE user_policies_windowed (
+			user_id TEXT NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+			policy_name TEXT NOT NULL,
+			not_before BIGINT NOT NULL DEFAULT 0,
+			expires_at BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (user_id, policy_name, not_before, expires_at)
+		)`,
+		`INSERT INTO user_policies_windowed (user_id, policy_name, not_before, expires_at)
+			SELECT user_id, policy_name, not_before, expires_at FROM user_policies`,
+		`DROP TABLE user_policies`,
+		`ALTER TABLE user_policies_windowed RENAME TO user_policies`,
+		`CREATE INDEX user_policies_policy_name ON user_policies (policy_name)`,
+		`CREATE TABLE user_policy_groups_windowed (
+			user_id TEXT NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+			group_name TEXT NOT NULL,
+			not_before BIGINT NOT NULL DEFAULT 0,
+			expires_at BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (user_id, group_name, not_before, expires_at)
+		)`,
+		`INSERT INTO user_policy_groups_windowed (user_id, group_name, not_before, expires_at)
+			SELECT user_id, group_name, not_before, expires_at FROM user_policy_groups`,
+		`DROP TABLE user_policy_groups`,
+		`ALTER TABLE user_policy_groups_windowed RENAME TO user_policy_groups`,
+		`CREATE INDEX user_policy_groups_group_name ON user_policy_groups (group_name)`,
+	},
+}
+
+// Migrate brings the schema of the database up to date and returns the
+// version it is at.
+func (s SQLPolicyStore) Migrate() (int, error) {
+	_, err := s.DB.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at BIGINT NOT NULL)`)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Could not create schema_migrations, %v", err))
+	}
+	var version int
+	if err = s.DB.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return 0, errors.New(fmt.Sprintf("Could not read schema version, %v", err))
+	}
+	if version > len(sqlMigrations) {
+		return version, errors.New(fmt.Sprintf("Schema version %d is newer than this server, which knows %d", version, len(sqlMigrations)))
+	}
+	for ; version < len(sqlMigrations); version++ {
+		statements := sqlMigrations[version]
+		next := version + 1
+		err = s.inTransaction(context.Background(), func(tx *sql.Tx) error {
+			for _, statement := range statements {
+				if _, err := tx.Exec(statement); err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec(s.rebind(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`), next, time.Now().Unix())
+			return err
+		})
+		if err != nil {
+			return version, errors.New(fmt.Sprintf("Migration %d failed, %v", next, err))
+		}
+	}
+	return version, nil
+}
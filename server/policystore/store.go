@@ -0,0 +1,107 @@
+// Package policystore loads the access policies, policy groups and policy
+// attachments of users, and resolves them into the permissions of a user.
+package policystore
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+)
+
+// PolicyStore loads the attachments, groups and policies that Resolve
+// resolves. Names that do not exist are left out of the results rather than
+// being an error. The lookups give up when the context is done.
+type PolicyStore interface {
+	// GetUserPolicyNames returns the attachments of the user, which are
+	// empty if the user has none.
+	GetUserPolicyNames(ctx context.Context, userId string) (UserPolicyNames, error)
+	GetPolicyGroups(ctx context.Context, names []string) ([]PolicyGroup, error)
+	// GetPermissions returns the permissions of the named policies that exist
+	GetPermissions(ctx context.Context, names []string) (map[string]auth.Permission, error)
+}
+
+type UserPolicyNames struct {
+	PolicyNames           []string              `dynamodbav:"access_policies" json:"access_policies"`
+	UserId                string                `dynamodbav:"user_id" json:"user_id"`
+	PolicyGroups          []string              `dynamodbav:"policy_groups" json:"policy_groups"`
+	PermissionBoundary    string                `dynamodbav:"permission_boundary" json:"permission_boundary"`
+	TimeBoundPolicies     []TimeBoundAttachment `dynamodbav:"time_bound_policies" json:"time_bound_policies"`
+	TimeBoundPolicyGroups []TimeBoundAttachment `dynamodbav:"time_bound_policy_groups" json:"time_bound_policy_groups"`
+	Revision              int                   `dynamodbav:"revision" json:"revision"`
+	// Scim is the profile of a user provisioned by an identity provider
+	// through SCIM, nil for users that were not
+	Scim *ScimProfile `dynamodbav:"scim,omitempty" json:"scim,omitempty"`
+}
+
+// ScimProfile is what an identity provider tells about a user it
+// provisions. A user that is not Active is denied everything, whatever is
+// attached to it.
+type ScimProfile struct {
+	UserName     string      `dynamodbav:"user_name" json:"user_name"`
+	ExternalId   string      `dynamodbav:"external_id" json:"external_id,omitempty"`
+	Active       bool        `dynamodbav:"active" json:"active"`
+	DisplayName  string      `dynamodbav:"display_name" json:"display_name,omitempty"`
+	GivenName    string      `dynamodbav:"given_name" json:"given_name,omitempty"`
+	FamilyName   string      `dynamodbav:"family_name" json:"family_name,omitempty"`
+	Emails       []ScimEmail `dynamodbav:"emails" json:"emails,omitempty"`
+	Created      int64       `dynamodbav:"created" json:"created"`
+	LastModified int64       `dynamodbav:"last_modified" json:"last_modified"`
+}
+
+type ScimEmail struct {
+	Value   string `dynamodbav:"value" json:"value"`
+	Type    string `dynamodbav:"type" json:"type,omitempty"`
+	Primary bool   `dynamodbav:"primary" json:"primary,omitempty"`
+}
+
+type PolicyGroup struct {
+	Name               string   `dynamodbav:"name"`
+	PolicyNames        []string `dynamodbav:"policy_names" json:"policy_names"`
+	PolicyGroups       []string `dynamodbav:"policy_groups" json:"policy_groups"`
+	PermissionBoundary string   `dynamodbav:"permission_boundary" json:"permission_boundary"`
+	Revision           int      `dynamodbav:"revision" json:"revision"`
+}
+
+type PermsWithMeta struct {
+	Name           string `dynamodbav:"name"`
+	Created_at     int
+	Updated_at     int
+	Description    string
+	Permissions    auth.Permission
+	DefaultVersion int `dynamodbav:"default_version" json:"default_version"`
+	Revision       int `dynamodbav:"revision" json:"revision"`
+}
+
+// PolicyVersion is an immutable revision of an access policy. Versions are
+// stored in their own table, keyed by name and version, and the access
+// policy item points at the default one.
+type PolicyVersion struct {
+	Name        string `dynamodbav:"name"`
+	Version     int    `dynamodbav:"version"`
+	Created_at  int
+	Description string
+	Permissions auth.Permission
+}
+
+func PolicyVersionKey(name string, version int) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"name":    &types.AttributeValueMemberS{Value: name},
+		"version": &types.AttributeValueMemberN{Value: strconv.Itoa(version)},
+	}
+}
+
+// TimeBoundAttachment attaches a policy or policy group to a user only
+// between NotBefore and ExpiresAt, in Unix seconds. Zero means unbounded.
+type TimeBoundAttachment struct {
+	Name      string `dynamodbav:"name" json:"name"`
+	NotBefore int64  `dynamodbav:"not_before" json:"not_before"`
+	ExpiresAt int64  `dynamodbav:"expires_at" json:"expires_at"`
+}
+
+func (a TimeBoundAttachment) ActiveAt(t time.Time) bool {
+	return (a.NotBefore == 0 || a.NotBefore <= t.Unix()) && (a.ExpiresAt == 0 || t.Unix() < a.ExpiresAt)
+}
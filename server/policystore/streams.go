@@ -0,0 +1,184 @@
+package policystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	streamtypes "github.com/aws/aws-sdk-go-v2/service/dynamodbstreams/types"
+)
+
+const defaultStreamPollInterval = time.Second
+
+// StreamsClient is the part of *dynamodbstreams.Client the StreamConsumer
+// uses.
+type StreamsClient interface {
+	DescribeStream(ctx context.Context, params *dynamodbstreams.DescribeStreamInput, optFns ...func(*dynamodbstreams.Options)) (*dynamodbstreams.DescribeStreamOutput, error)
+	GetShardIterator(ctx context.Context, params *dynamodbstreams.GetShardIteratorInput, optFns ...func(*dynamodbstreams.Options)) (*dynamodbstreams.GetShardIteratorOutput, error)
+	GetRecords(ctx context.Context, params *dynamodbstreams.GetRecordsInput, optFns ...func(*dynamodbstreams.Options)) (*dynamodbstreams.GetRecordsOutput, error)
+}
+
+// KeyInvalidation turns the keys of a changed item into the invalidation of
+// what it affects.
+type KeyInvalidation func(keys map[string]streamtypes.AttributeValue) Invalidation
+
+// UserKeyInvalidation is for the table of user attachments.
+func UserKeyInvalidation(keys map[string]streamtypes.AttributeValue) Invalidation {
+	return Invalidation{UserId: streamString(keys["user_id"])}
+}
+
+// GroupKeyInvalidation is for the table of policy groups.
+func GroupKeyInvalidation(keys map[string]streamtypes.AttributeValue) Invalidation {
+	return Invalidation{Group: streamString(keys["name"])}
+}
+
+// PolicyKeyInvalidation is for the tables of access policies and of their
+// versions.
+func PolicyKeyInvalidation(keys map[string]streamtypes.AttributeValue) Invalidation {
+	return Invalidation{Policy: streamString(keys["name"])}
+}
+
+func streamString(av streamtypes.AttributeValue) string {
+	if s, ok := av.(*streamtypes.AttributeValueMemberS); ok {
+		return s.Value
+	}
+	return ""
+}
+
+// StreamConsumer reads the DynamoDB Streams of the policy tables and
+// invalidates the cache for every item changed, so that changes reach every
+// server instance within about PollInterval rather than the TTL of the
+// cache. When changes may have been missed, because a shard could not be
+// read, the whole cache is invalidated.
+type StreamConsumer struct {
+	Streams      StreamsClient
+	Cache        *CachingPolicyStore
+	PollInterval time.Duration
+}
+
+// Consume reads the stream until the context is done. Changes made before it
+// starts are skipped, since the cache was filled after them.
+func (c StreamConsumer) Consume(ctx context.Context, streamArn string, invalidation KeyInvalidation) error {
+	consumed := map[string]struct{}{}
+	for first := true; ; first = false {
+		shards, err := c.shards(ctx, streamArn)
+		if err != nil {
+			log.Printf("Could not describe stream %s, %v", streamArn, err)
+			c.Cache.InvalidateAll()
+		}
+		current := map[string]struct{}{}
+		for _, shard := range shards {
+			shardId := aws.ToString(shard.ShardId)
+			current[shardId] = struct{}{}
+			if _, exists := consumed[shardId]; exists {
+				continue
+			}
+			consumed[shardId] = struct{}{}
+			closed := shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil
+			if first && closed {
+				continue
+			}
+			// Shards that appear later are read from their beginning, so that
+			// no change is lost when a shard splits or rolls over
+			iteratorType := streamtypes.ShardIteratorTypeTrimHorizon
+			if first {
+				iteratorType = streamtypes.ShardIteratorTypeLatest
+			}
+			go c.consumeShard(ctx, streamArn, shardId, iteratorType, invalidation)
+		}
+		// Forget the shards that have been trimmed from the stream
+		for shardId := range consumed {
+			if _, exists := current[shardId]; !exists && err == nil {
+				delete(consumed, shardId)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * c.pollInterval()):
+		}
+	}
+}
+
+func (c StreamConsumer) shards(ctx context.Context, streamArn string) ([]streamtypes.Shard, error) {
+	shards := []streamtypes.Shard{}
+	var exclusiveStartShardId *string
+	for {
+		result, err := c.Streams.DescribeStream(ctx, &dynamodbstreams.DescribeStreamInput{
+			StreamArn:             aws.String(streamArn),
+			ExclusiveStartShardId: exclusiveStartShardId,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if result.StreamDescription == nil {
+			return nil, errors.New(fmt.Sprintf("Stream %s has no description", streamArn))
+		}
+		shards = append(shards, result.StreamDescription.Shards...)
+		exclusiveStartShardId = result.StreamDescription.LastEvaluatedShardId
+		if exclusiveStartShardId == nil {
+			return shards, nil
+		}
+	}
+}
+
+func (c StreamConsumer) consumeShard(ctx context.Context, streamArn, shardId string, iteratorType streamtypes.ShardIteratorType, invalidation KeyInvalidation) {
+	var iterator *string
+	for ctx.Err() == nil {
+		if iterator == nil {
+			result, err := c.Streams.GetShardIterator(ctx, &dynamodbstreams.GetShardIteratorInput{
+				StreamArn:         aws.String(streamArn),
+				ShardId:           aws.String(shardId),
+				ShardIteratorType: iteratorType,
+			})
+			if err != nil {
+				log.Printf("Could not read shard %s of %s, %v", shardId, streamArn, err)
+				c.wait(ctx)
+				continue
+			}
+			iterator = result.ShardIterator
+		}
+		result, err := c.Streams.GetRecords(ctx, &dynamodbstreams.GetRecordsInput{ShardIterator: iterator})
+		if err != nil {
+			// Start over from the latest change, having invalidated
+			// everything that may have changed in the meantime
+			log.Printf("Could not read records of shard %s of %s, %v", shardId, streamArn, err)
+			c.Cache.InvalidateAll()
+			iterator, iteratorType = nil, streamtypes.ShardIteratorTypeLatest
+			c.wait(ctx)
+			continue
+		}
+		for _, record := range result.Records {
+			if record.Dynamodb == nil {
+				continue
+			}
+			c.Cache.Invalidate(invalidation(record.Dynamodb.Keys))
+		}
+		// A closed shard has been read to its end
+		if result.NextShardIterator == nil {
+			return
+		}
+		iterator = result.NextShardIterator
+		if len(result.Records) == 0 {
+			c.wait(ctx)
+		}
+	}
+}
+
+func (c StreamConsumer) wait(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(c.pollInterval()):
+	}
+}
+
+func (c StreamConsumer) pollInterval() time.Duration {
+	if c.PollInterval <= 0 {
+		return defaultStreamPollInterval
+	}
+	return c.PollInterval
+}
@@ -0,0 +1,149 @@
+package policystore
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	streamtypes "github.com/aws/aws-sdk-go-v2/service/dynamodbstreams/types"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// memoryStream is a stream with a single open shard, whose iterators are
+// positions in its records.
+type memoryStream struct {
+	mu        sync.Mutex
+	records   []streamtypes.Record
+	iterators int
+}
+
+func (s *memoryStream) append(keys map[string]streamtypes.AttributeValue) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, streamtypes.Record{Dynamodb: &streamtypes.StreamRecord{Keys: keys}})
+}
+
+func (s *memoryStream) DescribeStream(ctx context.Context, params *dynamodbstreams.DescribeStreamInput, optFns ...func(*dynamodbstreams.Options)) (*dynamodbstreams.DescribeStreamOutput, error) {
+	return &dynamodbstreams.DescribeStreamOutput{StreamDescription: &streamtypes.StreamDescription{
+		Shards: []streamtypes.Shard{{ShardId: aws.String("shard-1"), SequenceNumberRange: &streamtypes.SequenceNumberRange{StartingSequenceNumber: aws.String("1")}}},
+	}}, nil
+}
+
+func (s *memoryStream) GetShardIterator(ctx context.Context, params *dynamodbstreams.GetShardIteratorInput, optFns ...func(*dynamodbstreams.Options)) (*dynamodbstreams.GetShardIteratorOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.iterators++
+	position := 0
+	if params.ShardIteratorType == streamtypes.ShardIteratorTypeLatest {
+		position = len(s.records)
+	}
+	return &dynamodbstreams.GetShardIteratorOutput{ShardIterator: aws.String(strconv.Itoa(position))}, nil
+}
+
+func (s *memoryStream) GetRecords(ctx context.Context, params *dynamodbstreams.GetRecordsInput, optFns ...func(*dynamodbstreams.Options)) (*dynamodbstreams.GetRecordsOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	position, _ := strconv.Atoi(aws.ToString(params.ShardIterator))
+	return &dynamodbstreams.GetRecordsOutput{
+		Records:           s.records[position:],
+		NextShardIterator: aws.String(strconv.Itoa(len(s.records))),
+	}, nil
+}
+
+func (s *memoryStream) started() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.iterators > 0
+}
+
+func eventually(condition func() bool) bool {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestStreamConsumer(t *testing.T) {
+
+	Convey("StreamConsumer", t, func() {
+		memory := NewMemoryPolicyStore()
+		memory.PutPolicyGroups(context.Background(), PolicyGroup{Name: "engineering", PolicyNames: []string{"pong"}})
+		cache := NewCachingPolicyStore(memory, time.Hour)
+		_, err := ResolveUser(context.Background(), cache, "bob", nil, []string{"engineering"}, nil, DefaultMaxPolicyGroupDepth)
+		So(err, ShouldBeNil)
+		cached := func() bool {
+			cache.mu.Lock()
+			defer cache.mu.Unlock()
+			_, exists := cache.resolutions["bob"]
+			return exists
+		}
+
+		stream := &memoryStream{}
+		// Changes made before the consumer starts are already in the cache
+		stream.append(map[string]streamtypes.AttributeValue{"name": &streamtypes.AttributeValueMemberS{Value: "engineering"}})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		consumer := StreamConsumer{Streams: stream, Cache: cache, PollInterval: time.Millisecond}
+		go consumer.Consume(ctx, "arn:groups", GroupKeyInvalidation)
+		So(eventually(stream.started), ShouldBeTrue)
+		So(cached(), ShouldBeTrue)
+
+		Convey("invalidates the members of a group changed in the table", func() {
+			stream.append(map[string]streamtypes.AttributeValue{"name": &streamtypes.AttributeValueMemberS{Value: "engineering"}})
+			So(eventually(func() bool { return !cached() }), ShouldBeTrue)
+		})
+	})
+}
+
+func TestStreamConsumerAgainstDynamoDBLocal(t *testing.T) {
+	svc := localDynamoDB(t)
+	streams := dynamodbstreams.New(dynamodbstreams.Options{
+		Region:           "us-east-1",
+		EndpointResolver: dynamodbstreams.EndpointResolverFromURL(os.Getenv("DYNAMODB_LOCAL_ENDPOINT")),
+		Credentials:      localCredentials,
+	})
+
+	Convey("StreamConsumer against DynamoDB Local", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		spec := TableSpec{
+			Name:           "user-policies-" + strconv.FormatInt(time.Now().UnixNano(), 10),
+			PartitionKey:   KeyAttribute{Name: "user_id", Type: types.ScalarAttributeTypeS},
+			StreamViewType: types.StreamViewTypeKeysOnly,
+		}
+		_, err := EnsureTable(ctx, svc, spec, true)
+		So(err, ShouldBeNil)
+		defer svc.DeleteTable(context.Background(), &dynamodb.DeleteTableInput{TableName: aws.String(spec.Name)})
+		description, err := svc.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(spec.Name)})
+		So(err, ShouldBeNil)
+
+		cache := NewCachingPolicyStore(DynamoPolicyStore{UserAccessPoliciesTableName: spec.Name, Svc: svc}, time.Hour)
+		_, err = ResolveUser(context.Background(), cache, "alice", []string{}, []string{}, nil, DefaultMaxPolicyGroupDepth)
+		So(err, ShouldBeNil)
+		consumer := StreamConsumer{Streams: streams, Cache: cache, PollInterval: 100 * time.Millisecond}
+		go consumer.Consume(ctx, aws.ToString(description.Table.LatestStreamArn), UserKeyInvalidation)
+		time.Sleep(time.Second)
+
+		item, err := attributevalue.MarshalMap(UserPolicyNames{UserId: "alice", PolicyNames: []string{"ping"}})
+		So(err, ShouldBeNil)
+		_, err = svc.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(spec.Name), Item: item})
+		So(err, ShouldBeNil)
+		invalidated := func() bool {
+			cache.mu.Lock()
+			defer cache.mu.Unlock()
+			_, exists := cache.resolutions["alice"]
+			return !exists
+		}
+		So(eventually(invalidated), ShouldBeTrue)
+	})
+}
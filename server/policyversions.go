@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/gorilla/mux"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/audit"
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	"github.com/shafiquejamal/reactjs-golang-starter/errorhandler"
+	"github.com/shafiquejamal/reactjs-golang-starter/policystore"
+)
+
+type PermissionDiff struct {
+	AddedAllows   []auth.Statement
+	RemovedAllows []auth.Statement
+	AddedDenys    []auth.Statement
+	RemovedDenys  []auth.Statement
+}
+
+type policyVersionStore struct {
+	accessPoliciesTableName       string
+	accessPolicyVersionsTableName string
+	svc                           *dynamodb.Client
+	// cache, if any, is cleared of a policy as its default version changes
+	cache *policystore.CachingPolicyStore
+}
+
+// CreateVersion validates the permissions and stores them as the next
+// version of the policy and, if asked to, makes it the default version of
+// the policy, which must exist then.
+func (s policyVersionStore) CreateVersion(ctx context.Context, name, description string, permissions auth.Permission, makeDefault bool) (policystore.PolicyVersion, error) {
+	if err := policystore.ValidatePolicy(policystore.PermsWithMeta{Name: name, Permissions: permissions}); err != nil {
+		return policystore.PolicyVersion{}, err
+	}
+	if makeDefault {
+		if err := s.policyExists(ctx, name); err != nil {
+			return policystore.PolicyVersion{}, err
+		}
+	}
+	versions, err := s.ListVersions(ctx, name)
+	if err != nil {
+		return policystore.PolicyVersion{}, err
+	}
+	policyVersion := policystore.PolicyVersion{
+		Name:        name,
+		Version:     1,
+		Created_at:  int(time.Now().Unix()),
+		Description: description,
+		Permissions: permissions,
+	}
+	if len(versions) > 0 {
+		policyVersion.Version = versions[len(versions)-1].Version + 1
+	}
+	item, err := attributevalue.MarshalMap(policyVersion)
+	if err != nil {
+		return policystore.PolicyVersion{}, errors.New(fmt.Sprintf("Failed to marshal policy version, %v", err))
+	}
+	// Versions are immutable, so never overwrite one written concurrently
+	_, err = s.svc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                aws.String(s.accessPolicyVersionsTableName),
+		Item:                     item,
+		ConditionExpression:      aws.String("attribute_not_exists(#v)"),
+		ExpressionAttributeNames: map[string]string{"#v": "version"},
+	})
+	if err != nil {
+		return policystore.PolicyVersion{}, errors.New(fmt.Sprintf("Got error calling PutItem: %s", err))
+	}
+	if makeDefault {
+		return policyVersion, s.SetDefaultVersion(ctx, name, policyVersion.Version)
+	}
+	return policyVersion, nil
+}
+
+// policyExists returns ErrNotFound if there is no policy of the name.
+func (s policyVersionStore) policyExists(ctx context.Context, name string) error {
+	result, err := s.svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:                aws.String(s.accessPoliciesTableName),
+		Key:                      map[string]types.AttributeValue{"name": &types.AttributeValueMemberS{Value: name}},
+		ProjectionExpression:     aws.String("#n"),
+		ExpressionAttributeNames: map[string]string{"#n": "name"},
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("Got error calling GetItem: %s", err))
+	}
+	if result.Item == nil {
+		return policystore.ErrNotFound
+	}
+	return nil
+}
+
+// ListVersions returns the versions of a policy, oldest first.
+func (s policyVersionStore) ListVersions(ctx context.Context, name string) ([]policystore.PolicyVersion, error) {
+	versions := []policystore.PolicyVersion{}
+	paginator := dynamodb.NewQueryPaginator(s.svc, &dynamodb.QueryInput{
+		TableName:                 aws.String(s.accessPolicyVersionsTableName),
+		KeyConditionExpression:    aws.String("#n = :name"),
+		ExpressionAttributeNames:  map[string]string{"#n": "name"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":name": &types.AttributeValueMemberS{Value: name}},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Got error calling Query: %s", err))
+		}
+		pageVersions := []policystore.PolicyVersion{}
+		if err = attributevalue.UnmarshalListOfMaps(page.Items, &pageVersions); err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to unmarshal policy versions, %v", err))
+		}
+		versions = append(versions, pageVersions...)
+	}
+	return versions, nil
+}
+
+func (s policyVersionStore) GetVersion(ctx context.Context, name string, version int) (policystore.PolicyVersion, error) {
+	result, err := s.svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.accessPolicyVersionsTableName),
+		Key:       policystore.PolicyVersionKey(name, version),
+	})
+	if err != nil {
+		return policystore.PolicyVersion{}, errors.New(fmt.Sprintf("Got error calling GetItem: %s", err))
+	}
+	if result.Item == nil {
+		return policystore.PolicyVersion{}, policystore.ErrNotFound
+	}
+	policyVersion := policystore.PolicyVersion{}
+	if err = attributevalue.UnmarshalMap(result.Item, &policyVersion); err != nil {
+		return policystore.PolicyVersion{}, errors.New(fmt.Sprintf("Failed to unmarshal policy version, %v", err))
+	}
+	return policyVersion, nil
+}
+
+// SetDefaultVersion points an existing policy at an existing version. This is
+// also how a policy is rolled back, as only the pointer changes.
+func (s policyVersionStore) SetDefaultVersion(ctx context.Context, name string, version int) error {
+	policyVersion, err := s.GetVersion(ctx, name, version)
+	if err != nil {
+		return err
+	}
+	now := &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)}
+	_, err = s.svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.accessPoliciesTableName),
+		Key: map[string]types.AttributeValue{
+			"name": &types.AttributeValueMemberS{Value: name},
+		},
+		// A new revision, so that admins editing the policy notice the change
+		UpdateExpression:         aws.String("SET default_version = :v, Description = :d, Updated_at = :now, Created_at = if_not_exists(Created_at, :now), revision = if_not_exists(revision, :zero) + :one"),
+		ConditionExpression:      aws.String("attribute_exists(#n)"),
+		ExpressionAttributeNames: map[string]string{"#n": "name"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":v":    &types.AttributeValueMemberN{Value: strconv.Itoa(policyVersion.Version)},
+			":d":    &types.AttributeValueMemberS{Value: policyVersion.Description},
+			":now":  now,
+			":zero": &types.AttributeValueMemberN{Value: "0"},
+			":one":  &types.AttributeValueMemberN{Value: "1"},
+		},
+	})
+	var missing *types.ConditionalCheckFailedException
+	if errors.As(err, &missing) {
+		return policystore.ErrNotFound
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Got error calling UpdateItem: %s", err))
+	}
+	// Without streams the cache would serve the old version until the TTL,
+	// so a rollback would not be instant
+	if s.cache != nil {
+		s.cache.Invalidate(policystore.Invalidation{Policy: name})
+	}
+	return nil
+}
+
+// diffPermissions lists the statements that are in "to" but not in "from" as
+// added, and those in "from" but not in "to" as removed.
+func diffPermissions(from, to auth.Permission) PermissionDiff {
+	return PermissionDiff{
+		AddedAllows:   statementsNotIn(to.Allows, from.Allows),
+		RemovedAllows: statementsNotIn(from.Allows, to.Allows),
+		AddedDenys:    statementsNotIn(to.Denys, from.Denys),
+		RemovedDenys:  statementsNotIn(from.Denys, to.Denys),
+	}
+}
+
+func statementsNotIn(statements, others []auth.Statement) []auth.Statement {
+	seen := map[string]struct{}{}
+	for _, other := range others {
+		seen[fmt.Sprint(other)] = struct{}{}
+	}
+	difference := []auth.Statement{}
+	for _, statement := range statements {
+		if _, exists := seen[fmt.Sprint(statement)]; !exists {
+			difference = append(difference, statement)
+		}
+	}
+	return difference
+}
+
+func listPolicyVersionsHandler(store policyVersionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		versions, err := store.ListVersions(r.Context(), mux.Vars(r)["name"])
+		if err != nil {
+			errorhandler.ReturnError(&w, http.StatusInternalServerError, "Could not list policy versions", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, versions)
+	}
+}
+
+func createPolicyVersionHandler(store policyVersionStore, trail auditTrail) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		request := struct {
+			Description string
+			Permissions auth.Permission
+			MakeDefault bool
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			errorhandler.ReturnError(&w, http.StatusBadRequest, "Malformed policy version", err)
+			return
+		}
+		name := mux.Vars(r)["name"]
+		policyVersion, err := store.CreateVersion(r.Context(), name, request.Description, request.Permissions, request.MakeDefault)
+		if err != nil {
+			returnStoreError(&w, "Could not create policy version", err)
+			return
+		}
+		// The version is numbered as it is created, so it is recorded after
+		actor := requestActor(w, r)
+		err = trail.record(r.Context(), actor, audit.Create, auditPolicyVersion, name, nil, policyVersion)
+		if err == nil && request.MakeDefault {
+			err = trail.record(r.Context(), actor, setDefaultVersion, auditPolicy, name, nil, defaultVersion{policyVersion.Version})
+		}
+		warnUnrecorded(w, err)
+		writeJSON(w, http.StatusCreated, policyVersion)
+	}
+}
+
+func diffPolicyVersionsHandler(store policyVersionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		from, errFrom := strconv.Atoi(vars["from"])
+		to, errTo := strconv.Atoi(vars["to"])
+		if errFrom != nil || errTo != nil {
+			errorhandler.ReturnError(&w, http.StatusBadRequest, "Malformed policy version", errors.New("Versions must be numbers"))
+			return
+		}
+		fromVersion, err := store.GetVersion(r.Context(), vars["name"], from)
+		if err != nil {
+			returnStoreError(&w, fmt.Sprintf("Could not get version %d", from), err)
+			return
+		}
+		toVersion, err := store.GetVersion(r.Context(), vars["name"], to)
+		if err != nil {
+			returnStoreError(&w, fmt.Sprintf("Could not get version %d", to), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, diffPermissions(fromVersion.Permissions, toVersion.Permissions))
+	}
+}
+
+// setDefaultVersion is the audit action of pointing a policy at a version
+const setDefaultVersion = "set-default-version"
+
+type defaultVersion struct {
+	DefaultVersion int `json:"default_version"`
+}
+
+func setDefaultPolicyVersionHandler(store policyVersionStore, trail auditTrail) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		request := struct {
+			Version int
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			errorhandler.ReturnError(&w, http.StatusBadRequest, "Malformed default version", err)
+			return
+		}
+		name := mux.Vars(r)["name"]
+		if _, err := store.GetVersion(r.Context(), name, request.Version); err != nil {
+			returnStoreError(&w, fmt.Sprintf("Could not get version %d", request.Version), err)
+			return
+		}
+		if err := store.SetDefaultVersion(r.Context(), name, request.Version); err != nil {
+			returnStoreError(&w, "Could not set default policy version", err)
+			return
+		}
+		warnUnrecorded(w, trail.record(r.Context(), requestActor(w, r), setDefaultVersion, auditPolicy, name, nil, defaultVersion{request.Version}))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		errorhandler.ReturnError(&w, http.StatusInternalServerError, "Could not encode response", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDiffPermissions(t *testing.T) {
+
+	Convey("diffPermissions", t, func() {
+		ping := auth.Statement{Actions: []string{"^/ping$"}, Resources: []string{".*"}}
+		pong := auth.Statement{Actions: []string{"^/pong$"}, Resources: []string{".*"}}
+		pung := auth.Statement{Actions: []string{"^/pung$"}, Resources: []string{".*"}}
+
+		Convey("is empty for identical permissions", func() {
+			p := auth.Permission{Allows: []auth.Statement{ping}, Denys: []auth.Statement{pung}}
+			diff := diffPermissions(p, p)
+			So(diff.AddedAllows, ShouldBeEmpty)
+			So(diff.RemovedAllows, ShouldBeEmpty)
+			So(diff.AddedDenys, ShouldBeEmpty)
+			So(diff.RemovedDenys, ShouldBeEmpty)
+		})
+
+		Convey("lists added and removed statements", func() {
+			from := auth.Permission{Allows: []auth.Statement{ping, pong}}
+			to := auth.Permission{Allows: []auth.Statement{ping}, Denys: []auth.Statement{pong}}
+			diff := diffPermissions(from, to)
+			So(diff.AddedAllows, ShouldBeEmpty)
+			So(diff.RemovedAllows, ShouldResemble, []auth.Statement{pong})
+			So(diff.AddedDenys, ShouldResemble, []auth.Statement{pong})
+			So(diff.RemovedDenys, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestCreatePolicyVersion(t *testing.T) {
+
+	Convey("createPolicyVersionHandler refuses an invalid version before writing it", t, func() {
+		router := mux.NewRouter()
+		// Without a DynamoDB client any write would panic
+		router.Handle("/policies/{name}/versions", createPolicyVersionHandler(policyVersionStore{}, auditTrail{})).Methods("POST")
+		create := func(name, body string) int {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("POST", "/policies/"+name+"/versions", strings.NewReader(body)))
+			return w.Code
+		}
+
+		So(create("read", `{"Permissions": {"Allows": [{"Actions": ["^/read($"]}]}, "MakeDefault": true}`), ShouldEqual, http.StatusUnprocessableEntity)
+		So(create("read", `{"Permissions": {"Allows": [{"Resources": [".*"]}]}}`), ShouldEqual, http.StatusUnprocessableEntity)
+		So(create("read%20all", `{"Permissions": {"Allows": [{"Actions": ["^/read$"]}]}, "MakeDefault": true}`), ShouldEqual, http.StatusUnprocessableEntity)
+	})
+}
@@ -0,0 +1,112 @@
+package rebac
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const defaultMaxCheckDepth = 25
+
+// Namespaces describe, per object type, how each relation is computed. A
+// relation that is not described only holds its directly written tuples.
+type Namespaces map[string]map[string]Relation
+
+// Relation is the union of its usersets.
+type Relation struct {
+	Union []Userset `json:"union"`
+}
+
+// Userset is one of: the tuples written for the relation itself ("this"),
+// another relation of the same object ("computed_userset"), or a relation of
+// the objects reached through a tupleset ("tuple_to_userset").
+type Userset struct {
+	This            bool            `json:"this"`
+	ComputedUserset string          `json:"computed_userset"`
+	TupleToUserset  *TupleToUserset `json:"tuple_to_userset"`
+}
+
+// TupleToUserset follows the Tupleset relation of an object, e.g. "parent",
+// and checks ComputedUserset on each object it leads to.
+type TupleToUserset struct {
+	Tupleset        string `json:"tupleset"`
+	ComputedUserset string `json:"computed_userset"`
+}
+
+func LoadNamespaces(path string) (Namespaces, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	namespaces := Namespaces{}
+	if err = json.Unmarshal(bs, &namespaces); err != nil {
+		return nil, errors.New(fmt.Sprintf("Malformed namespace config %s, %v", path, err))
+	}
+	return namespaces, nil
+}
+
+type Checker struct {
+	Store      TupleStore
+	Namespaces Namespaces
+	MaxDepth   int
+}
+
+// Check reports whether the subject, e.g. "user:alice", has the relation to
+// the object, following the rewrites of the object's namespace. The lookups
+// give up when the context is done.
+func (c Checker) Check(ctx context.Context, object, relation, subject string) (bool, error) {
+	maxDepth := c.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = defaultMaxCheckDepth
+	}
+	return c.check(ctx, object, relation, subject, maxDepth)
+}
+
+func (c Checker) check(ctx context.Context, object, relation, subject string, depth int) (bool, error) {
+	if depth == 0 {
+		return false, errors.New(fmt.Sprintf("Check of %s#%s@%s is nested too deeply", object, relation, subject))
+	}
+	namespace, _, _ := cut(object, ":")
+	usersets := c.Namespaces[namespace][relation].Union
+	if len(usersets) == 0 {
+		usersets = []Userset{{This: true}}
+	}
+	for _, userset := range usersets {
+		switch {
+		case userset.This:
+			tuples, err := c.Store.Read(ctx, object, relation)
+			if err != nil {
+				return false, err
+			}
+			for _, t := range tuples {
+				if t.Subject == subject {
+					return true, nil
+				}
+				if subjectObject, subjectRelation, isUserset := cut(t.Subject, "#"); isUserset {
+					if ok, err := c.check(ctx, subjectObject, subjectRelation, subject, depth-1); ok || err != nil {
+						return ok, err
+					}
+				}
+			}
+		case userset.ComputedUserset != "":
+			if ok, err := c.check(ctx, object, userset.ComputedUserset, subject, depth-1); ok || err != nil {
+				return ok, err
+			}
+		case userset.TupleToUserset != nil:
+			tuples, err := c.Store.Read(ctx, object, userset.TupleToUserset.Tupleset)
+			if err != nil {
+				return false, err
+			}
+			for _, t := range tuples {
+				related := strings.SplitN(t.Subject, "#", 2)[0]
+				if ok, err := c.check(ctx, related, userset.TupleToUserset.ComputedUserset, subject, depth-1); ok || err != nil {
+					return ok, err
+				}
+			}
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,74 @@
+package rebac
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoTupleStore keeps tuples in a table with the partition key
+// object_relation ("document:42#editor") and the sort key subject.
+type DynamoTupleStore struct {
+	TableName string
+	Svc       *dynamodb.Client
+}
+
+func (s DynamoTupleStore) Read(ctx context.Context, object, relation string) ([]Tuple, error) {
+	tuples := []Tuple{}
+	paginator := dynamodb.NewQueryPaginator(s.Svc, &dynamodb.QueryInput{
+		TableName:              aws.String(s.TableName),
+		KeyConditionExpression: aws.String("object_relation = :or"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":or": &types.AttributeValueMemberS{Value: object + "#" + relation},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Got error calling Query: %s", err))
+		}
+		for _, item := range page.Items {
+			if subject, ok := item["subject"].(*types.AttributeValueMemberS); ok {
+				tuples = append(tuples, Tuple{Object: object, Relation: relation, Subject: subject.Value})
+			}
+		}
+	}
+	return tuples, nil
+}
+
+func (s DynamoTupleStore) Write(ctx context.Context, tuples ...Tuple) error {
+	for _, t := range tuples {
+		_, err := s.Svc.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(s.TableName),
+			Item:      tupleKey(t),
+		})
+		if err != nil {
+			return errors.New(fmt.Sprintf("Got error calling PutItem: %s", err))
+		}
+	}
+	return nil
+}
+
+func (s DynamoTupleStore) Delete(ctx context.Context, tuples ...Tuple) error {
+	for _, t := range tuples {
+		_, err := s.Svc.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(s.TableName),
+			Key:       tupleKey(t),
+		})
+		if err != nil {
+			return errors.New(fmt.Sprintf("Got error calling DeleteItem: %s", err))
+		}
+	}
+	return nil
+}
+
+func tupleKey(t Tuple) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"object_relation": &types.AttributeValueMemberS{Value: t.Object + "#" + t.Relation},
+		"subject":         &types.AttributeValueMemberS{Value: t.Subject},
+	}
+}
@@ -0,0 +1,114 @@
+package rebac_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	"github.com/shafiquejamal/reactjs-golang-starter/rebac"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var testNamespaces = rebac.Namespaces{
+	"folder": {
+		"editor": {Union: []rebac.Userset{{This: true}, {TupleToUserset: &rebac.TupleToUserset{Tupleset: "parent", ComputedUserset: "editor"}}}},
+		"viewer": {Union: []rebac.Userset{{This: true}, {ComputedUserset: "editor"}}},
+	},
+	"document": {
+		"editor": {Union: []rebac.Userset{{This: true}, {TupleToUserset: &rebac.TupleToUserset{Tupleset: "parent", ComputedUserset: "editor"}}}},
+		"viewer": {Union: []rebac.Userset{{This: true}, {ComputedUserset: "editor"}, {TupleToUserset: &rebac.TupleToUserset{Tupleset: "parent", ComputedUserset: "viewer"}}}},
+	},
+}
+
+func testTuples(ss ...string) []rebac.Tuple {
+	tuples := []rebac.Tuple{}
+	for _, s := range ss {
+		t, err := rebac.ParseTuple(s)
+		if err != nil {
+			panic(err)
+		}
+		tuples = append(tuples, t)
+	}
+	return tuples
+}
+
+func TestRebac(t *testing.T) {
+
+	Convey("ParseTuple", t, func() {
+		Convey("parses object#relation@subject", func() {
+			tuple, err := rebac.ParseTuple("folder:7#editor@group:eng#member")
+			So(err, ShouldBeNil)
+			So(tuple, ShouldResemble, rebac.Tuple{Object: "folder:7", Relation: "editor", Subject: "group:eng#member"})
+			So(tuple.String(), ShouldEqual, "folder:7#editor@group:eng#member")
+		})
+
+		Convey("errors on a malformed tuple", func() {
+			_, err := rebac.ParseTuple("folder:7@user:alice")
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Checker", t, func() {
+		store := rebac.NewMemoryTupleStore()
+		store.Write(context.Background(), testTuples(
+			"document:42#parent@folder:7",
+			"folder:7#editor@user:alice",
+			"folder:7#viewer@group:eng#member",
+			"group:eng#member@user:bob",
+		)...)
+		checker := rebac.Checker{Store: store, Namespaces: testNamespaces}
+
+		Convey("follows the parent of an object", func() {
+			ok, err := checker.Check(context.Background(), "document:42", "editor", "user:alice")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("follows computed usersets", func() {
+			ok, err := checker.Check(context.Background(), "document:42", "viewer", "user:alice")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("follows usersets written as subjects", func() {
+			ok, err := checker.Check(context.Background(), "document:42", "viewer", "user:bob")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			ok, err = checker.Check(context.Background(), "document:42", "editor", "user:bob")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("stops following cyclic tuples", func() {
+			store.Write(context.Background(), testTuples("folder:7#parent@folder:8", "folder:8#parent@folder:7")...)
+			_, err := checker.Check(context.Background(), "document:42", "editor", "user:carol")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("no longer allows a deleted relation", func() {
+			store.Delete(context.Background(), testTuples("folder:7#editor@user:alice")...)
+			ok, err := checker.Check(context.Background(), "document:42", "editor", "user:alice")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+	})
+
+	Convey("RelationAuthorizationStrategy", t, func() {
+		store := rebac.NewMemoryTupleStore()
+		store.Write(context.Background(), testTuples("document:42#editor@user:alice")...)
+		strategy := rebac.RelationAuthorizationStrategy(rebac.Checker{Store: store, Namespaces: testNamespaces}, "editor", rebac.ObjectFromRouteVar("document", "id"))
+		r := mux.SetURLVars(&http.Request{RequestURI: "/api/documents/42"}, map[string]string{"id": "42"})
+
+		Convey("allows a user with the relation", func() {
+			u := auth.User{Identity: auth.UserIdentity{UserId: "alice"}}
+			So(strategy(u, r), ShouldBeNil)
+		})
+
+		Convey("denies a user without the relation", func() {
+			u := auth.User{Identity: auth.UserIdentity{UserId: "bob"}}
+			So(strategy(u, r), ShouldNotBeNil)
+		})
+	})
+}
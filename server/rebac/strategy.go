@@ -0,0 +1,43 @@
+package rebac
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+)
+
+// RelationAuthorizationStrategy allows the request if the user has the
+// relation to the object the request is about.
+func RelationAuthorizationStrategy(checker Checker, relation string, objectFromRequest func(r *http.Request) (string, error)) func(user auth.User, r *http.Request) error {
+	return func(user auth.User, r *http.Request) error {
+		object, err := objectFromRequest(r)
+		if err != nil {
+			return err
+		}
+		ok, err := checker.Check(r.Context(), object, relation, "user:"+user.Identity.UserId)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return auth.Denied(fmt.Sprintf("No %s relation to %s", relation, object))
+		}
+		return nil
+	}
+}
+
+// ObjectFromRouteVar builds the object from a route variable, e.g. the route
+// "/documents/{id}" and ObjectFromRouteVar("document", "id") give
+// "document:42" for "/documents/42".
+func ObjectFromRouteVar(namespace, name string) func(r *http.Request) (string, error) {
+	return func(r *http.Request) (string, error) {
+		id := mux.Vars(r)[name]
+		if id == "" {
+			return "", errors.New(fmt.Sprintf("Route variable %s is missing", name))
+		}
+		return namespace + ":" + id, nil
+	}
+}
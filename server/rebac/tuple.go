@@ -0,0 +1,91 @@
+package rebac
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Tuple relates a subject to an object, written object#relation@subject,
+// e.g. "document:42#parent@folder:7" or "folder:7#editor@user:alice". The
+// subject may itself be a userset such as "group:eng#member".
+type Tuple struct {
+	Object   string
+	Relation string
+	Subject  string
+}
+
+func (t Tuple) String() string {
+	return t.Object + "#" + t.Relation + "@" + t.Subject
+}
+
+func ParseTuple(s string) (Tuple, error) {
+	objectRelation, subject, found := cut(s, "@")
+	if !found {
+		return Tuple{}, errors.New(fmt.Sprintf("Malformed tuple %s, expected object#relation@subject", s))
+	}
+	object, relation, found := cut(objectRelation, "#")
+	if !found || object == "" || relation == "" || subject == "" {
+		return Tuple{}, errors.New(fmt.Sprintf("Malformed tuple %s, expected object#relation@subject", s))
+	}
+	return Tuple{Object: object, Relation: relation, Subject: subject}, nil
+}
+
+// TupleStore persists relationship tuples.
+type TupleStore interface {
+	// Read returns the tuples of the object with the given relation.
+	Read(ctx context.Context, object, relation string) ([]Tuple, error)
+	Write(ctx context.Context, tuples ...Tuple) error
+	Delete(ctx context.Context, tuples ...Tuple) error
+}
+
+// MemoryTupleStore keeps tuples in memory, for tests and local development.
+type MemoryTupleStore struct {
+	mu     sync.RWMutex
+	tuples map[string]map[string]struct{}
+}
+
+func NewMemoryTupleStore() *MemoryTupleStore {
+	return &MemoryTupleStore{tuples: map[string]map[string]struct{}{}}
+}
+
+func (s *MemoryTupleStore) Read(ctx context.Context, object, relation string) ([]Tuple, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tuples := []Tuple{}
+	for subject := range s.tuples[object+"#"+relation] {
+		tuples = append(tuples, Tuple{Object: object, Relation: relation, Subject: subject})
+	}
+	return tuples, nil
+}
+
+func (s *MemoryTupleStore) Write(ctx context.Context, tuples ...Tuple) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range tuples {
+		key := t.Object + "#" + t.Relation
+		if s.tuples[key] == nil {
+			s.tuples[key] = map[string]struct{}{}
+		}
+		s.tuples[key][t.Subject] = struct{}{}
+	}
+	return nil
+}
+
+func (s *MemoryTupleStore) Delete(ctx context.Context, tuples ...Tuple) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range tuples {
+		delete(s.tuples[t.Object+"#"+t.Relation], t.Subject)
+	}
+	return nil
+}
+
+func cut(s, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,11 @@
+package http.authz
+
+default allow = false
+
+# input.user, input.method, input.path, input.headers and input.vars are
+# built from the request by the regoauth package.
+allow {
+	input.method == "GET"
+	input.path == "/api/pang"
+	input.user.identity.email_verified
+}
@@ -0,0 +1,158 @@
+package regoauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gorilla/mux"
+	"github.com/open-policy-agent/opa/rego"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+)
+
+const DefaultQuery = "data.http.authz.allow"
+
+// RegoStrategy authorizes requests with the Rego policies and data files
+// found in a local directory. The query must evaluate to true for a request
+// to be allowed.
+type RegoStrategy struct {
+	dir   string
+	query string
+	mu    sync.RWMutex
+	pq    rego.PreparedEvalQuery
+}
+
+func NewRegoStrategy(dir, query string) (*RegoStrategy, error) {
+	if query == "" {
+		query = DefaultQuery
+	}
+	s := &RegoStrategy{dir: dir, query: query}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload compiles the policies in the directory again. The policies in use
+// are only replaced if compilation succeeds.
+func (s *RegoStrategy) Reload() error {
+	pq, err := rego.New(
+		rego.Query(s.query),
+		rego.Load([]string{s.dir}, nil),
+	).PrepareForEval(context.Background())
+	if err != nil {
+		return errors.New(fmt.Sprintf("Could not compile Rego policies in %s, %v", s.dir, err))
+	}
+	s.mu.Lock()
+	s.pq = pq
+	s.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the policies whenever a file in the directory or any
+// directory below it changes, until the context is done. Directories
+// created later are watched as they appear.
+func (s *RegoStrategy) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err = watchTree(watcher, s.dir); err != nil {
+		watcher.Close()
+		return err
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-watcher.Events:
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+					continue
+				}
+				// The files of a new directory may be written before it is
+				// watched, but the reload below picks them up
+				if info, err := os.Stat(event.Name); event.Op&fsnotify.Create != 0 && err == nil && info.IsDir() {
+					if err = watchTree(watcher, event.Name); err != nil {
+						log.Println("Could not watch Rego policy directory", event.Name, err)
+					}
+				}
+				if err := s.Reload(); err != nil {
+					log.Println("Keeping previous Rego policies", err)
+					continue
+				}
+				log.Println("Reloaded Rego policies from", s.dir)
+			case err := <-watcher.Errors:
+				log.Println("Rego policy watcher error", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// watchTree watches the directory and every directory below it, as fsnotify
+// does not watch recursively. A removed directory drops out of the watcher
+// by itself.
+func watchTree(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+// Authorize conforms to the authorization strategy signature expected by
+// auth.RequireAuthentication.
+func (s *RegoStrategy) Authorize(user auth.User, r *http.Request) error {
+	s.mu.RLock()
+	pq := s.pq
+	s.mu.RUnlock()
+	rs, err := pq.Eval(r.Context(), rego.EvalInput(Input(user, r)))
+	if err != nil {
+		return errors.New(fmt.Sprintf("Could not evaluate Rego policies, %v", err))
+	}
+	if !rs.Allowed() {
+		return auth.Denied("Denied by Rego policy")
+	}
+	return nil
+}
+
+// Input builds the document that policies see as input. The bearer token is
+// left out of the headers.
+func Input(user auth.User, r *http.Request) map[string]interface{} {
+	headers := map[string]interface{}{}
+	for name, values := range r.Header {
+		if name == "Authorization" {
+			continue
+		}
+		headers[strings.ToLower(name)] = values
+	}
+	path := strings.SplitN(r.RequestURI, "?", 2)[0]
+	if r.URL != nil && r.URL.Path != "" {
+		path = r.URL.Path
+	}
+	return map[string]interface{}{
+		"user": map[string]interface{}{
+			"identity":     user.Identity,
+			"permissions":  user.Permissions,
+			"policy_paths": user.PolicyPaths,
+		},
+		"method":  r.Method,
+		"path":    path,
+		"headers": headers,
+		"vars":    mux.Vars(r),
+	}
+}
@@ -0,0 +1,111 @@
+package regoauth_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	"github.com/shafiquejamal/reactjs-golang-starter/regoauth"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testPolicy = `package http.authz
+
+default allow = false
+
+allow {
+	input.method == "GET"
+	input.path == "/api/ping"
+	input.user.identity.email_verified
+}
+
+allow {
+	input.headers["x-team"][_] == data.teams[_]
+}
+`
+
+const testData = `{"teams": ["platform"]}`
+
+func TestRegoStrategy(t *testing.T) {
+
+	Convey("RegoStrategy", t, func() {
+		dir, err := ioutil.TempDir("", "rego")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		So(ioutil.WriteFile(filepath.Join(dir, "authz.rego"), []byte(testPolicy), 0644), ShouldBeNil)
+		So(ioutil.WriteFile(filepath.Join(dir, "data.json"), []byte(testData), 0644), ShouldBeNil)
+
+		s, err := regoauth.NewRegoStrategy(dir, "")
+		So(err, ShouldBeNil)
+		u := auth.User{Identity: auth.UserIdentity{EmailVerified: true}}
+
+		Convey("allows a request the policy allows", func() {
+			r, _ := http.NewRequest("GET", "/api/ping?foo=bar", nil)
+			So(s.Authorize(u, r), ShouldBeNil)
+		})
+
+		Convey("uses headers and data documents", func() {
+			r, _ := http.NewRequest("POST", "/api/pong", nil)
+			r.Header.Set("X-Team", "platform")
+			So(s.Authorize(u, r), ShouldBeNil)
+		})
+
+		Convey("denies a request the policy does not allow", func() {
+			r, _ := http.NewRequest("POST", "/api/ping", nil)
+			So(s.Authorize(u, r), ShouldNotBeNil)
+		})
+
+		Convey("picks up changed policies on reload", func() {
+			So(ioutil.WriteFile(filepath.Join(dir, "authz.rego"), []byte("package http.authz\n\nallow = true\n"), 0644), ShouldBeNil)
+			So(s.Reload(), ShouldBeNil)
+			r, _ := http.NewRequest("POST", "/api/ping", nil)
+			So(s.Authorize(u, r), ShouldBeNil)
+		})
+
+		Convey("watches the directories below, including those created later", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			So(os.Mkdir(filepath.Join(dir, "teams"), 0755), ShouldBeNil)
+			So(s.Watch(ctx), ShouldBeNil)
+			eventually := func(method string) error {
+				r, _ := http.NewRequest(method, "/api/pong", nil)
+				err := s.Authorize(u, r)
+				for deadline := time.Now().Add(5 * time.Second); err != nil && time.Now().Before(deadline); err = s.Authorize(u, r) {
+					time.Sleep(10 * time.Millisecond)
+				}
+				return err
+			}
+
+			So(ioutil.WriteFile(filepath.Join(dir, "teams", "put.rego"), []byte("package http.authz\n\nallow {\n\tinput.method == \"PUT\"\n}\n"), 0644), ShouldBeNil)
+			So(eventually("PUT"), ShouldBeNil)
+
+			So(os.MkdirAll(filepath.Join(dir, "later", "deeper"), 0755), ShouldBeNil)
+			So(ioutil.WriteFile(filepath.Join(dir, "later", "deeper", "delete.rego"), []byte("package http.authz\n\nallow {\n\tinput.method == \"DELETE\"\n}\n"), 0644), ShouldBeNil)
+			So(eventually("DELETE"), ShouldBeNil)
+
+			So(ioutil.WriteFile(filepath.Join(dir, "later", "deeper", "delete.rego"), []byte("package http.authz\n\nallow {\n\tinput.method == \"PATCH\"\n}\n"), 0644), ShouldBeNil)
+			So(eventually("PATCH"), ShouldBeNil)
+		})
+
+		Convey("keeps the previous policies if the new ones do not compile", func() {
+			So(ioutil.WriteFile(filepath.Join(dir, "authz.rego"), []byte("package http.authz\n\nallow {"), 0644), ShouldBeNil)
+			So(s.Reload(), ShouldNotBeNil)
+			r, _ := http.NewRequest("GET", "/api/ping", nil)
+			So(s.Authorize(u, r), ShouldBeNil)
+		})
+	})
+
+	Convey("Input", t, func() {
+		Convey("leaves out the bearer token", func() {
+			r, _ := http.NewRequest("GET", "/api/ping", nil)
+			r.Header.Set("Authorization", "Bearer some-token")
+			input := regoauth.Input(auth.User{}, r)
+			So(input["headers"], ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/gorilla/mux"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	"github.com/shafiquejamal/reactjs-golang-starter/cf"
+	"github.com/shafiquejamal/reactjs-golang-starter/rebac"
+)
+
+// strategyFactory makes an authorization strategy from the parameters a
+// route gives it.
+type strategyFactory func(parameters map[string]string) (func(user auth.User, r *http.Request) error, error)
+
+// withoutParameters makes a strategy that takes no parameters.
+func withoutParameters(authorizationStrategy func(user auth.User, r *http.Request) error) strategyFactory {
+	return func(parameters map[string]string) (func(user auth.User, r *http.Request) error, error) {
+		if len(parameters) > 0 {
+			return nil, errors.New("The strategy takes no parameters")
+		}
+		return authorizationStrategy, nil
+	}
+}
+
+// relationStrategy checks that the user has the relation parameter to the
+// object of the namespace parameter whose id is the route variable
+// route_var, which defaults to id.
+func relationStrategy(checker rebac.Checker) strategyFactory {
+	return func(parameters map[string]string) (func(user auth.User, r *http.Request) error, error) {
+		relation, namespace, routeVar := parameters["relation"], parameters["namespace"], parameters["route_var"]
+		if relation == "" || namespace == "" {
+			return nil, errors.New("The strategy needs a relation and a namespace")
+		}
+		if routeVar == "" {
+			routeVar = "id"
+		}
+		return rebac.RelationAuthorizationStrategy(checker, relation, rebac.ObjectFromRouteVar(namespace, routeVar)), nil
+	}
+}
+
+// defaultRoutes are the routes served when the configuration declares none,
+// with the strategies and enforcement modes configured for them by path.
+func defaultRoutes(configuration cf.Configuration) []cf.Route {
+	routes := []cf.Route{}
+	for _, route := range []cf.Route{
+		{Path: "/ping", Strategy: "allow_all"},
+		{Path: "/pong", Strategy: "policy"},
+		{Path: "/pung", Strategy: "policy"},
+		{Path: "/pang", Strategy: "policy"},
+	} {
+		if strategy := configuration.RouteStrategies[route.Path]; strategy != "" {
+			route.Strategy = strategy
+		}
+		route.EnforcementMode = configuration.EnforcementModes[route.Path]
+		route.Handler = "ping"
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// The routes of the features of the server, each served when its feature is
+// configured, by the handler of that name.
+var (
+	meRoutes = []cf.Route{
+		{Path: "/me", Strategy: "allow_all", Handler: "me"},
+		{Path: "/me/can", Strategy: "allow_all", Handler: "me_can"},
+		{Path: "/debug/vars", Strategy: "policy", Handler: "debug_vars"},
+	}
+	documentRoutes = []cf.Route{
+		{Path: "/documents/{id}", Strategy: "relation", StrategyParameters: map[string]string{"relation": "viewer", "namespace": "document"}, Handler: "ping"},
+	}
+	policyVersionRoutes = []cf.Route{
+		{Path: "/policies/{name}/versions", Strategy: "policy", Handler: "list_policy_versions"},
+		{Path: "/policies/{name}/versions", Methods: []string{"POST"}, Strategy: "policy", Handler: "create_policy_version"},
+		{Path: "/policies/{name}/versions/{from:[0-9]+}/diff/{to:[0-9]+}", Strategy: "policy", Handler: "diff_policy_versions"},
+		{Path: "/policies/{name}/default-version", Methods: []string{"PUT"}, Strategy: "policy", Handler: "set_default_policy_version"},
+	}
+	grantRoutes = []cf.Route{
+		{Path: "/grants", Methods: []string{"POST"}, Strategy: "policy", Handler: "request_grant"},
+		{Path: "/grants/{userId}", Strategy: "policy", Handler: "list_grants"},
+		{Path: "/grants/{userId}/{grantId}/approve", Methods: []string{"POST"}, Strategy: "policy", Handler: "approve_grant"},
+	}
+	// Any user may ask for break-glass access, which checks their eligibility
+	breakGlassRoutes = []cf.Route{
+		{Path: "/break-glass", Methods: []string{"POST"}, Strategy: "allow_all", Handler: "activate_break_glass"},
+	}
+	adminRoutes = []cf.Route{
+		{Path: "/admin/policies", Strategy: "policy", Handler: "list_policies"},
+		{Path: "/admin/policies/{name}", Strategy: "policy", Handler: "get_policy"},
+		{Path: "/admin/policies/{name}", Methods: []string{"PUT"}, Strategy: "policy", Handler: "put_policy"},
+		{Path: "/admin/policies/{name}", Methods: []string{"DELETE"}, Strategy: "policy", Handler: "delete_policy"},
+		{Path: "/admin/policies/{name}/users", Strategy: "policy", Handler: "list_policy_holders"},
+		{Path: "/admin/groups", Strategy: "policy", Handler: "list_policy_groups"},
+		{Path: "/admin/groups/{name}", Strategy: "policy", Handler: "get_policy_group"},
+		{Path: "/admin/groups/{name}", Methods: []string{"PUT"}, Strategy: "policy", Handler: "put_policy_group"},
+		{Path: "/admin/groups/{name}", Methods: []string{"DELETE"}, Strategy: "policy", Handler: "delete_policy_group"},
+		{Path: "/admin/groups/{name}/members", Strategy: "policy", Handler: "list_policy_group_members"},
+		{Path: "/admin/user-attachments", Strategy: "policy", Handler: "export_attachments"},
+		{Path: "/admin/user-attachments", Methods: []string{"POST"}, Strategy: "policy", Handler: "import_attachments"},
+		{Path: "/admin/users", Strategy: "policy", Handler: "list_users"},
+		{Path: "/admin/users/{userId}", Strategy: "policy", Handler: "get_user"},
+		{Path: "/admin/users/{userId}", Methods: []string{"PUT"}, Strategy: "policy", Handler: "put_user"},
+		{Path: "/admin/users/{userId}", Methods: []string{"DELETE"}, Strategy: "policy", Handler: "delete_user"},
+	}
+	auditRoutes = []cf.Route{
+		{Path: "/admin/audit", Strategy: "policy", Handler: "list_audit_events"},
+	}
+)
+
+// featureRoutes are the routes of the features, in the enforcement modes
+// configured for them by path.
+func featureRoutes(configuration cf.Configuration, features ...[]cf.Route) []cf.Route {
+	routes := []cf.Route{}
+	for _, feature := range features {
+		for _, route := range feature {
+			route.EnforcementMode = configuration.EnforcementModes[route.Path]
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+// routeTable adds the routes to the router, each method of a route behind
+// the authentication and authorization that authenticate returns for its
+// strategy and enforcement mode. Nothing is added if a route names an
+// unknown strategy, handler, principal type or enforcement mode.
+func routeTable(
+	r *mux.Router,
+	apiPrefix string,
+	routes []cf.Route,
+	strategies map[string]strategyFactory,
+	handlers map[string]http.Handler,
+	authenticate func(method, route string, mode auth.EnforcementMode, authorizationStrategy func(user auth.User, r *http.Request) error) func(http.Handler) http.Handler) error {
+	type methodRoute struct {
+		method, path string
+		mode         auth.EnforcementMode
+		strategy     func(user auth.User, r *http.Request) error
+		handler      http.Handler
+	}
+	methodRoutes := []methodRoute{}
+	for _, route := range routes {
+		if route.Path == "" {
+			return errors.New("A route has no path")
+		}
+		authorizationStrategy, mode, err := buildRouteStrategy(route, strategies)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Route %s, %v", route.Path, err))
+		}
+		handler, err := routeHandler(route, handlers)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Route %s, %v", route.Path, err))
+		}
+		methods := route.Methods
+		if len(methods) == 0 {
+			methods = []string{"GET"}
+		}
+		for _, method := range methods {
+			methodRoutes = append(methodRoutes, methodRoute{method: method, path: route.Path, mode: mode, strategy: authorizationStrategy, handler: handler})
+		}
+	}
+	for _, route := range methodRoutes {
+		r.Handle(apiPrefix+route.path, authenticate(route.method, route.path, route.mode, route.strategy)(route.handler)).Methods(route.method)
+	}
+	return nil
+}
+
+// buildRouteStrategy makes the strategy of the route, allowing only the
+// principal types of the route, if any, and parses its enforcement mode. The
+// strategy is left for authenticate to wrap in the mode, so that /me/can can
+// evaluate it without counting or logging a decision.
+func buildRouteStrategy(route cf.Route, strategies map[string]strategyFactory) (func(user auth.User, r *http.Request) error, auth.EnforcementMode, error) {
+	factory, exists := strategies[route.Strategy]
+	if !exists {
+		return nil, "", errors.New(fmt.Sprintf("Unknown authorization strategy %s", route.Strategy))
+	}
+	authorizationStrategy, err := factory(route.StrategyParameters)
+	if err != nil {
+		return nil, "", errors.New(fmt.Sprintf("Invalid parameters for strategy %s, %v", route.Strategy, err))
+	}
+	if len(route.PrincipalTypes) > 0 {
+		principalTypes := []auth.PrincipalType{}
+		for _, name := range route.PrincipalTypes {
+			principalType, err := auth.ParsePrincipalType(name)
+			if err != nil {
+				return nil, "", err
+			}
+			principalTypes = append(principalTypes, principalType)
+		}
+		authorizationStrategy = auth.AllOf(auth.Named("principal", auth.PrincipalTypeStrategy(principalTypes...)), auth.Named(route.Strategy, authorizationStrategy))
+	}
+	mode, err := auth.ParseEnforcementMode(route.EnforcementMode)
+	if err != nil {
+		return nil, "", err
+	}
+	return authorizationStrategy, mode, nil
+}
+
+// routeHandler returns the named handler of the route or a proxy to its
+// upstream. The proxied request keeps its path, API prefix included.
+func routeHandler(route cf.Route, handlers map[string]http.Handler) (http.Handler, error) {
+	switch {
+	case route.Handler != "" && route.Upstream != "":
+		return nil, errors.New("A route has either a handler or an upstream, not both")
+	case route.Handler != "":
+		handler, exists := handlers[route.Handler]
+		if !exists {
+			return nil, errors.New(fmt.Sprintf("Unknown handler %s", route.Handler))
+		}
+		return handler, nil
+	case route.Upstream != "":
+		upstream, err := url.Parse(route.Upstream)
+		if err != nil || upstream.Scheme == "" || upstream.Host == "" {
+			return nil, errors.New(fmt.Sprintf("Invalid upstream %s", route.Upstream))
+		}
+		return httputil.NewSingleHostReverseProxy(upstream), nil
+	}
+	return nil, errors.New("A route needs a handler or an upstream")
+}
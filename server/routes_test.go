@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	"github.com/shafiquejamal/reactjs-golang-starter/cf"
+	"github.com/shafiquejamal/reactjs-golang-starter/rebac"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRouteTable(t *testing.T) {
+
+	Convey("routeTable", t, func() {
+		router := mux.NewRouter()
+		strategies := map[string]strategyFactory{
+			"allow_all": withoutParameters(auth.AllowAllAuthorizationStrategy),
+			"policy":    withoutParameters(auth.PolicyAuthorizationStrategy("/api")),
+		}
+		handlers := map[string]http.Handler{"ping": pingHandler()}
+		authorized := map[string]bool{}
+		unwrapped := map[string]func(user auth.User, r *http.Request) error{}
+		user := auth.User{Identity: auth.UserIdentity{Email: "jane@example.com"}}
+		// authenticate stands in for RequireAuthentication with a user
+		// already known
+		authenticate := func(method, route string, mode auth.EnforcementMode, authorizationStrategy func(user auth.User, r *http.Request) error) func(http.Handler) http.Handler {
+			authorized[method+" "+route] = true
+			unwrapped[method+" "+route] = authorizationStrategy
+			authorizationStrategy = auth.EnforcementModeStrategy(mode, route, authorizationStrategy)
+			return func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if err := authorizationStrategy(user, r); err != nil {
+						w.WriteHeader(http.StatusUnauthorized)
+						return
+					}
+					next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "User", user)))
+				})
+			}
+		}
+		call := func(method, path string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+			return w
+		}
+
+		Convey("serves each method of a route through its strategy", func() {
+			routes := []cf.Route{
+				{Path: "/ping", Strategy: "allow_all", Handler: "ping"},
+				{Path: "/pong", Methods: []string{"GET", "POST"}, Strategy: "policy", Handler: "ping"},
+			}
+			So(routeTable(router, "/api", routes, strategies, handlers, authenticate), ShouldBeNil)
+			So(authorized, ShouldResemble, map[string]bool{"GET /ping": true, "GET /pong": true, "POST /pong": true})
+			w := call("GET", "/api/ping")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqual, "jane@example.com")
+			So(call("POST", "/api/pong").Code, ShouldEqual, http.StatusUnauthorized)
+			So(call("POST", "/api/ping").Code, ShouldEqual, http.StatusMethodNotAllowed)
+		})
+
+		Convey("lets a denied request through in audit mode", func() {
+			routes := []cf.Route{{Path: "/pong", Strategy: "policy", EnforcementMode: "audit", Handler: "ping"}}
+			So(routeTable(router, "/api", routes, strategies, handlers, authenticate), ShouldBeNil)
+			So(call("GET", "/api/pong").Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("gives authenticate the strategy before it is wrapped in the enforcement mode", func() {
+			routes := []cf.Route{{Path: "/pong", Strategy: "policy", EnforcementMode: "audit", Handler: "ping"}}
+			So(routeTable(router, "/api", routes, strategies, handlers, authenticate), ShouldBeNil)
+			before := auth.AuthorizationDecisions.String()
+			r := httptest.NewRequest("GET", "/api/pong", nil)
+			So(unwrapped["GET /pong"](user, r), ShouldNotBeNil)
+			So(auth.AuthorizationDecisions.String(), ShouldEqual, before)
+		})
+
+		Convey("allows only the principal types of a route", func() {
+			routes := []cf.Route{{Path: "/incidents", Strategy: "allow_all", PrincipalTypes: []string{"break_glass"}, Handler: "ping"}}
+			So(routeTable(router, "/api", routes, strategies, handlers, authenticate), ShouldBeNil)
+			So(call("GET", "/api/incidents").Code, ShouldEqual, http.StatusUnauthorized)
+			user.BreakGlass = &auth.BreakGlassElevation{ActivationId: "1"}
+			So(call("GET", "/api/incidents").Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("passes the parameters of a route to its strategy", func() {
+			strategies["route_var"] = func(parameters map[string]string) (func(user auth.User, r *http.Request) error, error) {
+				return func(user auth.User, r *http.Request) error {
+					if mux.Vars(r)[parameters["name"]] != "42" {
+						return errors.New("Not 42")
+					}
+					return nil
+				}, nil
+			}
+			routes := []cf.Route{{Path: "/documents/{id}", Strategy: "route_var", StrategyParameters: map[string]string{"name": "id"}, Handler: "ping"}}
+			So(routeTable(router, "/api", routes, strategies, handlers, authenticate), ShouldBeNil)
+			So(call("GET", "/api/documents/42").Code, ShouldEqual, http.StatusOK)
+			So(call("GET", "/api/documents/7").Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("proxies a route to its upstream", func() {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("upstream " + r.URL.Path))
+			}))
+			defer upstream.Close()
+			routes := []cf.Route{{Path: "/reports", Strategy: "allow_all", Upstream: upstream.URL}}
+			So(routeTable(router, "/api", routes, strategies, handlers, authenticate), ShouldBeNil)
+			w := call("GET", "/api/reports")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqual, "upstream /api/reports")
+		})
+
+		Convey("fails without adding any route when a route is invalid", func() {
+			for _, route := range []cf.Route{
+				{Path: "/pong", Strategy: "nope", Handler: "ping"},
+				{Path: "/pong", Strategy: "policy", StrategyParameters: map[string]string{"a": "b"}, Handler: "ping"},
+				{Path: "/pong", Strategy: "policy", Handler: "nope"},
+				{Path: "/pong", Strategy: "policy"},
+				{Path: "/pong", Strategy: "policy", Handler: "ping", Upstream: "http://localhost:8091"},
+				{Path: "/pong", Strategy: "policy", Upstream: "localhost"},
+				{Path: "/pong", Strategy: "policy", PrincipalTypes: []string{"robot"}, Handler: "ping"},
+				{Path: "/pong", Strategy: "policy", EnforcementMode: "maybe", Handler: "ping"},
+				{Strategy: "policy", Handler: "ping"},
+			} {
+				routes := []cf.Route{{Path: "/ping", Strategy: "allow_all", Handler: "ping"}, route}
+				So(routeTable(router, "/api", routes, strategies, handlers, authenticate), ShouldNotBeNil)
+			}
+			So(authorized, ShouldBeEmpty)
+			So(call("GET", "/api/ping").Code, ShouldEqual, http.StatusNotFound)
+		})
+	})
+
+	Convey("defaultRoutes", t, func() {
+		routes := defaultRoutes(cf.Configuration{
+			RouteStrategies:  map[string]string{"/pang": "rego"},
+			EnforcementModes: map[string]string{"/pong": "audit"},
+		})
+		So(routes, ShouldResemble, []cf.Route{
+			{Path: "/ping", Strategy: "allow_all", Handler: "ping"},
+			{Path: "/pong", Strategy: "policy", EnforcementMode: "audit", Handler: "ping"},
+			{Path: "/pung", Strategy: "policy", Handler: "ping"},
+			{Path: "/pang", Strategy: "rego", Handler: "ping"},
+		})
+	})
+
+	Convey("featureRoutes", t, func() {
+		features := [][]cf.Route{meRoutes, documentRoutes, policyVersionRoutes, grantRoutes, breakGlassRoutes, adminRoutes, auditRoutes}
+
+		Convey("sets the enforcement modes configured for the routes", func() {
+			routes := featureRoutes(cf.Configuration{EnforcementModes: map[string]string{"/documents/{id}": "audit"}}, features...)
+			modes := map[string]string{}
+			for _, route := range routes {
+				modes[route.Path] = route.EnforcementMode
+			}
+			So(modes["/documents/{id}"], ShouldEqual, "audit")
+			So(modes["/admin/policies"], ShouldEqual, "")
+		})
+
+		Convey("builds every route through the route table", func() {
+			strategies := map[string]strategyFactory{
+				"allow_all": withoutParameters(auth.AllowAllAuthorizationStrategy),
+				"policy":    withoutParameters(auth.PolicyAuthorizationStrategy("/api")),
+				"relation":  relationStrategy(rebac.Checker{}),
+			}
+			routes := featureRoutes(cf.Configuration{}, features...)
+			handlers := map[string]http.Handler{}
+			for _, route := range routes {
+				handlers[route.Handler] = pingHandler()
+			}
+			authenticated := []string{}
+			authenticate := func(method, route string, mode auth.EnforcementMode, authorizationStrategy func(user auth.User, r *http.Request) error) func(http.Handler) http.Handler {
+				authenticated = append(authenticated, method+" "+route)
+				return func(next http.Handler) http.Handler { return next }
+			}
+			So(routeTable(mux.NewRouter(), "/api", routes, strategies, handlers, authenticate), ShouldBeNil)
+			So(authenticated, ShouldContain, "DELETE /admin/users/{userId}")
+			So(authenticated, ShouldContain, "GET /me/can")
+			So(authenticated, ShouldContain, "GET /documents/{id}")
+			So(len(authenticated), ShouldEqual, 29)
+		})
+	})
+}
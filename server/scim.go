@@ -0,0 +1,1028 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/shafiquejamal/reactjs-golang-starter/audit"
+	"github.com/shafiquejamal/reactjs-golang-starter/policystore"
+)
+
+const (
+	scimPrefix                      = "/scim/v2"
+	scimContentType                 = "application/scim+json"
+	scimUserSchema                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema                 = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListResponseSchema          = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema                 = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimServiceProviderConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	// scimActor is the user id changes made through SCIM are recorded as
+	scimActor        = "scim"
+	scimDefaultCount = 100
+	scimMaxResults   = 200
+)
+
+// scimProvisioning serves the SCIM 2.0 endpoints (RFC 7643, 7644) through
+// which identity providers create, update and deactivate users and manage
+// their memberships of policy groups.
+//
+// A SCIM user is the user of the policy store whose id is userIdPrefix
+// followed by the userName it was created with, which should be the id the
+// identity provider puts in the tokens it issues. A SCIM group is the policy
+// group named by its displayName, and its members are the users it is
+// permanently attached to. Policies are only ever attached through the
+// admin API.
+type scimProvisioning struct {
+	admin        adminStore
+	userIdPrefix string
+}
+
+type scimName struct {
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type scimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Created      string `json:"created,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Location     string `json:"location"`
+	Version      string `json:"version,omitempty"`
+}
+
+type scimMember struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+type scimUser struct {
+	Schemas     []string                `json:"schemas"`
+	Id          string                  `json:"id"`
+	ExternalId  string                  `json:"externalId,omitempty"`
+	UserName    string                  `json:"userName"`
+	Name        *scimName               `json:"name,omitempty"`
+	DisplayName string                  `json:"displayName,omitempty"`
+	Emails      []policystore.ScimEmail `json:"emails,omitempty"`
+	// Active is nil when a request leaves it out, which creates an active
+	// user
+	Active *bool        `json:"active,omitempty"`
+	Groups []scimMember `json:"groups,omitempty"`
+	Meta   *scimMeta    `json:"meta,omitempty"`
+}
+
+type scimGroup struct {
+	Schemas     []string     `json:"schemas"`
+	Id          string       `json:"id"`
+	DisplayName string       `json:"displayName"`
+	Members     []scimMember `json:"members,omitempty"`
+	Meta        *scimMeta    `json:"meta,omitempty"`
+}
+
+type scimListResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+type scimPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+type scimPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []scimPatchOperation `json:"Operations"`
+}
+
+type scimErrorResponse struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+}
+
+// scimError is a request SCIM rejects with the status and the scimType, such
+// as invalidFilter or uniqueness, telling the client what to fix.
+type scimError struct {
+	status   int
+	scimType string
+	detail   string
+}
+
+func (e scimError) Error() string {
+	return e.detail
+}
+
+func scimInvalid(scimType, format string, args ...interface{}) error {
+	return scimError{status: http.StatusBadRequest, scimType: scimType, detail: fmt.Sprintf(format, args...)}
+}
+
+func writeScim(w http.ResponseWriter, statusCode int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		returnScimError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", scimContentType)
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
+
+// returnScimError answers in the error schema of SCIM, with the status
+// returnStoreError would answer for the errors of the store.
+func returnScimError(w http.ResponseWriter, err error) {
+	response := scimError{status: http.StatusInternalServerError, detail: err.Error()}
+	var rejected scimError
+	var validationError policystore.ValidationError
+	var inUse inUseError
+	var conflict policystore.ConflictError
+	switch {
+	case errors.As(err, &rejected):
+		response = rejected
+	case errors.As(err, &validationError):
+		response = scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: err.Error()}
+	case err == policystore.ErrNotFound:
+		response.status = http.StatusNotFound
+	case errors.As(err, &inUse), errors.As(err, &conflict):
+		response.status = http.StatusConflict
+	default:
+		log.Println("SCIM request failed", err)
+	}
+	body, _ := json.Marshal(scimErrorResponse{
+		Schemas:  []string{scimErrorSchema},
+		Status:   strconv.Itoa(response.status),
+		ScimType: response.scimType,
+		Detail:   response.detail,
+	})
+	w.Header().Set("Content-Type", scimContentType)
+	w.WriteHeader(response.status)
+	w.Write(body)
+}
+
+// scimAuthentication lets through the requests that carry the provisioning
+// token, which the identity provider is configured with, as a bearer token.
+func scimAuthentication(token string) func(http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+				returnScimError(w, scimError{status: http.StatusUnauthorized, detail: "The provisioning token is missing or wrong"})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// scimRequestActor records changes as made by SCIM provisioning, from the
+// address of the identity provider.
+func scimRequestActor(w http.ResponseWriter, r *http.Request) audit.Actor {
+	actor := requestActor(w, r)
+	actor.UserId = scimActor
+	return actor
+}
+
+// scimBaseUrl is the URL the resources are located at, as the client sees
+// it.
+func scimBaseUrl(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + scimPrefix
+}
+
+func scimTime(seconds int64) string {
+	if seconds == 0 {
+		return ""
+	}
+	return time.Unix(seconds, 0).UTC().Format(time.RFC3339)
+}
+
+func scimVersion(revision int) string {
+	return fmt.Sprintf(`W/"%d"`, revision)
+}
+
+// decodeScim decodes the body of a request, which is JSON whether it is
+// sent as application/scim+json or application/json.
+func decodeScim(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return scimInvalid("invalidSyntax", "Malformed request, %v", err)
+	}
+	return nil
+}
+
+// toScimUser represents the user, which has a profile of its own only if it
+// was provisioned through SCIM.
+func toScimUser(user policystore.UserPolicyNames, baseUrl string) scimUser {
+	profile := policystore.ScimProfile{UserName: user.UserId, Active: true}
+	if user.Scim != nil {
+		profile = *user.Scim
+	}
+	active := profile.Active
+	u := scimUser{
+		Schemas:     []string{scimUserSchema},
+		Id:          user.UserId,
+		ExternalId:  profile.ExternalId,
+		UserName:    profile.UserName,
+		DisplayName: profile.DisplayName,
+		Emails:      profile.Emails,
+		Active:      &active,
+		Meta: &scimMeta{
+			ResourceType: "User",
+			Created:      scimTime(profile.Created),
+			LastModified: scimTime(profile.LastModified),
+			Location:     baseUrl + "/Users/" + url.PathEscape(user.UserId),
+			Version:      scimVersion(user.Revision),
+		},
+	}
+	if profile.GivenName != "" || profile.FamilyName != "" {
+		u.Name = &scimName{GivenName: profile.GivenName, FamilyName: profile.FamilyName}
+	}
+	for _, name := range user.PolicyGroups {
+		u.Groups = append(u.Groups, scimMember{Value: name, Display: name, Ref: baseUrl + "/Groups/" + url.PathEscape(name)})
+	}
+	return u
+}
+
+// scimProfile is the profile the representation describes, created at the
+// time given.
+func scimProfile(u scimUser, created int64) (policystore.ScimProfile, error) {
+	if strings.TrimSpace(u.UserName) == "" {
+		return policystore.ScimProfile{}, scimInvalid("invalidValue", "The userName is required")
+	}
+	profile := policystore.ScimProfile{
+		UserName:     u.UserName,
+		ExternalId:   u.ExternalId,
+		Active:       u.Active == nil || *u.Active,
+		DisplayName:  u.DisplayName,
+		Emails:       u.Emails,
+		Created:      created,
+		LastModified: time.Now().Unix(),
+	}
+	if u.Name != nil {
+		profile.GivenName, profile.FamilyName = u.Name.GivenName, u.Name.FamilyName
+	}
+	return profile, nil
+}
+
+func toScimGroup(group policystore.PolicyGroup, members []policystore.UserPolicyNames, baseUrl string) scimGroup {
+	g := scimGroup{
+		Schemas:     []string{scimGroupSchema},
+		Id:          group.Name,
+		DisplayName: group.Name,
+		Meta: &scimMeta{
+			ResourceType: "Group",
+			Location:     baseUrl + "/Groups/" + url.PathEscape(group.Name),
+			Version:      scimVersion(group.Revision),
+		},
+	}
+	for _, member := range members {
+		display := member.UserId
+		if member.Scim != nil {
+			display = member.Scim.UserName
+		}
+		g.Members = append(g.Members, scimMember{Value: member.UserId, Display: display, Ref: baseUrl + "/Users/" + url.PathEscape(member.UserId)})
+	}
+	return g
+}
+
+// scimResource is the JSON form of a representation that filters and PATCH
+// operations work on.
+func scimResource(v interface{}) (map[string]interface{}, error) {
+	document, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	resource := map[string]interface{}{}
+	return resource, json.Unmarshal(document, &resource)
+}
+
+// fromScimResource decodes a resource changed by PATCH operations. Azure AD
+// sends active as the string "True" or "False".
+func fromScimResource(resource map[string]interface{}, v interface{}) error {
+	for key, value := range resource {
+		if s, ok := value.(string); ok && strings.EqualFold(key, "active") {
+			active, err := strconv.ParseBool(s)
+			if err != nil {
+				return scimInvalid("invalidValue", "The active %q is not a boolean", s)
+			}
+			resource[key] = active
+		}
+	}
+	document, err := json.Marshal(resource)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(document, v); err != nil {
+		return scimInvalid("invalidValue", "The resource is not valid after the operations, %v", err)
+	}
+	return nil
+}
+
+// scimList filters the resources, drops the excluded attributes and answers
+// the page of them that startIndex and count select.
+func scimList(w http.ResponseWriter, r *http.Request, representations []interface{}) {
+	query := r.URL.Query()
+	var filter scimFilter
+	if expression := query.Get("filter"); expression != "" {
+		var err error
+		if filter, err = parseScimFilter(expression); err != nil {
+			returnScimError(w, scimInvalid("invalidFilter", "Malformed filter %q, %v", expression, err))
+			return
+		}
+	}
+	startIndex, count := 1, scimDefaultCount
+	if value := query.Get("startIndex"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			returnScimError(w, scimInvalid("invalidValue", "The startIndex %q is not a number", value))
+			return
+		}
+		if n > 1 {
+			startIndex = n
+		}
+	}
+	if value := query.Get("count"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			returnScimError(w, scimInvalid("invalidValue", "The count %q is not a number", value))
+			return
+		}
+		count = n
+	}
+	if count < 0 {
+		count = 0
+	}
+	if count > scimMaxResults {
+		count = scimMaxResults
+	}
+	matching := []interface{}{}
+	for _, representation := range representations {
+		resource, err := scimResource(representation)
+		if err != nil {
+			returnScimError(w, err)
+			return
+		}
+		if filter != nil && !filter.matches(resource) {
+			continue
+		}
+		excludeScimAttributes(resource, query.Get("excludedAttributes"))
+		matching = append(matching, resource)
+	}
+	page := []interface{}{}
+	if startIndex <= len(matching) {
+		page = matching[startIndex-1:]
+	}
+	if len(page) > count {
+		page = page[:count]
+	}
+	writeScim(w, http.StatusOK, scimListResponse{
+		Schemas:      []string{scimListResponseSchema},
+		TotalResults: len(matching),
+		StartIndex:   startIndex,
+		ItemsPerPage: len(page),
+		Resources:    page,
+	})
+}
+
+// excludeScimAttributes drops the comma separated attributes, other than
+// those always returned.
+func excludeScimAttributes(resource map[string]interface{}, excluded string) {
+	for _, name := range strings.Split(excluded, ",") {
+		name = stripScimSchema(strings.TrimSpace(name))
+		for key := range resource {
+			if strings.EqualFold(key, name) && key != "id" && key != "schemas" {
+				delete(resource, key)
+			}
+		}
+	}
+}
+
+// getScimUser returns ErrNotFound for a user that is not in the store.
+func (s scimProvisioning) getScimUser(ctx context.Context, userId string) (policystore.UserPolicyNames, error) {
+	user, err := s.admin.store.GetUserPolicyNames(ctx, userId)
+	if err == nil && user.UserId == "" {
+		err = policystore.ErrNotFound
+	}
+	return user, err
+}
+
+// groupMembers returns the users permanently attached to each group.
+func (s scimProvisioning) groupMembers(ctx context.Context, options policystore.ListOptions) (map[string][]policystore.UserPolicyNames, error) {
+	users, err := s.admin.allUsers(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	members := map[string][]policystore.UserPolicyNames{}
+	for _, user := range users {
+		for _, name := range user.PolicyGroups {
+			members[name] = append(members[name], user)
+		}
+	}
+	return members, nil
+}
+
+// setMembers attaches the group to the users that are to be members and
+// detaches it from the others, after checking that all of them exist.
+func (s scimProvisioning) setMembers(ctx context.Context, actor audit.Actor, name string, current []policystore.UserPolicyNames, memberIds []string) error {
+	changed := []policystore.UserPolicyNames{}
+	for _, userId := range memberIds {
+		if containsUser(current, userId) || containsUser(changed, userId) {
+			continue
+		}
+		user, err := s.getScimUser(ctx, userId)
+		if err == policystore.ErrNotFound {
+			return scimInvalid("invalidValue", "No such user %s", userId)
+		}
+		if err != nil {
+			return err
+		}
+		user.PolicyGroups = append(user.PolicyGroups, name)
+		changed = append(changed, user)
+	}
+	for _, user := range current {
+		if !contains(memberIds, user.UserId) {
+			user.PolicyGroups = difference(user.PolicyGroups, []string{name})
+			changed = append(changed, user)
+		}
+	}
+	// A change made but not recorded does not stop the others
+	var unrecorded error
+	for _, user := range changed {
+		_, _, err := s.admin.putUser(ctx, actor, user)
+		if _, ok := err.(unrecordedError); ok {
+			unrecorded = err
+		} else if err != nil {
+			return err
+		}
+	}
+	return unrecorded
+}
+
+func containsUser(users []policystore.UserPolicyNames, userId string) bool {
+	for _, user := range users {
+		if user.UserId == userId {
+			return true
+		}
+	}
+	return false
+}
+
+func memberIds(members []scimMember) []string {
+	ids := []string{}
+	for _, member := range members {
+		ids = append(ids, member.Value)
+	}
+	return ids
+}
+
+// applyScimPatch applies the operations of a PATCH request to the resource.
+func applyScimPatch(resource map[string]interface{}, request scimPatchRequest) error {
+	if len(request.Operations) == 0 {
+		return scimInvalid("invalidSyntax", "The request has no Operations")
+	}
+	for _, operation := range request.Operations {
+		op := strings.ToLower(operation.Op)
+		if op != "add" && op != "replace" && op != "remove" {
+			return scimInvalid("invalidSyntax", "Unknown op %q", operation.Op)
+		}
+		var value interface{}
+		if len(operation.Value) > 0 {
+			if err := json.Unmarshal(operation.Value, &value); err != nil {
+				return scimInvalid("invalidValue", "Malformed value of the %s operation, %v", op, err)
+			}
+		}
+		if operation.Path == "" {
+			// Without a path the value holds the attributes to add or
+			// replace
+			attributes, ok := value.(map[string]interface{})
+			if !ok || op == "remove" {
+				return scimInvalid("noTarget", "The %s operation needs a path", op)
+			}
+			for name, value := range attributes {
+				path, err := parseScimPath(name)
+				if err != nil {
+					return scimInvalid("invalidPath", "Malformed path %q, %v", name, err)
+				}
+				patchScimPath(resource, op, path, value)
+			}
+			continue
+		}
+		path, err := parseScimPath(operation.Path)
+		if err != nil {
+			return scimInvalid("invalidPath", "Malformed path %q, %v", operation.Path, err)
+		}
+		if op != "remove" && value == nil {
+			return scimInvalid("invalidValue", "The %s operation of %s has no value", op, operation.Path)
+		}
+		patchScimPath(resource, op, path, value)
+	}
+	return nil
+}
+
+// patchScimPath adds, replaces or removes the value at the path. Adding to
+// a multi-valued attribute appends to it, and removing from one with a
+// value removes only the values given, as Azure AD does for members.
+func patchScimPath(resource map[string]interface{}, op string, path scimPath, value interface{}) {
+	key, current := scimKey(resource, path.attribute)
+	list, isList := current.([]interface{})
+	switch {
+	case path.filter != nil:
+		patched, found := []interface{}{}, false
+		for _, element := range list {
+			object, ok := element.(map[string]interface{})
+			if !ok || !path.filter.matches(object) {
+				patched = append(patched, element)
+				continue
+			}
+			found = true
+			switch {
+			case op == "remove" && path.subAttribute == "":
+			case op == "remove":
+				subKey, _ := scimKey(object, path.subAttribute)
+				delete(object, subKey)
+				patched = append(patched, object)
+			case path.subAttribute != "":
+				subKey, _ := scimKey(object, path.subAttribute)
+				object[subKey] = value
+				patched = append(patched, object)
+			default:
+				if replacement, ok := value.(map[string]interface{}); ok {
+					for k, v := range replacement {
+						subKey, _ := scimKey(object, k)
+						object[subKey] = v
+					}
+				}
+				patched = append(patched, object)
+			}
+		}
+		// Setting emails[type eq "work"].value when there is no work email
+		// adds one
+		if comparison, ok := path.filter.(scimComparison); !found && op != "remove" && ok && comparison.operator == "eq" && comparison.path.filter == nil && comparison.path.subAttribute == "" {
+			element := map[string]interface{}{comparison.path.attribute: comparison.value}
+			if path.subAttribute != "" {
+				element[path.subAttribute] = value
+			} else if object, ok := value.(map[string]interface{}); ok {
+				for k, v := range object {
+					element[k] = v
+				}
+			}
+			patched = append(patched, element)
+		}
+		resource[key] = patched
+	case path.subAttribute != "":
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			object = map[string]interface{}{}
+		}
+		subKey, _ := scimKey(object, path.subAttribute)
+		if op == "remove" {
+			delete(object, subKey)
+		} else {
+			object[subKey] = value
+		}
+		resource[key] = object
+	case op == "remove" && isList && value != nil:
+		removed := memberValues(value)
+		patched := []interface{}{}
+		for _, element := range list {
+			if !contains(removed, scimElementValue(element)) {
+				patched = append(patched, element)
+			}
+		}
+		resource[key] = patched
+	case op == "remove":
+		delete(resource, key)
+	case op == "add" && isList:
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+		for _, v := range values {
+			if !contains(memberValues(list), scimElementValue(v)) || scimElementValue(v) == "" {
+				list = append(list, v)
+			}
+		}
+		resource[key] = list
+	default:
+		resource[key] = value
+	}
+}
+
+// scimKey returns the key of the attribute in the resource, whatever its
+// case, and its value, or the name given when it is not there.
+func scimKey(resource map[string]interface{}, name string) (string, interface{}) {
+	for key, value := range resource {
+		if strings.EqualFold(key, name) {
+			return key, value
+		}
+	}
+	return name, nil
+}
+
+// scimElementValue is the value sub-attribute of an element of a
+// multi-valued attribute, such as the id of a member.
+func scimElementValue(element interface{}) string {
+	if object, ok := element.(map[string]interface{}); ok {
+		_, value := scimKey(object, "value")
+		s, _ := value.(string)
+		return s
+	}
+	s, _ := element.(string)
+	return s
+}
+
+func memberValues(value interface{}) []string {
+	values := []string{}
+	list, ok := value.([]interface{})
+	if !ok {
+		list = []interface{}{value}
+	}
+	for _, element := range list {
+		values = append(values, scimElementValue(element))
+	}
+	return values
+}
+
+func scimServiceProviderConfigHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeScim(w, http.StatusOK, map[string]interface{}{
+			"schemas":        []string{scimServiceProviderConfigSchema},
+			"patch":          map[string]bool{"supported": true},
+			"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+			"filter":         map[string]interface{}{"supported": true, "maxResults": scimMaxResults},
+			"changePassword": map[string]bool{"supported": false},
+			"sort":           map[string]bool{"supported": false},
+			"etag":           map[string]bool{"supported": false},
+			"authenticationSchemes": []map[string]string{{
+				"type":        "oauthbearertoken",
+				"name":        "Provisioning token",
+				"description": "The bearer token configured as scimBearerToken",
+			}},
+			"meta": map[string]string{"resourceType": "ServiceProviderConfig", "location": scimBaseUrl(r) + "/ServiceProviderConfig"},
+		})
+	}
+}
+
+// scimListUsersHandler reads all the users for every request, as filters
+// may name any attribute of the profiles.
+func scimListUsersHandler(s scimProvisioning) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		users, err := s.admin.allUsers(r.Context(), policystore.ListOptions{})
+		if err != nil {
+			returnScimError(w, err)
+			return
+		}
+		baseUrl := scimBaseUrl(r)
+		representations := []interface{}{}
+		for _, user := range users {
+			representations = append(representations, toScimUser(user, baseUrl))
+		}
+		scimList(w, r, representations)
+	}
+}
+
+func scimGetUserHandler(s scimProvisioning) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := s.getScimUser(r.Context(), mux.Vars(r)["id"])
+		if err != nil {
+			returnScimError(w, err)
+			return
+		}
+		writeScim(w, http.StatusOK, toScimUser(user, scimBaseUrl(r)))
+	}
+}
+
+// scimCreateUserHandler creates the user, or gives a profile to a user the
+// admin API already attached policies to.
+func scimCreateUserHandler(s scimProvisioning) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := scimUser{}
+		if err := decodeScim(r, &u); err != nil {
+			returnScimError(w, err)
+			return
+		}
+		profile, err := scimProfile(u, time.Now().Unix())
+		if err != nil {
+			returnScimError(w, err)
+			return
+		}
+		user, err := s.admin.store.GetUserPolicyNames(r.Context(), s.userIdPrefix+profile.UserName)
+		if err != nil {
+			returnScimError(w, err)
+			return
+		}
+		if user.Scim != nil {
+			returnScimError(w, scimError{status: http.StatusConflict, scimType: "uniqueness", detail: fmt.Sprintf("The user %s exists", profile.UserName)})
+			return
+		}
+		user.UserId, user.Scim = s.userIdPrefix+profile.UserName, &profile
+		user, _, err = s.admin.putUser(r.Context(), scimRequestActor(w, r), user)
+		if err = made(w, err); err != nil {
+			returnScimError(w, err)
+			return
+		}
+		writeScim(w, http.StatusCreated, toScimUser(user, scimBaseUrl(r)))
+	}
+}
+
+// scimReplaceUserHandler replaces the profile of the user. The id stays
+// what it was created with when the userName changes.
+func scimReplaceUserHandler(s scimProvisioning) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := s.getScimUser(r.Context(), mux.Vars(r)["id"])
+		if err != nil {
+			returnScimError(w, err)
+			return
+		}
+		u := scimUser{}
+		if err = decodeScim(r, &u); err != nil {
+			returnScimError(w, err)
+			return
+		}
+		s.writeUser(w, r, user, u)
+	}
+}
+
+func scimPatchUserHandler(s scimProvisioning) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := s.getScimUser(r.Context(), mux.Vars(r)["id"])
+		if err != nil {
+			returnScimError(w, err)
+			return
+		}
+		request := scimPatchRequest{}
+		if err = decodeScim(r, &request); err != nil {
+			returnScimError(w, err)
+			return
+		}
+		resource, err := scimResource(toScimUser(user, scimBaseUrl(r)))
+		if err == nil {
+			err = applyScimPatch(resource, request)
+		}
+		u := scimUser{}
+		if err == nil {
+			err = fromScimResource(resource, &u)
+		}
+		if err != nil {
+			returnScimError(w, err)
+			return
+		}
+		s.writeUser(w, r, user, u)
+	}
+}
+
+// writeUser gives the user the profile of the representation, keeping the
+// time it was first provisioned.
+func (s scimProvisioning) writeUser(w http.ResponseWriter, r *http.Request, user policystore.UserPolicyNames, u scimUser) {
+	created := time.Now().Unix()
+	if user.Scim != nil {
+		created = user.Scim.Created
+	}
+	profile, err := scimProfile(u, created)
+	if err != nil {
+		returnScimError(w, err)
+		return
+	}
+	user.Scim = &profile
+	user, _, err = s.admin.putUser(r.Context(), scimRequestActor(w, r), user)
+	if err = made(w, err); err != nil {
+		returnScimError(w, err)
+		return
+	}
+	writeScim(w, http.StatusOK, toScimUser(user, scimBaseUrl(r)))
+}
+
+// scimDeleteUserHandler deletes the user with its attachments. Identity
+// providers usually deactivate users instead, which keeps them.
+func scimDeleteUserHandler(s scimProvisioning) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId := mux.Vars(r)["id"]
+		if _, err := s.getScimUser(r.Context(), userId); err != nil {
+			returnScimError(w, err)
+			return
+		}
+		if err := made(w, s.admin.deleteUser(r.Context(), scimRequestActor(w, r), userId, anyRevision)); err != nil {
+			returnScimError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// scimListGroupsHandler reads the members of the groups unless they are
+// excluded and not filtered on, as when Azure AD looks a group up by name.
+func scimListGroupsHandler(s scimProvisioning) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		groups, err := s.admin.allPolicyGroups(r.Context(), policystore.ListOptions{})
+		if err != nil {
+			returnScimError(w, err)
+			return
+		}
+		members := map[string][]policystore.UserPolicyNames{}
+		query := r.URL.Query()
+		if !strings.Contains(strings.ToLower(query.Get("excludedAttributes")), "members") || strings.Contains(strings.ToLower(query.Get("filter")), "members") {
+			if members, err = s.groupMembers(r.Context(), policystore.ListOptions{}); err != nil {
+				returnScimError(w, err)
+				return
+			}
+		}
+		baseUrl := scimBaseUrl(r)
+		representations := []interface{}{}
+		for _, group := range groups {
+			representations = append(representations, toScimGroup(group, members[group.Name], baseUrl))
+		}
+		scimList(w, r, representations)
+	}
+}
+
+// getScimGroup returns the group with its members.
+func (s scimProvisioning) getScimGroup(ctx context.Context, name string) (policystore.PolicyGroup, []policystore.UserPolicyNames, error) {
+	group, err := s.admin.getPolicyGroup(ctx, name)
+	if err != nil {
+		return group, nil, err
+	}
+	members, err := s.groupMembers(ctx, policystore.ListOptions{Group: name})
+	if err != nil {
+		return group, nil, err
+	}
+	sort.Slice(members[name], func(i, j int) bool { return members[name][i].UserId < members[name][j].UserId })
+	return group, members[name], nil
+}
+
+func scimGetGroupHandler(s scimProvisioning) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		group, members, err := s.getScimGroup(r.Context(), mux.Vars(r)["id"])
+		if err != nil {
+			returnScimError(w, err)
+			return
+		}
+		writeScim(w, http.StatusOK, toScimGroup(group, members, scimBaseUrl(r)))
+	}
+}
+
+// scimCreateGroupHandler creates a policy group without policies, which the
+// admin API attaches. The displayName must be a valid policy group name.
+func scimCreateGroupHandler(s scimProvisioning) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		g := scimGroup{}
+		if err := decodeScim(r, &g); err != nil {
+			returnScimError(w, err)
+			return
+		}
+		if err := policystore.ValidateName("policy group", g.DisplayName); err != nil {
+			returnScimError(w, err)
+			return
+		}
+		_, err := s.admin.getPolicyGroup(r.Context(), g.DisplayName)
+		if err == nil {
+			returnScimError(w, scimError{status: http.StatusConflict, scimType: "uniqueness", detail: fmt.Sprintf("The group %s exists", g.DisplayName)})
+			return
+		}
+		if err != policystore.ErrNotFound {
+			returnScimError(w, err)
+			return
+		}
+		actor := scimRequestActor(w, r)
+		if _, _, err = s.admin.putPolicyGroup(r.Context(), actor, policystore.PolicyGroup{Name: g.DisplayName}); made(w, err) != nil {
+			returnScimError(w, err)
+			return
+		}
+		s.writeMembers(w, r, actor, g.DisplayName, nil, memberIds(g.Members), http.StatusCreated)
+	}
+}
+
+// scimReplaceGroupHandler replaces the members of the group. Groups cannot
+// be renamed, as their name is their id.
+func scimReplaceGroupHandler(s scimProvisioning) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		group, members, err := s.getScimGroup(r.Context(), mux.Vars(r)["id"])
+		if err != nil {
+			returnScimError(w, err)
+			return
+		}
+		g := scimGroup{}
+		if err = decodeScim(r, &g); err != nil {
+			returnScimError(w, err)
+			return
+		}
+		if g.DisplayName != "" && g.DisplayName != group.Name {
+			returnScimError(w, scimInvalid("mutability", "The group %s cannot be renamed", group.Name))
+			return
+		}
+		s.writeMembers(w, r, scimRequestActor(w, r), group.Name, members, memberIds(g.Members), http.StatusOK)
+	}
+}
+
+func scimPatchGroupHandler(s scimProvisioning) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		group, members, err := s.getScimGroup(r.Context(), mux.Vars(r)["id"])
+		if err != nil {
+			returnScimError(w, err)
+			return
+		}
+		request := scimPatchRequest{}
+		if err = decodeScim(r, &request); err != nil {
+			returnScimError(w, err)
+			return
+		}
+		resource, err := scimResource(toScimGroup(group, members, scimBaseUrl(r)))
+		if err == nil {
+			err = applyScimPatch(resource, request)
+		}
+		g := scimGroup{}
+		if err == nil {
+			err = fromScimResource(resource, &g)
+		}
+		if err == nil && g.DisplayName != group.Name {
+			err = scimInvalid("mutability", "The group %s cannot be renamed", group.Name)
+		}
+		if err != nil {
+			returnScimError(w, err)
+			return
+		}
+		s.writeMembers(w, r, scimRequestActor(w, r), group.Name, members, memberIds(g.Members), http.StatusOK)
+	}
+}
+
+// writeMembers sets the members of the group and answers with the group.
+func (s scimProvisioning) writeMembers(w http.ResponseWriter, r *http.Request, actor audit.Actor, name string, current []policystore.UserPolicyNames, ids []string, statusCode int) {
+	if err := made(w, s.setMembers(r.Context(), actor, name, current, ids)); err != nil {
+		returnScimError(w, err)
+		return
+	}
+	group, members, err := s.getScimGroup(r.Context(), name)
+	if err != nil {
+		returnScimError(w, err)
+		return
+	}
+	writeScim(w, statusCode, toScimGroup(group, members, scimBaseUrl(r)))
+}
+
+// scimDeleteGroupHandler removes the members from the group and deletes
+// it, unless it is nested in another group.
+func scimDeleteGroupHandler(s scimProvisioning) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		group, members, err := s.getScimGroup(r.Context(), mux.Vars(r)["id"])
+		if err != nil {
+			returnScimError(w, err)
+			return
+		}
+		parents, _, err := s.admin.store.ListPolicyGroups(r.Context(), policystore.ListOptions{Group: group.Name, Limit: 1})
+		if err != nil {
+			returnScimError(w, err)
+			return
+		}
+		if len(parents) > 0 {
+			returnScimError(w, inUseError{name: group.Name, referrer: "policy group " + parents[0].Name})
+			return
+		}
+		actor := scimRequestActor(w, r)
+		if err = made(w, s.setMembers(r.Context(), actor, group.Name, members, nil)); err == nil {
+			err = made(w, s.admin.deletePolicyGroup(r.Context(), actor, group.Name, anyRevision))
+		}
+		if err != nil {
+			returnScimError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// routeScim registers the SCIM endpoints on the router, behind the
+// provisioning token.
+func routeScim(r *mux.Router, s scimProvisioning, token string) {
+	scim := r.PathPrefix(scimPrefix).Subrouter()
+	scim.Use(scimAuthentication(token))
+	scim.Handle("/ServiceProviderConfig", scimServiceProviderConfigHandler()).Methods("GET")
+	scim.Handle("/Users", scimListUsersHandler(s)).Methods("GET")
+	scim.Handle("/Users", scimCreateUserHandler(s)).Methods("POST")
+	scim.Handle("/Users/{id}", scimGetUserHandler(s)).Methods("GET")
+	scim.Handle("/Users/{id}", scimReplaceUserHandler(s)).Methods("PUT")
+	scim.Handle("/Users/{id}", scimPatchUserHandler(s)).Methods("PATCH")
+	scim.Handle("/Users/{id}", scimDeleteUserHandler(s)).Methods("DELETE")
+	scim.Handle("/Groups", scimListGroupsHandler(s)).Methods("GET")
+	scim.Handle("/Groups", scimCreateGroupHandler(s)).Methods("POST")
+	scim.Handle("/Groups/{id}", scimGetGroupHandler(s)).Methods("GET")
+	scim.Handle("/Groups/{id}", scimReplaceGroupHandler(s)).Methods("PUT")
+	scim.Handle("/Groups/{id}", scimPatchGroupHandler(s)).Methods("PATCH")
+	scim.Handle("/Groups/{id}", scimDeleteGroupHandler(s)).Methods("DELETE")
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/shafiquejamal/reactjs-golang-starter/audit"
+	"github.com/shafiquejamal/reactjs-golang-starter/auth"
+	"github.com/shafiquejamal/reactjs-golang-starter/policystore"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestScimFilter(t *testing.T) {
+
+	Convey("SCIM filters", t, func() {
+		resource := map[string]interface{}{
+			"userName": "Jane@example.com",
+			"active":   true,
+			"name":     map[string]interface{}{"givenName": "Jane"},
+			"emails": []interface{}{
+				map[string]interface{}{"value": "jane@example.com", "type": "work"},
+				map[string]interface{}{"value": "jane@home.example", "type": "home"},
+			},
+		}
+		matches := func(expression string) bool {
+			filter, err := parseScimFilter(expression)
+			So(err, ShouldBeNil)
+			return filter.matches(resource)
+		}
+
+		Convey("compare attributes and values case-insensitively", func() {
+			So(matches(`userName eq "jane@example.com"`), ShouldBeTrue)
+			So(matches(`USERNAME sw "jane" and active eq true`), ShouldBeTrue)
+			So(matches(`urn:ietf:params:scim:schemas:core:2.0:User:userName ew "example.com"`), ShouldBeTrue)
+			So(matches(`name.givenName ne "Jane"`), ShouldBeFalse)
+			So(matches(`externalId pr`), ShouldBeFalse)
+			So(matches(`externalId pr or not (active eq false)`), ShouldBeTrue)
+		})
+
+		Convey("select values of multi-valued attributes", func() {
+			So(matches(`emails co "home.example"`), ShouldBeTrue)
+			So(matches(`emails[type eq "work" and value co "home"]`), ShouldBeFalse)
+			So(matches(`emails[type eq "home"].value eq "jane@home.example"`), ShouldBeTrue)
+			So(matches(`(emails.type eq "other") or (userName eq "bob")`), ShouldBeFalse)
+		})
+
+		Convey("reject what they cannot parse", func() {
+			for _, expression := range []string{`userName eq`, `userName is "jane"`, `userName eq "jane`, `(active eq true`, `active eq true false`} {
+				_, err := parseScimFilter(expression)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
+
+func TestScimProvisioning(t *testing.T) {
+
+	Convey("SCIM provisioning", t, func() {
+		store := policystore.NewMemoryPolicyStore()
+		store.PutPolicies(context.Background(), policystore.PermsWithMeta{Name: "deploy", Permissions: auth.Permission{Allows: []auth.Statement{{Actions: []string{"^/deploy$"}}}}})
+		store.PutPolicyGroups(context.Background(),
+			policystore.PolicyGroup{Name: "backend", PolicyNames: []string{"deploy"}},
+			policystore.PolicyGroup{Name: "engineering", PolicyGroups: []string{"backend"}},
+		)
+		store.PutUserPolicyNames(context.Background(), policystore.UserPolicyNames{UserId: "okta|bob@example.com", PolicyNames: []string{"deploy"}})
+		dir, err := ioutil.TempDir("", "scim")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		sink := audit.NewFileSink(filepath.Join(dir, "audit.log"))
+		admin := adminStore{store: store, maxPolicyGroupDepth: policystore.DefaultMaxPolicyGroupDepth, trail: auditTrail{sink: sink}}
+		router := mux.NewRouter()
+		routeScim(router, scimProvisioning{admin: admin, userIdPrefix: "okta|"}, "secret")
+		serve := func(method, target, body string) (*httptest.ResponseRecorder, map[string]interface{}) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(method, target, strings.NewReader(body))
+			r.Header.Set("Authorization", "Bearer secret")
+			router.ServeHTTP(w, r)
+			response := map[string]interface{}{}
+			json.Unmarshal(w.Body.Bytes(), &response)
+			return w, response
+		}
+
+		Convey("needs the provisioning token", func() {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/scim/v2/Users", nil)
+			r.Header.Set("Authorization", "Bearer guess")
+			router.ServeHTTP(w, r)
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+			So(w.Header().Get("Content-Type"), ShouldEqual, scimContentType)
+		})
+
+		w, created := serve("POST", "/scim/v2/Users", `{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"], "userName": "jane@example.com", "externalId": "00u1", "name": {"givenName": "Jane"}, "emails": [{"value": "jane@example.com", "type": "work", "primary": true}]}`)
+		So(w.Code, ShouldEqual, http.StatusCreated)
+		So(created["id"], ShouldEqual, "okta|jane@example.com")
+		So(created["active"], ShouldEqual, true)
+
+		Convey("creates users, once", func() {
+			user, _ := store.GetUserPolicyNames(context.Background(), "okta|jane@example.com")
+			So(user.Scim.ExternalId, ShouldEqual, "00u1")
+			So(user.Scim.GivenName, ShouldEqual, "Jane")
+			w, response := serve("POST", "/scim/v2/Users", `{"userName": "jane@example.com"}`)
+			So(w.Code, ShouldEqual, http.StatusConflict)
+			So(response["scimType"], ShouldEqual, "uniqueness")
+			events, _, _ := sink.Query(context.Background(), audit.Filter{Actor: scimActor})
+			So(len(events), ShouldEqual, 1)
+		})
+
+		Convey("gives a profile to a user with attachments", func() {
+			w, response := serve("POST", "/scim/v2/Users", `{"userName": "bob@example.com"}`)
+			So(w.Code, ShouldEqual, http.StatusCreated)
+			So(response["id"], ShouldEqual, "okta|bob@example.com")
+			user, _ := store.GetUserPolicyNames(context.Background(), "okta|bob@example.com")
+			So(user.PolicyNames, ShouldResemble, []string{"deploy"})
+		})
+
+		Convey("lists users by filter, a page at a time", func() {
+			w, response := serve("GET", `/scim/v2/Users?filter=userName+eq+%22JANE@example.com%22`, "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(response["totalResults"], ShouldEqual, 1)
+			_, response = serve("GET", "/scim/v2/Users?startIndex=2&count=5", "")
+			So(response["totalResults"], ShouldEqual, 2)
+			So(response["itemsPerPage"], ShouldEqual, 1)
+			So(response["Resources"].([]interface{})[0].(map[string]interface{})["id"], ShouldEqual, "okta|jane@example.com")
+			w, response = serve("GET", `/scim/v2/Users?filter=userName+eq`, "")
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(response["scimType"], ShouldEqual, "invalidFilter")
+		})
+
+		Convey("patches users, and denies deactivated ones everything", func() {
+			store.PutUserPolicyNames(context.Background(), policystore.UserPolicyNames{UserId: "okta|jane@example.com", PolicyNames: []string{"deploy"}, Scim: &policystore.ScimProfile{UserName: "jane@example.com", Active: true}, Revision: 1})
+			w, response := serve("PATCH", "/scim/v2/Users/okta%7Cjane@example.com", `{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [
+				{"op": "Replace", "path": "active", "value": "False"},
+				{"op": "replace", "path": "emails[type eq \"work\"].value", "value": "jane.doe@example.com"},
+				{"op": "add", "value": {"name.familyName": "Doe", "displayName": "Jane Doe"}}
+			]}`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(response["active"], ShouldEqual, false)
+			user, _ := store.GetUserPolicyNames(context.Background(), "okta|jane@example.com")
+			So(user.Scim.Emails, ShouldResemble, []policystore.ScimEmail{{Value: "jane.doe@example.com", Type: "work"}})
+			So(user.Scim.FamilyName, ShouldEqual, "Doe")
+			So(user.Scim.DisplayName, ShouldEqual, "Jane Doe")
+			So(user.PolicyNames, ShouldResemble, []string{"deploy"})
+
+			u := auth.User{}
+			So(userDataFetcher(store, nil, nil, nil, policystore.DefaultMaxPolicyGroupDepth)(context.Background(), &auth.UserIdentity{UserId: "okta|jane@example.com"}, &u), ShouldBeNil)
+			So(u.Permissions, ShouldBeEmpty)
+			So(u.Deactivated, ShouldBeTrue)
+
+			w, response = serve("PATCH", "/scim/v2/Users/okta%7Cjane@example.com", `{"Operations": [{"op": "move", "path": "active"}]}`)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(response["scimType"], ShouldEqual, "invalidSyntax")
+		})
+
+		Convey("keeps the profile when the admin API replaces the attachments", func() {
+			_, _, err := admin.putUser(context.Background(), audit.Actor{UserId: "auth0|admin"}, policystore.UserPolicyNames{UserId: "okta|jane@example.com", PolicyGroups: []string{"backend"}, Revision: 1})
+			So(err, ShouldBeNil)
+			_, response := serve("GET", "/scim/v2/Users/okta%7Cjane@example.com", "")
+			So(response["userName"], ShouldEqual, "jane@example.com")
+			So(response["groups"].([]interface{})[0].(map[string]interface{})["value"], ShouldEqual, "backend")
+		})
+
+		Convey("maps groups onto policy groups", func() {
+			w, group := serve("POST", "/scim/v2/Groups", `{"displayName": "oncall", "members": [{"value": "okta|jane@example.com"}]}`)
+			So(w.Code, ShouldEqual, http.StatusCreated)
+			So(group["id"], ShouldEqual, "oncall")
+			user, _ := store.GetUserPolicyNames(context.Background(), "okta|jane@example.com")
+			So(user.PolicyGroups, ShouldResemble, []string{"oncall"})
+
+			w, _ = serve("POST", "/scim/v2/Groups", `{"displayName": "On call"}`)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			w, _ = serve("POST", "/scim/v2/Groups", `{"displayName": "backend", "members": [{"value": "okta|nobody"}]}`)
+			So(w.Code, ShouldEqual, http.StatusConflict)
+
+			Convey("whose members are patched", func() {
+				w, group := serve("PATCH", "/scim/v2/Groups/backend", `{"Operations": [{"op": "add", "path": "members", "value": [{"value": "okta|jane@example.com"}, {"value": "okta|bob@example.com"}]}]}`)
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(len(group["members"].([]interface{})), ShouldEqual, 2)
+				w, group = serve("PATCH", "/scim/v2/Groups/backend", `{"Operations": [{"op": "remove", "path": "members[value eq \"okta|bob@example.com\"]"}]}`)
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(len(group["members"].([]interface{})), ShouldEqual, 1)
+				user, _ := store.GetUserPolicyNames(context.Background(), "okta|bob@example.com")
+				So(user.PolicyGroups, ShouldBeEmpty)
+				w, _ = serve("PATCH", "/scim/v2/Groups/backend", `{"Operations": [{"op": "add", "path": "members", "value": [{"value": "okta|nobody"}]}]}`)
+				So(w.Code, ShouldEqual, http.StatusBadRequest)
+				w, _ = serve("PATCH", "/scim/v2/Groups/backend", `{"Operations": [{"op": "replace", "path": "displayName", "value": "frontend"}]}`)
+				So(w.Code, ShouldEqual, http.StatusBadRequest)
+
+				_, list := serve("GET", `/scim/v2/Groups?filter=members[value+eq+%22okta|jane@example.com%22]&excludedAttributes=members`, "")
+				So(list["totalResults"], ShouldEqual, 2)
+				So(list["Resources"].([]interface{})[0].(map[string]interface{})["members"], ShouldBeNil)
+				_, list = serve("GET", `/scim/v2/Groups?filter=displayName+eq+%22backend%22`, "")
+				So(list["totalResults"], ShouldEqual, 1)
+			})
+
+			Convey("which are deleted with their memberships, unless nested", func() {
+				w, _ := serve("DELETE", "/scim/v2/Groups/oncall", "")
+				So(w.Code, ShouldEqual, http.StatusNoContent)
+				user, _ := store.GetUserPolicyNames(context.Background(), "okta|jane@example.com")
+				So(user.PolicyGroups, ShouldBeEmpty)
+				w, _ = serve("DELETE", "/scim/v2/Groups/backend", "")
+				So(w.Code, ShouldEqual, http.StatusConflict)
+				w, _ = serve("GET", "/scim/v2/Groups/oncall", "")
+				So(w.Code, ShouldEqual, http.StatusNotFound)
+			})
+		})
+
+		Convey("deletes users", func() {
+			w, _ := serve("DELETE", "/scim/v2/Users/okta%7Cjane@example.com", "")
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+			w, response := serve("GET", "/scim/v2/Users/okta%7Cjane@example.com", "")
+			So(w.Code, ShouldEqual, http.StatusNotFound)
+			So(response["schemas"], ShouldResemble, []interface{}{scimErrorSchema})
+		})
+	})
+}
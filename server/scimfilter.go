@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// scimFilter is a parsed SCIM filter (RFC 7644, 3.4.2.2), evaluated against
+// the JSON form of a resource. Attribute names and string values compare
+// case-insensitively.
+type scimFilter interface {
+	matches(resource map[string]interface{}) bool
+}
+
+type scimLogical struct {
+	and         bool
+	left, right scimFilter
+}
+
+type scimNot struct {
+	filter scimFilter
+}
+
+// scimComparison compares the attribute at path with value, or tells
+// whether it is present for the pr operator.
+type scimComparison struct {
+	path     scimPath
+	operator string
+	value    interface{}
+}
+
+// scimValuePath selects the values of a multi-valued attribute the filter
+// matches, as in emails[type eq "work"].
+type scimValuePath struct {
+	attribute string
+	filter    scimFilter
+}
+
+// scimPath is an attribute, optionally narrowed to the values matching a
+// filter, and a sub-attribute of it, as in emails[type eq "work"].value or
+// name.givenName.
+type scimPath struct {
+	attribute    string
+	filter       scimFilter
+	subAttribute string
+}
+
+// scimSchemaPrefixes may precede an attribute name.
+var scimSchemaPrefixes = []string{scimUserSchema + ":", scimGroupSchema + ":"}
+
+func (f scimLogical) matches(resource map[string]interface{}) bool {
+	if f.and {
+		return f.left.matches(resource) && f.right.matches(resource)
+	}
+	return f.left.matches(resource) || f.right.matches(resource)
+}
+
+func (f scimNot) matches(resource map[string]interface{}) bool {
+	return !f.filter.matches(resource)
+}
+
+func (f scimValuePath) matches(resource map[string]interface{}) bool {
+	for _, value := range attributeValues(resource, f.attribute) {
+		if object, ok := value.(map[string]interface{}); ok && f.filter.matches(object) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f scimComparison) matches(resource map[string]interface{}) bool {
+	values := f.path.values(resource)
+	if f.operator == "pr" {
+		for _, value := range values {
+			if value != nil && value != "" {
+				return true
+			}
+		}
+		return false
+	}
+	if f.operator == "ne" {
+		return !scimComparison{path: f.path, operator: "eq", value: f.value}.matches(resource)
+	}
+	for _, value := range values {
+		if compareScimValues(value, f.operator, f.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// values returns the values at the path. A complex multi-valued attribute
+// without a sub-attribute stands for its value sub-attribute, so that
+// emails co "example.com" compares the addresses.
+func (p scimPath) values(resource map[string]interface{}) []interface{} {
+	values := []interface{}{}
+	for _, value := range attributeValues(resource, p.attribute) {
+		object, isObject := value.(map[string]interface{})
+		switch {
+		case p.filter != nil && (!isObject || !p.filter.matches(object)):
+		case p.subAttribute != "" && isObject:
+			values = append(values, attributeValues(object, p.subAttribute)...)
+		case p.subAttribute != "":
+		case isObject:
+			values = append(values, attributeValues(object, "value")...)
+		default:
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// attributeValues returns the value of the attribute, or each of them if it
+// is multi-valued.
+func attributeValues(resource map[string]interface{}, name string) []interface{} {
+	for key, value := range resource {
+		if !strings.EqualFold(key, name) {
+			continue
+		}
+		if list, ok := value.([]interface{}); ok {
+			return list
+		}
+		return []interface{}{value}
+	}
+	return nil
+}
+
+func compareScimValues(value interface{}, operator string, expected interface{}) bool {
+	switch expected := expected.(type) {
+	case string:
+		actual, ok := value.(string)
+		if !ok {
+			return false
+		}
+		actual, expected = strings.ToLower(actual), strings.ToLower(expected)
+		switch operator {
+		case "eq":
+			return actual == expected
+		case "co":
+			return strings.Contains(actual, expected)
+		case "sw":
+			return strings.HasPrefix(actual, expected)
+		case "ew":
+			return strings.HasSuffix(actual, expected)
+		case "gt":
+			return actual > expected
+		case "ge":
+			return actual >= expected
+		case "lt":
+			return actual < expected
+		case "le":
+			return actual <= expected
+		}
+	case float64:
+		actual, ok := value.(float64)
+		if !ok {
+			return false
+		}
+		switch operator {
+		case "eq":
+			return actual == expected
+		case "gt":
+			return actual > expected
+		case "ge":
+			return actual >= expected
+		case "lt":
+			return actual < expected
+		case "le":
+			return actual <= expected
+		}
+	default:
+		return operator == "eq" && value == expected
+	}
+	return false
+}
+
+// scimTokens splits a filter into attribute paths, operators, values and
+// the brackets and parentheses around them.
+func scimTokens(filter string) ([]string, error) {
+	tokens := []string{}
+	for i := 0; i < len(filter); {
+		c := rune(filter[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.ContainsRune("()[]", c):
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			end := i + 1
+			for ; end < len(filter) && filter[end] != '"'; end++ {
+				if filter[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(filter) {
+				return nil, errors.New(fmt.Sprintf("The string at %d is not terminated", i))
+			}
+			tokens = append(tokens, filter[i:end+1])
+			i = end + 1
+		default:
+			end := i
+			for ; end < len(filter) && !unicode.IsSpace(rune(filter[end])) && !strings.ContainsRune("()[]\"", rune(filter[end])); end++ {
+			}
+			// A sub-attribute may follow a value filter, as in emails[type eq "work"].value
+			tokens = append(tokens, filter[i:end])
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type scimFilterParser struct {
+	tokens []string
+	next   int
+}
+
+// parseScimFilter parses a filter such as
+// userName eq "jane" or (emails[type eq "work"] and not (active eq false)).
+func parseScimFilter(filter string) (scimFilter, error) {
+	tokens, err := scimTokens(filter)
+	if err != nil {
+		return nil, err
+	}
+	p := &scimFilterParser{tokens: tokens}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.next < len(p.tokens) {
+		return nil, errors.New(fmt.Sprintf("Unexpected %q", p.tokens[p.next]))
+	}
+	return f, nil
+}
+
+// parseScimPath parses the path of a PATCH operation, such as
+// members[value eq "2819c223"] or name.givenName.
+func parseScimPath(path string) (scimPath, error) {
+	tokens, err := scimTokens(path)
+	if err != nil {
+		return scimPath{}, err
+	}
+	p := &scimFilterParser{tokens: tokens}
+	parsed, err := p.path()
+	if err != nil {
+		return scimPath{}, err
+	}
+	if p.next < len(p.tokens) {
+		return scimPath{}, errors.New(fmt.Sprintf("Unexpected %q", p.tokens[p.next]))
+	}
+	return parsed, nil
+}
+
+func (p *scimFilterParser) peek() string {
+	if p.next < len(p.tokens) {
+		return p.tokens[p.next]
+	}
+	return ""
+}
+
+func (p *scimFilterParser) take() string {
+	token := p.peek()
+	p.next++
+	return token
+}
+
+func (p *scimFilterParser) expect(token string) error {
+	if next := p.take(); next != token {
+		return errors.New(fmt.Sprintf("Expected %q rather than %q", token, next))
+	}
+	return nil
+}
+
+func (p *scimFilterParser) or() (scimFilter, error) {
+	left, err := p.and()
+	for err == nil && strings.EqualFold(p.peek(), "or") {
+		p.take()
+		var right scimFilter
+		if right, err = p.and(); err == nil {
+			left = scimLogical{left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *scimFilterParser) and() (scimFilter, error) {
+	left, err := p.not()
+	for err == nil && strings.EqualFold(p.peek(), "and") {
+		p.take()
+		var right scimFilter
+		if right, err = p.not(); err == nil {
+			left = scimLogical{and: true, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *scimFilterParser) not() (scimFilter, error) {
+	if !strings.EqualFold(p.peek(), "not") {
+		return p.atom()
+	}
+	p.take()
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	return scimNot{filter: f}, p.expect(")")
+}
+
+func (p *scimFilterParser) atom() (scimFilter, error) {
+	if p.peek() == "(" {
+		p.take()
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return f, p.expect(")")
+	}
+	path, err := p.path()
+	if err != nil {
+		return nil, err
+	}
+	if path.filter != nil && path.subAttribute == "" && p.peek() != "pr" && !isScimOperator(p.peek()) {
+		return scimValuePath{attribute: path.attribute, filter: path.filter}, nil
+	}
+	operator := strings.ToLower(p.take())
+	if operator == "pr" {
+		return scimComparison{path: path, operator: operator}, nil
+	}
+	if !isScimOperator(operator) {
+		return nil, errors.New(fmt.Sprintf("Unknown operator %q", operator))
+	}
+	value, err := parseScimValue(p.take())
+	if err != nil {
+		return nil, err
+	}
+	return scimComparison{path: path, operator: operator, value: value}, nil
+}
+
+func (p *scimFilterParser) path() (scimPath, error) {
+	attribute := stripScimSchema(p.take())
+	if attribute == "" || strings.ContainsAny(attribute, "()[]\"") {
+		return scimPath{}, errors.New(fmt.Sprintf("Expected an attribute rather than %q", attribute))
+	}
+	path := scimPath{attribute: attribute}
+	if dot := strings.Index(attribute, "."); dot >= 0 {
+		path.attribute, path.subAttribute = attribute[:dot], attribute[dot+1:]
+		return path, nil
+	}
+	if p.peek() != "[" {
+		return path, nil
+	}
+	p.take()
+	f, err := p.or()
+	if err != nil {
+		return scimPath{}, err
+	}
+	if err = p.expect("]"); err != nil {
+		return scimPath{}, err
+	}
+	path.filter = f
+	if strings.HasPrefix(p.peek(), ".") {
+		path.subAttribute = strings.TrimPrefix(p.take(), ".")
+	}
+	return path, nil
+}
+
+func stripScimSchema(attribute string) string {
+	for _, prefix := range scimSchemaPrefixes {
+		if len(attribute) > len(prefix) && strings.EqualFold(attribute[:len(prefix)], prefix) {
+			return attribute[len(prefix):]
+		}
+	}
+	return attribute
+}
+
+func isScimOperator(token string) bool {
+	switch strings.ToLower(token) {
+	case "eq", "ne", "co", "sw", "ew", "gt", "ge", "lt", "le":
+		return true
+	}
+	return false
+}
+
+// parseScimValue parses a JSON string, number, boolean or null.
+func parseScimValue(token string) (interface{}, error) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(token), &value); err != nil {
+		return nil, errors.New(fmt.Sprintf("The value %q is not a string, number, boolean or null", token))
+	}
+	return value, nil
+}